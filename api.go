@@ -2,6 +2,7 @@ package docker
 
 import (
 	"code.google.com/p/go.net/websocket"
+	"crypto/tls"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
@@ -19,6 +20,7 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
 )
 
 const (
@@ -72,6 +74,10 @@ func httpError(w http.ResponseWriter, err error) {
 		statusCode = http.StatusUnauthorized
 	} else if strings.Contains(err.Error(), "hasn't been activated") {
 		statusCode = http.StatusForbidden
+	} else if _, ok := err.(*UntrustedImageError); ok {
+		statusCode = http.StatusForbidden
+	} else if _, ok := err.(*AuthzError); ok {
+		statusCode = http.StatusForbidden
 	}
 
 	if err != nil {
@@ -274,6 +280,28 @@ func getImagesHistory(srv *Server, version float64, w http.ResponseWriter, r *ht
 	return writeJSON(w, http.StatusOK, outs)
 }
 
+func getImagesGet(srv *Server, version float64, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	if vars == nil {
+		return fmt.Errorf("Missing parameter")
+	}
+	name := vars["name"]
+
+	w.Header().Set("Content-Type", "application/x-tar")
+	if err := srv.ImageExport(name, w); err != nil {
+		utils.Errorf("%s", err)
+		return err
+	}
+	return nil
+}
+
+func postImagesLoad(srv *Server, version float64, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	if err := srv.ImageLoad(r.Body); err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
 func getContainersChanges(srv *Server, version float64, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
 	if vars == nil {
 		return fmt.Errorf("Missing parameter")
@@ -287,6 +315,91 @@ func getContainersChanges(srv *Server, version float64, w http.ResponseWriter, r
 	return writeJSON(w, http.StatusOK, changesStr)
 }
 
+func getContainersStats(srv *Server, version float64, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	if err := parseForm(r); err != nil {
+		return err
+	}
+	if vars == nil {
+		return fmt.Errorf("Missing parameter")
+	}
+	stream := true
+	if value := r.Form.Get("stream"); value != "" {
+		var err error
+		if stream, err = getBoolParam(value); err != nil {
+			return err
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	return srv.ContainerStats(vars["name"], stream, utils.NewWriteFlusher(w))
+}
+
+func getContainersLogs(srv *Server, version float64, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	if err := parseForm(r); err != nil {
+		return err
+	}
+	if vars == nil {
+		return fmt.Errorf("Missing parameter")
+	}
+	name := vars["name"]
+
+	stdout, err := getBoolParam(r.Form.Get("stdout"))
+	if err != nil {
+		return err
+	}
+	stderr, err := getBoolParam(r.Form.Get("stderr"))
+	if err != nil {
+		return err
+	}
+	if !stdout && !stderr {
+		return fmt.Errorf("Bad parameters: you must choose at least one stream")
+	}
+	follow, err := getBoolParam(r.Form.Get("follow"))
+	if err != nil {
+		return err
+	}
+	timestamps, err := getBoolParam(r.Form.Get("timestamps"))
+	if err != nil {
+		return err
+	}
+	tail := -1
+	if value := r.Form.Get("tail"); value != "" && value != "all" {
+		if tail, err = strconv.Atoi(value); err != nil || tail < 0 {
+			return fmt.Errorf("Bad parameters: invalid tail %s", value)
+		}
+	}
+	var since time.Time
+	if value := r.Form.Get("since"); value != "" {
+		timestamp, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("Bad parameters: invalid since %s", value)
+		}
+		if timestamp != 0 {
+			since = time.Unix(timestamp, 0)
+		}
+	}
+
+	c, err := srv.ContainerInspect(name)
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", "application/vnd.docker.raw-stream")
+	var outStream, errStream io.Writer
+	outStream = utils.NewWriteFlusher(w)
+	if !c.Config.Tty {
+		errStream = utils.NewStdWriter(outStream, utils.Stderr)
+		outStream = utils.NewStdWriter(outStream, utils.Stdout)
+	} else {
+		errStream = outStream
+	}
+	var closed <-chan bool
+	if notifier, ok := w.(http.CloseNotifier); ok {
+		closed = notifier.CloseNotify()
+	}
+	return srv.ContainerLogs(name, stdout, stderr, follow, timestamps, tail, since, outStream, errStream, closed)
+}
+
 func getContainersTop(srv *Server, version float64, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
 	if version < 1.4 {
 		return fmt.Errorf("top was improved a lot since 1.3, Please upgrade your docker client.")
@@ -684,6 +797,28 @@ func postContainersStop(srv *Server, version float64, w http.ResponseWriter, r *
 	return nil
 }
 
+func postContainersPause(srv *Server, version float64, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	if vars == nil {
+		return fmt.Errorf("Missing parameter")
+	}
+	if err := srv.ContainerPause(vars["name"]); err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func postContainersUnpause(srv *Server, version float64, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	if vars == nil {
+		return fmt.Errorf("Missing parameter")
+	}
+	if err := srv.ContainerUnpause(vars["name"]); err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
 func postContainersWait(srv *Server, version float64, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
 	if vars == nil {
 		return fmt.Errorf("Missing parameter")
@@ -720,6 +855,99 @@ func postContainersResize(srv *Server, version float64, w http.ResponseWriter, r
 	return nil
 }
 
+func postContainersExec(srv *Server, version float64, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	if vars == nil {
+		return fmt.Errorf("Missing parameter")
+	}
+	name := vars["name"]
+
+	config := &ExecConfig{}
+	if err := json.NewDecoder(r.Body).Decode(config); err != nil {
+		return err
+	}
+	id, err := srv.ContainerExecCreate(name, config)
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusCreated, &APIID{ID: id})
+}
+
+func postExecStart(srv *Server, version float64, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	if vars == nil {
+		return fmt.Errorf("Missing parameter")
+	}
+	id := vars["id"]
+
+	command, err := srv.ContainerExecInspect(id)
+	if err != nil {
+		return err
+	}
+
+	inStream, outStream, err := hijackServer(w)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if tcpc, ok := inStream.(*net.TCPConn); ok {
+			tcpc.CloseWrite()
+		} else {
+			inStream.Close()
+		}
+	}()
+	defer func() {
+		if tcpc, ok := outStream.(*net.TCPConn); ok {
+			tcpc.CloseWrite()
+		} else if closer, ok := outStream.(io.Closer); ok {
+			closer.Close()
+		}
+	}()
+
+	var errStream io.Writer
+
+	fmt.Fprintf(outStream, "HTTP/1.1 200 OK\r\nContent-Type: application/vnd.docker.raw-stream\r\n\r\n")
+
+	if !command.Config.Tty {
+		errStream = utils.NewStdWriter(outStream, utils.Stderr)
+		outStream = utils.NewStdWriter(outStream, utils.Stdout)
+	} else {
+		errStream = outStream
+	}
+
+	if err := srv.ContainerExecStart(id, inStream, outStream, errStream); err != nil {
+		fmt.Fprintf(outStream, "Error: %s\n", err)
+	}
+	return nil
+}
+
+func postExecResize(srv *Server, version float64, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	if err := parseForm(r); err != nil {
+		return err
+	}
+	height, err := strconv.Atoi(r.Form.Get("h"))
+	if err != nil {
+		return err
+	}
+	width, err := strconv.Atoi(r.Form.Get("w"))
+	if err != nil {
+		return err
+	}
+	if vars == nil {
+		return fmt.Errorf("Missing parameter")
+	}
+	return srv.ContainerExecResize(vars["id"], height, width)
+}
+
+func getExecByID(srv *Server, version float64, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	if vars == nil {
+		return fmt.Errorf("Missing parameter")
+	}
+	command, err := srv.ContainerExecInspect(vars["id"])
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusOK, command)
+}
+
 func postContainersAttach(srv *Server, version float64, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
 	if err := parseForm(r); err != nil {
 		return err
@@ -876,6 +1104,74 @@ func getImagesByName(srv *Server, version float64, w http.ResponseWriter, r *htt
 	return writeJSON(w, http.StatusOK, image)
 }
 
+func getNetworksJSON(srv *Server, version float64, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	return writeJSON(w, http.StatusOK, srv.Networks())
+}
+
+func getNetworksByName(srv *Server, version float64, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	if vars == nil {
+		return fmt.Errorf("Missing parameter")
+	}
+	network, err := srv.NetworkInspect(vars["name"])
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusOK, network)
+}
+
+func postNetworksCreate(srv *Server, version float64, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	config := &APINetworkCreate{}
+	if err := json.NewDecoder(r.Body).Decode(config); err != nil {
+		return err
+	}
+	id, err := srv.NetworkCreate(config.Name, config.Subnet)
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusCreated, &APIID{ID: id})
+}
+
+func deleteNetworks(srv *Server, version float64, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	if vars == nil {
+		return fmt.Errorf("Missing parameter")
+	}
+	if err := srv.NetworkRemove(vars["name"]); err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func postNetworksConnect(srv *Server, version float64, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	if vars == nil {
+		return fmt.Errorf("Missing parameter")
+	}
+	config := &APINetworkConnect{}
+	if err := json.NewDecoder(r.Body).Decode(config); err != nil {
+		return err
+	}
+	if err := srv.NetworkConnect(vars["name"], config.Container); err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func postNetworksDisconnect(srv *Server, version float64, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	if vars == nil {
+		return fmt.Errorf("Missing parameter")
+	}
+	config := &APINetworkConnect{}
+	if err := json.NewDecoder(r.Body).Decode(config); err != nil {
+		return err
+	}
+	if err := srv.NetworkDisconnect(vars["name"], config.Container); err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
 func postBuild(srv *Server, version float64, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
 	if version < 1.3 {
 		return fmt.Errorf("Multipart upload for build is no longer supported. Please upgrade your docker client.")
@@ -1029,6 +1325,11 @@ func makeHttpHandler(srv *Server, logging bool, localMethod string, localRoute s
 func createRouter(srv *Server, logging bool) (*mux.Router, error) {
 	r := mux.NewRouter()
 
+	var plugins []*authzPlugin
+	for _, name := range srv.runtime.config.AuthzPlugins {
+		plugins = append(plugins, newAuthzPlugin(name))
+	}
+
 	m := map[string]map[string]HttpApiFunc{
 		"GET": {
 			"/events":                         getEvents,
@@ -1039,35 +1340,51 @@ func createRouter(srv *Server, logging bool) (*mux.Router, error) {
 			"/images/search":                  getImagesSearch,
 			"/images/{name:.*}/history":       getImagesHistory,
 			"/images/{name:.*}/json":          getImagesByName,
+			"/images/{name:.*}/get":           getImagesGet,
 			"/containers/ps":                  getContainersJSON,
 			"/containers/json":                getContainersJSON,
 			"/containers/{name:.*}/export":    getContainersExport,
 			"/containers/{name:.*}/changes":   getContainersChanges,
 			"/containers/{name:.*}/json":      getContainersByName,
 			"/containers/{name:.*}/top":       getContainersTop,
+			"/containers/{name:.*}/stats":     getContainersStats,
+			"/containers/{name:.*}/logs":      getContainersLogs,
+			"/exec/{id:.*}/json":              getExecByID,
+			"/networks":                       getNetworksJSON,
+			"/networks/{name:.*}/json":        getNetworksByName,
 			"/containers/{name:.*}/attach/ws": wsContainersAttach,
 		},
 		"POST": {
-			"/auth":                         postAuth,
-			"/commit":                       postCommit,
-			"/build":                        postBuild,
-			"/images/create":                postImagesCreate,
-			"/images/{name:.*}/insert":      postImagesInsert,
-			"/images/{name:.*}/push":        postImagesPush,
-			"/images/{name:.*}/tag":         postImagesTag,
-			"/containers/create":            postContainersCreate,
-			"/containers/{name:.*}/kill":    postContainersKill,
-			"/containers/{name:.*}/restart": postContainersRestart,
-			"/containers/{name:.*}/start":   postContainersStart,
-			"/containers/{name:.*}/stop":    postContainersStop,
-			"/containers/{name:.*}/wait":    postContainersWait,
-			"/containers/{name:.*}/resize":  postContainersResize,
-			"/containers/{name:.*}/attach":  postContainersAttach,
-			"/containers/{name:.*}/copy":    postContainersCopy,
+			"/auth":                          postAuth,
+			"/commit":                        postCommit,
+			"/build":                         postBuild,
+			"/images/create":                 postImagesCreate,
+			"/images/load":                   postImagesLoad,
+			"/images/{name:.*}/insert":       postImagesInsert,
+			"/images/{name:.*}/push":         postImagesPush,
+			"/images/{name:.*}/tag":          postImagesTag,
+			"/containers/create":             postContainersCreate,
+			"/containers/{name:.*}/kill":     postContainersKill,
+			"/containers/{name:.*}/restart":  postContainersRestart,
+			"/containers/{name:.*}/start":    postContainersStart,
+			"/containers/{name:.*}/stop":     postContainersStop,
+			"/containers/{name:.*}/pause":    postContainersPause,
+			"/containers/{name:.*}/unpause":  postContainersUnpause,
+			"/containers/{name:.*}/wait":     postContainersWait,
+			"/containers/{name:.*}/resize":   postContainersResize,
+			"/containers/{name:.*}/attach":   postContainersAttach,
+			"/containers/{name:.*}/copy":     postContainersCopy,
+			"/containers/{name:.*}/exec":     postContainersExec,
+			"/exec/{id:.*}/start":            postExecStart,
+			"/exec/{id:.*}/resize":           postExecResize,
+			"/networks/create":               postNetworksCreate,
+			"/networks/{name:.*}/connect":    postNetworksConnect,
+			"/networks/{name:.*}/disconnect": postNetworksDisconnect,
 		},
 		"DELETE": {
 			"/containers/{name:.*}": deleteContainers,
 			"/images/{name:.*}":     deleteImages,
+			"/networks/{name:.*}":   deleteNetworks,
 		},
 		"OPTIONS": {
 			"": optionsHandler,
@@ -1084,6 +1401,9 @@ func createRouter(srv *Server, logging bool) (*mux.Router, error) {
 
 			// build the handler function
 			f := makeHttpHandler(srv, logging, localMethod, localRoute, localFct)
+			if len(plugins) > 0 {
+				f = authorizeHandler(plugins, authzStreamRoutes[localMethod+" "+localRoute], f)
+			}
 
 			// add the new route
 			if localRoute == "" {
@@ -1099,8 +1419,6 @@ func createRouter(srv *Server, logging bool) (*mux.Router, error) {
 }
 
 func ListenAndServe(proto, addr string, srv *Server, logging bool) error {
-	log.Printf("Listening for HTTP on %s (%s)\n", addr, proto)
-
 	r, err := createRouter(srv, logging)
 	if err != nil {
 		return err
@@ -1109,6 +1427,17 @@ func ListenAndServe(proto, addr string, srv *Server, logging bool) error {
 	if e != nil {
 		return e
 	}
+	if config := srv.runtime.config; proto == "tcp" && config.TLSCert != "" {
+		tlsConfig, err := NewServerTLSConfig(config.TLSCert, config.TLSKey, config.TLSCACert)
+		if err != nil {
+			l.Close()
+			return err
+		}
+		l = tls.NewListener(l, tlsConfig)
+		log.Printf("Listening for HTTPS on %s (%s)\n", addr, proto)
+	} else {
+		log.Printf("Listening for HTTP on %s (%s)\n", addr, proto)
+	}
 	if proto == "unix" {
 		if err := os.Chmod(addr, 0660); err != nil {
 			return err
@@ -1130,6 +1459,9 @@ func ListenAndServe(proto, addr string, srv *Server, logging bool) error {
 			}
 		}
 	}
+	if proto == "unix" {
+		l = &peerListener{Listener: l}
+	}
 	httpSrv := http.Server{Addr: addr, Handler: r}
 	return httpSrv.Serve(l)
 }
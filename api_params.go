@@ -21,6 +21,8 @@ type APIInfo struct {
 	Debug              bool
 	Containers         int
 	Images             int
+	Driver             string `json:",omitempty"`
+	ExecutionDriver    string `json:",omitempty"`
 	NFd                int    `json:",omitempty"`
 	NGoroutines        int    `json:",omitempty"`
 	MemoryLimit        bool   `json:",omitempty"`
@@ -87,6 +89,14 @@ type APIID struct {
 	ID string `json:"Id"`
 }
 
+type APIExec struct {
+	ID          string `json:"Id"`
+	ContainerID string
+	Config      ExecConfig
+	Running     bool
+	ExitCode    int
+}
+
 type APIRun struct {
 	ID       string   `json:"Id"`
 	Warnings []string `json:",omitempty"`
@@ -122,3 +132,69 @@ type APICopy struct {
 	Resource string
 	HostPath string
 }
+
+// APIStats is a sample of the resource usage of a container.
+// Network counters are seen from the container: Rx is what it received.
+type APIStats struct {
+	Read    int64 // Unix time in nanoseconds
+	CPU     APICPUStats
+	Memory  APIMemoryStats
+	Blkio   APIBlkioStats
+	Network APINetworkStats
+}
+
+type APICPUStats struct {
+	TotalUsage  uint64   // Nanoseconds of CPU time used by the container
+	PercpuUsage []uint64 `json:",omitempty"`
+	SystemUsage uint64   // Nanoseconds of CPU time used by the host
+}
+
+type APIMemoryStats struct {
+	Usage    uint64
+	MaxUsage uint64
+	Limit    uint64
+}
+
+type APIBlkioStats struct {
+	ReadBytes  uint64
+	WriteBytes uint64
+}
+
+type APINetworkStats struct {
+	RxBytes   uint64
+	RxPackets uint64
+	RxErrors  uint64
+	RxDropped uint64
+	TxBytes   uint64
+	TxPackets uint64
+	TxErrors  uint64
+	TxDropped uint64
+}
+
+type APINetwork struct {
+	ID          string `json:"Id,omitempty"` // Empty for the default network
+	Name        string
+	Bridge      string
+	Subnet      string
+	Gateway     string
+	SubnetIPv6  string                         `json:",omitempty"`
+	GatewayIPv6 string                         `json:",omitempty"`
+	Created     int64                          `json:",omitempty"`
+	Containers  map[string]APINetworkContainer `json:",omitempty"` // Running containers, by ID
+}
+
+type APINetworkContainer struct {
+	Name        string
+	Interface   string
+	IPAddress   string
+	IPv6Address string `json:",omitempty"`
+}
+
+type APINetworkCreate struct {
+	Name   string
+	Subnet string `json:",omitempty"`
+}
+
+type APINetworkConnect struct {
+	Container string
+}
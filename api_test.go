@@ -474,6 +474,58 @@ func TestGetContainersChanges(t *testing.T) {
 	}
 }
 
+func TestGetContainersLogs(t *testing.T) {
+	runtime := mkRuntime(t)
+	defer nuke(runtime)
+
+	srv := &Server{runtime: runtime}
+
+	container, _, err := runtime.Create(
+		&Config{
+			Image: GetTestImage(runtime).ID,
+			Cmd:   []string{"/bin/sh", "-c", "echo hello; echo world; echo oops >&2"},
+		},
+		"",
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer runtime.Destroy(container)
+
+	if err := container.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := http.NewRequest("GET", "/containers/"+container.ID+"/logs?stdout=1&tail=2&timestamps=1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRecorder()
+	if err := getContainersLogs(srv, APIVERSION, r, req, map[string]string{"name": container.ID}); err != nil {
+		t.Fatal(err)
+	}
+	stdout, stderr := bytes.NewBuffer(nil), bytes.NewBuffer(nil)
+	if _, err := utils.StdCopy(stdout, stderr, r.Body); err != nil {
+		t.Fatal(err)
+	}
+	if stderr.Len() != 0 {
+		t.Fatalf("stderr was not requested, found %q", stderr.String())
+	}
+
+	// The last 2 lines are "world" and "oops", but only stdout is requested
+	lines := strings.Split(strings.TrimSpace(stdout.String()), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("Expected 1 line, found %q", stdout.String())
+	}
+	parts := strings.SplitN(lines[0], " ", 2)
+	if _, err := time.Parse(time.RFC3339Nano, parts[0]); err != nil {
+		t.Fatalf("Expected a timestamp at the beginning of %q: %s", lines[0], err)
+	}
+	if len(parts) != 2 || parts[1] != "world" {
+		t.Fatalf("Expected world, found %q", lines[0])
+	}
+}
+
 func TestGetContainersTop(t *testing.T) {
 	t.Skip("Fixme. Skipping test for now. Reported error when testing using dind: 'api_test.go:527: Expected 2 processes, found 0.'")
 	runtime := mkRuntime(t)
@@ -676,7 +728,12 @@ func TestPostContainersCreate(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	if _, err := os.Stat(path.Join(container.rwPath(), "test")); err != nil {
+	if err := container.EnsureMounted(); err != nil {
+		t.Fatal(err)
+	}
+	defer container.Unmount()
+
+	if _, err := os.Stat(path.Join(container.RootfsPath(), "test")); err != nil {
 		if os.IsNotExist(err) {
 			utils.Debugf("Err: %s", err)
 			t.Fatalf("The test file has not been created")
@@ -1145,8 +1202,8 @@ func TestDeleteContainers(t *testing.T) {
 		t.Fatalf("The container as not been deleted")
 	}
 
-	if _, err := os.Stat(path.Join(container.rwPath(), "test")); err == nil {
-		t.Fatalf("The test file has not been deleted")
+	if runtime.driver.Exists(container.ID) {
+		t.Fatalf("The container's filesystem has not been deleted")
 	}
 }
 
@@ -1280,7 +1337,7 @@ func TestDeleteImages(t *testing.T) {
 			t.Fatalf("The container as not been deleted")
 		}
 
-		if _, err := os.Stat(path.Join(container.rwPath(), "test")); err == nil {
+		if _, err := os.Stat(path.Join(container.RootfsPath(), "test")); err == nil {
 			t.Fatalf("The test file has not been deleted")
 		} */
 }
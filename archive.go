@@ -11,6 +11,7 @@ import (
 	"os/exec"
 	"path"
 	"path/filepath"
+	"strings"
 )
 
 type Archive io.Reader
@@ -80,13 +81,22 @@ func (compression *Compression) Extension() string {
 // Tar creates an archive from the directory at `path`, and returns it as a
 // stream of bytes.
 func Tar(path string, compression Compression) (io.Reader, error) {
-	return TarFilter(path, compression, nil)
+	return TarFilter(path, compression, nil, nil)
 }
 
 // Tar creates an archive from the directory at `path`, only including files whose relative
 // paths are included in `filter`. If `filter` is nil, then all files are included.
-func TarFilter(path string, compression Compression, filter []string) (io.Reader, error) {
+// Files and directories whose relative paths are in `exclude` are left out, along
+// with the content of the directories.
+func TarFilter(path string, compression Compression, filter []string, exclude []string) (io.Reader, error) {
 	args := []string{"tar", "--numeric-owner", "-f", "-", "-C", path}
+	if len(exclude) > 0 {
+		// Exclude the exact paths, whether the archive names them ./<path> or <path>
+		args = append(args, "--anchored", "--no-wildcards")
+		for _, e := range exclude {
+			args = append(args, "--exclude=./"+e, "--exclude="+e)
+		}
+	}
 	if filter == nil {
 		filter = []string{"."}
 	}
@@ -140,7 +150,7 @@ func Untar(archive io.Reader, path string) error {
 // TarUntar aborts and returns the error.
 func TarUntar(src string, filter []string, dst string) error {
 	utils.Debugf("TarUntar(%s %s %s)", src, filter, dst)
-	archive, err := TarFilter(src, Uncompressed, filter)
+	archive, err := TarFilter(src, Uncompressed, filter, nil)
 	if err != nil {
 		return err
 	}
@@ -300,3 +310,57 @@ func (archive *TempArchive) Read(data []byte) (int, error) {
 	}
 	return n, err
 }
+
+// ApplyLayer unpacks the layer archive `layer` on top of the filesystem tree
+// at `dest`, then processes the AUFS-style whiteouts it contains: each
+// `.wh.<name>` entry removes `<name>` from `dest`.
+func ApplyLayer(dest string, layer Archive) error {
+	if err := Untar(layer, dest); err != nil {
+		return err
+	}
+
+	// Removing a whiteout changes the mtime of its parent directory,
+	// so remember the original times to restore them afterwards.
+	modifiedDirs := make(map[string]os.FileInfo)
+	err := filepath.Walk(dest, func(fullPath string, f os.FileInfo, err error) error {
+		if err != nil {
+			// The file may already have been removed by a whiteout
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		filename := filepath.Base(fullPath)
+		if !strings.HasPrefix(filename, ".wh.") {
+			return nil
+		}
+		parent := filepath.Dir(fullPath)
+		if _, exists := modifiedDirs[parent]; !exists {
+			if st, err := os.Lstat(parent); err == nil {
+				modifiedDirs[parent] = st
+			}
+		}
+		// AUFS metadata (.wh..wh.*) is dropped, whiteouts remove their target
+		if !strings.HasPrefix(filename, ".wh..wh.") {
+			if err := os.RemoveAll(filepath.Join(parent, filename[len(".wh."):])); err != nil {
+				return err
+			}
+		}
+		if err := os.RemoveAll(fullPath); err != nil {
+			return err
+		}
+		if f.IsDir() {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for dir, st := range modifiedDirs {
+		if err := os.Chtimes(dir, st.ModTime(), st.ModTime()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
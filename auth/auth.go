@@ -34,8 +34,25 @@ type AuthConfig struct {
 }
 
 type ConfigFile struct {
-	Configs  map[string]AuthConfig `json:"configs,omitempty"`
-	rootPath string
+	Configs map[string]AuthConfig `json:"configs,omitempty"`
+	// CredentialsStore is the credential helper keeping the credentials of
+	// the registries, instead of the config file
+	CredentialsStore string
+	// CredentialHelpers overrides CredentialsStore for some registries
+	CredentialHelpers map[string]string
+	rootPath          string
+	// stored maps the registries whose credentials are kept by a helper to
+	// that helper, to erase the ones removed from Configs on save
+	stored map[string]string
+}
+
+// configFileFormat is the format of the config file when credential helpers
+// are used. Without them, the file is only the "auths" map, which older
+// versions of docker can read.
+type configFileFormat struct {
+	Auths       map[string]AuthConfig `json:"auths"`
+	CredsStore  string                `json:"credsStore,omitempty"`
+	CredHelpers map[string]string     `json:"credHelpers,omitempty"`
 }
 
 func IndexServerAddress() string {
@@ -74,7 +91,7 @@ func decodeAuth(authStr string) (string, string, error) {
 // load up the auth config information and return values
 // FIXME: use the internal golang config parser
 func LoadConfig(rootPath string) (*ConfigFile, error) {
-	configFile := ConfigFile{Configs: make(map[string]AuthConfig), rootPath: rootPath}
+	configFile := ConfigFile{Configs: make(map[string]AuthConfig), rootPath: rootPath, stored: make(map[string]string)}
 	confFile := path.Join(rootPath, CONFIGFILE)
 	if _, err := os.Stat(confFile); err != nil {
 		return &configFile, nil //missing file is not an error
@@ -84,6 +101,29 @@ func LoadConfig(rootPath string) (*ConfigFile, error) {
 		return &configFile, err
 	}
 
+	var format configFileFormat
+	if err := json.Unmarshal(b, &format); err == nil && (format.Auths != nil || format.CredsStore != "" || format.CredHelpers != nil) {
+		configFile.CredentialsStore = format.CredsStore
+		configFile.CredentialHelpers = format.CredHelpers
+		for k, authConfig := range format.Auths {
+			if authConfig.Auth != "" {
+				// Saved before a helper was configured: it moves to the
+				// helper on the next save
+				authConfig.Username, authConfig.Password, err = decodeAuth(authConfig.Auth)
+			} else if helper := configFile.helperFor(k); helper != "" {
+				authConfig.Username, authConfig.Password, err = helperGet(helper, k)
+				configFile.stored[k] = helper
+			}
+			if err != nil {
+				return &configFile, err
+			}
+			authConfig.Auth = ""
+			authConfig.ServerAddress = k
+			configFile.Configs[k] = authConfig
+		}
+		return &configFile, nil
+	}
+
 	if err := json.Unmarshal(b, &configFile.Configs); err != nil {
 		arr := strings.Split(string(b), "\n")
 		if len(arr) < 2 {
@@ -119,8 +159,20 @@ func LoadConfig(rootPath string) (*ConfigFile, error) {
 	return &configFile, nil
 }
 
+// helperFor returns the credential helper of the registry `serverAddress`,
+// or an empty string if its credentials are kept in the config file.
+func (config *ConfigFile) helperFor(serverAddress string) string {
+	if helper, exists := config.CredentialHelpers[serverAddress]; exists {
+		return helper
+	}
+	return config.CredentialsStore
+}
+
 // save the auth config
 func SaveConfig(configFile *ConfigFile) error {
+	if configFile.CredentialsStore != "" || len(configFile.CredentialHelpers) > 0 {
+		return saveConfigWithHelpers(configFile)
+	}
 	confFile := path.Join(configFile.rootPath, CONFIGFILE)
 	if len(configFile.Configs) == 0 {
 		os.Remove(confFile)
@@ -149,6 +201,51 @@ func SaveConfig(configFile *ConfigFile) error {
 	return nil
 }
 
+// saveConfigWithHelpers hands the credentials to their helpers, erases the
+// ones removed since the config file was loaded, and only keeps the email
+// of each registry in the config file.
+func saveConfigWithHelpers(configFile *ConfigFile) error {
+	if configFile.stored == nil {
+		configFile.stored = make(map[string]string)
+	}
+	format := configFileFormat{
+		Auths:       make(map[string]AuthConfig, len(configFile.Configs)),
+		CredsStore:  configFile.CredentialsStore,
+		CredHelpers: configFile.CredentialHelpers,
+	}
+	for k, authConfig := range configFile.Configs {
+		authCopy := authConfig
+		if helper := configFile.helperFor(k); helper != "" {
+			if err := helperStore(helper, k, authConfig.Username, authConfig.Password); err != nil {
+				return err
+			}
+			configFile.stored[k] = helper
+			authCopy.Auth = ""
+		} else {
+			authCopy.Auth = encodeAuth(&authCopy)
+		}
+		authCopy.Username = ""
+		authCopy.Password = ""
+		authCopy.ServerAddress = ""
+		format.Auths[k] = authCopy
+	}
+	for k, helper := range configFile.stored {
+		if _, exists := configFile.Configs[k]; exists {
+			continue
+		}
+		if err := helperErase(helper, k); err != nil {
+			return err
+		}
+		delete(configFile.stored, k)
+	}
+
+	b, err := json.Marshal(format)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path.Join(configFile.rootPath, CONFIGFILE), b, 0600)
+}
+
 // try to register/login to the registry server
 func Login(authConfig *AuthConfig, factory *utils.HTTPRequestFactory) (string, error) {
 	client := &http.Client{}
@@ -232,9 +329,19 @@ func Login(authConfig *AuthConfig, factory *utils.HTTPRequestFactory) (string, e
 
 // this method matches a auth configuration to a server address or a url
 func (config *ConfigFile) ResolveAuthConfig(registry string) AuthConfig {
+	if serverAddress, found := config.ResolveServerAddress(registry); found {
+		return config.Configs[serverAddress]
+	}
+	return AuthConfig{}
+}
+
+// ResolveServerAddress returns the key of the auth configuration matching a
+// server address or a url, and whether there is one.
+func (config *ConfigFile) ResolveServerAddress(registry string) (string, bool) {
 	if registry == IndexServerAddress() || len(registry) == 0 {
 		// default to the index server
-		return config.Configs[IndexServerAddress()]
+		_, found := config.Configs[IndexServerAddress()]
+		return IndexServerAddress(), found
 	}
 	// if its not the index server there are three cases:
 	//
@@ -255,16 +362,16 @@ func (config *ConfigFile) ResolveAuthConfig(registry string) AuthConfig {
 		return url
 	}
 
-	resolveIgnoringProtocol := func(url string) AuthConfig {
-		if c, found := config.Configs[url]; found {
-			return c
+	resolveIgnoringProtocol := func(url string) (string, bool) {
+		if _, found := config.Configs[url]; found {
+			return url, true
 		}
 		registrySwappedProtocol := swapProtocol(url)
 		// now try to match with the different protocol
-		if c, found := config.Configs[registrySwappedProtocol]; found {
-			return c
+		if _, found := config.Configs[registrySwappedProtocol]; found {
+			return registrySwappedProtocol, true
 		}
-		return AuthConfig{}
+		return "", false
 	}
 
 	// match both protocols as it could also be a server name like httpfoo
@@ -3,8 +3,12 @@ package auth
 import (
 	"crypto/rand"
 	"encoding/hex"
+	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"os"
+	"os/exec"
+	"path"
 	"strings"
 	"testing"
 )
@@ -189,3 +193,164 @@ func TestResolveAuthConfigFullURL(t *testing.T) {
 		}
 	}
 }
+
+// TestHelperProcess isn't a real test: it is the credential helper run by
+// the tests, keeping the credentials in the json file $DOCKER_TEST_HELPER_STORE.
+func TestHelperProcess(t *testing.T) {
+	storePath := os.Getenv("DOCKER_TEST_HELPER_STORE")
+	if storePath == "" {
+		return
+	}
+	defer os.Exit(0)
+
+	store := make(map[string]helperCredentials)
+	if data, err := ioutil.ReadFile(storePath); err == nil {
+		json.Unmarshal(data, &store)
+	}
+	input := helperCredentials{}
+	if err := json.NewDecoder(os.Stdin).Decode(&input); err != nil {
+		fmt.Fprintf(os.Stderr, "invalid input: %s", err)
+		os.Exit(1)
+	}
+	switch action := os.Args[len(os.Args)-1]; action {
+	case "store":
+		store[input.ServerURL] = input
+	case "get":
+		json.NewEncoder(os.Stdout).Encode(store[input.ServerURL])
+		return
+	case "erase":
+		delete(store, input.ServerURL)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown action %s", action)
+		os.Exit(1)
+	}
+	data, _ := json.Marshal(store)
+	ioutil.WriteFile(storePath, data, 0600)
+}
+
+func setupTestHelper(storePath string) func() {
+	helperCommand = func(name, action string) *exec.Cmd {
+		cmd := exec.Command(os.Args[0], "-test.run=TestHelperProcess", "--", name, action)
+		cmd.Env = append(os.Environ(), "DOCKER_TEST_HELPER_STORE="+storePath)
+		return cmd
+	}
+	return func() {
+		helperCommand = func(name, action string) *exec.Cmd {
+			return exec.Command(credentialHelperPrefix+name, action)
+		}
+	}
+}
+
+func TestCredentialHelper(t *testing.T) {
+	configFile, err := setupTempConfigFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(configFile.rootPath)
+	storePath := path.Join(configFile.rootPath, "helper-store.json")
+	defer setupTestHelper(storePath)()
+
+	configFile.CredentialsStore = "test"
+	if err := SaveConfig(configFile); err != nil {
+		t.Fatal(err)
+	}
+
+	// The config file doesn't hold the passwords anymore
+	data, err := ioutil.ReadFile(path.Join(configFile.rootPath, CONFIGFILE))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), encodeAuth(&AuthConfig{Username: "docker-user", Password: "docker-pass"})) ||
+		strings.Contains(string(data), "docker-pass") {
+		t.Fatalf("Expected the credentials to be kept by the helper, got %s", data)
+	}
+	if !strings.Contains(string(data), "docker@docker.io") {
+		t.Fatalf("Expected the email in the config file, got %s", data)
+	}
+
+	loaded, err := LoadConfig(configFile.rootPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.CredentialsStore != "test" {
+		t.Fatalf("Expected the credentials store to be kept, got %q", loaded.CredentialsStore)
+	}
+	resolved := loaded.ResolveAuthConfig(IndexServerAddress())
+	if resolved.Username != "docker-user" || resolved.Password != "docker-pass" || resolved.Email != "docker@docker.io" {
+		t.Fatalf("Unexpected credentials for the index: %#v", resolved)
+	}
+
+	// Logging out erases the credentials from the helper
+	delete(loaded.Configs, "testIndex")
+	if err := SaveConfig(loaded); err != nil {
+		t.Fatal(err)
+	}
+	data, err = ioutil.ReadFile(storePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "testIndex") {
+		t.Fatalf("Expected the credentials of testIndex to be erased, got %s", data)
+	}
+	loaded, err = LoadConfig(configFile.rootPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, exists := loaded.Configs["testIndex"]; exists {
+		t.Fatal("Expected testIndex to be logged out")
+	}
+	if loaded.Configs[IndexServerAddress()].Password != "docker-pass" {
+		t.Fatal("Expected the index to stay logged in")
+	}
+}
+
+func TestCredentialHelperPerRegistry(t *testing.T) {
+	configFile, err := setupTempConfigFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(configFile.rootPath)
+	storePath := path.Join(configFile.rootPath, "helper-store.json")
+	defer setupTestHelper(storePath)()
+
+	configFile.CredentialHelpers = map[string]string{"testIndex": "test"}
+	if err := SaveConfig(configFile); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(storePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), "testIndex") || strings.Contains(string(data), IndexServerAddress()) {
+		t.Fatalf("Expected only testIndex in the helper, got %s", data)
+	}
+	loaded, err := LoadConfig(configFile.rootPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, registry := range []string{"testIndex", IndexServerAddress()} {
+		if loaded.Configs[registry].Password != "docker-pass" {
+			t.Fatalf("Expected the password of %s, got %#v", registry, loaded.Configs[registry])
+		}
+	}
+}
+
+func TestResolveServerAddress(t *testing.T) {
+	configFile, err := setupTempConfigFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(configFile.rootPath)
+	configFile.Configs["https://registry.example.com/v1/"] = AuthConfig{}
+
+	if key, found := configFile.ResolveServerAddress("registry.example.com"); !found || key != "https://registry.example.com/v1/" {
+		t.Fatalf("Expected https://registry.example.com/v1/, got %q", key)
+	}
+	if _, found := configFile.ResolveServerAddress("other.example.com"); found {
+		t.Fatal("Expected other.example.com not to be found")
+	}
+	delete(configFile.Configs, IndexServerAddress())
+	if _, found := configFile.ResolveServerAddress(""); found {
+		t.Fatal("Expected the index not to be found once logged out")
+	}
+}
@@ -0,0 +1,77 @@
+package auth
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// Credential helpers are programs named docker-credential-<name>, found in
+// the PATH, which store the credentials of registries in a safer place than
+// the config file, such as the keychain of the desktop. They are called
+// with an action as their only argument, and exchange json on their
+// standard input and output:
+//
+//	store: {"ServerURL": "...", "Username": "...", "Secret": "..."}
+//	get:   {"ServerURL": "..."}, answered by {"Username": "...", "Secret": "..."}
+//	erase: {"ServerURL": "..."}
+//
+// A helper answers `get` for an unknown server with empty credentials, and
+// reports errors with a non-zero exit status and a message on its standard
+// error.
+const credentialHelperPrefix = "docker-credential-"
+
+type helperCredentials struct {
+	ServerURL string `json:",omitempty"`
+	Username  string `json:",omitempty"`
+	Secret    string `json:",omitempty"`
+}
+
+// helperCommand returns the command running `action` with the helper
+// `name`. It is replaced by the tests.
+var helperCommand = func(name, action string) *exec.Cmd {
+	return exec.Command(credentialHelperPrefix+name, action)
+}
+
+func runHelper(name, action string, input *helperCredentials) ([]byte, error) {
+	in, err := json.Marshal(input)
+	if err != nil {
+		return nil, err
+	}
+	var stdout, stderr bytes.Buffer
+	cmd := helperCommand(name, action)
+	cmd.Stdin = bytes.NewReader(in)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("Credential helper %s%s failed to %s the credentials of %s: %s", credentialHelperPrefix, name, action, input.ServerURL, msg)
+		}
+		return nil, fmt.Errorf("Credential helper %s%s failed to %s the credentials of %s: %s", credentialHelperPrefix, name, action, input.ServerURL, err)
+	}
+	return stdout.Bytes(), nil
+}
+
+func helperStore(name, serverAddress, username, secret string) error {
+	_, err := runHelper(name, "store", &helperCredentials{ServerURL: serverAddress, Username: username, Secret: secret})
+	return err
+}
+
+func helperGet(name, serverAddress string) (string, string, error) {
+	out, err := runHelper(name, "get", &helperCredentials{ServerURL: serverAddress})
+	if err != nil {
+		return "", "", err
+	}
+	creds := &helperCredentials{}
+	if err := json.Unmarshal(out, creds); err != nil {
+		return "", "", fmt.Errorf("Invalid answer of the credential helper %s%s: %s", credentialHelperPrefix, name, err)
+	}
+	return creds.Username, creds.Secret, nil
+}
+
+func helperErase(name, serverAddress string) error {
+	_, err := runHelper(name, "erase", &helperCredentials{ServerURL: serverAddress})
+	return err
+}
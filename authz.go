@@ -0,0 +1,380 @@
+package docker
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/dotcloud/docker/utils"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+)
+
+// Authorization plugins are local processes consulted by the daemon on every
+// call of the remote API, to enforce policies such as "no privileged
+// containers". They listen on a unix socket, and are sent a POST of an
+// AuthzRequest on each phase of the call:
+//
+//	/AuthZPlugin.AuthZReq: before the call, with the request
+//	/AuthZPlugin.AuthZRes: after the call, with the request and its response
+//
+// They answer with an AuthzResponse. The call is refused as soon as one of
+// the plugins denies it, or fails to answer.
+const (
+	authzRequestPath  = "/AuthZPlugin.AuthZReq"
+	authzResponsePath = "/AuthZPlugin.AuthZRes"
+
+	// DefaultAuthzPluginDir is where plugins given by name have their socket
+	DefaultAuthzPluginDir = "/run/docker/plugins"
+
+	// Requests with a larger body are refused, as the plugins can't see it,
+	// and larger responses are streamed to the client before they see them
+	maxAuthzBodySize = 1 << 20
+)
+
+// authzStreamRoutes are the routes whose request body is a stream, such as
+// a tar archive, rather than a config: it is passed to the handler unread,
+// and the plugins are only told it was withheld.
+var authzStreamRoutes = map[string]bool{
+	"POST /build":         true,
+	"POST /images/create": true,
+	"POST /images/load":   true,
+}
+
+type AuthzRequest struct {
+	User                string `json:",omitempty"` // CommonName of the TLS certificate, or name of the local user
+	UserAuthNMethod     string `json:",omitempty"` // "TLS" or "unix"
+	RequestMethod       string
+	RequestURI          string
+	RequestBody         []byte            `json:",omitempty"`
+	RequestBodyWithheld bool              `json:",omitempty"` // Set when the body is a stream the plugins aren't sent
+	RequestHeaders      map[string]string `json:",omitempty"`
+	ResponseStatusCode  int               `json:",omitempty"`
+	ResponseBody        []byte            `json:",omitempty"` // Only json bodies
+	ResponseHeaders     map[string]string `json:",omitempty"`
+}
+
+type AuthzResponse struct {
+	Allow bool
+	Msg   string `json:",omitempty"` // Why the call is denied
+	Err   string `json:",omitempty"` // Set when the plugin failed to decide
+}
+
+// AuthzError is returned when a plugin denies a call.
+type AuthzError struct {
+	Plugin string
+	Msg    string
+}
+
+func (e *AuthzError) Error() string {
+	if e.Msg == "" {
+		return fmt.Sprintf("Authorization denied by plugin %s", e.Plugin)
+	}
+	return fmt.Sprintf("Authorization denied by plugin %s: %s", e.Plugin, e.Msg)
+}
+
+type authzPlugin struct {
+	name   string
+	client *http.Client
+}
+
+// newAuthzPlugin returns the plugin listening on the unix socket `name`, or
+// on DefaultAuthzPluginDir/<name>.sock if `name` isn't a path.
+func newAuthzPlugin(name string) *authzPlugin {
+	socket := name
+	if !strings.Contains(name, "/") {
+		socket = path.Join(DefaultAuthzPluginDir, name+".sock")
+	}
+	return &authzPlugin{
+		name: name,
+		client: &http.Client{
+			Transport: &http.Transport{
+				Dial: func(_, _ string) (net.Conn, error) {
+					return net.Dial("unix", socket)
+				},
+			},
+		},
+	}
+}
+
+func (p *authzPlugin) call(endpoint string, req *AuthzRequest) (*AuthzResponse, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	res, err := p.client.Post("http://plugin"+endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(res.Body)
+		return nil, fmt.Errorf("HTTP code %d: %s", res.StatusCode, bytes.TrimSpace(msg))
+	}
+	authzRes := &AuthzResponse{}
+	if err := json.NewDecoder(res.Body).Decode(authzRes); err != nil {
+		return nil, err
+	}
+	return authzRes, nil
+}
+
+// authorize asks each plugin in turn to authorize the phase `endpoint` of
+// the call `req`.
+func authorize(plugins []*authzPlugin, endpoint string, req *AuthzRequest) error {
+	for _, p := range plugins {
+		res, err := p.call(endpoint, req)
+		if err != nil {
+			return fmt.Errorf("Authorization plugin %s failed: %s", p.name, err)
+		}
+		if res.Err != "" {
+			return fmt.Errorf("Authorization plugin %s failed: %s", p.name, res.Err)
+		}
+		if !res.Allow {
+			return &AuthzError{Plugin: p.name, Msg: res.Msg}
+		}
+	}
+	return nil
+}
+
+// peerListener names the local user connected on each unix connection it
+// accepts in the remote address of the connection, which the requests
+// read on it are given as their RemoteAddr.
+type peerListener struct {
+	net.Listener
+	sync.Mutex
+	count int
+}
+
+func (l *peerListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	user := peerUser(c)
+	if user == "" {
+		return c, nil
+	}
+	l.Lock()
+	l.count++
+	addr := &peerAddr{id: l.count, user: user}
+	l.Unlock()
+	return &peerConn{Conn: c, addr: addr}, nil
+}
+
+type peerConn struct {
+	net.Conn
+	addr *peerAddr
+}
+
+func (c *peerConn) RemoteAddr() net.Addr {
+	return c.addr
+}
+
+// peerAddr is the remote address of a unix connection: the connections
+// are numbered so that their addresses stay distinct.
+type peerAddr struct {
+	id   int
+	user string
+}
+
+const peerAddrPrefix = "unix-peer:"
+
+func (a *peerAddr) Network() string {
+	return "unix"
+}
+
+func (a *peerAddr) String() string {
+	return fmt.Sprintf("%s%d:%s", peerAddrPrefix, a.id, a.user)
+}
+
+// requestUser returns the user who sent `r`, and how it was authenticated.
+func requestUser(r *http.Request) (string, string) {
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		return r.TLS.PeerCertificates[0].Subject.CommonName, "TLS"
+	}
+	if strings.HasPrefix(r.RemoteAddr, peerAddrPrefix) {
+		if parts := strings.SplitN(r.RemoteAddr[len(peerAddrPrefix):], ":", 2); len(parts) == 2 {
+			return parts[1], "unix"
+		}
+	}
+	return "", ""
+}
+
+func authzHeaders(header http.Header) map[string]string {
+	headers := make(map[string]string)
+	for k := range header {
+		// Don't leak the credentials of the registries to the plugins
+		if k == "X-Registry-Auth" || k == "Authorization" {
+			continue
+		}
+		headers[k] = header.Get(k)
+	}
+	return headers
+}
+
+var errAuthzBodyTooLarge = fmt.Errorf("Request body too large for the authorization plugins (more than %d bytes)", maxAuthzBodySize)
+
+// authzRequestBody returns the body of `r` for the plugins, whatever its
+// type, and restores it for the handler. The handler must never get a config
+// the plugins didn't see: bodies too large to be sent to them are an error.
+func authzRequestBody(r *http.Request) ([]byte, error) {
+	if r.Body == nil {
+		return nil, nil
+	}
+	if r.ContentLength > maxAuthzBodySize {
+		return nil, errAuthzBodyTooLarge
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxAuthzBodySize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > maxAuthzBodySize {
+		return nil, errAuthzBodyTooLarge
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	if len(body) == 0 {
+		return nil, nil
+	}
+	return body, nil
+}
+
+// authzResponseWriter holds the response of a call until the plugins
+// authorize it. Responses which are flushed, hijacked or too large are
+// streamed to the client as they are written instead: the plugins only see
+// them afterwards, and can't deny them anymore.
+type authzResponseWriter struct {
+	http.ResponseWriter
+	status    int
+	body      bytes.Buffer
+	streaming bool
+	hijacked  bool
+}
+
+func (w *authzResponseWriter) WriteHeader(status int) {
+	if w.status != 0 {
+		return
+	}
+	w.status = status
+	if w.streaming {
+		w.ResponseWriter.WriteHeader(status)
+	}
+}
+
+func (w *authzResponseWriter) Write(b []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	if !w.streaming && w.body.Len()+len(b) > maxAuthzBodySize {
+		if err := w.stream(); err != nil {
+			return 0, err
+		}
+	}
+	if w.streaming {
+		return w.ResponseWriter.Write(b)
+	}
+	return w.body.Write(b)
+}
+
+// stream sends what was held of the response, and the rest as it is written.
+func (w *authzResponseWriter) stream() error {
+	if w.streaming {
+		return nil
+	}
+	w.streaming = true
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	w.ResponseWriter.WriteHeader(w.status)
+	_, err := w.ResponseWriter.Write(w.body.Bytes())
+	return err
+}
+
+func (w *authzResponseWriter) Flush() {
+	if err := w.stream(); err != nil {
+		return
+	}
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (w *authzResponseWriter) CloseNotify() <-chan bool {
+	if notifier, ok := w.ResponseWriter.(http.CloseNotifier); ok {
+		return notifier.CloseNotify()
+	}
+	return nil
+}
+
+func (w *authzResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("The response can't be hijacked")
+	}
+	w.hijacked = true
+	return hijacker.Hijack()
+}
+
+// authorizeHandler runs `handler` only if the plugins authorize the request,
+// and sends its response only if they authorize it too. The request body is
+// withheld from the plugins if `streamBody` is set.
+func authorizeHandler(plugins []*authzPlugin, streamBody bool, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		req := &AuthzRequest{
+			RequestMethod:  r.Method,
+			RequestURI:     r.RequestURI,
+			RequestHeaders: authzHeaders(r.Header),
+		}
+		req.User, req.UserAuthNMethod = requestUser(r)
+		if streamBody {
+			req.RequestBodyWithheld = r.Body != nil && r.ContentLength != 0
+		} else {
+			body, err := authzRequestBody(r)
+			if err == errAuthzBodyTooLarge {
+				http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+				return
+			} else if err != nil {
+				httpError(w, err)
+				return
+			}
+			req.RequestBody = body
+		}
+
+		if err := authorize(plugins, authzRequestPath, req); err != nil {
+			httpError(w, err)
+			return
+		}
+
+		rw := &authzResponseWriter{ResponseWriter: w}
+		handler(rw, r)
+		if rw.hijacked {
+			return
+		}
+		if rw.status == 0 {
+			rw.status = http.StatusOK
+		}
+		req.ResponseStatusCode = rw.status
+		req.ResponseHeaders = authzHeaders(w.Header())
+		if contentType := w.Header().Get("Content-Type"); !rw.streaming && contentType != "" && matchesContentType(contentType, "application/json") {
+			req.ResponseBody = rw.body.Bytes()
+		}
+
+		err := authorize(plugins, authzResponsePath, req)
+		if rw.streaming {
+			if err != nil {
+				utils.Errorf("%s, but the response of %s %s was already sent", err, r.Method, r.RequestURI)
+			}
+			return
+		}
+		if err != nil {
+			for k := range w.Header() {
+				w.Header().Del(k)
+			}
+			httpError(w, err)
+			return
+		}
+		rw.stream()
+	}
+}
@@ -0,0 +1,7 @@
+package docker
+
+import "net"
+
+func peerUser(c net.Conn) string {
+	return ""
+}
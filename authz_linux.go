@@ -0,0 +1,31 @@
+package docker
+
+import (
+	"net"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+// peerUser returns the name of the local user connected on `c`, from the
+// credentials of the unix socket, or its uid if it has no name.
+func peerUser(c net.Conn) string {
+	conn, ok := c.(*net.UnixConn)
+	if !ok {
+		return ""
+	}
+	f, err := conn.File()
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	cred, err := syscall.GetsockoptUcred(int(f.Fd()), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	if err != nil {
+		return ""
+	}
+	uid := strconv.Itoa(int(cred.Uid))
+	if u, err := user.LookupId(uid); err == nil {
+		return u.Username
+	}
+	return uid
+}
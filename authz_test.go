@@ -0,0 +1,277 @@
+package docker
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/user"
+	"path"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// spawnTestAuthzPlugin serves a plugin denying privileged containers, and
+// responses containing a secret. It returns the plugin, and the requests
+// it was sent.
+func spawnTestAuthzPlugin(t *testing.T, dir string) (*authzPlugin, *[]AuthzRequest) {
+	socket := path.Join(dir, "authz.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var requests []AuthzRequest
+	go http.Serve(l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := AuthzRequest{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		requests = append(requests, req)
+		res := &AuthzResponse{Allow: true}
+		switch r.URL.Path {
+		case authzRequestPath:
+			if bytes.Contains(req.RequestBody, []byte(`"Privileged":true`)) {
+				res = &AuthzResponse{Msg: "privileged containers are forbidden"}
+			}
+		case authzResponsePath:
+			if bytes.Contains(req.ResponseBody, []byte("secret")) {
+				res = &AuthzResponse{Msg: "the response contains a secret"}
+			}
+		default:
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(res)
+	}))
+	return newAuthzPlugin(socket), &requests
+}
+
+func authzTestRequest(t *testing.T, handler http.HandlerFunc, body string) *httptest.ResponseRecorder {
+	r, err := http.NewRequest("POST", "/containers/create", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.RequestURI = "/containers/create"
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set("X-Registry-Auth", "credentials")
+	r.TLS = &tls.ConnectionState{
+		PeerCertificates: []*x509.Certificate{{Subject: pkix.Name{CommonName: "alice"}}},
+	}
+	w := httptest.NewRecorder()
+	handler(w, r)
+	return w
+}
+
+func TestAuthorizeHandler(t *testing.T) {
+	dir, err := ioutil.TempDir("", "docker-test-authz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	plugin, requests := spawnTestAuthzPlugin(t, dir)
+
+	called := false
+	handler := authorizeHandler([]*authzPlugin{plugin}, false, func(w http.ResponseWriter, r *http.Request) {
+		called = true
+		// The handler gets the whole body, after the plugin read it
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		w.Write(body)
+	})
+
+	w := authzTestRequest(t, handler, `{"Image":"base"}`)
+	if !called || w.Code != http.StatusCreated {
+		t.Fatalf("Expected the call to be allowed, got %d: %s", w.Code, w.Body)
+	}
+	if w.Body.String() != `{"Image":"base"}` {
+		t.Fatalf("Expected the response of the handler, got %s", w.Body)
+	}
+	if len(*requests) != 2 {
+		t.Fatalf("Expected the plugin to authorize the request and the response, got %d calls", len(*requests))
+	}
+	req := (*requests)[1]
+	if req.User != "alice" || req.UserAuthNMethod != "TLS" {
+		t.Fatalf("Expected the user of the certificate, got %s (%s)", req.User, req.UserAuthNMethod)
+	}
+	if req.RequestMethod != "POST" || req.RequestURI != "/containers/create" || req.ResponseStatusCode != http.StatusCreated {
+		t.Fatalf("Unexpected request sent to the plugin: %#v", req)
+	}
+	if _, exists := req.RequestHeaders["X-Registry-Auth"]; exists {
+		t.Fatal("The credentials of the registries shouldn't be sent to the plugins")
+	}
+
+	// Denied request: the handler isn't called
+	called = false
+	w = authzTestRequest(t, handler, `{"Image":"base","Privileged":true}`)
+	if called {
+		t.Fatal("The handler shouldn't be called when the request is denied")
+	}
+	if w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), "privileged containers are forbidden") {
+		t.Fatalf("Expected the request to be denied, got %d: %s", w.Code, w.Body)
+	}
+
+	// Denied response: the output of the handler isn't sent
+	w = authzTestRequest(t, handler, `{"Image":"secret"}`)
+	if w.Code != http.StatusForbidden || strings.Contains(w.Body.String(), `"Image"`) {
+		t.Fatalf("Expected the response to be denied, got %d: %s", w.Code, w.Body)
+	}
+	if w.Header().Get("Content-Type") == "application/json" {
+		t.Fatal("The headers of the denied response shouldn't be sent")
+	}
+}
+
+func TestAuthorizeHandlerRequestBody(t *testing.T) {
+	dir, err := ioutil.TempDir("", "docker-test-authz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	plugin, _ := spawnTestAuthzPlugin(t, dir)
+
+	called := false
+	handler := authorizeHandler([]*authzPlugin{plugin}, false, func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	})
+
+	// The body is sent to the plugins whatever its type
+	r, err := http.NewRequest("POST", "/containers/create", strings.NewReader(`{"Image":"base","Privileged":true}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.RequestURI = "/containers/create"
+	r.Header.Set("Content-Type", "text/plain")
+	w := httptest.NewRecorder()
+	handler(w, r)
+	if called || w.Code != http.StatusForbidden {
+		t.Fatalf("Expected the request to be denied whatever its content type, got %d: %s", w.Code, w.Body)
+	}
+
+	// A body too large for the plugins is refused
+	padded := `{"Image":"base",` + strings.Repeat(" ", maxAuthzBodySize) + `"Privileged":true}`
+	w = authzTestRequest(t, handler, padded)
+	if called || w.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("Expected a body too large for the plugins to be refused, got %d: %s", w.Code, w.Body)
+	}
+
+	// Even without its length
+	r, err = http.NewRequest("POST", "/containers/create", ioutil.NopCloser(strings.NewReader(padded)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.RequestURI = "/containers/create"
+	r.Header.Set("Content-Type", "application/json")
+	w = httptest.NewRecorder()
+	handler(w, r)
+	if called || w.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("Expected a chunked body too large for the plugins to be refused, got %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestAuthorizeHandlerStreamBody(t *testing.T) {
+	dir, err := ioutil.TempDir("", "docker-test-authz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	plugin, requests := spawnTestAuthzPlugin(t, dir)
+
+	// The build context is passed to the handler unread, whatever its size
+	buildContext := strings.Repeat("a", 2*maxAuthzBodySize)
+	var received []byte
+	handler := authorizeHandler([]*authzPlugin{plugin}, authzStreamRoutes["POST /build"], func(w http.ResponseWriter, r *http.Request) {
+		received, _ = ioutil.ReadAll(r.Body)
+	})
+	r, err := http.NewRequest("POST", "/build", strings.NewReader(buildContext))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.RequestURI = "/build"
+	r.Header.Set("Content-Type", "application/tar")
+	w := httptest.NewRecorder()
+	handler(w, r)
+	if w.Code != http.StatusOK || string(received) != buildContext {
+		t.Fatalf("Expected the build context to reach the handler, got %d: %s", w.Code, w.Body)
+	}
+	if len(*requests) != 2 {
+		t.Fatalf("Expected 2 requests to the plugin, got %d", len(*requests))
+	}
+	if req := (*requests)[0]; !req.RequestBodyWithheld || req.RequestBody != nil {
+		t.Fatalf("Expected the plugin to be told the body was withheld, got %v", req)
+	}
+}
+
+func TestAuthorizeHandlerPluginFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "docker-test-authz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	called := false
+	plugin := newAuthzPlugin(path.Join(dir, "missing.sock"))
+	handler := authorizeHandler([]*authzPlugin{plugin}, false, func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	})
+	w := authzTestRequest(t, handler, "{}")
+	if called || w.Code != http.StatusInternalServerError {
+		t.Fatalf("Expected the call to be refused when the plugin can't be reached, got %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestAuthzPeerUser(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("The credentials of unix sockets are only read on linux")
+	}
+	current, err := user.Current()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "docker-test-authz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	socket := path.Join(dir, "docker.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go http.Serve(&peerListener{Listener: l}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name, method := requestUser(r)
+		w.Write([]byte(name + " " + method))
+	}))
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			Dial: func(_, _ string) (net.Conn, error) {
+				return net.Dial("unix", socket)
+			},
+		},
+	}
+	res, err := client.Get("http://docker/version")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := current.Username + " unix"; string(body) != expected {
+		t.Fatalf("Expected %s, got %s", expected, body)
+	}
+}
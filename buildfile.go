@@ -1,6 +1,8 @@
 package docker
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"github.com/dotcloud/docker/utils"
@@ -9,8 +11,10 @@ import (
 	"net/url"
 	"os"
 	"path"
+	"path/filepath"
 	"reflect"
 	"regexp"
+	"strconv"
 	"strings"
 )
 
@@ -35,9 +39,25 @@ type buildFile struct {
 	tmpContainers map[string]struct{}
 	tmpImages     map[string]struct{}
 
+	// Set once a step misses the cache: the following steps can't hit it
+	cacheBusted bool
+
+	// Images built by the previous stages of the Dockerfile, which start
+	// with each FROM. Only the image of the last stage is returned.
+	stages    []buildStage
+	stageName string
+
 	out io.Writer
 }
 
+type buildStage struct {
+	name  string
+	image string
+}
+
+// Stage names follow the rules of repository names
+var validStageName = regexp.MustCompile(`^[a-z0-9_.-]+$`)
+
 func (b *buildFile) clearTmp(containers map[string]struct{}) {
 	for c := range containers {
 		tmp := b.runtime.Get(c)
@@ -46,7 +66,60 @@ func (b *buildFile) clearTmp(containers map[string]struct{}) {
 	}
 }
 
-func (b *buildFile) CmdFrom(name string) error {
+// parseFrom splits the arguments of FROM into the image and the optional
+// name of the stage: FROM <image> [AS <name>]
+func parseFrom(args string) (string, string, error) {
+	fields := strings.Fields(args)
+	switch {
+	case len(fields) == 1:
+		return fields[0], "", nil
+	case len(fields) == 3 && strings.ToLower(fields[1]) == "as":
+		name := strings.ToLower(fields[2])
+		if !validStageName.MatchString(name) {
+			return "", "", fmt.Errorf("Invalid stage name: %s, only [a-z0-9_.-] are allowed", fields[2])
+		}
+		if _, err := strconv.Atoi(name); err == nil {
+			return "", "", fmt.Errorf("Invalid stage name: %s, stages are already numbered", fields[2])
+		}
+		return fields[0], name, nil
+	}
+	return "", "", fmt.Errorf("Invalid FROM format")
+}
+
+// lookupStage returns the image built by a previous stage, referenced
+// either by its name or by its index, starting at 0.
+func (b *buildFile) lookupStage(name string) (string, bool) {
+	for i, stage := range b.stages {
+		if (stage.name != "" && stage.name == strings.ToLower(name)) || strconv.Itoa(i) == name {
+			return stage.image, true
+		}
+	}
+	return "", false
+}
+
+func (b *buildFile) CmdFrom(args string) error {
+	name, stageName, err := parseFrom(args)
+	if err != nil {
+		return err
+	}
+	if stageName != "" {
+		if _, exists := b.lookupStage(stageName); exists || stageName == b.stageName {
+			return fmt.Errorf("Conflict: stage name %s is used twice", stageName)
+		}
+	}
+	// A new stage starts, the current one is done
+	if b.image != "" {
+		b.stages = append(b.stages, buildStage{name: b.stageName, image: b.image})
+	}
+	b.stageName = stageName
+	b.maintainer = ""
+	b.cacheBusted = false
+
+	// A stage can build on top of a previous one
+	if stage, exists := b.lookupStage(name); exists {
+		name = stage
+	}
+
 	image, err := b.runtime.repositories.LookupImage(name)
 	if err != nil {
 		if b.runtime.graph.IsNotExist(err) {
@@ -92,17 +165,8 @@ func (b *buildFile) CmdRun(args string) error {
 
 	utils.Debugf("Command to be executed: %v", b.config.Cmd)
 
-	if b.utilizeCache {
-		if cache, err := b.srv.ImageGetCached(b.image, b.config); err != nil {
-			return err
-		} else if cache != nil {
-			fmt.Fprintf(b.out, " ---> Using cache\n")
-			utils.Debugf("[BUILDER] Use cached version")
-			b.image = cache.ID
-			return nil
-		} else {
-			utils.Debugf("[BUILDER] Cache miss")
-		}
+	if cached, err := b.probeCache(""); err != nil || cached {
+		return err
 	}
 
 	cid, err := b.run()
@@ -201,8 +265,67 @@ func (b *buildFile) CmdInsert(args string) error {
 	return fmt.Errorf("INSERT has been deprecated. Please use ADD instead")
 }
 
+// CmdCopy copies files from the image of a previous stage:
+// COPY --from=<stage> <src> <dest>
+// Without --from, COPY is the deprecated alias of ADD.
 func (b *buildFile) CmdCopy(args string) error {
-	return fmt.Errorf("COPY has been deprecated. Please use ADD instead")
+	if !strings.HasPrefix(args, "--from=") {
+		return fmt.Errorf("COPY has been deprecated. Please use ADD instead")
+	}
+	tmp := strings.Fields(args)
+	if len(tmp) != 3 {
+		return fmt.Errorf("Invalid COPY format")
+	}
+	stage := strings.TrimPrefix(tmp[0], "--from=")
+	source, exists := b.lookupStage(stage)
+	if !exists {
+		return fmt.Errorf("No such build stage: %s", stage)
+	}
+
+	orig, err := b.ReplaceEnvMatches(tmp[1])
+	if err != nil {
+		return err
+	}
+	dest, err := b.ReplaceEnvMatches(tmp[2])
+	if err != nil {
+		return err
+	}
+
+	cmd := b.config.Cmd
+	// The ID of the source image makes the cache safe to use: images never change
+	b.config.Cmd = []string{"/bin/sh", "-c", fmt.Sprintf("#(nop) COPY --from=%s %s in %s", source, orig, dest)}
+	defer func(cmd []string) { b.config.Cmd = cmd }(cmd)
+
+	b.config.Image = b.image
+	if cached, err := b.probeCache(""); err != nil || cached {
+		return err
+	}
+
+	container, _, err := b.runtime.Create(b.config, "")
+	if err != nil {
+		return err
+	}
+	b.tmpContainers[container.ID] = struct{}{}
+	if err := container.EnsureMounted(); err != nil {
+		return err
+	}
+	defer container.Unmount()
+
+	// The files are read from a container of the source image, which is never started
+	sourceContainer, _, err := b.runtime.Create(&Config{Image: source, Cmd: []string{"/bin/sh", "-c", "#(nop)"}}, "")
+	if err != nil {
+		return err
+	}
+	b.tmpContainers[sourceContainer.ID] = struct{}{}
+	if err := sourceContainer.EnsureMounted(); err != nil {
+		return err
+	}
+	defer sourceContainer.Unmount()
+
+	if err := b.addFromStage(sourceContainer, container, orig, dest); err != nil {
+		return err
+	}
+	return b.commit(container.ID, cmd, fmt.Sprintf("COPY --from=%s %s in %s", stage, orig, dest))
 }
 
 func (b *buildFile) CmdEntrypoint(args string) error {
@@ -248,13 +371,87 @@ func (b *buildFile) CmdVolume(args string) error {
 	return nil
 }
 
-func (b *buildFile) addRemote(container *Container, orig, dest string) error {
-	file, err := utils.Download(orig, ioutil.Discard)
+// downloadRemote downloads the file at `url` to a temporary file, and
+// returns it along with the hash of its content.
+func downloadRemote(url string) (*os.File, string, error) {
+	resp, err := utils.Download(url, ioutil.Discard)
 	if err != nil {
-		return err
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	file, err := ioutil.TempFile("", "docker-build-remote")
+	if err != nil {
+		return nil, "", err
+	}
+	hash := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(file, hash), resp.Body); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, "", err
+	}
+	if _, err := file.Seek(0, 0); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, "", err
+	}
+	return file, "sha256:" + hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// hashPath hashes the content of a file, or of a directory along with the
+// names, types and permissions of the files in it. Modification times and
+// owners are left out, so that a fresh checkout of the same files hits the cache.
+func hashPath(root string) (string, error) {
+	// ADD follows a symlink given as source
+	root, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.New()
+	err = filepath.Walk(root, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(root, filePath)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(hash, "%s\x00%s\x00", relPath, info.Mode())
+		switch {
+		case info.Mode()&os.ModeSymlink != 0:
+			target, err := os.Readlink(filePath)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(hash, "%s\x00", target)
+		case info.Mode().IsRegular():
+			file, err := os.Open(filePath)
+			if err != nil {
+				return err
+			}
+			defer file.Close()
+			fmt.Fprintf(hash, "%d\x00", info.Size())
+			if _, err := io.Copy(hash, file); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return "sha256:" + hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// shortHash truncates the hex part of a content hash for display
+func shortHash(hash string) string {
+	if i := strings.Index(hash, ":"); i >= 0 && len(hash) > i+13 {
+		return hash[:i+13]
 	}
-	defer file.Body.Close()
+	return hash
+}
 
+func (b *buildFile) addRemote(container *Container, file io.Reader, orig, dest string) error {
 	// If the destination is a directory, figure out the filename.
 	if strings.HasSuffix(dest, "/") {
 		u, err := url.Parse(orig)
@@ -273,22 +470,35 @@ func (b *buildFile) addRemote(container *Container, orig, dest string) error {
 		dest = dest + filename
 	}
 
-	return container.Inject(file.Body, dest)
+	return container.Inject(file, dest)
 }
 
-func (b *buildFile) addContext(container *Container, orig, dest string) error {
+// contextPath returns the path of `orig` in the build context, and makes
+// sure that it exists and doesn't lead out of the context.
+func (b *buildFile) contextPath(orig string) (string, error) {
 	origPath := path.Join(b.context, orig)
+	if !strings.HasPrefix(origPath, b.context) {
+		return "", fmt.Errorf("Forbidden path: %s", origPath)
+	}
+	if _, err := os.Stat(origPath); err != nil {
+		return "", fmt.Errorf("%s: no such file or directory", orig)
+	}
+	return origPath, nil
+}
+
+func (b *buildFile) addContext(container *Container, orig, dest string) error {
+	origPath, err := b.contextPath(orig)
+	if err != nil {
+		return err
+	}
 	destPath := path.Join(container.RootfsPath(), dest)
 	// Preserve the trailing '/'
 	if strings.HasSuffix(dest, "/") {
 		destPath = destPath + "/"
 	}
-	if !strings.HasPrefix(origPath, b.context) {
-		return fmt.Errorf("Forbidden path: %s", origPath)
-	}
 	fi, err := os.Stat(origPath)
 	if err != nil {
-		return fmt.Errorf("%s: no such file or directory", orig)
+		return err
 	}
 	if fi.IsDir() {
 		if err := CopyWithTar(origPath, destPath); err != nil {
@@ -308,6 +518,79 @@ func (b *buildFile) addContext(container *Container, orig, dest string) error {
 	return nil
 }
 
+// addFromStage copies `orig` from the filesystem of `source` to `dest` in
+// the filesystem of `container`. Unlike ADD, archives are copied as they are.
+func (b *buildFile) addFromStage(source, container *Container, orig, dest string) error {
+	// Symlinks in the source image must not lead out of it
+	origPath, err := resolveInRoot(source.RootfsPath(), orig)
+	if err != nil {
+		return err
+	}
+	destPath := path.Join(container.RootfsPath(), dest)
+	// Preserve the trailing '/'
+	if strings.HasSuffix(dest, "/") {
+		destPath = destPath + "/"
+	}
+	fi, err := os.Stat(origPath)
+	if err != nil {
+		return fmt.Errorf("%s: no such file or directory", orig)
+	}
+	if !fi.IsDir() {
+		if err := os.MkdirAll(path.Dir(destPath), 0755); err != nil {
+			return err
+		}
+	}
+	return CopyWithTar(origPath, destPath)
+}
+
+// resolveInRoot returns the path of `p` within the directory `root`,
+// resolving the symlinks along the way as if `root` was the root of the
+// filesystem, so that the result never leads out of it.
+func resolveInRoot(root, p string) (string, error) {
+	var (
+		resolved = "/"
+		pending  = strings.Split(p, "/")
+		links    = 0
+	)
+	for len(pending) > 0 {
+		part := pending[0]
+		pending = pending[1:]
+		if part == "" || part == "." {
+			continue
+		}
+		if part == ".." {
+			resolved = path.Dir(resolved)
+			continue
+		}
+		next := path.Join(resolved, part)
+		fi, err := os.Lstat(path.Join(root, next))
+		if err != nil {
+			if os.IsNotExist(err) {
+				// Left for the caller to report
+				resolved = next
+				continue
+			}
+			return "", err
+		}
+		if fi.Mode()&os.ModeSymlink == 0 {
+			resolved = next
+			continue
+		}
+		if links++; links > 255 {
+			return "", fmt.Errorf("Too many levels of symbolic links: %s", p)
+		}
+		target, err := os.Readlink(path.Join(root, next))
+		if err != nil {
+			return "", err
+		}
+		if path.IsAbs(target) {
+			resolved = "/"
+		}
+		pending = append(strings.Split(target, "/"), pending...)
+	}
+	return path.Join(root, resolved), nil
+}
+
 func (b *buildFile) CmdAdd(args string) error {
 	if b.context == "" {
 		return fmt.Errorf("No context given. Impossible to use ADD")
@@ -327,10 +610,36 @@ func (b *buildFile) CmdAdd(args string) error {
 		return err
 	}
 
+	// The cache is keyed on the content of the files
+	var (
+		hash   string
+		remote *os.File
+	)
+	if utils.IsURL(orig) {
+		if remote, hash, err = downloadRemote(orig); err != nil {
+			return err
+		}
+		defer os.Remove(remote.Name())
+		defer remote.Close()
+	} else {
+		origPath, err := b.contextPath(orig)
+		if err != nil {
+			return err
+		}
+		if hash, err = hashPath(origPath); err != nil {
+			return err
+		}
+	}
+
 	cmd := b.config.Cmd
 	b.config.Cmd = []string{"/bin/sh", "-c", fmt.Sprintf("#(nop) ADD %s in %s", orig, dest)}
+	defer func(cmd []string) { b.config.Cmd = cmd }(cmd)
 
 	b.config.Image = b.image
+	if cached, err := b.probeCache(hash); err != nil || cached {
+		return err
+	}
+
 	// Create the container and start it
 	container, _, err := b.runtime.Create(b.config, "")
 	if err != nil {
@@ -343,8 +652,8 @@ func (b *buildFile) CmdAdd(args string) error {
 	}
 	defer container.Unmount()
 
-	if utils.IsURL(orig) {
-		if err := b.addRemote(container, orig, dest); err != nil {
+	if remote != nil {
+		if err := b.addRemote(container, remote, orig, dest); err != nil {
 			return err
 		}
 	} else {
@@ -356,8 +665,11 @@ func (b *buildFile) CmdAdd(args string) error {
 	if err := b.commit(container.ID, cmd, fmt.Sprintf("ADD %s in %s", orig, dest)); err != nil {
 		return err
 	}
-	b.config.Cmd = cmd
-	return nil
+	image, err := b.runtime.graph.Get(b.image)
+	if err != nil {
+		return err
+	}
+	return image.StoreContentHash(hash)
 }
 
 func (b *buildFile) run() (string, error) {
@@ -406,6 +718,51 @@ func (b *buildFile) run() (string, error) {
 	return c.ID, nil
 }
 
+// probeCache looks for the image built by the current step in a previous
+// build, i.e. from the same image with the same config and, for ADD, from
+// files with the same content hash. It uses the image if there is one, and
+// reports why it does or doesn't.
+func (b *buildFile) probeCache(contentHash string) (bool, error) {
+	if !b.utilizeCache {
+		return false, nil
+	}
+	if b.cacheBusted {
+		fmt.Fprintf(b.out, " ---> Cache miss: a previous step wasn't cached\n")
+		return false, nil
+	}
+	cache, stale, err := b.srv.ImageGetCached(b.image, b.config, contentHash)
+	if err != nil {
+		return false, err
+	}
+	if cache != nil {
+		if contentHash != "" {
+			fmt.Fprintf(b.out, " ---> Using cache: same parent, instruction and content %s\n", shortHash(contentHash))
+		} else {
+			fmt.Fprintf(b.out, " ---> Using cache: same parent and instruction\n")
+		}
+		utils.Debugf("[BUILDER] Use cached version")
+		b.image = cache.ID
+		return true, nil
+	}
+
+	utils.Debugf("[BUILDER] Cache miss")
+	b.cacheBusted = true
+	if stale == nil {
+		fmt.Fprintf(b.out, " ---> Cache miss: no image was built from %s with this instruction\n", utils.TruncateID(b.image))
+		return false, nil
+	}
+	staleHash, err := stale.ContentHash()
+	if err != nil {
+		return false, err
+	}
+	if staleHash == "" {
+		fmt.Fprintf(b.out, " ---> Cache miss: the content of the files added by %s is unknown\n", stale.ShortID())
+	} else {
+		fmt.Fprintf(b.out, " ---> Cache miss: the content of the files changed from %s to %s\n", shortHash(staleHash), shortHash(contentHash))
+	}
+	return false, nil
+}
+
 // Commit the container <id> with the autorun command <autoCmd>
 func (b *buildFile) commit(id string, autoCmd []string, comment string) error {
 	if b.image == "" {
@@ -417,17 +774,8 @@ func (b *buildFile) commit(id string, autoCmd []string, comment string) error {
 		b.config.Cmd = []string{"/bin/sh", "-c", "#(nop) " + comment}
 		defer func(cmd []string) { b.config.Cmd = cmd }(cmd)
 
-		if b.utilizeCache {
-			if cache, err := b.srv.ImageGetCached(b.image, b.config); err != nil {
-				return err
-			} else if cache != nil {
-				fmt.Fprintf(b.out, " ---> Using cache\n")
-				utils.Debugf("[BUILDER] Use cached version")
-				b.image = cache.ID
-				return nil
-			} else {
-				utils.Debugf("[BUILDER] Cache miss")
-			}
+		if cached, err := b.probeCache(""); err != nil || cached {
+			return err
 		}
 
 		container, warnings, err := b.runtime.Create(b.config, "")
@@ -477,6 +825,10 @@ func (b *buildFile) Build(context io.Reader) (string, error) {
 		return "", err
 	}
 	defer os.RemoveAll(name)
+	// The client may not know about .dockerignore
+	if err := removeExcluded(name); err != nil {
+		return "", err
+	}
 	b.context = name
 	filename := path.Join(name, "Dockerfile")
 	if _, err := os.Stat(filename); os.IsNotExist(err) {
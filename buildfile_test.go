@@ -6,8 +6,11 @@ import (
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path"
 	"strings"
 	"testing"
+	"time"
 )
 
 // mkTestContext generates a build context from the contents of the provided dockerfile.
@@ -189,6 +192,22 @@ run    [ "$(cat /bar/withfile)" = "test2" ]
 		},
 		nil,
 	},
+
+	{
+		`
+from   {IMAGE} as builder
+run    sh -c 'echo hello > /hello'
+run    ln -s /hello /link
+from   {IMAGE}
+copy   --from=builder /link /greeting
+copy   --from=0 /hello /tmp/
+run    [ "$(cat /greeting)" = "hello" ]
+run    [ "$(cat /tmp/hello)" = "hello" ]
+run    [ ! -e /hello ]
+`,
+		nil,
+		nil,
+	},
 }
 
 // FIXME: test building with 2 successive overlapping ADD commands
@@ -451,6 +470,39 @@ func TestBuildImageWithoutCache(t *testing.T) {
 	}
 }
 
+func TestBuildADDCacheContent(t *testing.T) {
+	runtime := mkRuntime(t)
+	defer nuke(runtime)
+
+	srv := &Server{
+		runtime:     runtime,
+		pullingPool: make(map[string]struct{}),
+		pushingPool: make(map[string]struct{}),
+	}
+
+	dockerfile := `
+        from {IMAGE}
+        add foo /usr/lib/bla/bar
+        add dir /usr/lib/dir
+        `
+	template := testContextTemplate{dockerfile, [][2]string{{"foo", "hello"}, {"dir/file", "world"}}, nil}
+	img := buildImage(template, t, srv, true)
+
+	if cached := buildImage(template, t, srv, true); cached.ID != img.ID {
+		t.Fatalf("The same files should hit the cache: %s != %s", img.ID, cached.ID)
+	}
+
+	for _, files := range [][][2]string{
+		{{"foo", "hello world"}, {"dir/file", "world"}},
+		{{"foo", "hello"}, {"dir/file", "world"}, {"dir/other", "!"}},
+	} {
+		changed := buildImage(testContextTemplate{dockerfile, files, nil}, t, srv, true)
+		if changed.ID == img.ID {
+			t.Fatalf("Changing the files %v should miss the cache", files)
+		}
+	}
+}
+
 func TestForbiddenContextPath(t *testing.T) {
 	runtime := mkRuntime(t)
 	defer nuke(runtime)
@@ -497,6 +549,124 @@ func TestForbiddenContextPath(t *testing.T) {
 	}
 }
 
+func TestResolveInRoot(t *testing.T) {
+	root, err := ioutil.TempDir("", "docker-test-resolve")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	if err := os.MkdirAll(path.Join(root, "usr/lib"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for link, target := range map[string]string{
+		"lib":       "usr/lib",
+		"abs":       "/usr",
+		"escape":    "../../../etc",
+		"usr/up":    "../lib",
+		"loop":      "loop",
+		"etcpasswd": "/etc/passwd",
+	} {
+		if err := os.Symlink(target, path.Join(root, link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for p, expected := range map[string]string{
+		"/usr/lib":        "/usr/lib",
+		"lib":             "/usr/lib",
+		"/abs/lib":        "/usr/lib",
+		"/escape":         "/etc",
+		"/escape/passwd":  "/etc/passwd",
+		"/usr/up/foo":     "/usr/lib/foo",
+		"/../../etc":      "/etc",
+		"/etcpasswd":      "/etc/passwd",
+		"/usr/lib/../../": "/",
+	} {
+		resolved, err := resolveInRoot(root, p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resolved != path.Join(root, expected) {
+			t.Fatalf("Expected %s to resolve to %s, found %s", p, path.Join(root, expected), resolved)
+		}
+	}
+	if _, err := resolveInRoot(root, "/loop"); err == nil {
+		t.Fatal("Expected an error for a symlink loop")
+	}
+}
+
+func TestHashPath(t *testing.T) {
+	root, err := ioutil.TempDir("", "docker-test-hash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	dir := path.Join(root, "dir")
+	if err := os.MkdirAll(path.Join(dir, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path.Join(dir, "sub/file"), []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	hash := func() string {
+		h, err := hashPath(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return h
+	}
+	initial := hash()
+	if !strings.HasPrefix(initial, "sha256:") {
+		t.Fatalf("Unexpected hash format: %s", initial)
+	}
+
+	// Times don't matter
+	if err := os.Chtimes(path.Join(dir, "sub/file"), time.Unix(0, 0), time.Unix(0, 0)); err != nil {
+		t.Fatal(err)
+	}
+	if h := hash(); h != initial {
+		t.Fatalf("Changing the modification time shouldn't change the hash")
+	}
+
+	for _, change := range []func() error{
+		func() error { return ioutil.WriteFile(path.Join(dir, "sub/file"), []byte("world"), 0644) },
+		func() error { return os.Chmod(path.Join(dir, "sub/file"), 0755) },
+		func() error { return os.Rename(path.Join(dir, "sub/file"), path.Join(dir, "sub/renamed")) },
+		func() error { return os.Symlink("renamed", path.Join(dir, "sub/link")) },
+	} {
+		previous := hash()
+		if err := change(); err != nil {
+			t.Fatal(err)
+		}
+		if h := hash(); h == previous {
+			t.Fatalf("The hash should change with the content")
+		}
+	}
+}
+
+func TestParseFrom(t *testing.T) {
+	for args, expected := range map[string][2]string{
+		"ubuntu":                  {"ubuntu", ""},
+		"ubuntu:12.04 AS builder": {"ubuntu:12.04", "builder"},
+		"ubuntu as Builder":       {"ubuntu", "builder"},
+	} {
+		image, stage, err := parseFrom(args)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if image != expected[0] || stage != expected[1] {
+			t.Fatalf("Expected %v for %s, found %s and %s", expected, args, image, stage)
+		}
+	}
+	for _, args := range []string{"", "ubuntu builder", "ubuntu as", "ubuntu as 1", "ubuntu as b/c"} {
+		if _, _, err := parseFrom(args); err == nil {
+			t.Fatalf("Expected an error for %q", args)
+		}
+	}
+}
+
 func TestBuildADDFileNotFound(t *testing.T) {
 	runtime := mkRuntime(t)
 	defer nuke(runtime)
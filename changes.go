@@ -1,10 +1,14 @@
 package docker
 
 import (
+	"archive/tar"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 	"strings"
+	"syscall"
+	"time"
 )
 
 type ChangeType int
@@ -104,3 +108,182 @@ func Changes(layers []string, rw string) ([]Change, error) {
 	}
 	return changes, nil
 }
+
+// ChangesDirs compares the filesystem trees at newDir and oldDir, and returns
+// the changes needed to turn the latter into the former.
+// If oldDir is empty, every file in newDir is reported as added.
+func ChangesDirs(newDir, oldDir string) ([]Change, error) {
+	var changes []Change
+	err := filepath.Walk(newDir, func(newPath string, f os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		// Rebase path
+		path, err := filepath.Rel(newDir, newPath)
+		if err != nil {
+			return err
+		}
+		path = filepath.Join("/", path)
+
+		// Skip root
+		if path == "/" {
+			return nil
+		}
+
+		change := Change{
+			Path: path,
+			Kind: ChangeAdd,
+		}
+		if oldDir != "" {
+			oldStat, err := os.Lstat(filepath.Join(oldDir, path))
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			if err == nil {
+				if sameFileInfo(f, oldStat) {
+					return nil
+				}
+				change.Kind = ChangeModify
+			}
+		}
+		changes = append(changes, change)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if oldDir == "" {
+		return changes, nil
+	}
+
+	// Anything left in oldDir but missing from newDir was deleted.
+	err = filepath.Walk(oldDir, func(oldPath string, f os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		path, err := filepath.Rel(oldDir, oldPath)
+		if err != nil {
+			return err
+		}
+		path = filepath.Join("/", path)
+		if path == "/" {
+			return nil
+		}
+		if _, err := os.Lstat(filepath.Join(newDir, path)); err == nil {
+			return nil
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+		changes = append(changes, Change{
+			Path: path,
+			Kind: ChangeDelete,
+		})
+		// The whole subtree is gone, no need to report its content
+		if f.IsDir() {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return changes, nil
+}
+
+func sameFileInfo(a, b os.FileInfo) bool {
+	if a.Mode() != b.Mode() || a.Size() != b.Size() || a.ModTime() != b.ModTime() {
+		return false
+	}
+	aSt, aOk := a.Sys().(*syscall.Stat_t)
+	bSt, bOk := b.Sys().(*syscall.Stat_t)
+	if !aOk || !bOk {
+		return aOk == bOk
+	}
+	return aSt.Uid == bSt.Uid && aSt.Gid == bSt.Gid && aSt.Rdev == bSt.Rdev
+}
+
+// ExportChanges produces an archive of the files listed in `changes`, read
+// from the filesystem tree at `dir`. Deleted files are represented by
+// AUFS-style whiteouts, so that the archive can be applied with ApplyLayer.
+func ExportChanges(dir string, changes []Change) (Archive, error) {
+	reader, writer := io.Pipe()
+	go func() {
+		tw := tar.NewWriter(writer)
+		for _, change := range changes {
+			if err := exportChange(tw, dir, change); err != nil {
+				writer.CloseWithError(err)
+				return
+			}
+		}
+		if err := tw.Close(); err != nil {
+			writer.CloseWithError(err)
+			return
+		}
+		writer.Close()
+	}()
+	return reader, nil
+}
+
+func exportChange(tw *tar.Writer, dir string, change Change) error {
+	name := strings.TrimPrefix(change.Path, "/")
+	if change.Kind == ChangeDelete {
+		whiteout := filepath.Join(filepath.Dir(name), ".wh."+filepath.Base(name))
+		return tw.WriteHeader(&tar.Header{
+			Name:       whiteout,
+			Mode:       0600,
+			Typeflag:   tar.TypeReg,
+			ModTime:    time.Now(),
+			AccessTime: time.Now(),
+			ChangeTime: time.Now(),
+		})
+	}
+
+	src := filepath.Join(dir, change.Path)
+	fi, err := os.Lstat(src)
+	if err != nil {
+		return err
+	}
+	// Sockets can't be archived, and are meaningless outside of a running container anyway
+	if fi.Mode()&os.ModeSocket != 0 {
+		return nil
+	}
+	var link string
+	if fi.Mode()&os.ModeSymlink != 0 {
+		if link, err = os.Readlink(src); err != nil {
+			return err
+		}
+	}
+	hdr, err := tar.FileInfoHeader(fi, link)
+	if err != nil {
+		return err
+	}
+	hdr.Name = name
+	if fi.IsDir() {
+		hdr.Name += "/"
+	}
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		hdr.Uid = int(st.Uid)
+		hdr.Gid = int(st.Gid)
+		hdr.Uname = ""
+		hdr.Gname = ""
+		if fi.Mode()&(os.ModeDevice|os.ModeCharDevice) != 0 {
+			hdr.Devmajor = int64(st.Rdev >> 8 & 0xfff)
+			hdr.Devminor = int64(st.Rdev&0xff | st.Rdev>>12&0xfff00)
+		}
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	if hdr.Typeflag == tar.TypeReg {
+		f, err := os.Open(src)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		if _, err := io.Copy(tw, f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,216 @@
+package docker
+
+import (
+	"bufio"
+	"compress/bzip2"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/dotcloud/docker/utils"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// ChecksumError is returned when a layer pulled from a registry doesn't
+// match the checksum listed by the index.
+type ChecksumError struct {
+	ID       string
+	Expected string
+	Computed string
+}
+
+func (e *ChecksumError) Error() string {
+	return fmt.Sprintf("Checksum mismatch for layer %s: expected %s, computed %s. The layer may be corrupted or tampered with", utils.TruncateID(e.ID), e.Expected, e.Computed)
+}
+
+// layerHasher computes the checksum of the layer written to it.
+type layerHasher interface {
+	io.Writer
+	Checksum() (string, error)
+}
+
+// newLayerHasher returns a hasher using the same algorithm as `checksum`:
+// layers pushed by this version of docker have a tarsum, older ones
+// a sha256 of their json and their raw archive.
+func newLayerHasher(checksum string, jsonData []byte) (layerHasher, error) {
+	switch {
+	case strings.HasPrefix(checksum, "tarsum+sha256:"):
+		return newTarsumHasher(jsonData), nil
+	case strings.HasPrefix(checksum, "sha256:"):
+		h := &legacyHasher{sha256.New()}
+		h.Write(jsonData)
+		h.Write([]byte("\n"))
+		return h, nil
+	}
+	return nil, fmt.Errorf("Unknown checksum algorithm: %s", checksum)
+}
+
+type legacyHasher struct {
+	hash.Hash
+}
+
+func (h *legacyHasher) Checksum() (string, error) {
+	return "sha256:" + hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// tarsumHasher feeds the layer to a TarSum, which reads the archive entry
+// by entry in its own goroutine.
+type tarsumHasher struct {
+	*io.PipeWriter
+	jsonData []byte
+	tarsum   *utils.TarSum
+	done     chan error
+}
+
+func newTarsumHasher(jsonData []byte) *tarsumHasher {
+	pipeR, pipeW := io.Pipe()
+	h := &tarsumHasher{
+		PipeWriter: pipeW,
+		jsonData:   jsonData,
+		done:       make(chan error, 1),
+	}
+	go func() {
+		err := h.consume(pipeR)
+		// Don't block the writer if the archive ends early or is invalid
+		io.Copy(ioutil.Discard, pipeR)
+		h.done <- err
+	}()
+	return h
+}
+
+func (h *tarsumHasher) consume(layer io.Reader) error {
+	archive, err := decompressLayer(layer)
+	if err != nil {
+		return err
+	}
+	h.tarsum = &utils.TarSum{Reader: archive}
+	_, err = io.Copy(ioutil.Discard, h.tarsum)
+	return err
+}
+
+func (h *tarsumHasher) Checksum() (string, error) {
+	h.Close()
+	if err := <-h.done; err != nil {
+		return "", fmt.Errorf("Unable to compute the tarsum of the layer: %s", err)
+	}
+	return h.tarsum.Sum(h.jsonData), nil
+}
+
+// decompressLayer returns the tar archive of a layer, which registries
+// usually store compressed.
+func decompressLayer(layer io.Reader) (io.Reader, error) {
+	buf := bufio.NewReader(layer)
+	// The error, if any, is returned by the next read
+	magic, _ := buf.Peek(10)
+	switch compression := DetectCompression(magic); compression {
+	case Uncompressed:
+		return buf, nil
+	case Gzip:
+		return gzip.NewReader(buf)
+	case Bzip2:
+		return bzip2.NewReader(buf), nil
+	default:
+		return nil, fmt.Errorf("Unsupported compression for checksum verification: %s", compression.Extension())
+	}
+}
+
+// downloadLayer appends the layer of image `id` to the file at `path`,
+// where an interrupted download may have left its beginning, computing its
+// checksum on the way. It returns the file only if the checksum matches:
+// a corrupted layer never reaches the graph. The file is kept if the
+// download fails, so that the next one resumes from there.
+// Registries without an index provide no checksum, in which case
+// `checksum` is empty and the layer can't be verified.
+func downloadLayer(id string, layer io.Reader, jsonData []byte, checksum, path string) (*TempArchive, error) {
+	var hasher layerHasher
+	if checksum != "" {
+		h, err := newLayerHasher(checksum, jsonData)
+		if err != nil {
+			return nil, err
+		}
+		hasher = h
+	}
+
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	discard := func(err error) (*TempArchive, error) {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+
+	var (
+		dst     io.Writer = f
+		resumed io.Writer = ioutil.Discard
+	)
+	if hasher != nil {
+		dst = io.MultiWriter(f, hasher)
+		resumed = hasher
+	}
+	// Hash what an interrupted download left, which leaves f at its end
+	offset, err := io.Copy(resumed, f)
+	if err != nil {
+		if hasher != nil {
+			hasher.Checksum()
+		}
+		return discard(err)
+	}
+	if offset > 0 {
+		utils.Debugf("Resuming the download of layer %s at %d bytes", id, offset)
+	}
+	size, err := io.Copy(dst, layer)
+	size += offset
+	if hasher != nil {
+		computed, sumErr := hasher.Checksum()
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		if sumErr != nil {
+			return discard(sumErr)
+		}
+		if computed != checksum {
+			return discard(&ChecksumError{ID: id, Expected: checksum, Computed: computed})
+		}
+		utils.Debugf("Checksum of layer %s verified: %s", id, checksum)
+	} else if err != nil {
+		f.Close()
+		return nil, err
+	} else {
+		utils.Debugf("No checksum for layer %s, skipping verification", id)
+	}
+
+	if _, err := f.Seek(0, 0); err != nil {
+		return discard(err)
+	}
+	return &TempArchive{f, size}, nil
+}
+
+// LayerChecksum computes the checksum of the layer of the image `id` as it
+// is pushed: the tarsum of its archive and its json.
+func (graph *Graph) LayerChecksum(id string) (string, error) {
+	img, err := graph.Get(id)
+	if err != nil {
+		return "", err
+	}
+	jsonData, err := ioutil.ReadFile(jsonPath(graph.imageRoot(id)))
+	if err != nil {
+		return "", err
+	}
+	archive, err := img.TarLayer()
+	if err != nil {
+		return "", err
+	}
+	hasher := newTarsumHasher(jsonData)
+	if _, err := io.Copy(hasher, archive); err != nil {
+		hasher.Checksum()
+		return "", err
+	}
+	return hasher.Checksum()
+}
@@ -0,0 +1,175 @@
+package docker
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/dotcloud/docker/utils"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func tarLayer(t *testing.T, files map[string]string) []byte {
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	for name, content := range files {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content))}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestDownloadLayer(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "docker-checksum-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	layerPath := path.Join(tmp, "foo.partial")
+	jsonData := []byte(`{"id":"foo"}`)
+	layer := tarLayer(t, map[string]string{"a": "hello", "b": "world"})
+
+	// What a push sends to the registry: the gzipped layer and its tarsum
+	tarsum := &utils.TarSum{Reader: bytes.NewReader(layer)}
+	pushed, err := ioutil.ReadAll(tarsum)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checksum := tarsum.Sum(jsonData)
+
+	h := sha256.New()
+	h.Write(jsonData)
+	h.Write([]byte("\n"))
+	h.Write(layer)
+	legacyChecksum := "sha256:" + hex.EncodeToString(h.Sum(nil))
+
+	for _, valid := range []struct {
+		data     []byte
+		checksum string
+	}{
+		{pushed, checksum},
+		{layer, checksum},
+		{layer, legacyChecksum},
+		{layer, ""},
+	} {
+		archive, err := downloadLayer("foo", bytes.NewReader(valid.data), jsonData, valid.checksum, layerPath)
+		if err != nil {
+			t.Fatalf("Unexpected error with checksum %q: %s", valid.checksum, err)
+		}
+		data, err := ioutil.ReadAll(archive)
+		archive.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, valid.data) {
+			t.Fatalf("The downloaded layer should be left untouched")
+		}
+	}
+
+	// Resume a download interrupted halfway
+	for _, valid := range []struct {
+		data     []byte
+		checksum string
+	}{
+		{pushed, checksum},
+		{layer, legacyChecksum},
+	} {
+		half := len(valid.data) / 2
+		if err := ioutil.WriteFile(layerPath, valid.data[:half], 0600); err != nil {
+			t.Fatal(err)
+		}
+		archive, err := downloadLayer("foo", bytes.NewReader(valid.data[half:]), jsonData, valid.checksum, layerPath)
+		if err != nil {
+			t.Fatalf("Unexpected error with checksum %q: %s", valid.checksum, err)
+		}
+		data, err := ioutil.ReadAll(archive)
+		archive.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, valid.data) {
+			t.Fatalf("The resumed layer should be the whole layer")
+		}
+	}
+
+	tampered := tarLayer(t, map[string]string{"a": "hello", "b": "w0rld"})
+	for _, invalid := range []struct {
+		data     []byte
+		checksum string
+	}{
+		{tampered, checksum},
+		{tampered, legacyChecksum},
+		{pushed[:len(pushed)/2], checksum},
+		{layer, "tarsum+sha256:" + hex.EncodeToString(make([]byte, 32))},
+		{layer, "md5:d41d8cd98f00b204e9800998ecf8427e"},
+	} {
+		if _, err := downloadLayer("foo", bytes.NewReader(invalid.data), jsonData, invalid.checksum, layerPath); err == nil {
+			t.Fatalf("Expected an error with checksum %q", invalid.checksum)
+		}
+	}
+	if _, err := downloadLayer("foo", bytes.NewReader(tampered), jsonData, checksum, layerPath); err == nil {
+		t.Fatal("Expected an error")
+	} else if _, ok := err.(*ChecksumError); !ok {
+		t.Fatalf("Expected a ChecksumError, found %#v", err)
+	}
+
+	if files, err := ioutil.ReadDir(tmp); err != nil {
+		t.Fatal(err)
+	} else if len(files) != 0 {
+		t.Fatalf("Rejected layers should be removed, found %d files", len(files))
+	}
+}
+
+func TestLayerChecksum(t *testing.T) {
+	graph := tempGraph(t)
+	defer os.RemoveAll(graph.Root)
+	image := &Image{ID: GenerateID(), Created: time.Now()}
+	if err := graph.Register(nil, bytes.NewReader(tarLayer(t, map[string]string{"a": "hello"})), image); err != nil {
+		t.Fatal(err)
+	}
+
+	// What a push computes
+	jsonData, err := ioutil.ReadFile(jsonPath(graph.imageRoot(image.ID)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive, err := image.TarLayer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tarsum := &utils.TarSum{Reader: archive}
+	if _, err := io.Copy(ioutil.Discard, tarsum); err != nil {
+		t.Fatal(err)
+	}
+
+	checksum, err := graph.LayerChecksum(image.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := tarsum.Sum(jsonData); checksum != expected {
+		t.Fatalf("Expected the checksum of the push %s, got %s", expected, checksum)
+	}
+
+	other := &Image{ID: GenerateID(), Created: image.Created}
+	if err := graph.Register(nil, bytes.NewReader(tarLayer(t, map[string]string{"a": "world"})), other); err != nil {
+		t.Fatal(err)
+	}
+	if otherChecksum, err := graph.LayerChecksum(other.ID); err != nil {
+		t.Fatal(err)
+	} else if otherChecksum == checksum {
+		t.Fatal("Expected layers with another content to have another checksum")
+	}
+}
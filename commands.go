@@ -4,6 +4,7 @@ import (
 	"archive/tar"
 	"bufio"
 	"bytes"
+	"crypto/tls"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
@@ -28,6 +29,7 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"text/tabwriter"
 	"time"
@@ -51,8 +53,11 @@ func (cli *DockerCli) getMethod(name string) (func(...string) error, bool) {
 	return method.Interface().(func(...string) error), true
 }
 
-func ParseCommands(proto, addr string, args ...string) error {
+// ParseCommands runs the command of `args` against the daemon at `addr`,
+// over TLS with `tlsConfig` if it isn't nil.
+func ParseCommands(proto, addr string, tlsConfig *tls.Config, args ...string) error {
 	cli := NewDockerCli(os.Stdin, os.Stdout, os.Stderr, proto, addr)
+	cli.tlsConfig = tlsConfig
 
 	if len(args) > 0 {
 		method, exists := cli.getMethod(args[0])
@@ -83,6 +88,7 @@ func (cli *DockerCli) CmdHelp(args ...string) error {
 		{"cp", "Copy files/folders from the containers filesystem to the host path"},
 		{"diff", "Inspect changes on a container's filesystem"},
 		{"events", "Get real time events from the server"},
+		{"exec", "Run a command in a running container"},
 		{"export", "Stream the contents of a container as a tar archive"},
 		{"history", "Show the history of an image"},
 		{"images", "List images"},
@@ -91,8 +97,12 @@ func (cli *DockerCli) CmdHelp(args ...string) error {
 		{"insert", "Insert a file in an image"},
 		{"inspect", "Return low-level information on a container"},
 		{"kill", "Kill a running container"},
+		{"load", "Load an image from a tar archive"},
 		{"login", "Register or Login to the docker registry server"},
+		{"logout", "Log out from a docker registry server"},
 		{"logs", "Fetch the logs of a container"},
+		{"network", "Manage the networks of the containers"},
+		{"pause", "Pause all processes within a container"},
 		{"port", "Lookup the public-facing port which is NAT-ed to PRIVATE_PORT"},
 		{"ps", "List containers"},
 		{"pull", "Pull an image or a repository from the docker registry server"},
@@ -101,11 +111,14 @@ func (cli *DockerCli) CmdHelp(args ...string) error {
 		{"rm", "Remove one or more containers"},
 		{"rmi", "Remove one or more images"},
 		{"run", "Run a command in a new container"},
+		{"save", "Save an image to a tar archive"},
 		{"search", "Search for an image in the docker index"},
 		{"start", "Start a stopped container"},
+		{"stats", "Display a live stream of the resource usage of containers"},
 		{"stop", "Stop a running container"},
 		{"tag", "Tag an image into a repository"},
 		{"top", "Lookup the running processes of a container"},
+		{"unpause", "Unpause a paused container"},
 		{"version", "Show the docker version information"},
 		{"wait", "Block until a container stops, then print its exit code"},
 	} {
@@ -194,7 +207,10 @@ func (cli *DockerCli) CmdBuild(args ...string) error {
 		if _, err := os.Stat(cmd.Arg(0)); err != nil {
 			return err
 		}
-		context, err = Tar(cmd.Arg(0), Uncompressed)
+		context, err = TarContext(cmd.Arg(0))
+	}
+	if err != nil {
+		return err
 	}
 	var body io.Reader
 	// Setup an upload progress bar
@@ -226,7 +242,7 @@ func (cli *DockerCli) CmdBuild(args ...string) error {
 	if context != nil {
 		req.Header.Set("Content-Type", "application/tar")
 	}
-	dial, err := net.Dial(cli.proto, cli.addr)
+	dial, err := cli.dial()
 	if err != nil {
 		return err
 	}
@@ -257,6 +273,15 @@ func (cli *DockerCli) CmdBuild(args ...string) error {
 	return nil
 }
 
+// loginArgs returns the arguments of `docker login` for the registry at
+// `hostname`, empty for the index.
+func loginArgs(hostname string) []string {
+	if hostname == "" {
+		return nil
+	}
+	return []string{hostname}
+}
+
 // 'docker login': login / register a user to registry service.
 func (cli *DockerCli) CmdLogin(args ...string) error {
 	cmd := Subcmd("login", "[OPTIONS] [SERVER]", "Register or Login to a docker registry server, if no server is specified \""+auth.IndexServerAddress()+"\" is the default.")
@@ -272,8 +297,13 @@ func (cli *DockerCli) CmdLogin(args ...string) error {
 	}
 	serverAddress := auth.IndexServerAddress()
 	if len(cmd.Args()) > 0 {
-		serverAddress, err = registry.ExpandAndVerifyRegistryUrl(cmd.Arg(0))
+		// The registries allowed over plain HTTP are only known to the
+		// daemon: they must be given with their scheme to log in to them
+		serverAddress, err = registry.ExpandAndVerifyRegistryUrl(cmd.Arg(0), false)
 		if err != nil {
+			if !strings.Contains(cmd.Arg(0), "://") {
+				return fmt.Errorf("%s\nTo log in to it over plain HTTP, run: docker login http://%s", err, cmd.Arg(0))
+			}
 			return err
 		}
 		fmt.Fprintf(cli.out, "Login against server at %s\n", serverAddress)
@@ -358,13 +388,44 @@ func (cli *DockerCli) CmdLogin(args ...string) error {
 		cli.configFile, _ = auth.LoadConfig(os.Getenv("HOME"))
 		return err
 	}
-	auth.SaveConfig(cli.configFile)
+	if err := auth.SaveConfig(cli.configFile); err != nil {
+		return err
+	}
 	if out2.Status != "" {
 		fmt.Fprintf(cli.out, "%s\n", out2.Status)
 	}
 	return nil
 }
 
+// 'docker logout': remove the credentials of a registry
+func (cli *DockerCli) CmdLogout(args ...string) error {
+	cmd := Subcmd("logout", "[SERVER]", "Log out from a docker registry server, if no server is specified \""+auth.IndexServerAddress()+"\" is the default.")
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+	if cmd.NArg() > 1 {
+		cmd.Usage()
+		return nil
+	}
+	serverAddress := auth.IndexServerAddress()
+	if cmd.NArg() == 1 {
+		serverAddress = cmd.Arg(0)
+	}
+
+	cli.LoadConfigFile()
+	key, found := cli.configFile.ResolveServerAddress(serverAddress)
+	if !found {
+		fmt.Fprintf(cli.out, "Not logged in to %s\n", serverAddress)
+		return nil
+	}
+	delete(cli.configFile.Configs, key)
+	if err := auth.SaveConfig(cli.configFile); err != nil {
+		return err
+	}
+	fmt.Fprintf(cli.out, "Removed the credentials of %s\n", key)
+	return nil
+}
+
 // 'docker wait': block until a container stops
 func (cli *DockerCli) CmdWait(args ...string) error {
 	cmd := Subcmd("wait", "CONTAINER [CONTAINER...]", "Block until a container stops, then print its exit code.")
@@ -460,6 +521,12 @@ func (cli *DockerCli) CmdInfo(args ...string) error {
 
 	fmt.Fprintf(cli.out, "Containers: %d\n", out.Containers)
 	fmt.Fprintf(cli.out, "Images: %d\n", out.Images)
+	if out.Driver != "" {
+		fmt.Fprintf(cli.out, "Driver: %s\n", out.Driver)
+	}
+	if out.ExecutionDriver != "" {
+		fmt.Fprintf(cli.out, "Execution Driver: %s\n", out.ExecutionDriver)
+	}
 	if out.Debug || os.Getenv("DEBUG") != "" {
 		fmt.Fprintf(cli.out, "Debug mode (server): %v\n", out.Debug)
 		fmt.Fprintf(cli.out, "Debug mode (client): %v\n", os.Getenv("DEBUG") != "")
@@ -515,6 +582,48 @@ func (cli *DockerCli) CmdStop(args ...string) error {
 	return nil
 }
 
+func (cli *DockerCli) CmdPause(args ...string) error {
+	cmd := Subcmd("pause", "CONTAINER [CONTAINER...]", "Pause all processes within a container")
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+	if cmd.NArg() < 1 {
+		cmd.Usage()
+		return nil
+	}
+
+	for _, name := range cmd.Args() {
+		_, _, err := cli.call("POST", "/containers/"+name+"/pause", nil)
+		if err != nil {
+			fmt.Fprintf(cli.err, "%s\n", err)
+		} else {
+			fmt.Fprintf(cli.out, "%s\n", name)
+		}
+	}
+	return nil
+}
+
+func (cli *DockerCli) CmdUnpause(args ...string) error {
+	cmd := Subcmd("unpause", "CONTAINER [CONTAINER...]", "Unpause all processes within a container")
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+	if cmd.NArg() < 1 {
+		cmd.Usage()
+		return nil
+	}
+
+	for _, name := range cmd.Args() {
+		_, _, err := cli.call("POST", "/containers/"+name+"/unpause", nil)
+		if err != nil {
+			fmt.Fprintf(cli.err, "%s\n", err)
+		} else {
+			fmt.Fprintf(cli.out, "%s\n", name)
+		}
+	}
+	return nil
+}
+
 func (cli *DockerCli) CmdRestart(args ...string) error {
 	cmd := Subcmd("restart", "[OPTIONS] CONTAINER [CONTAINER...]", "Restart a running container")
 	nSeconds := cmd.Int("t", 10, "Number of seconds to try to stop for before killing the container. Once killed it will then be restarted. Default=10")
@@ -588,7 +697,7 @@ func (cli *DockerCli) CmdStart(args ...string) error {
 		}
 
 		if container.Config.Tty && cli.isTerminal {
-			if err := cli.monitorTtySize(cmd.Arg(0)); err != nil {
+			if err := cli.monitorTtySize(cmd.Arg(0), false); err != nil {
 				return err
 			}
 		}
@@ -681,6 +790,134 @@ func (cli *DockerCli) CmdInspect(args ...string) error {
 	return nil
 }
 
+// containerStats keeps the last two samples of a stream of stats, the CPU
+// usage being the difference between them.
+type containerStats struct {
+	sync.Mutex
+	name              string
+	previous, current *APIStats
+	err               error
+}
+
+func (s *containerStats) collect(cli *DockerCli, samples int) {
+	resp, err := cli.openStream("GET", "/containers/"+s.name+"/stats", nil, nil)
+	if err != nil {
+		s.err = err
+		return
+	}
+	defer resp.Body.Close()
+
+	decoder := json.NewDecoder(resp.Body)
+	for i := 0; samples <= 0 || i < samples; i++ {
+		stats := &APIStats{}
+		if err := decoder.Decode(stats); err != nil {
+			if err != io.EOF {
+				s.err = err
+			}
+			return
+		}
+		s.Lock()
+		s.previous, s.current = s.current, stats
+		s.Unlock()
+	}
+}
+
+func (s *containerStats) display(w io.Writer) {
+	s.Lock()
+	defer s.Unlock()
+	if s.current == nil {
+		return
+	}
+	cpu := "--"
+	if s.previous != nil {
+		if system := s.current.CPU.SystemUsage - s.previous.CPU.SystemUsage; system > 0 {
+			usage := float64(s.current.CPU.TotalUsage-s.previous.CPU.TotalUsage) / float64(system)
+			cpu = fmt.Sprintf("%.2f%%", usage*float64(len(s.current.CPU.PercpuUsage))*100)
+		}
+	}
+	memory := "--"
+	if s.current.Memory.Limit > 0 {
+		memory = fmt.Sprintf("%.2f%%", float64(s.current.Memory.Usage)/float64(s.current.Memory.Limit)*100)
+	}
+	fmt.Fprintf(w, "%s\t%s\t%s / %s\t%s\t%s / %s\t%s / %s\n",
+		s.name, cpu,
+		utils.HumanSize(int64(s.current.Memory.Usage)), utils.HumanSize(int64(s.current.Memory.Limit)), memory,
+		utils.HumanSize(int64(s.current.Network.RxBytes)), utils.HumanSize(int64(s.current.Network.TxBytes)),
+		utils.HumanSize(int64(s.current.Blkio.ReadBytes)), utils.HumanSize(int64(s.current.Blkio.WriteBytes)))
+}
+
+func (cli *DockerCli) CmdStats(args ...string) error {
+	cmd := Subcmd("stats", "[OPTIONS] CONTAINER [CONTAINER...]", "Display a live stream of the resource usage of containers")
+	noStream := cmd.Bool("no-stream", false, "Display a single sample and exit")
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+	if cmd.NArg() < 1 {
+		cmd.Usage()
+		return nil
+	}
+
+	// The CPU usage needs two samples
+	samples := 0
+	if *noStream {
+		samples = 2
+	}
+	var (
+		containers []*containerStats
+		wg         sync.WaitGroup
+	)
+	for _, name := range cmd.Args() {
+		s := &containerStats{name: name}
+		containers = append(containers, s)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.collect(cli, samples)
+		}()
+	}
+	finished := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(finished)
+	}()
+
+	display := func() {
+		if cli.isTerminal && !*noStream {
+			// Clear the screen and move the cursor home
+			fmt.Fprint(cli.out, "\033[2J\033[H")
+		}
+		w := tabwriter.NewWriter(cli.out, 20, 1, 3, ' ', 0)
+		fmt.Fprint(w, "CONTAINER\tCPU %\tMEM USAGE / LIMIT\tMEM %\tNET I/O\tBLOCK I/O\n")
+		for _, s := range containers {
+			s.display(w)
+		}
+		w.Flush()
+	}
+
+	if *noStream {
+		<-finished
+		display()
+	} else {
+		for stop := false; !stop; {
+			select {
+			case <-time.After(time.Second):
+			case <-finished:
+				stop = true
+			}
+			display()
+		}
+	}
+
+	var err error
+	for _, s := range containers {
+		if s.err != nil {
+			fmt.Fprintf(cli.err, "%s: %s\n", s.name, s.err)
+			err = s.err
+		}
+	}
+	return err
+}
+
 func (cli *DockerCli) CmdTop(args ...string) error {
 	cmd := Subcmd("top", "CONTAINER", "Lookup the running processes of a container")
 	if err := cmd.Parse(args); err != nil {
@@ -745,7 +982,7 @@ func (cli *DockerCli) CmdPort(args ...string) error {
 			fmt.Fprintf(cli.out, "%s\n", port)
 		} else {
 			for _, frontend := range frontends {
-				fmt.Fprintf(cli.out, "%s:%s\n", frontend.HostIp, frontend.HostPort)
+				fmt.Fprintf(cli.out, "%s\n", net.JoinHostPort(frontend.HostIp, frontend.HostPort))
 			}
 		}
 	} else {
@@ -935,13 +1172,13 @@ func (cli *DockerCli) CmdPush(args ...string) error {
 
 	cli.LoadConfigFile()
 
-	// Resolve the Repository name from fqn to endpoint + name
-	endpoint, _, err := registry.ResolveRepositoryName(name)
+	// Find the registry of the repository, the daemon resolves its endpoint
+	hostname, _, err := registry.SplitReposName(name)
 	if err != nil {
 		return err
 	}
 	// Resolve the Auth config relevant for this server
-	authConfig := cli.configFile.ResolveAuthConfig(endpoint)
+	authConfig := cli.configFile.ResolveAuthConfig(hostname)
 	// If we're not using a custom registry, we know the restrictions
 	// applied to repository names and can warn the user in advance.
 	// Custom repositories can have different rules, and we must also
@@ -972,10 +1209,10 @@ func (cli *DockerCli) CmdPush(args ...string) error {
 	if err := push(authConfig); err != nil {
 		if err.Error() == registry.ErrLoginRequired.Error() {
 			fmt.Fprintln(cli.out, "\nPlease login prior to push:")
-			if err := cli.CmdLogin(endpoint); err != nil {
+			if err := cli.CmdLogin(loginArgs(hostname)...); err != nil {
 				return err
 			}
-			authConfig := cli.configFile.ResolveAuthConfig(endpoint)
+			authConfig := cli.configFile.ResolveAuthConfig(hostname)
 			return push(authConfig)
 		}
 		return err
@@ -1000,8 +1237,8 @@ func (cli *DockerCli) CmdPull(args ...string) error {
 		*tag = parsedTag
 	}
 
-	// Resolve the Repository name from fqn to endpoint + name
-	endpoint, _, err := registry.ResolveRepositoryName(remote)
+	// Find the registry of the repository, the daemon resolves its endpoint
+	hostname, _, err := registry.SplitReposName(remote)
 	if err != nil {
 		return err
 	}
@@ -1009,7 +1246,7 @@ func (cli *DockerCli) CmdPull(args ...string) error {
 	cli.LoadConfigFile()
 
 	// Resolve the Auth config relevant for this server
-	authConfig := cli.configFile.ResolveAuthConfig(endpoint)
+	authConfig := cli.configFile.ResolveAuthConfig(hostname)
 	v := url.Values{}
 	v.Set("fromImage", remote)
 	v.Set("tag", *tag)
@@ -1031,10 +1268,10 @@ func (cli *DockerCli) CmdPull(args ...string) error {
 	if err := pull(authConfig); err != nil {
 		if err.Error() == registry.ErrLoginRequired.Error() {
 			fmt.Fprintln(cli.out, "\nPlease login prior to push:")
-			if err := cli.CmdLogin(endpoint); err != nil {
+			if err := cli.CmdLogin(loginArgs(hostname)...); err != nil {
 				return err
 			}
-			authConfig := cli.configFile.ResolveAuthConfig(endpoint)
+			authConfig := cli.configFile.ResolveAuthConfig(hostname)
 			return pull(authConfig)
 		}
 		return err
@@ -1126,7 +1363,7 @@ func displayablePorts(ports []APIPort) string {
 		if port.IP == "" {
 			result = append(result, fmt.Sprintf("%d/%s", port.PublicPort, port.Type))
 		} else {
-			result = append(result, fmt.Sprintf("%s:%d->%d/%s", port.IP, port.PublicPort, port.PrivatePort, port.Type))
+			result = append(result, fmt.Sprintf("%s->%d/%s", net.JoinHostPort(port.IP, strconv.FormatInt(port.PublicPort, 10)), port.PrivatePort, port.Type))
 		}
 	}
 	sort.Strings(result)
@@ -1222,6 +1459,178 @@ func (cli *DockerCli) CmdPs(args ...string) error {
 	return nil
 }
 
+// 'docker network COMMAND' manages the networks of the containers
+func (cli *DockerCli) CmdNetwork(args ...string) error {
+	cmd := Subcmd("network", "COMMAND [arg...]", "Manage the networks of the containers\n\nCommands:\n    connect     Connect a container to a network\n    create      Create a network\n    disconnect  Disconnect a container from a network\n    inspect     Return low-level information on a network\n    ls          List networks\n    rm          Remove one or more networks")
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+	if cmd.NArg() < 1 {
+		cmd.Usage()
+		return nil
+	}
+	commands := map[string]func(...string) error{
+		"connect":    cli.networkConnect,
+		"create":     cli.networkCreate,
+		"disconnect": cli.networkDisconnect,
+		"inspect":    cli.networkInspect,
+		"ls":         cli.networkLs,
+		"rm":         cli.networkRm,
+	}
+	command, exists := commands[cmd.Arg(0)]
+	if !exists {
+		fmt.Fprintf(cli.err, "Error: Command not found: network %s\n", cmd.Arg(0))
+		cmd.Usage()
+		return nil
+	}
+	return command(cmd.Args()[1:]...)
+}
+
+func (cli *DockerCli) networkCreate(args ...string) error {
+	cmd := Subcmd("network create", "[OPTIONS] NAME", "Create a network, with its own bridge and subnet")
+	subnet := cmd.String("subnet", "", "Subnet of the network in CIDR notation, a free one by default")
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+	if cmd.NArg() != 1 {
+		cmd.Usage()
+		return nil
+	}
+	body, _, err := cli.call("POST", "/networks/create", &APINetworkCreate{Name: cmd.Arg(0), Subnet: *subnet})
+	if err != nil {
+		return err
+	}
+	apiID := &APIID{}
+	if err := json.Unmarshal(body, apiID); err != nil {
+		return err
+	}
+	fmt.Fprintf(cli.out, "%s\n", apiID.ID)
+	return nil
+}
+
+func (cli *DockerCli) networkLs(args ...string) error {
+	cmd := Subcmd("network ls", "[OPTIONS]", "List networks")
+	quiet := cmd.Bool("q", false, "Only display names")
+	noTrunc := cmd.Bool("notrunc", false, "Don't truncate output")
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+
+	body, _, err := cli.call("GET", "/networks", nil)
+	if err != nil {
+		return err
+	}
+	var outs []APINetwork
+	if err := json.Unmarshal(body, &outs); err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(cli.out, 20, 1, 3, ' ', 0)
+	if !*quiet {
+		fmt.Fprintln(w, "NAME\tID\tBRIDGE\tSUBNET\tGATEWAY")
+	}
+	for _, out := range outs {
+		if *quiet {
+			fmt.Fprintln(w, out.Name)
+			continue
+		}
+		if !*noTrunc {
+			out.ID = utils.TruncateID(out.ID)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", out.Name, out.ID, out.Bridge, out.Subnet, out.Gateway)
+	}
+	w.Flush()
+	return nil
+}
+
+func (cli *DockerCli) networkRm(args ...string) error {
+	cmd := Subcmd("network rm", "NETWORK [NETWORK...]", "Remove one or more networks")
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+	if cmd.NArg() < 1 {
+		cmd.Usage()
+		return nil
+	}
+	var encounteredError error
+	for _, name := range cmd.Args() {
+		if _, _, err := cli.call("DELETE", "/networks/"+name, nil); err != nil {
+			fmt.Fprintf(cli.err, "%s\n", err)
+			encounteredError = fmt.Errorf("Error: failed to remove one or more networks")
+		} else {
+			fmt.Fprintf(cli.out, "%s\n", name)
+		}
+	}
+	return encounteredError
+}
+
+func (cli *DockerCli) networkInspect(args ...string) error {
+	cmd := Subcmd("network inspect", "NETWORK [NETWORK...]", "Return low-level information on a network")
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+	if cmd.NArg() < 1 {
+		cmd.Usage()
+		return nil
+	}
+
+	indented := new(bytes.Buffer)
+	status := 0
+	for _, name := range cmd.Args() {
+		obj, _, err := cli.call("GET", "/networks/"+name+"/json", nil)
+		if err != nil {
+			fmt.Fprintf(cli.err, "%s\n", err)
+			status = 1
+			continue
+		}
+		if err := json.Indent(indented, obj, "", "    "); err != nil {
+			fmt.Fprintf(cli.err, "%s\n", err)
+			status = 1
+			continue
+		}
+		indented.WriteString(",")
+	}
+	if indented.Len() > 0 {
+		// Remove trailling ','
+		indented.Truncate(indented.Len() - 1)
+	}
+
+	fmt.Fprintf(cli.out, "[")
+	if _, err := io.Copy(cli.out, indented); err != nil {
+		return err
+	}
+	fmt.Fprintf(cli.out, "]")
+	if status != 0 {
+		return &utils.StatusError{Status: status}
+	}
+	return nil
+}
+
+func (cli *DockerCli) networkConnect(args ...string) error {
+	cmd := Subcmd("network connect", "NETWORK CONTAINER", "Connect a container to a network")
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+	if cmd.NArg() != 2 {
+		cmd.Usage()
+		return nil
+	}
+	_, _, err := cli.call("POST", "/networks/"+cmd.Arg(0)+"/connect", &APINetworkConnect{Container: cmd.Arg(1)})
+	return err
+}
+
+func (cli *DockerCli) networkDisconnect(args ...string) error {
+	cmd := Subcmd("network disconnect", "NETWORK CONTAINER", "Disconnect a container from a network")
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+	if cmd.NArg() != 2 {
+		cmd.Usage()
+		return nil
+	}
+	_, _, err := cli.call("POST", "/networks/"+cmd.Arg(0)+"/disconnect", &APINetworkConnect{Container: cmd.Arg(1)})
+	return err
+}
+
 func (cli *DockerCli) CmdCommit(args ...string) error {
 	cmd := Subcmd("commit", "[OPTIONS] CONTAINER [REPOSITORY [TAG]]", "Create a new image from a container's changes")
 	flComment := cmd.String("m", "", "Commit message")
@@ -1304,6 +1713,41 @@ func (cli *DockerCli) CmdExport(args ...string) error {
 	return nil
 }
 
+func (cli *DockerCli) CmdSave(args ...string) error {
+	cmd := Subcmd("save", "IMAGE", "Save an image or a repository to a tar archive (streamed to stdout), along with its history and tags")
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+
+	if cmd.NArg() != 1 {
+		cmd.Usage()
+		return nil
+	}
+
+	if err := cli.stream("GET", "/images/"+cmd.Arg(0)+"/get", nil, cli.out, nil); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (cli *DockerCli) CmdLoad(args ...string) error {
+	cmd := Subcmd("load", "", "Load images and their tags from a tar archive read on stdin")
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+
+	if cmd.NArg() != 0 {
+		cmd.Usage()
+		return nil
+	}
+
+	headers := map[string][]string{"Content-Type": {"application/x-tar"}}
+	if err := cli.stream("POST", "/images/load", cli.in, cli.out, headers); err != nil {
+		return err
+	}
+	return nil
+}
+
 func (cli *DockerCli) CmdDiff(args ...string) error {
 	cmd := Subcmd("diff", "CONTAINER", "Inspect changes on a container's filesystem")
 	if err := cmd.Parse(args); err != nil {
@@ -1330,8 +1774,72 @@ func (cli *DockerCli) CmdDiff(args ...string) error {
 	return nil
 }
 
+func (cli *DockerCli) CmdExec(args ...string) error {
+	cmd := Subcmd("exec", "[OPTIONS] CONTAINER COMMAND [ARG...]", "Run a command in a running container")
+	flStdin := cmd.Bool("i", false, "Keep stdin open even if not attached")
+	flTty := cmd.Bool("t", false, "Allocate a pseudo-tty")
+	flUser := cmd.String("u", "", "Username or UID, instead of the user of the container")
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+	if cmd.NArg() < 2 {
+		cmd.Usage()
+		return nil
+	}
+	name := cmd.Arg(0)
+
+	config := &ExecConfig{
+		User:         *flUser,
+		Tty:          *flTty,
+		AttachStdin:  *flStdin,
+		AttachStdout: true,
+		AttachStderr: true,
+		Cmd:          cmd.Args()[1:],
+	}
+	body, _, err := cli.call("POST", "/containers/"+name+"/exec", config)
+	if err != nil {
+		return err
+	}
+	command := &APIID{}
+	if err := json.Unmarshal(body, command); err != nil {
+		return err
+	}
+
+	// The size is applied by the daemon once the command starts
+	if *flTty && cli.isTerminal {
+		if err := cli.monitorTtySize(command.ID, true); err != nil {
+			utils.Debugf("Error monitoring TTY size: %s", err)
+		}
+	}
+
+	var in io.ReadCloser
+	if *flStdin {
+		in = cli.in
+	}
+	if err := cli.hijack("POST", "/exec/"+command.ID+"/start", *flTty, in, cli.out, cli.err, nil); err != nil {
+		return err
+	}
+
+	body, _, err = cli.call("GET", "/exec/"+command.ID+"/json", nil)
+	if err != nil {
+		return err
+	}
+	state := &APIExec{}
+	if err := json.Unmarshal(body, state); err != nil {
+		return err
+	}
+	if state.ExitCode != 0 {
+		return &utils.StatusError{Status: state.ExitCode}
+	}
+	return nil
+}
+
 func (cli *DockerCli) CmdLogs(args ...string) error {
-	cmd := Subcmd("logs", "CONTAINER", "Fetch the logs of a container")
+	cmd := Subcmd("logs", "[OPTIONS] CONTAINER", "Fetch the logs of a container")
+	follow := cmd.Bool("f", false, "Follow log output")
+	timestamps := cmd.Bool("t", false, "Show timestamps")
+	tail := cmd.String("tail", "all", "Output the specified number of lines at the end of logs")
+	since := cmd.String("since", "", "Show logs since timestamp (unix time or RFC 3339)")
 	if err := cmd.Parse(args); err != nil {
 		return nil
 	}
@@ -1341,10 +1849,51 @@ func (cli *DockerCli) CmdLogs(args ...string) error {
 	}
 	name := cmd.Arg(0)
 
-	if err := cli.hijack("POST", "/containers/"+name+"/attach?logs=1&stdout=1&stderr=1", false, nil, cli.out, cli.err, nil); err != nil {
+	body, _, err := cli.call("GET", "/containers/"+name+"/json", nil)
+	if err != nil {
 		return err
 	}
-	return nil
+	container := &Container{}
+	if err := json.Unmarshal(body, container); err != nil {
+		return err
+	}
+
+	v := url.Values{}
+	v.Set("stdout", "1")
+	v.Set("stderr", "1")
+	v.Set("tail", *tail)
+	if *follow {
+		v.Set("follow", "1")
+	}
+	if *timestamps {
+		v.Set("timestamps", "1")
+	}
+	if *since != "" {
+		if t, err := time.Parse(time.RFC3339, *since); err == nil {
+			v.Set("since", strconv.FormatInt(t.Unix(), 10))
+		} else if _, err := strconv.ParseInt(*since, 10, 64); err == nil {
+			v.Set("since", *since)
+		} else {
+			return fmt.Errorf("Invalid timestamp: %s", *since)
+		}
+	}
+
+	path := "/containers/" + name + "/logs?" + v.Encode()
+	if container.Config.Tty {
+		return cli.stream("GET", path, nil, cli.out, nil)
+	}
+	// Without a tty, stdout and stderr are multiplexed in the response
+	r, w := io.Pipe()
+	copied := utils.Go(func() error {
+		_, err := utils.StdCopy(cli.out, cli.err, r)
+		return err
+	})
+	err = cli.stream("GET", path, nil, w, nil)
+	w.CloseWithError(err)
+	if copyErr := <-copied; err == nil && copyErr != nil {
+		return copyErr
+	}
+	return err
 }
 
 func (cli *DockerCli) CmdAttach(args ...string) error {
@@ -1375,7 +1924,7 @@ func (cli *DockerCli) CmdAttach(args ...string) error {
 	}
 
 	if container.Config.Tty && cli.isTerminal {
-		if err := cli.monitorTtySize(cmd.Arg(0)); err != nil {
+		if err := cli.monitorTtySize(cmd.Arg(0), false); err != nil {
 			utils.Debugf("Error monitoring TTY size: %s", err)
 		}
 	}
@@ -1587,9 +2136,9 @@ func (cli *DockerCli) CmdRun(args ...string) error {
 		v.Set("fromImage", repos)
 		v.Set("tag", tag)
 
-		// Resolve the Repository name from fqn to endpoint + name
-		var endpoint string
-		endpoint, _, err = registry.ResolveRepositoryName(repos)
+		// Find the registry of the repository, the daemon resolves its endpoint
+		var hostname string
+		hostname, _, err = registry.SplitReposName(repos)
 		if err != nil {
 			return err
 		}
@@ -1598,7 +2147,7 @@ func (cli *DockerCli) CmdRun(args ...string) error {
 		cli.LoadConfigFile()
 
 		// Resolve the Auth config relevant for this server
-		authConfig := cli.configFile.ResolveAuthConfig(endpoint)
+		authConfig := cli.configFile.ResolveAuthConfig(hostname)
 		buf, err := json.Marshal(authConfig)
 		if err != nil {
 			return err
@@ -1705,7 +2254,7 @@ func (cli *DockerCli) CmdRun(args ...string) error {
 	}
 
 	if (config.AttachStdin || config.AttachStdout || config.AttachStderr) && config.Tty && cli.isTerminal {
-		if err := cli.monitorTtySize(runResult.ID); err != nil {
+		if err := cli.monitorTtySize(runResult.ID, false); err != nil {
 			utils.Errorf("Error monitoring TTY size: %s\n", err)
 		}
 	}
@@ -1780,6 +2329,14 @@ func (cli *DockerCli) CmdCp(args ...string) error {
 	return nil
 }
 
+// dial connects to the daemon, over TLS if the client is configured for it.
+func (cli *DockerCli) dial() (net.Conn, error) {
+	if cli.tlsConfig != nil && cli.proto == "tcp" {
+		return tls.Dial(cli.proto, cli.addr, cli.tlsConfig)
+	}
+	return net.Dial(cli.proto, cli.addr)
+}
+
 func (cli *DockerCli) call(method, path string, data interface{}) ([]byte, int, error) {
 	var params io.Reader
 	if data != nil {
@@ -1805,7 +2362,7 @@ func (cli *DockerCli) call(method, path string, data interface{}) ([]byte, int,
 	} else if method == "POST" {
 		req.Header.Set("Content-Type", "plain/text")
 	}
-	dial, err := net.Dial(cli.proto, cli.addr)
+	dial, err := cli.dial()
 	if err != nil {
 		if strings.Contains(err.Error(), "connection refused") {
 			return nil, -1, ErrConnectionRefused
@@ -1837,6 +2394,25 @@ func (cli *DockerCli) call(method, path string, data interface{}) ([]byte, int,
 }
 
 func (cli *DockerCli) stream(method, path string, in io.Reader, out io.Writer, headers map[string][]string) error {
+	resp, err := cli.openStream(method, path, in, headers)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if matchesContentType(resp.Header.Get("Content-Type"), "application/json") {
+		return utils.DisplayJSONMessagesStream(resp.Body, out)
+	} else {
+		if _, err := io.Copy(out, resp.Body); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// openStream sends a request to the daemon and returns its response once
+// its status is checked. Closing the body of the response closes the connection.
+func (cli *DockerCli) openStream(method, path string, in io.Reader, headers map[string][]string) (*http.Response, error) {
 	if (method == "POST" || method == "PUT") && in == nil {
 		in = bytes.NewReader([]byte{})
 	}
@@ -1847,7 +2423,7 @@ func (cli *DockerCli) stream(method, path string, in io.Reader, out io.Writer, h
 
 	req, err := http.NewRequest(method, fmt.Sprintf("/v%g%s", APIVERSION, path), in)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	req.Header.Set("User-Agent", "Docker-Client/"+VERSION)
 	req.Host = cli.addr
@@ -1861,43 +2437,49 @@ func (cli *DockerCli) stream(method, path string, in io.Reader, out io.Writer, h
 		}
 	}
 
-	dial, err := net.Dial(cli.proto, cli.addr)
+	dial, err := cli.dial()
 	if err != nil {
 		if strings.Contains(err.Error(), "connection refused") {
-			return fmt.Errorf("Can't connect to docker daemon. Is 'docker -d' running on this host?")
+			return nil, fmt.Errorf("Can't connect to docker daemon. Is 'docker -d' running on this host?")
 		}
-		return err
+		return nil, err
 	}
 	clientconn := httputil.NewClientConn(dial, nil)
 	resp, err := clientconn.Do(req)
-	defer clientconn.Close()
 	if err != nil {
+		clientconn.Close()
 		if strings.Contains(err.Error(), "connection refused") {
-			return fmt.Errorf("Can't connect to docker daemon. Is 'docker -d' running on this host?")
+			return nil, fmt.Errorf("Can't connect to docker daemon. Is 'docker -d' running on this host?")
 		}
-		return err
+		return nil, err
 	}
-	defer resp.Body.Close()
 
 	if resp.StatusCode < 200 || resp.StatusCode >= 400 {
+		defer clientconn.Close()
+		defer resp.Body.Close()
 		body, err := ioutil.ReadAll(resp.Body)
 		if err != nil {
-			return err
+			return nil, err
 		}
 		if len(body) == 0 {
-			return fmt.Errorf("Error :%s", http.StatusText(resp.StatusCode))
+			return nil, fmt.Errorf("Error :%s", http.StatusText(resp.StatusCode))
 		}
-		return fmt.Errorf("Error: %s", body)
+		return nil, fmt.Errorf("Error: %s", body)
 	}
+	resp.Body = &connBody{ReadCloser: resp.Body, conn: clientconn}
+	return resp, nil
+}
 
-	if matchesContentType(resp.Header.Get("Content-Type"), "application/json") {
-		return utils.DisplayJSONMessagesStream(resp.Body, out)
-	} else {
-		if _, err := io.Copy(out, resp.Body); err != nil {
-			return err
-		}
-	}
-	return nil
+// connBody closes the connection of a response along with its body
+type connBody struct {
+	io.ReadCloser
+	conn *httputil.ClientConn
+}
+
+func (b *connBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.conn.Close()
+	return err
 }
 
 func (cli *DockerCli) hijack(method, path string, setRawTerminal bool, in io.ReadCloser, stdout, stderr io.Writer, started chan bool) error {
@@ -1913,7 +2495,7 @@ func (cli *DockerCli) hijack(method, path string, setRawTerminal bool, in io.Rea
 	req.Header.Set("Content-Type", "plain/text")
 	req.Host = cli.addr
 
-	dial, err := net.Dial(cli.proto, cli.addr)
+	dial, err := cli.dial()
 	if err != nil {
 		if strings.Contains(err.Error(), "connection refused") {
 			return fmt.Errorf("Can't connect to docker daemon. Is 'docker -d' running on this host?")
@@ -1969,6 +2551,10 @@ func (cli *DockerCli) hijack(method, path string, setRawTerminal bool, in io.Rea
 			if err := unixc.CloseWrite(); err != nil {
 				utils.Errorf("Couldn't send EOF: %s\n", err)
 			}
+		} else if tlsc, ok := rwc.(*tls.Conn); ok {
+			if err := tlsc.CloseWrite(); err != nil {
+				utils.Errorf("Couldn't send EOF: %s\n", err)
+			}
 		}
 		// Discard errors due to pipe interruption
 		return nil
@@ -2005,7 +2591,9 @@ func (cli *DockerCli) getTtySize() (int, int) {
 	return int(ws.Height), int(ws.Width)
 }
 
-func (cli *DockerCli) resizeTty(id string) {
+// resizeTty resizes the tty of container `id`, or of exec command `id`
+// if isExec is set, to the size of the terminal.
+func (cli *DockerCli) resizeTty(id string, isExec bool) {
 	height, width := cli.getTtySize()
 	if height == 0 && width == 0 {
 		return
@@ -2013,19 +2601,23 @@ func (cli *DockerCli) resizeTty(id string) {
 	v := url.Values{}
 	v.Set("h", strconv.Itoa(height))
 	v.Set("w", strconv.Itoa(width))
-	if _, _, err := cli.call("POST", "/containers/"+id+"/resize?"+v.Encode(), nil); err != nil {
+	path := "/containers/" + id + "/resize?"
+	if isExec {
+		path = "/exec/" + id + "/resize?"
+	}
+	if _, _, err := cli.call("POST", path+v.Encode(), nil); err != nil {
 		utils.Errorf("Error resize: %s", err)
 	}
 }
 
-func (cli *DockerCli) monitorTtySize(id string) error {
-	cli.resizeTty(id)
+func (cli *DockerCli) monitorTtySize(id string, isExec bool) error {
+	cli.resizeTty(id, isExec)
 
 	sigchan := make(chan os.Signal, 1)
 	signal.Notify(sigchan, syscall.SIGWINCH)
 	go func() {
 		for _ = range sigchan {
-			cli.resizeTty(id)
+			cli.resizeTty(id, isExec)
 		}
 	}()
 	return nil
@@ -2120,4 +2712,5 @@ type DockerCli struct {
 	err        io.Writer
 	isTerminal bool
 	terminalFd uintptr
+	tlsConfig  *tls.Config
 }
@@ -11,8 +11,26 @@ type DaemonConfig struct {
 	AutoRestart                 bool
 	EnableCors                  bool
 	Dns                         []string
+	EmbeddedDns                 bool // Resolve the names of the containers with a dns server on the bridge
 	EnableIptables              bool
 	BridgeIface                 string
+	IPv6Subnet                  string // Subnet of the IPv6 addresses of the containers on the bridge, none if empty
 	DefaultIp                   net.IP
 	InterContainerCommunication bool
+	GraphDriver                 string
+	ExecDriver                  string
+	MaxConcurrentDownloads      int
+	Mirrors                     []string // Tried before the index when pulling
+	InsecureRegistries          []string // Hostnames of the registries which may be reached over plain HTTP
+	TrustKey                    string   // Key signing the pushed tags, generated if missing
+	TrustKeyring                string   // Directory of the public keys trusted when pulling
+	RequireSignedImages         bool     // Only create containers from images with a verified signature
+	TrustDerivedImages          bool     // Sign the images built or committed from a trusted image with the key of the daemon
+	TLSCert                     string   // Certificate of the remote API on tcp addresses, served over HTTP if empty
+	TLSKey                      string   // Key of TLSCert
+	TLSCACert                   string   // CAs signing the certificates of the clients, which aren't verified if empty
+	AuthzPlugins                []string // Sockets of the plugins authorizing the calls of the remote API, in order
 }
+
+// DefaultMaxConcurrentDownloads is the number of layers pulled at the same time
+const DefaultMaxConcurrentDownloads = 3
@@ -6,6 +6,7 @@ import (
 	"errors"
 	"flag"
 	"fmt"
+	"github.com/dotcloud/docker/sysinit"
 	"github.com/dotcloud/docker/term"
 	"github.com/dotcloud/docker/utils"
 	"github.com/kr/pty"
@@ -17,14 +18,14 @@ import (
 	"os/exec"
 	"path"
 	"path/filepath"
-	"strconv"
 	"strings"
 	"syscall"
 	"time"
 )
 
 type Container struct {
-	root string
+	root   string // Path to the container's metadata
+	rootfs string // Path to the container's root filesystem, as mounted by the storage driver
 
 	ID string
 
@@ -38,6 +39,7 @@ type Container struct {
 	Image  string
 
 	network         *NetworkInterface
+	networks        map[string]*NetworkInterface // Interfaces on each network, eth0 included
 	NetworkSettings *NetworkSettings
 
 	SysInitPath    string
@@ -45,6 +47,11 @@ type Container struct {
 	HostnamePath   string
 	HostsPath      string
 	Name           string
+	ExecDriver     string
+
+	// Number of times the container was restarted by its restart policy
+	// since it was last started by hand
+	RestartCount int
 
 	cmd       *exec.Cmd
 	stdout    *utils.WriteBroadcaster
@@ -62,6 +69,12 @@ type Container struct {
 	VolumesRW map[string]bool
 
 	activeLinks map[string]*Link
+
+	// Set when the container is stopped on purpose, so that its restart
+	// policy doesn't bring it back up
+	stopRequested bool
+	// Delay before the next automatic restart, doubled after each restart
+	restartDelay time.Duration
 }
 
 type Config struct {
@@ -88,6 +101,9 @@ type Config struct {
 	WorkingDir      string
 	Entrypoint      []string
 	NetworkDisabled bool
+	Networks        []string // Networks of the container, the first one giving it eth0 and its gateway
+	IPAddress       string   `json:",omitempty"` // Static IPv4 address of eth0, reserved until the container is destroyed
+	MacAddress      string   `json:",omitempty"` // Static MAC address of eth0
 	Privileged      bool
 }
 
@@ -97,6 +113,17 @@ type HostConfig struct {
 	LxcConf         []KeyValuePair
 	PortBindings    map[Port][]PortBinding
 	Links           []string
+	RestartPolicy   RestartPolicy
+	LogConfig       LogConfig
+}
+
+// RestartPolicy tells the daemon what to do when the process of a container exits:
+// "never" (or empty) leaves it stopped, "always" restarts it whatever its exit code,
+// and "on-failure" restarts it only when it exits with a non-zero code, at most
+// MaximumRetryCount times if it is positive.
+type RestartPolicy struct {
+	Name              string
+	MaximumRetryCount int
 }
 
 type BindMap struct {
@@ -105,12 +132,22 @@ type BindMap struct {
 	Mode    string
 }
 
+// Bounds of the delay between two automatic restarts of a container
+const (
+	restartBackoffMin   = 100 * time.Millisecond
+	restartBackoffMax   = time.Minute
+	restartBackoffReset = 10 * time.Second
+)
+
 var (
-	ErrContainerStart           = errors.New("The container failed to start. Unkown error")
-	ErrContainerStartTimeout    = errors.New("The container failed to start due to timed out.")
-	ErrInvalidWorikingDirectory = errors.New("The working directory is invalid. It needs to be an absolute path.")
-	ErrConflictAttachDetach     = errors.New("Conflicting options: -a and -d")
-	ErrConflictDetachAutoRemove = errors.New("Conflicting options: -rm and -d")
+	ErrContainerStart            = errors.New("The container failed to start. Unkown error")
+	ErrContainerStartTimeout     = errors.New("The container failed to start due to timed out.")
+	ErrInvalidWorikingDirectory  = errors.New("The working directory is invalid. It needs to be an absolute path.")
+	ErrConflictAttachDetach      = errors.New("Conflicting options: -a and -d")
+	ErrConflictDetachAutoRemove  = errors.New("Conflicting options: -rm and -d")
+	ErrConflictRestartAutoRemove = errors.New("Conflicting options: -rm and -restart")
+	ErrConflictNetworkDisabled   = errors.New("Conflicting options: -n=false and -net")
+	ErrConflictStaticAddress     = errors.New("Conflicting options: -n=false and -ip or -mac-address")
 )
 
 type KeyValuePair struct {
@@ -202,6 +239,17 @@ func ParseRun(args []string, capabilities *Capabilities) (*Config, *HostConfig,
 	var flLinks utils.ListOpts
 	cmd.Var(&flLinks, "link", "Add link to another container (name:alias)")
 
+	var flNetworks utils.ListOpts
+	cmd.Var(&flNetworks, "net", "Connect the container to a network instead of the default bridge (can be repeated)")
+	flIPAddress := cmd.String("ip", "", "Static IPv4 address of the container on its first network")
+	flMacAddress := cmd.String("mac-address", "", "Static MAC address of the container on its first network")
+
+	flRestart := cmd.String("restart", "never", "Restart policy when the container exits (never, on-failure[:max-retry], always)")
+
+	flLogDriver := cmd.String("log-driver", DefaultLogDriver, "Where to send the output of the container (json, syslog, none)")
+	var flLogOpts utils.ListOpts
+	cmd.Var(&flLogOpts, "log-opt", "Add log driver options -log-opt=\"max-size=10m\"")
+
 	if err := cmd.Parse(args); err != nil {
 		return nil, nil, cmd, err
 	}
@@ -214,6 +262,12 @@ func ParseRun(args []string, capabilities *Capabilities) (*Config, *HostConfig,
 	if *flDetach && *flAutoRemove {
 		return nil, nil, cmd, ErrConflictDetachAutoRemove
 	}
+	if !*flNetwork && len(flNetworks) > 0 {
+		return nil, nil, cmd, ErrConflictNetworkDisabled
+	}
+	if !*flNetwork && (*flIPAddress != "" || *flMacAddress != "") {
+		return nil, nil, cmd, ErrConflictStaticAddress
+	}
 
 	// If neither -d or -a are set, attach to everything by default
 	if len(flAttach) == 0 && !*flDetach {
@@ -271,6 +325,23 @@ func ParseRun(args []string, capabilities *Capabilities) (*Config, *HostConfig,
 		return nil, nil, cmd, err
 	}
 
+	restartPolicy, err := parseRestartPolicy(*flRestart)
+	if err != nil {
+		return nil, nil, cmd, err
+	}
+	if *flAutoRemove && restartPolicy.Name != "never" {
+		return nil, nil, cmd, ErrConflictRestartAutoRemove
+	}
+
+	logOpts, err := parseLogOpts(flLogOpts)
+	if err != nil {
+		return nil, nil, cmd, err
+	}
+	logConfig := LogConfig{Driver: *flLogDriver, Options: logOpts}
+	if err := validateLogConfig(logConfig); err != nil {
+		return nil, nil, cmd, err
+	}
+
 	hostname := *flHostname
 	domainname := ""
 
@@ -304,6 +375,9 @@ func ParseRun(args []string, capabilities *Capabilities) (*Config, *HostConfig,
 		User:            *flUser,
 		Tty:             *flTty,
 		NetworkDisabled: !*flNetwork,
+		Networks:        flNetworks,
+		IPAddress:       *flIPAddress,
+		MacAddress:      *flMacAddress,
 		OpenStdin:       *flStdin,
 		Memory:          *flMemory,
 		CpuShares:       *flCpuShares,
@@ -327,6 +401,8 @@ func ParseRun(args []string, capabilities *Capabilities) (*Config, *HostConfig,
 		LxcConf:         lxcConf,
 		PortBindings:    portBindings,
 		Links:           flLinks,
+		RestartPolicy:   restartPolicy,
+		LogConfig:       logConfig,
 	}
 
 	if capabilities != nil && *flMemory > 0 && !capabilities.SwapLimit {
@@ -343,13 +419,79 @@ func ParseRun(args []string, capabilities *Capabilities) (*Config, *HostConfig,
 
 type PortMapping map[string]string // Deprecated
 
+// NetworkSettings describes the network of a running container. The top
+// level addresses are the ones of eth0, on the first network of the
+// container.
 type NetworkSettings struct {
-	IPAddress   string
-	IPPrefixLen int
-	Gateway     string
-	Bridge      string
-	PortMapping map[string]PortMapping // Deprecated
-	Ports       map[Port][]PortBinding
+	IPAddress     string
+	IPPrefixLen   int
+	Gateway       string
+	IPv6Address   string `json:",omitempty"` // Set when the bridge has an IPv6 subnet
+	IPv6PrefixLen int    `json:",omitempty"`
+	IPv6Gateway   string `json:",omitempty"`
+	MacAddress    string `json:",omitempty"` // Only set when it is static
+	Bridge        string
+	HostVeth      string                 // Host side of the veth pair of the container
+	PortMapping   map[string]PortMapping // Deprecated
+	Ports         map[Port][]PortBinding
+	Networks      map[string]*EndpointSettings // By network name
+}
+
+// EndpointSettings describes the interface of a container on one of its
+// networks.
+type EndpointSettings struct {
+	NetworkID     string `json:",omitempty"` // Empty for the default network
+	Interface     string // Name of the interface in the container
+	IPAddress     string
+	IPPrefixLen   int
+	Gateway       string
+	IPv6Address   string `json:",omitempty"`
+	IPv6PrefixLen int    `json:",omitempty"`
+	IPv6Gateway   string `json:",omitempty"`
+	Bridge        string
+	HostVeth      string
+}
+
+// networkNames returns the names of the networks of the container, in the
+// order of its interfaces.
+func (settings *NetworkSettings) networkNames() []string {
+	var names []string
+	for name := range settings.Networks {
+		names = append(names, name)
+	}
+	sortStrings(names, func(i, j string) bool {
+		a, b := settings.Networks[i].Interface, settings.Networks[j].Interface
+		// eth2 comes before eth10
+		return len(a) < len(b) || (len(a) == len(b) && a < b)
+	})
+	return names
+}
+
+// endpoints returns the interfaces of the container by network name.
+func (settings *NetworkSettings) endpoints() map[string]*EndpointSettings {
+	if len(settings.Networks) == 0 {
+		// Containers started before the networks existed only have eth0
+		return map[string]*EndpointSettings{
+			DefaultNetworkName: {
+				Interface:   "eth0",
+				IPAddress:   settings.IPAddress,
+				IPv6Address: settings.IPv6Address,
+				HostVeth:    settings.HostVeth,
+			},
+		}
+	}
+	return settings.Networks
+}
+
+// ExtraEndpoints returns the interfaces of the container other than eth0.
+func (settings *NetworkSettings) ExtraEndpoints() []*EndpointSettings {
+	var endpoints []*EndpointSettings
+	for _, name := range settings.networkNames() {
+		if endpoint := settings.Networks[name]; endpoint.Interface != "eth0" {
+			endpoints = append(endpoints, endpoint)
+		}
+	}
+	return endpoints
 }
 
 func (settings *NetworkSettings) PortMappingAPI() []APIPort {
@@ -379,15 +521,19 @@ func (settings *NetworkSettings) PortMappingAPI() []APIPort {
 
 // Inject the io.Reader at the given path. Note: do not close the reader
 func (container *Container) Inject(file io.Reader, pth string) error {
+	if err := container.EnsureMounted(); err != nil {
+		return err
+	}
 	// Make sure the directory exists
-	if err := os.MkdirAll(path.Join(container.rwPath(), path.Dir(pth)), 0755); err != nil {
+	if err := os.MkdirAll(path.Join(container.RootfsPath(), path.Dir(pth)), 0755); err != nil {
 		return err
 	}
 	// FIXME: Handle permissions/already existing dest
-	dest, err := os.Create(path.Join(container.rwPath(), pth))
+	dest, err := os.Create(path.Join(container.RootfsPath(), pth))
 	if err != nil {
 		return err
 	}
+	defer dest.Close()
 	if _, err := io.Copy(dest, file); err != nil {
 		return err
 	}
@@ -661,9 +807,14 @@ func (container *Container) Attach(stdin io.ReadCloser, stdinCloser io.Closer, s
 	})
 }
 
-func (container *Container) Start(hostConfig *HostConfig) (err error) {
+func (container *Container) Start(hostConfig *HostConfig) error {
 	container.State.Lock()
 	defer container.State.Unlock()
+	return container.startLocked(hostConfig)
+}
+
+// startLocked starts the container, whose State lock is held.
+func (container *Container) startLocked(hostConfig *HostConfig) (err error) {
 	defer func() {
 		if err != nil {
 			container.cleanup()
@@ -677,6 +828,10 @@ func (container *Container) Start(hostConfig *HostConfig) (err error) {
 	if container.State.Running {
 		return fmt.Errorf("The container %s is already running.", container.ID)
 	}
+	container.stopRequested = false
+	if err := validateLogConfig(hostConfig.LogConfig); err != nil {
+		return err
+	}
 	if err := container.EnsureMounted(); err != nil {
 		return err
 	}
@@ -686,6 +841,12 @@ func (container *Container) Start(hostConfig *HostConfig) (err error) {
 		if err := container.allocateNetwork(hostConfig); err != nil {
 			return err
 		}
+		if err := container.writeHostsFile(); err != nil {
+			return err
+		}
+	}
+	if err := container.runtime.setupResolvConf(container); err != nil {
+		return err
 	}
 
 	// Make sure the config is compatible with the current kernel
@@ -786,13 +947,13 @@ func (container *Container) Start(hostConfig *HostConfig) (err error) {
 			}
 			// Otherwise create an directory in $ROOT/volumes/ and use that
 		} else {
-			c, err := container.runtime.volumes.Create(nil, container, "", "", nil)
+			c, err := container.runtime.volumes.Create(nil, nil, "", "", nil)
 			if err != nil {
 				return err
 			}
-			srcPath, err = c.layer()
+			srcPath, err = container.runtime.volumes.driver.Get(c.ID)
 			if err != nil {
-				return err
+				return fmt.Errorf("Driver %s failed to get volume rootfs %s: %s", container.runtime.volumes.driver, c.ID, err)
 			}
 			srcRW = true // RW by default
 		}
@@ -841,20 +1002,18 @@ func (container *Container) Start(hostConfig *HostConfig) (err error) {
 		}
 	}
 
-	if err := container.generateLXCConfig(hostConfig); err != nil {
-		return err
-	}
+	driver := container.runtime.execDriver
+	container.ExecDriver = driver.String()
 
-	params := []string{
-		"-n", container.ID,
-		"-f", container.lxcConfigPath(),
-		"--",
-		"/.dockerinit",
-	}
+	// Arguments of dockerinit
+	params := []string{}
 
 	// Networking
 	if !container.Config.NetworkDisabled {
 		params = append(params, "-g", container.network.Gateway.String())
+		if container.network.IPv6Gateway != nil {
+			params = append(params, "-g6", container.network.IPv6Gateway.String())
+		}
 	}
 
 	// User
@@ -866,7 +1025,7 @@ func (container *Container) Start(hostConfig *HostConfig) (err error) {
 	env := []string{
 		"HOME=/",
 		"PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin",
-		"container=lxc",
+		"container=" + driver.String(),
 		"HOSTNAME=" + container.Config.Hostname,
 	}
 
@@ -938,69 +1097,37 @@ func (container *Container) Start(hostConfig *HostConfig) (err error) {
 	params = append(params, "--", container.Path)
 	params = append(params, container.Args...)
 
-	container.cmd = exec.Command("lxc-start", params...)
-
-	// Setup logging of stdout and stderr to disk
-	if err := container.runtime.LogToDisk(container.stdout, container.logPath("json"), "stdout"); err != nil {
+	// Setup logging of stdout and stderr
+	if err := container.setupLogging(hostConfig); err != nil {
 		return err
 	}
-	if err := container.runtime.LogToDisk(container.stderr, container.logPath("json"), "stderr"); err != nil {
-		return err
+
+	launch := func(cmd *exec.Cmd) error {
+		container.cmd = cmd
+		if container.Config.Tty {
+			return container.startPty()
+		}
+		return container.start()
 	}
+	running := func() {
+		// FIXME: save state on disk *first*, then converge
+		// this way disk state is used as a journal, eg. we can restore after crash etc.
+		container.State.setRunning(container.cmd.Process.Pid)
 
-	container.cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+		// Init the lock
+		container.waitLock = make(chan struct{})
 
-	if container.Config.Tty {
-		err = container.startPty()
-	} else {
-		err = container.start()
+		container.ToDisk()
+		container.SaveHostConfig(hostConfig)
+		go container.monitor(hostConfig)
 	}
+	err = driver.Start(container, hostConfig, params, launch, running)
+	defer utils.Debugf("Container running: %v", container.State.Running)
 	if err != nil {
 		return err
 	}
-	// FIXME: save state on disk *first*, then converge
-	// this way disk state is used as a journal, eg. we can restore after crash etc.
-	container.State.setRunning(container.cmd.Process.Pid)
-
-	// Init the lock
-	container.waitLock = make(chan struct{})
-
-	container.ToDisk()
-	container.SaveHostConfig(hostConfig)
-	go container.monitor(hostConfig)
-
-	defer utils.Debugf("Container running: %v", container.State.Running)
-	// We wait for the container to be fully running.
-	// Timeout after 5 seconds. In case of broken pipe, just retry.
-	// Note: The container can run and finish correctly before
-	//       the end of this loop
-	for now := time.Now(); time.Since(now) < 5*time.Second; {
-		// If the container dies while waiting for it, just return
-		if !container.State.Running {
-			return nil
-		}
-		output, err := exec.Command("lxc-info", "-s", "-n", container.ID).CombinedOutput()
-		if err != nil {
-			utils.Debugf("Error with lxc-info: %s (%s)", err, output)
-
-			output, err = exec.Command("lxc-info", "-s", "-n", container.ID).CombinedOutput()
-			if err != nil {
-				utils.Debugf("Second Error with lxc-info: %s (%s)", err, output)
-				return err
-			}
-
-		}
-		if strings.Contains(string(output), "RUNNING") {
-			return nil
-		}
-		utils.Debugf("Waiting for the container to start (running: %v): %s", container.State.Running, bytes.TrimSpace(output))
-		time.Sleep(50 * time.Millisecond)
-	}
-
-	if container.State.Running {
-		return ErrContainerStartTimeout
-	}
-	return ErrContainerStart
+	runtime.updateNetworkHosts(container.NetworkSettings.networkNames(), container)
+	return nil
 }
 
 func (container *Container) Run() error {
@@ -1055,35 +1182,26 @@ func (container *Container) allocateNetwork(hostConfig *HostConfig) error {
 		return nil
 	}
 
+	manager := container.runtime.networkManager
 	var iface *NetworkInterface
-	var err error
-	if !container.State.Ghost {
-		iface, err = container.runtime.networkManager.Allocate()
-		if err != nil {
-			return err
-		}
+	if manager.disabled {
+		iface = &NetworkInterface{disabled: true}
 	} else {
-		manager := container.runtime.networkManager
-		if manager.disabled {
-			iface = &NetworkInterface{disabled: true}
-		} else {
-			iface = &NetworkInterface{
-				IPNet:   net.IPNet{IP: net.ParseIP(container.NetworkSettings.IPAddress), Mask: manager.bridgeNetwork.Mask},
-				Gateway: manager.bridgeNetwork.IP,
-				manager: manager,
-			}
-			ipNum := ipToInt(iface.IPNet.IP)
-			manager.ipAllocator.inUse[ipNum] = struct{}{}
+		if err := container.allocateInterfaces(); err != nil {
+			return err
 		}
+		iface = container.networks[container.NetworkSettings.networkNames()[0]]
 	}
 
 	if container.Config.PortSpecs != nil {
 		utils.Debugf("Migrating port mappings for container: %s", strings.Join(container.Config.PortSpecs, ", "))
 		if err := migratePortMappings(container.Config, hostConfig); err != nil {
+			container.releaseInterfaces()
 			return err
 		}
 		container.Config.PortSpecs = nil
 		if err := container.SaveHostConfig(hostConfig); err != nil {
+			container.releaseInterfaces()
 			return err
 		}
 	}
@@ -1109,13 +1227,20 @@ func (container *Container) allocateNetwork(hostConfig *HostConfig) error {
 
 	container.NetworkSettings.PortMapping = nil
 
+	// The ports are published on eth0
 	for port := range portSpecs {
 		binding := bindings[port]
 		for i := 0; i < len(binding); i++ {
 			b := binding[i]
-			nat, err := iface.AllocatePort(port, b)
+			var nat *Nat
+			var err error
+			if container.State.Ghost {
+				nat, err = iface.restorePort(port, b)
+			} else {
+				nat, err = iface.AllocatePort(port, b)
+			}
 			if err != nil {
-				iface.Release()
+				container.releaseInterfaces()
 				return err
 			}
 			utils.Debugf("Allocate port: %s:%s->%s", nat.Binding.HostIp, port, nat.Binding.HostPort)
@@ -1128,31 +1253,366 @@ func (container *Container) allocateNetwork(hostConfig *HostConfig) error {
 	container.NetworkSettings.Ports = bindings
 	container.network = iface
 
-	container.NetworkSettings.Bridge = container.runtime.networkManager.bridgeIface
+	container.NetworkSettings.Bridge = manager.bridgeIface
+	if !manager.disabled {
+		endpoint := container.NetworkSettings.Networks[container.NetworkSettings.networkNames()[0]]
+		container.NetworkSettings.Bridge = endpoint.Bridge
+		container.NetworkSettings.HostVeth = endpoint.HostVeth
+	}
 	container.NetworkSettings.IPAddress = iface.IPNet.IP.String()
 	container.NetworkSettings.IPPrefixLen, _ = iface.IPNet.Mask.Size()
 	container.NetworkSettings.Gateway = iface.Gateway.String()
+	if iface.IPv6Net != nil {
+		container.NetworkSettings.IPv6Address = iface.IPv6Net.IP.String()
+		container.NetworkSettings.IPv6PrefixLen, _ = iface.IPv6Net.Mask.Size()
+		container.NetworkSettings.IPv6Gateway = iface.IPv6Gateway.String()
+	}
+	container.NetworkSettings.MacAddress = container.Config.MacAddress
+
+	return nil
+}
+
+// networkNames returns the names of the networks the container joins when
+// it starts, the first one giving it eth0.
+func (container *Container) networkNames() []string {
+	if len(container.Config.Networks) == 0 {
+		return []string{DefaultNetworkName}
+	}
+	return container.Config.Networks
+}
+
+// hostVethName returns the name of the host end of the veth pair of the
+// interface eth<index>. It is named after the container so that its
+// counters can be found.
+func (container *Container) hostVethName(index int) string {
+	if index == 0 {
+		return "veth" + container.ID[:8]
+	}
+	return fmt.Sprintf("veth%s%d", container.ID[:8], index)
+}
+
+func newEndpoint(network *Network, iface *NetworkInterface, name, hostVeth string) *EndpointSettings {
+	prefixLen, _ := iface.IPNet.Mask.Size()
+	endpoint := &EndpointSettings{
+		NetworkID:   network.ID,
+		Interface:   name,
+		IPAddress:   iface.IPNet.IP.String(),
+		IPPrefixLen: prefixLen,
+		Gateway:     iface.Gateway.String(),
+		Bridge:      network.Bridge,
+		HostVeth:    hostVeth,
+	}
+	if iface.IPv6Net != nil {
+		endpoint.IPv6Address = iface.IPv6Net.IP.String()
+		endpoint.IPv6PrefixLen, _ = iface.IPv6Net.Mask.Size()
+		endpoint.IPv6Gateway = iface.IPv6Gateway.String()
+	}
+	return endpoint
+}
+
+// allocateInterfaces allocates an interface on each network of the
+// container, or takes back the interfaces of a ghost container.
+func (container *Container) allocateInterfaces() error {
+	manager := container.runtime.networkManager
+	endpoints := make(map[string]*EndpointSettings)
+	if container.State.Ghost {
+		endpoints = container.NetworkSettings.endpoints()
+	} else {
+		for i, name := range container.networkNames() {
+			endpoints[name] = &EndpointSettings{
+				Interface: fmt.Sprintf("eth%d", i),
+				HostVeth:  container.hostVethName(i),
+			}
+		}
+	}
 
+	container.networks = make(map[string]*NetworkInterface)
+	container.NetworkSettings.Networks = make(map[string]*EndpointSettings)
+	for name, endpoint := range endpoints {
+		network, err := manager.GetNetwork(name)
+		if err != nil {
+			container.releaseInterfaces()
+			return err
+		}
+		static := container.isStaticEndpoint(endpoint)
+		var iface *NetworkInterface
+		if container.State.Ghost {
+			iface = manager.restoreInterface(network, net.ParseIP(endpoint.IPAddress), net.ParseIP(endpoint.IPv6Address))
+		} else if static {
+			iface, err = manager.allocateWithIP(network, net.ParseIP(container.Config.IPAddress))
+		} else {
+			iface, err = manager.AllocateOn(network)
+		}
+		if err != nil {
+			container.releaseInterfaces()
+			return err
+		}
+		// The static IP stays reserved once the container stops
+		iface.static = static
+		container.networks[name] = iface
+		container.NetworkSettings.Networks[name] = newEndpoint(network, iface, endpoint.Interface, endpoint.HostVeth)
+	}
 	return nil
 }
 
+// isStaticEndpoint returns whether the address of `endpoint` is the static
+// IP of the container.
+func (container *Container) isStaticEndpoint(endpoint *EndpointSettings) bool {
+	return endpoint.Interface == "eth0" && container.Config.IPAddress != ""
+}
+
+// releaseInterfaces releases the interfaces of the container on all its
+// networks.
+func (container *Container) releaseInterfaces() {
+	for _, iface := range container.networks {
+		iface.Release()
+	}
+	container.networks = nil
+}
+
 func (container *Container) releaseNetwork() {
 	if container.Config.NetworkDisabled || container.network == nil {
 		return
 	}
-	container.network.Release()
+	networks := container.NetworkSettings.networkNames()
+	container.releaseInterfaces()
 	container.network = nil
 	container.NetworkSettings = &NetworkSettings{}
+	container.runtime.updateNetworkHosts(networks, container)
+}
+
+// ConnectNetwork connects the container to the network `name`. A running
+// container gets its new interface right away.
+func (container *Container) ConnectNetwork(name string) error {
+	container.State.Lock()
+	defer container.State.Unlock()
+
+	if container.Config.NetworkDisabled {
+		return fmt.Errorf("Impossible to connect %s to network %s: its networking is disabled", container.ShortID(), name)
+	}
+	network, err := container.runtime.networkManager.beginJoin(name)
+	if err != nil {
+		return err
+	}
+	defer container.runtime.networkManager.endJoin(network)
+	names := container.networkNames()
+	for _, n := range names {
+		if n == network.Name {
+			return fmt.Errorf("Conflict, %s is already connected to network %s", container.ShortID(), network.Name)
+		}
+	}
+	if container.State.Running {
+		if err := container.plugInterface(network); err != nil {
+			return err
+		}
+		container.runtime.updateNetworkHosts([]string{network.Name}, nil)
+	}
+	container.Config.Networks = append(names, network.Name)
+	return container.ToDisk()
+}
+
+// DisconnectNetwork disconnects the container from the network `name`. A
+// running container can't leave the network of its eth0.
+func (container *Container) DisconnectNetwork(name string) error {
+	container.State.Lock()
+	defer container.State.Unlock()
+
+	network, err := container.runtime.networkManager.GetNetwork(name)
+	if err != nil {
+		return err
+	}
+	names := container.networkNames()
+	index := -1
+	for i, n := range names {
+		if n == network.Name {
+			index = i
+		}
+	}
+	if index == -1 {
+		return fmt.Errorf("Impossible to disconnect %s: it isn't connected to network %s", container.ShortID(), network.Name)
+	}
+	if len(names) == 1 {
+		return fmt.Errorf("Impossible to disconnect %s from network %s: it is its only network", container.ShortID(), network.Name)
+	}
+	if index == 0 && container.Config.IPAddress != "" {
+		return fmt.Errorf("Impossible to disconnect %s from network %s: its static IP %s is on it", container.ShortID(), network.Name, container.Config.IPAddress)
+	}
+	if container.State.Running {
+		if endpoint := container.NetworkSettings.Networks[network.Name]; endpoint != nil && endpoint.Interface == "eth0" {
+			return fmt.Errorf("Impossible to disconnect the running container %s from network %s: it gives it eth0", container.ShortID(), network.Name)
+		}
+		if err := container.unplugInterface(network); err != nil {
+			return err
+		}
+		container.runtime.updateNetworkHosts([]string{network.Name}, container)
+		if err := container.writeHostsFile(); err != nil {
+			return err
+		}
+	}
+	networks := []string{}
+	for i, n := range names {
+		if i != index {
+			networks = append(networks, n)
+		}
+	}
+	container.Config.Networks = networks
+	return container.ToDisk()
+}
+
+// plugInterface allocates an interface on `network`, and adds it to the
+// running container.
+func (container *Container) plugInterface(network *Network) error {
+	driver, err := container.execDriver()
+	if err != nil {
+		return err
+	}
+	pid, err := driver.InitPid(container)
+	if err != nil {
+		return err
+	}
+	iface, err := container.runtime.networkManager.AllocateOn(network)
+	if err != nil {
+		return err
+	}
+
+	// Use the first free ethN
+	index := 0
+	for used := true; used; {
+		index++
+		used = false
+		for _, endpoint := range container.NetworkSettings.Networks {
+			if endpoint.Interface == fmt.Sprintf("eth%d", index) {
+				used = true
+			}
+		}
+	}
+	endpoint := newEndpoint(network, iface, fmt.Sprintf("eth%d", index), container.hostVethName(index))
+	vethPeer := vethPeerName(endpoint.HostVeth)
+
+	if err := createVeth(endpoint.Bridge, endpoint.HostVeth, vethPeer, pid); err != nil {
+		deleteVeth(endpoint.HostVeth)
+		iface.Release()
+		return err
+	}
+	config, err := json.Marshal(&sysinit.NativeNetwork{
+		Name:          endpoint.Interface,
+		Interface:     vethPeer,
+		IPAddress:     endpoint.IPAddress,
+		IPPrefixLen:   endpoint.IPPrefixLen,
+		IPv6Address:   endpoint.IPv6Address,
+		IPv6PrefixLen: endpoint.IPv6PrefixLen,
+		Mtu:           1500,
+	})
+	if err != nil {
+		deleteVeth(endpoint.HostVeth)
+		iface.Release()
+		return err
+	}
+	// dockerinit configures the interface from inside the container
+	err = driver.Exec(container, []string{"-connect", string(config)}, func(cmd *exec.Cmd) error {
+		if output, err := cmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("%s (%s)", err, bytes.TrimSpace(output))
+		}
+		return nil
+	})
+	if err != nil {
+		deleteVeth(endpoint.HostVeth)
+		iface.Release()
+		return fmt.Errorf("Unable to connect %s to network %s: %s", container.ShortID(), network.Name, err)
+	}
+	container.networks[network.Name] = iface
+	container.NetworkSettings.Networks[network.Name] = endpoint
+	return nil
+}
+
+// unplugInterface removes the interface of the running container on
+// `network`, and releases it.
+func (container *Container) unplugInterface(network *Network) error {
+	endpoint := container.NetworkSettings.Networks[network.Name]
+	iface := container.networks[network.Name]
+	if endpoint == nil || iface == nil {
+		return nil
+	}
+	// The end of the veth pair in the container goes away with this one
+	if err := deleteVeth(endpoint.HostVeth); err != nil {
+		return fmt.Errorf("Unable to disconnect %s from network %s: %s", container.ShortID(), network.Name, err)
+	}
+	iface.Release()
+	delete(container.networks, network.Name)
+	delete(container.NetworkSettings.Networks, network.Name)
+	return nil
+}
+
+// writeHostsFile writes the hosts file of the container, with the addresses
+// of the running containers sharing one of its user-defined networks. It is
+// rewritten in place, since it is bind mounted into the container.
+func (container *Container) writeHostsFile() error {
+	if container.HostsPath == "" {
+		return nil
+	}
+	content := bytes.NewBuffer(nil)
+	if container.Config.Domainname != "" {
+		fmt.Fprintf(content, "127.0.0.1\t%s.%s %s\n", container.Config.Hostname, container.Config.Domainname, container.Config.Hostname)
+		fmt.Fprintf(content, "::1\t\t%s.%s %s\n", container.Config.Hostname, container.Config.Domainname, container.Config.Hostname)
+	} else {
+		fmt.Fprintf(content, "127.0.0.1\t%s\n", container.Config.Hostname)
+		fmt.Fprintf(content, "::1\t\t%s\n", container.Config.Hostname)
+	}
+	content.WriteString(`
+127.0.0.1	localhost
+::1		localhost ip6-localhost ip6-loopback
+fe00::0		ip6-localnet
+ff00::0		ip6-mcastprefix
+ff02::1		ip6-allnodes
+ff02::2		ip6-allrouters
+`)
+
+	if container.runtime != nil && container.NetworkSettings != nil {
+		for _, network := range container.NetworkSettings.networkNames() {
+			if network == DefaultNetworkName {
+				continue
+			}
+			for _, peer := range container.runtime.List() {
+				if peer.ID == container.ID || !peer.State.Running || peer.NetworkSettings == nil {
+					continue
+				}
+				if endpoint, exists := peer.NetworkSettings.Networks[network]; exists {
+					fmt.Fprintf(content, "%s\t%s\n", endpoint.IPAddress, strings.TrimPrefix(peer.Name, "/"))
+				}
+			}
+		}
+	}
+	return ioutil.WriteFile(container.HostsPath, content.Bytes(), 0644)
 }
 
 // FIXME: replace this with a control socket within dockerinit
-func (container *Container) waitLxc() error {
+// execDriver returns the execution driver the container was started with.
+// Containers created before execution drivers existed were run by lxc.
+func (container *Container) execDriver() (ExecDriver, error) {
+	name := container.ExecDriver
+	if name == "" {
+		name = "lxc"
+	}
+	driver, exists := container.runtime.execDrivers[name]
+	if !exists {
+		return nil, fmt.Errorf("No such execution driver: %s", name)
+	}
+	return driver, nil
+}
+
+// waitGhost polls the execution driver until a container started by a
+// previous instance of the daemon stops running.
+func (container *Container) waitGhost() error {
+	driver, err := container.execDriver()
+	if err != nil {
+		return err
+	}
 	for {
-		output, err := exec.Command("lxc-info", "-n", container.ID).CombinedOutput()
+		running, err := driver.Running(container)
 		if err != nil {
 			return err
 		}
-		if !strings.Contains(string(output), "RUNNING") {
+		if !running {
 			return nil
 		}
 		time.Sleep(500 * time.Millisecond)
@@ -1162,12 +1622,12 @@ func (container *Container) waitLxc() error {
 func (container *Container) monitor(hostConfig *HostConfig) {
 	// Wait for the program to exit
 
-	// If the command does not exist, try to wait via lxc
+	// If the command does not exist, try to wait via the execution driver
 	// (This probably happens only for ghost containers, i.e. containers that were running when Docker started)
 	if container.cmd == nil {
-		utils.Debugf("monitor: waiting for container %s using waitLxc", container.ID)
-		if err := container.waitLxc(); err != nil {
-			utils.Errorf("monitor: while waiting for container %s, waitLxc had a problem: %s", container.ID, err)
+		utils.Debugf("monitor: waiting for container %s using waitGhost", container.ID)
+		if err := container.waitGhost(); err != nil {
+			utils.Errorf("monitor: while waiting for container %s, waitGhost had a problem: %s", container.ID, err)
 		}
 	} else {
 		utils.Debugf("monitor: waiting for container %s using cmd.Wait", container.ID)
@@ -1184,6 +1644,12 @@ func (container *Container) monitor(hostConfig *HostConfig) {
 		exitCode = container.cmd.ProcessState.Sys().(syscall.WaitStatus).ExitStatus()
 	}
 
+	if driver, err := container.execDriver(); err != nil {
+		utils.Errorf("monitor: %s", err)
+	} else if err := driver.Cleanup(container); err != nil {
+		utils.Errorf("monitor: %s: Error cleaning up after the container: %s", container.ID, err)
+	}
+
 	// Report status back
 	container.State.setStopped(exitCode)
 
@@ -1199,6 +1665,10 @@ func (container *Container) monitor(hostConfig *HostConfig) {
 		container.stdin, container.stdinPipe = io.Pipe()
 	}
 
+	// Decide before releasing the lock: whoever waits for the container
+	// may start it again right away
+	restart := container.shouldRestart(hostConfig, exitCode)
+
 	// Release the lock
 	close(container.waitLock)
 
@@ -1211,6 +1681,69 @@ func (container *Container) monitor(hostConfig *HostConfig) {
 		// FIXME: why are we serializing running state to disk in the first place?
 		//log.Printf("%s: Failed to dump configuration to the disk: %s", container.ID, err)
 	}
+
+	if restart {
+		container.restartWithBackoff()
+	}
+}
+
+// shouldRestart applies the restart policy of the container once its process exited.
+func (container *Container) shouldRestart(hostConfig *HostConfig, exitCode int) bool {
+	container.State.Lock()
+	stopRequested := container.stopRequested
+	container.State.Unlock()
+	if stopRequested || container.runtime == nil || hostConfig == nil {
+		return false
+	}
+	policy := hostConfig.RestartPolicy
+	switch policy.Name {
+	case "always":
+		return true
+	case "on-failure":
+		if exitCode == 0 {
+			return false
+		}
+		return policy.MaximumRetryCount <= 0 || container.RestartCount < policy.MaximumRetryCount
+	}
+	return false
+}
+
+// nextRestartDelay returns the delay before the next automatic restart.
+func (container *Container) nextRestartDelay() time.Duration {
+	if container.State.FinishedAt.Sub(container.State.StartedAt) >= restartBackoffReset {
+		container.restartDelay = 0
+	}
+	if container.restartDelay == 0 {
+		container.restartDelay = restartBackoffMin
+	} else if container.restartDelay *= 2; container.restartDelay > restartBackoffMax {
+		container.restartDelay = restartBackoffMax
+	}
+	return container.restartDelay
+}
+
+// restartWithBackoff starts the container again after a delay which doubles
+// with each consecutive restart, so that a container crashing in a loop doesn't
+// hog the host. The delay is reset once the container manages to run for a while.
+func (container *Container) restartWithBackoff() {
+	delay := container.nextRestartDelay()
+	utils.Debugf("monitor: restarting container %s in %s", container.ID, delay)
+	time.Sleep(delay)
+
+	// The container may have been stopped or removed while we were waiting:
+	// the lock keeps it from being stopped between the check and the start
+	container.State.Lock()
+	defer container.State.Unlock()
+	if container.stopRequested || container.State.Running || container.runtime.Get(container.ID) == nil {
+		return
+	}
+	container.RestartCount++
+	if err := container.startLocked(nil); err != nil {
+		utils.Errorf("monitor: %s: Failed to restart the container: %s", container.ID, err)
+		return
+	}
+	if container.runtime.srv != nil {
+		container.runtime.srv.LogEvent("restart", container.ShortID(), container.runtime.repositories.ImageName(container.Image))
+	}
 }
 
 func (container *Container) cleanup() {
@@ -1254,15 +1787,23 @@ func (container *Container) kill(sig int) error {
 		return nil
 	}
 
-	if output, err := exec.Command("lxc-kill", "-n", container.ID, strconv.Itoa(sig)).CombinedOutput(); err != nil {
-		log.Printf("error killing container %s (%s, %s)", container.ShortID(), output, err)
+	driver, err := container.execDriver()
+	if err != nil {
 		return err
 	}
+	return driver.Kill(container, sig)
+}
 
-	return nil
+// requestStop keeps the restart policy from starting the container again
+// once it stops.
+func (container *Container) requestStop() {
+	container.State.Lock()
+	container.stopRequested = true
+	container.State.Unlock()
 }
 
 func (container *Container) Kill() error {
+	container.requestStop()
 	if !container.State.Running {
 		return nil
 	}
@@ -1275,9 +1816,9 @@ func (container *Container) Kill() error {
 	// 2. Wait for the process to die, in last resort, try to kill the process directly
 	if err := container.WaitTimeout(10 * time.Second); err != nil {
 		if container.cmd == nil {
-			return fmt.Errorf("lxc-kill failed, impossible to kill the container %s", container.ShortID())
+			return fmt.Errorf("Failed to kill the container %s", container.ShortID())
 		}
-		log.Printf("Container %s failed to exit within 10 seconds of lxc-kill %s - trying direct SIGKILL", "SIGKILL", container.ShortID())
+		log.Printf("Container %s failed to exit within 10 seconds of SIGKILL - trying direct SIGKILL", container.ShortID())
 		if err := container.cmd.Process.Kill(); err != nil {
 			return err
 		}
@@ -1288,6 +1829,7 @@ func (container *Container) Kill() error {
 }
 
 func (container *Container) Stop(seconds int) error {
+	container.requestStop()
 	if !container.State.Running {
 		return nil
 	}
@@ -1316,13 +1858,85 @@ func (container *Container) Restart(seconds int) error {
 	if err := container.Stop(seconds); err != nil {
 		return err
 	}
-	hostConfig := &HostConfig{}
-	if err := container.Start(hostConfig); err != nil {
+	if err := container.Start(nil); err != nil {
 		return err
 	}
 	return nil
 }
 
+// Pause freezes all the processes of the container with the freezer cgroup.
+// They get no CPU time until the container is unpaused.
+func (container *Container) Pause() error {
+	container.State.Lock()
+	defer container.State.Unlock()
+	if !container.State.Running {
+		return fmt.Errorf("Container %s is not running", container.ShortID())
+	}
+	if container.State.Paused {
+		return fmt.Errorf("Container %s is already paused", container.ShortID())
+	}
+	if err := container.setFrozen(true); err != nil {
+		return err
+	}
+	container.State.Paused = true
+	return container.ToDisk()
+}
+
+func (container *Container) Unpause() error {
+	container.State.Lock()
+	defer container.State.Unlock()
+	if !container.State.Running {
+		return fmt.Errorf("Container %s is not running", container.ShortID())
+	}
+	if !container.State.Paused {
+		return fmt.Errorf("Container %s is not paused", container.ShortID())
+	}
+	if err := container.setFrozen(false); err != nil {
+		return err
+	}
+	container.State.Paused = false
+	return container.ToDisk()
+}
+
+// setFrozen writes the state of the freezer cgroup of the container, and
+// waits for the kernel to apply it: freezing goes through the FREEZING
+// state until every task of the cgroup is stopped.
+func (container *Container) setFrozen(frozen bool) error {
+	driver, err := container.execDriver()
+	if err != nil {
+		return err
+	}
+	dir, err := driver.CgroupPath(container, "freezer")
+	if err != nil {
+		return err
+	}
+	state := "THAWED"
+	if frozen {
+		state = "FROZEN"
+	}
+	statePath := path.Join(dir, "freezer.state")
+	for start := time.Now(); time.Since(start) < 10*time.Second; {
+		// Tasks forking while the cgroup freezes can leave it in FREEZING,
+		// writing the state again retries them.
+		if err := ioutil.WriteFile(statePath, []byte(state), 0700); err != nil {
+			return fmt.Errorf("Unable to write %s to %s: %s", state, statePath, err)
+		}
+		current, err := ioutil.ReadFile(statePath)
+		if err != nil {
+			return err
+		}
+		if strings.TrimSpace(string(current)) == state {
+			return nil
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if frozen {
+		// Don't leave the container half frozen
+		ioutil.WriteFile(statePath, []byte("THAWED"), 0700)
+	}
+	return fmt.Errorf("Timeout while setting %s to %s", statePath, state)
+}
+
 // Wait blocks until the container stops running, then returns its exit code.
 func (container *Container) Wait() int {
 	<-container.waitLock
@@ -1338,11 +1952,14 @@ func (container *Container) Resize(h, w int) error {
 }
 
 func (container *Container) ExportRw() (Archive, error) {
-	return Tar(container.rwPath(), Uncompressed)
+	if container.runtime == nil {
+		return nil, fmt.Errorf("Can't export the rw layer of unregistered container")
+	}
+	return container.runtime.driver.Diff(container.ID)
 }
 
 func (container *Container) RwChecksum() (string, error) {
-	rwData, err := Tar(container.rwPath(), Xz)
+	rwData, err := container.ExportRw()
 	if err != nil {
 		return "", err
 	}
@@ -1371,29 +1988,30 @@ func (container *Container) WaitTimeout(timeout time.Duration) error {
 	}
 }
 
+// EnsureMounted makes sure the root filesystem of the container is available
+// at RootfsPath. Storage drivers don't mount a layer twice, so it is
+// equivalent to Mount.
 func (container *Container) EnsureMounted() error {
-	if mounted, err := container.Mounted(); err != nil {
-		return err
-	} else if mounted {
-		return nil
-	}
 	return container.Mount()
 }
 
 func (container *Container) Mount() error {
-	image, err := container.GetImage()
+	if container.runtime == nil {
+		return fmt.Errorf("Can't mount the filesystem of unregistered container")
+	}
+	dir, err := container.runtime.driver.Get(container.ID)
 	if err != nil {
-		return err
+		return fmt.Errorf("Error getting container %s from driver %s: %s", container.ID, container.runtime.driver, err)
 	}
-	return image.Mount(container.RootfsPath(), container.rwPath())
+	container.rootfs = dir
+	return nil
 }
 
 func (container *Container) Changes() ([]Change, error) {
-	image, err := container.GetImage()
-	if err != nil {
-		return nil, err
+	if container.runtime == nil {
+		return nil, fmt.Errorf("Can't get the changes of unregistered container")
 	}
-	return image.Changes(container.rwPath())
+	return container.runtime.driver.Changes(container.ID)
 }
 
 func (container *Container) GetImage() (*Image, error) {
@@ -1403,18 +2021,11 @@ func (container *Container) GetImage() (*Image, error) {
 	return container.runtime.graph.Get(container.Image)
 }
 
-func (container *Container) Mounted() (bool, error) {
-	return Mounted(container.RootfsPath())
-}
-
 func (container *Container) Unmount() error {
-	if _, err := os.Stat(container.RootfsPath()); err != nil {
-		if os.IsNotExist(err) {
-			return nil
-		}
-		return err
+	if container.runtime == nil {
+		return fmt.Errorf("Can't unmount the filesystem of unregistered container")
 	}
-	return Unmount(container.RootfsPath())
+	return container.runtime.driver.Put(container.ID)
 }
 
 // ShortID returns a shorthand version of the container's id for convenience.
@@ -1429,7 +2040,12 @@ func (container *Container) logPath(name string) string {
 	return path.Join(container.root, fmt.Sprintf("%s-%s.log", container.ID, name))
 }
 
-func (container *Container) ReadLog(name string) (io.Reader, error) {
+// ReadLog opens the log file `name` of the container. JSON logs are read
+// across the files left by log rotation, from the oldest to the newest.
+func (container *Container) ReadLog(name string) (io.ReadCloser, error) {
+	if name == "json" {
+		return openRotatedLogs(container.logPath(name), -1)
+	}
 	return os.Open(container.logPath(name))
 }
 
@@ -1450,12 +2066,9 @@ func (container *Container) lxcConfigPath() string {
 }
 
 // This method must be exported to be used from the lxc template
+// The path is only valid once the container has been mounted.
 func (container *Container) RootfsPath() string {
-	return path.Join(container.root, "rootfs")
-}
-
-func (container *Container) rwPath() string {
-	return path.Join(container.root, "rw")
+	return container.rootfs
 }
 
 func validateID(id string) error {
@@ -1469,15 +2082,18 @@ func validateID(id string) error {
 func (container *Container) GetSize() (int64, int64) {
 	var sizeRw, sizeRootfs int64
 
-	filepath.Walk(container.rwPath(), func(path string, fileInfo os.FileInfo, err error) error {
-		if fileInfo != nil {
-			sizeRw += fileInfo.Size()
-		}
-		return nil
-	})
+	if err := container.EnsureMounted(); err != nil {
+		utils.Errorf("Warning: failed to compute size of container rootfs %s: %s", container.ID, err)
+		return sizeRw, sizeRootfs
+	}
+
+	if size, err := container.runtime.driver.DiffSize(container.ID); err != nil {
+		utils.Errorf("Warning: failed to compute size of container rw layer %s: %s", container.ID, err)
+	} else {
+		sizeRw = size
+	}
 
-	_, err := os.Stat(container.RootfsPath())
-	if err == nil {
+	if _, err := os.Stat(container.RootfsPath()); err == nil {
 		filepath.Walk(container.RootfsPath(), func(path string, fileInfo os.FileInfo, err error) error {
 			if fileInfo != nil {
 				sizeRootfs += fileInfo.Size()
@@ -1506,7 +2122,7 @@ func (container *Container) Copy(resource string) (Archive, error) {
 		filter = []string{path.Base(basePath)}
 		basePath = path.Dir(basePath)
 	}
-	return TarFilter(basePath, Uncompressed, filter)
+	return TarFilter(basePath, Uncompressed, filter, nil)
 }
 
 // Returns true if the container exposes a certain port
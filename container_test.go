@@ -552,6 +552,52 @@ func TestKill(t *testing.T) {
 	}
 }
 
+func TestPause(t *testing.T) {
+	runtime := mkRuntime(t)
+	defer nuke(runtime)
+	container, _, err := runtime.Create(&Config{
+		Image: GetTestImage(runtime).ID,
+		Cmd:   []string{"sleep", "10"},
+	},
+		"",
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer runtime.Destroy(container)
+
+	if err := container.Pause(); err == nil {
+		t.Fatal("Pausing a stopped container should fail")
+	}
+	if err := container.Start(&HostConfig{}); err != nil {
+		t.Fatal(err)
+	}
+	defer container.Kill()
+
+	if err := container.Pause(); err != nil {
+		t.Fatal(err)
+	}
+	if !container.State.Paused {
+		t.Errorf("Container should be paused")
+	}
+	if !strings.HasSuffix(container.State.String(), "(Paused)") {
+		t.Errorf("The state should tell that the container is paused, found %s", container.State.String())
+	}
+	if err := container.Pause(); err == nil {
+		t.Fatal("Pausing a paused container should fail")
+	}
+
+	if err := container.Unpause(); err != nil {
+		t.Fatal(err)
+	}
+	if container.State.Paused {
+		t.Errorf("Container shouldn't be paused")
+	}
+	if err := container.Unpause(); err == nil {
+		t.Fatal("Unpausing a running container should fail")
+	}
+}
+
 func TestExitCode(t *testing.T) {
 	runtime := mkRuntime(t)
 	defer nuke(runtime)
@@ -1658,3 +1704,65 @@ func TestMultipleVolumesFrom(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestShouldRestart(t *testing.T) {
+	container := &Container{runtime: &Runtime{}}
+	policy := func(name string, retries int) *HostConfig {
+		return &HostConfig{RestartPolicy: RestartPolicy{Name: name, MaximumRetryCount: retries}}
+	}
+
+	if container.shouldRestart(nil, 1) {
+		t.Fatal("A container without host config shouldn't be restarted")
+	}
+	for _, name := range []string{"", "never"} {
+		if container.shouldRestart(policy(name, 0), 1) {
+			t.Fatalf("The restart policy %q shouldn't restart the container", name)
+		}
+	}
+	if !container.shouldRestart(policy("always", 0), 0) {
+		t.Fatal("The always restart policy should restart a container which exited successfully")
+	}
+	if container.shouldRestart(policy("on-failure", 0), 0) {
+		t.Fatal("The on-failure restart policy shouldn't restart a container which exited successfully")
+	}
+	if !container.shouldRestart(policy("on-failure", 0), 1) {
+		t.Fatal("The on-failure restart policy should restart a container which failed")
+	}
+
+	container.RestartCount = 2
+	if !container.shouldRestart(policy("on-failure", 3), 1) {
+		t.Fatal("The container should be restarted until the maximum retry count")
+	}
+	container.RestartCount = 3
+	if container.shouldRestart(policy("on-failure", 3), 1) {
+		t.Fatal("The container shouldn't be restarted past the maximum retry count")
+	}
+
+	container.requestStop()
+	if container.shouldRestart(policy("always", 0), 1) {
+		t.Fatal("A container stopped on purpose shouldn't be restarted")
+	}
+}
+
+func TestRestartBackoff(t *testing.T) {
+	container := &Container{}
+	now := time.Now()
+	container.State.StartedAt = now
+	container.State.FinishedAt = now.Add(time.Second)
+
+	expected := restartBackoffMin
+	for i := 0; i < 20; i++ {
+		if delay := container.nextRestartDelay(); delay != expected {
+			t.Fatalf("Expected a delay of %s for the restart %d, got %s", expected, i, delay)
+		}
+		if expected *= 2; expected > restartBackoffMax {
+			expected = restartBackoffMax
+		}
+	}
+
+	// A container which ran long enough starts over from the minimum delay
+	container.State.FinishedAt = now.Add(restartBackoffReset)
+	if delay := container.nextRestartDelay(); delay != restartBackoffMin {
+		t.Fatalf("Expected the delay to be reset to %s, got %s", restartBackoffMin, delay)
+	}
+}
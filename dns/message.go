@@ -0,0 +1,136 @@
+package dns
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"strings"
+)
+
+// Only the parts of the DNS protocol (RFC 1035) needed to answer A and AAAA
+// queries are implemented: the other queries are forwarded as they are.
+const (
+	headerLen = 12
+
+	typeA    = 1
+	typeAAAA = 28
+	typeANY  = 255
+	classIN  = 1
+
+	flagResponse           = 1 << 15
+	flagAuthoritative      = 1 << 10
+	flagRecursionDesired   = 1 << 8
+	flagRecursionAvailable = 1 << 7
+
+	rcodeFormatError   = 1
+	rcodeServerFailure = 2
+)
+
+var errMalformed = errors.New("Malformed DNS query")
+
+type question struct {
+	name  string // Without the trailing dot
+	qtype uint16
+	class uint16
+	end   int // Offset of the end of the question in the query
+}
+
+// parseQuestion returns the question of `query`, which must be a standard
+// query with a single question.
+func parseQuestion(query []byte) (*question, error) {
+	if len(query) < headerLen {
+		return nil, errMalformed
+	}
+	flags := binary.BigEndian.Uint16(query[2:])
+	if flags&flagResponse != 0 || (flags>>11)&0xf != 0 {
+		return nil, errors.New("Not a standard DNS query")
+	}
+	if binary.BigEndian.Uint16(query[4:]) != 1 {
+		return nil, errors.New("Only DNS queries with one question are supported")
+	}
+	var labels []string
+	offset := headerLen
+	for {
+		if offset >= len(query) {
+			return nil, errMalformed
+		}
+		length := int(query[offset])
+		offset++
+		if length == 0 {
+			break
+		}
+		// Queries don't compress their only name
+		if length > 63 || offset+length > len(query) {
+			return nil, errMalformed
+		}
+		labels = append(labels, string(query[offset:offset+length]))
+		offset += length
+	}
+	if offset+4 > len(query) {
+		return nil, errMalformed
+	}
+	return &question{
+		name:  strings.Join(labels, "."),
+		qtype: binary.BigEndian.Uint16(query[offset:]),
+		class: binary.BigEndian.Uint16(query[offset+2:]),
+		end:   offset + 4,
+	}, nil
+}
+
+// newResponse returns the header and question of the response to `query`,
+// with `answers` answers to come.
+func newResponse(query []byte, q *question, rcode uint16, answers int) []byte {
+	flags := binary.BigEndian.Uint16(query[2:])
+	response := make([]byte, headerLen, q.end+answers*28)
+	copy(response, query[:2])
+	flags = flagResponse | flagAuthoritative | flagRecursionAvailable | flags&flagRecursionDesired | rcode
+	binary.BigEndian.PutUint16(response[2:], flags)
+	binary.BigEndian.PutUint16(response[4:], 1)
+	binary.BigEndian.PutUint16(response[6:], uint16(answers))
+	return append(response, query[headerLen:q.end]...)
+}
+
+// errorResponse returns the response to `query` failing with `rcode`.
+func errorResponse(query []byte, q *question, rcode uint16) []byte {
+	if q == nil {
+		// Without the question
+		response := make([]byte, headerLen)
+		copy(response, query[:2])
+		binary.BigEndian.PutUint16(response[2:], flagResponse|rcode)
+		return response
+	}
+	return newResponse(query, q, rcode, 0)
+}
+
+// answerResponse returns the response to the A, AAAA or ANY query `query`
+// with the addresses of `ips` of the family asked for.
+func answerResponse(query []byte, q *question, ips []net.IP) []byte {
+	type record struct {
+		rtype uint16
+		data  []byte
+	}
+	var records []record
+	for _, ip := range ips {
+		if ip4 := ip.To4(); ip4 != nil {
+			if q.qtype == typeA || q.qtype == typeANY {
+				records = append(records, record{typeA, ip4})
+			}
+		} else if q.qtype == typeAAAA || q.qtype == typeANY {
+			records = append(records, record{typeAAAA, ip.To16()})
+		}
+	}
+	response := newResponse(query, q, 0, len(records))
+	for _, r := range records {
+		rr := make([]byte, 12, 12+len(r.data))
+		// The name is the one of the question, right after the header
+		binary.BigEndian.PutUint16(rr, 0xc000|headerLen)
+		binary.BigEndian.PutUint16(rr[2:], r.rtype)
+		binary.BigEndian.PutUint16(rr[4:], classIN)
+		// A TTL of 0, so that the address of a restarted container is
+		// never cached
+		binary.BigEndian.PutUint32(rr[6:], 0)
+		binary.BigEndian.PutUint16(rr[10:], uint16(len(r.data)))
+		response = append(response, append(rr, r.data...)...)
+	}
+	return response
+}
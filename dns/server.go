@@ -0,0 +1,140 @@
+package dns
+
+import (
+	"errors"
+	"github.com/dotcloud/docker/utils"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	// Large enough for the answers of upstream servers using EDNS
+	maxPacketSize  = 4096
+	forwardTimeout = 5 * time.Second
+	// Queries served at once, the next ones wait in the socket buffer
+	maxConcurrentQueries = 64
+)
+
+// A Resolver gives the answers of a Server.
+type Resolver interface {
+	// Accepts returns whether the queries of `client` are served at all:
+	// the others are dropped, so that the server isn't an open resolver.
+	Accepts(client net.IP) bool
+	// Lookup returns the addresses of `name` for the client `client`, and
+	// false if the name is unknown and the query must be forwarded.
+	Lookup(client net.IP, name string) ([]net.IP, bool)
+	// Upstream returns the servers the queries of `client` are forwarded
+	// to, in order, as IP addresses or host:port.
+	Upstream(client net.IP) []string
+}
+
+// Server is a DNS server answering the A and AAAA queries of the names its
+// Resolver knows, and forwarding the others upstream. It only serves UDP.
+type Server struct {
+	conn     *net.UDPConn
+	resolver Resolver
+	slots    chan struct{}
+}
+
+func NewServer(addr *net.UDPAddr, resolver Resolver) (*Server, error) {
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &Server{conn: conn, resolver: resolver, slots: make(chan struct{}, maxConcurrentQueries)}, nil
+}
+
+// Addr returns the address the server listens on.
+func (srv *Server) Addr() *net.UDPAddr {
+	return srv.conn.LocalAddr().(*net.UDPAddr)
+}
+
+// Run serves the queries until the server is closed.
+func (srv *Server) Run() {
+	for {
+		buf := make([]byte, maxPacketSize)
+		n, client, err := srv.conn.ReadFromUDP(buf)
+		if err != nil {
+			if !strings.Contains(err.Error(), "use of closed network connection") {
+				utils.Errorf("DNS server stopped: %s", err)
+			}
+			return
+		}
+		if !srv.resolver.Accepts(client.IP) {
+			continue
+		}
+		srv.slots <- struct{}{}
+		go func() {
+			defer func() { <-srv.slots }()
+			srv.serve(buf[:n], client)
+		}()
+	}
+}
+
+func (srv *Server) Close() error {
+	return srv.conn.Close()
+}
+
+func (srv *Server) serve(query []byte, client *net.UDPAddr) {
+	if len(query) < headerLen {
+		return
+	}
+	q, err := parseQuestion(query)
+	if err != nil {
+		utils.Debugf("Invalid DNS query from %s: %s", client, err)
+		srv.conn.WriteToUDP(errorResponse(query, nil, rcodeFormatError), client)
+		return
+	}
+	if q.class == classIN && (q.qtype == typeA || q.qtype == typeAAAA || q.qtype == typeANY) {
+		if ips, known := srv.resolver.Lookup(client.IP, q.name); known {
+			srv.conn.WriteToUDP(answerResponse(query, q, ips), client)
+			return
+		}
+	}
+	response, err := forward(query, srv.resolver.Upstream(client.IP))
+	if err != nil {
+		utils.Debugf("Unable to forward the DNS query of %s for %s: %s", client, q.name, err)
+		response = errorResponse(query, q, rcodeServerFailure)
+	}
+	srv.conn.WriteToUDP(response, client)
+}
+
+// forward sends `query` to each server of `upstream` in turn, and returns
+// the first response.
+func forward(query []byte, upstream []string) ([]byte, error) {
+	err := errors.New("No upstream DNS server")
+	for _, server := range upstream {
+		if net.ParseIP(server) != nil {
+			server = net.JoinHostPort(server, "53")
+		}
+		var response []byte
+		if response, err = exchange(query, server); err == nil {
+			return response, nil
+		}
+	}
+	return nil, err
+}
+
+func exchange(query []byte, server string) ([]byte, error) {
+	conn, err := net.Dial("udp", server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(forwardTimeout))
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, maxPacketSize)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		// Skip the stray responses to other queries
+		if n >= headerLen && buf[0] == query[0] && buf[1] == query[1] {
+			return buf[:n], nil
+		}
+	}
+}
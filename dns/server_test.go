@@ -0,0 +1,157 @@
+package dns
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+type testResolver struct {
+	names    map[string][]net.IP
+	upstream []string
+	refused  bool
+}
+
+func (r *testResolver) Accepts(client net.IP) bool {
+	return !r.refused
+}
+
+func (r *testResolver) Lookup(client net.IP, name string) ([]net.IP, bool) {
+	ips, known := r.names[name]
+	return ips, known
+}
+
+func (r *testResolver) Upstream(client net.IP) []string {
+	return r.upstream
+}
+
+func newQuery(id uint16, name string, qtype uint16) []byte {
+	query := make([]byte, headerLen)
+	binary.BigEndian.PutUint16(query, id)
+	binary.BigEndian.PutUint16(query[2:], flagRecursionDesired)
+	binary.BigEndian.PutUint16(query[4:], 1)
+	for _, label := range []string{name[:len(name)-len(".example")], "example"} {
+		query = append(query, byte(len(label)))
+		query = append(query, label...)
+	}
+	query = append(query, 0, byte(qtype>>8), byte(qtype), 0, classIN)
+	return query
+}
+
+func exchangeTest(t *testing.T, srv *Server, query []byte) []byte {
+	response, err := exchange(query, srv.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return response
+}
+
+func startTestServer(t *testing.T, resolver Resolver) *Server {
+	srv, err := NewServer(&net.UDPAddr{IP: net.ParseIP("127.0.0.1")}, resolver)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Run()
+	return srv
+}
+
+func TestServerLookup(t *testing.T) {
+	srv := startTestServer(t, &testResolver{
+		names: map[string][]net.IP{
+			"db.example": {net.ParseIP("172.17.0.2"), net.ParseIP("fd00::2")},
+		},
+	})
+	defer srv.Close()
+
+	response := exchangeTest(t, srv, newQuery(42, "db.example", typeA))
+	if id := binary.BigEndian.Uint16(response); id != 42 {
+		t.Fatalf("Expected the id of the query, got %d", id)
+	}
+	flags := binary.BigEndian.Uint16(response[2:])
+	if flags&flagResponse == 0 || flags&flagRecursionDesired == 0 || flags&0xf != 0 {
+		t.Fatalf("Unexpected flags %x", flags)
+	}
+	if answers := binary.BigEndian.Uint16(response[6:]); answers != 1 {
+		t.Fatalf("Expected 1 answer, got %d", answers)
+	}
+	if ip := net.IP(response[len(response)-4:]); !ip.Equal(net.ParseIP("172.17.0.2")) {
+		t.Fatalf("Expected 172.17.0.2, got %s", ip)
+	}
+
+	response = exchangeTest(t, srv, newQuery(43, "db.example", typeAAAA))
+	if answers := binary.BigEndian.Uint16(response[6:]); answers != 1 {
+		t.Fatalf("Expected 1 answer, got %d", answers)
+	}
+	if ip := net.IP(response[len(response)-16:]); !ip.Equal(net.ParseIP("fd00::2")) {
+		t.Fatalf("Expected fd00::2, got %s", ip)
+	}
+}
+
+func TestServerForward(t *testing.T) {
+	upstream, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer upstream.Close()
+	go func() {
+		buf := make([]byte, maxPacketSize)
+		n, addr, err := upstream.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		q, err := parseQuestion(buf[:n])
+		if err != nil {
+			return
+		}
+		upstream.WriteToUDP(answerResponse(buf[:n], q, []net.IP{net.ParseIP("10.0.0.1")}), addr)
+	}()
+
+	srv := startTestServer(t, &testResolver{upstream: []string{upstream.LocalAddr().String()}})
+	defer srv.Close()
+
+	response := exchangeTest(t, srv, newQuery(7, "www.example", typeA))
+	if ip := net.IP(response[len(response)-4:]); !ip.Equal(net.ParseIP("10.0.0.1")) {
+		t.Fatalf("Expected the answer of the upstream server, got %s", ip)
+	}
+}
+
+func TestServerForwardFailure(t *testing.T) {
+	// Nothing listens on the upstream server
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := conn.LocalAddr().String()
+	conn.Close()
+
+	srv := startTestServer(t, &testResolver{upstream: []string{addr}})
+	defer srv.Close()
+
+	start := time.Now()
+	response := exchangeTest(t, srv, newQuery(8, "www.example", typeA))
+	if rcode := binary.BigEndian.Uint16(response[2:]) & 0xf; rcode != rcodeServerFailure {
+		t.Fatalf("Expected SERVFAIL, got %d after %s", rcode, time.Since(start))
+	}
+}
+
+func TestServerRefusedClient(t *testing.T) {
+	srv := startTestServer(t, &testResolver{
+		names:   map[string][]net.IP{"db.example": {net.ParseIP("172.17.0.2")}},
+		refused: true,
+	})
+	defer srv.Close()
+
+	conn, err := net.Dial("udp", srv.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write(newQuery(9, "db.example", typeA)); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(200 * time.Millisecond))
+	if n, err := conn.Read(make([]byte, maxPacketSize)); err == nil {
+		t.Fatalf("Expected the query of an unknown client to be dropped, got %d bytes", n)
+	}
+}
@@ -1,9 +1,11 @@
 package main
 
 import (
+	"crypto/tls"
 	"flag"
 	"fmt"
 	"github.com/dotcloud/docker"
+	"github.com/dotcloud/docker/registry"
 	"github.com/dotcloud/docker/sysinit"
 	"github.com/dotcloud/docker/utils"
 	"io/ioutil"
@@ -22,7 +24,9 @@ var (
 )
 
 func main() {
-	if selfPath := utils.SelfPath(); selfPath == "/sbin/init" || selfPath == "/.dockerinit" {
+	// Check argv[0] first: the native execution driver runs dockerinit as
+	// /.dockerinit before the container's rootfs, where that path exists, is set up.
+	if os.Args[0] == "/.dockerinit" || utils.SelfPath() == "/sbin/init" {
 		// Running in init mode
 		sysinit.SysInit()
 		return
@@ -37,11 +41,30 @@ func main() {
 	flGraphPath := flag.String("g", "/var/lib/docker", "Path to graph storage base dir.")
 	flEnableCors := flag.Bool("api-enable-cors", false, "Enable CORS requests in the remote api.")
 	flDns := flag.String("dns", "", "Set custom dns servers")
+	flEmbeddedDns := flag.Bool("embedded-dns", false, "Resolve the names of the containers with a dns server on the bridge")
 	flHosts := utils.ListOpts{fmt.Sprintf("unix://%s", docker.DEFAULTUNIXSOCKET)}
 	flag.Var(&flHosts, "H", "tcp://host:port to bind/connect to or unix://path/to/socket to use")
 	flEnableIptables := flag.Bool("iptables", true, "Disable iptables within docker")
 	flDefaultIp := flag.String("ip", "0.0.0.0", "Default ip address to use when binding a containers ports")
+	flIPv6Subnet := flag.String("ipv6-subnet", "", "IPv6 subnet of the bridge, giving the containers an IPv6 address too (e.g. 2001:db8::/64)")
 	flInterContainerComm := flag.Bool("icc", true, "Enable inter-container communication")
+	flGraphDriver := flag.String("s", "", "Force the docker runtime to use a specific storage driver")
+	flExecDriver := flag.String("e", docker.DefaultExecDriver, "Force the docker runtime to use a specific exec driver")
+	var flMirrors, flInsecureRegistries utils.ListOpts
+	flag.Var(&flMirrors, "registry-mirror", "URL of a mirror of the index, tried first when pulling (can be repeated)")
+	flag.Var(&flInsecureRegistries, "insecure-registry", "host[:port] of a registry which may be reached over plain HTTP (can be repeated)")
+	flTrustKey := flag.String("trust-key", "", "Key signing the pushed images (default: <graph>/trust/key.pem, generated if missing)")
+	flTrustKeyring := flag.String("trust-keyring", "", "Directory of the public keys trusted when pulling (default: <graph>/trust/keyring)")
+	flRequireSigned := flag.Bool("require-signed", false, "Only run images signed by a trusted key")
+	flTrustDerived := flag.Bool("trust-derived", false, "Trust the images built or committed from a trusted image")
+	flTls := flag.Bool("tls", false, "Connect to the daemon over TLS, verifying it against the CAs of the system unless -tlscacert is set")
+	flTlsCert := flag.String("tlscert", "", "Certificate of the daemon on tcp addresses, or of the client")
+	flTlsKey := flag.String("tlskey", "", "Key of the certificate given with -tlscert")
+	flTlsCACert := flag.String("tlscacert", "", "CAs verifying the certificates of the clients, or of the daemon")
+	flInsecureTcp := flag.Bool("insecure-tcp", false, "Allow the daemon to serve the API on tcp addresses without TLS and client certificates")
+	var flAuthzPlugins utils.ListOpts
+	flag.Var(&flAuthzPlugins, "authz-plugin", "Socket, or name in "+docker.DefaultAuthzPluginDir+", of a plugin authorizing the calls of the remote API (can be repeated)")
+	flMaxDownloads := flag.Int("max-concurrent-downloads", docker.DefaultMaxConcurrentDownloads, "Maximum number of layers pulled at the same time")
 
 	flag.Parse()
 
@@ -88,21 +111,51 @@ func main() {
 			AutoRestart:                 *flAutoRestart,
 			EnableCors:                  *flEnableCors,
 			Dns:                         dns,
+			EmbeddedDns:                 *flEmbeddedDns,
 			EnableIptables:              *flEnableIptables,
 			BridgeIface:                 bridge,
+			IPv6Subnet:                  *flIPv6Subnet,
 			ProtoAddresses:              flHosts,
 			DefaultIp:                   ip,
 			InterContainerCommunication: *flInterContainerComm,
+			GraphDriver:                 *flGraphDriver,
+			ExecDriver:                  *flExecDriver,
+			MaxConcurrentDownloads:      *flMaxDownloads,
+			Mirrors:                     flMirrors,
+			InsecureRegistries:          flInsecureRegistries,
+			TrustKey:                    *flTrustKey,
+			TrustKeyring:                *flTrustKeyring,
+			RequireSignedImages:         *flRequireSigned,
+			TrustDerivedImages:          *flTrustDerived,
+			TLSCert:                     *flTlsCert,
+			TLSKey:                      *flTlsKey,
+			TLSCACert:                   *flTlsCACert,
+			AuthzPlugins:                flAuthzPlugins,
+		}
+		if err := checkTcpHosts(config, *flInsecureTcp); err != nil {
+			log.Fatal(err)
 		}
 		if err := daemon(config); err != nil {
 			log.Fatal(err)
 		}
+	} else if flag.Arg(0) == "registry-serve" {
+		// The registry doesn't need a daemon
+		if err := registryServe(flag.Args()[1:]); err != nil {
+			log.Fatal(err)
+		}
 	} else {
 		if len(flHosts) > 1 {
 			log.Fatal("Please specify only one -H")
 		}
 		protoAddrParts := strings.SplitN(flHosts[0], "://", 2)
-		if err := docker.ParseCommands(protoAddrParts[0], protoAddrParts[1], flag.Args()...); err != nil {
+		var tlsConfig *tls.Config
+		if *flTls || *flTlsCert != "" || *flTlsKey != "" || *flTlsCACert != "" {
+			var err error
+			if tlsConfig, err = docker.NewClientTLSConfig(*flTlsCert, *flTlsKey, *flTlsCACert); err != nil {
+				log.Fatal(err)
+			}
+		}
+		if err := docker.ParseCommands(protoAddrParts[0], protoAddrParts[1], tlsConfig, flag.Args()...); err != nil {
 			if sterr, ok := err.(*utils.StatusError); ok {
 				os.Exit(sterr.Status)
 			}
@@ -142,6 +195,23 @@ func removePidFile(pidfile string) {
 	}
 }
 
+// checkTcpHosts refuses to serve the API on tcp addresses without TLS and
+// client certificates: whoever can reach the API is root on the host.
+func checkTcpHosts(config *docker.DaemonConfig, insecure bool) error {
+	if insecure || (config.TLSCert != "" && config.TLSKey != "" && config.TLSCACert != "") {
+		return nil
+	}
+	if (config.TLSCert == "") != (config.TLSKey == "") {
+		return fmt.Errorf("The certificate and the key of the daemon must be given together with -tlscert and -tlskey")
+	}
+	for _, protoAddr := range config.ProtoAddresses {
+		if strings.HasPrefix(protoAddr, "tcp://") {
+			return fmt.Errorf("Refusing to serve the API on %s without TLS and client certificates: set -tlscert, -tlskey and -tlscacert, or -insecure-tcp to override", protoAddr)
+		}
+	}
+	return nil
+}
+
 func daemon(config *docker.DaemonConfig) error {
 	if err := createPidFile(config.Pidfile); err != nil {
 		log.Fatal(err)
@@ -170,7 +240,7 @@ func daemon(config *docker.DaemonConfig) error {
 		if protoAddrParts[0] == "unix" {
 			syscall.Unlink(protoAddrParts[1])
 		} else if protoAddrParts[0] == "tcp" {
-			if !strings.HasPrefix(protoAddrParts[1], "127.0.0.1") {
+			if config.TLSCACert == "" && !strings.HasPrefix(protoAddrParts[1], "127.0.0.1") {
 				log.Println("/!\\ DON'T BIND ON ANOTHER IP ADDRESS THAN 127.0.0.1 IF YOU DON'T KNOW WHAT YOU'RE DOING /!\\")
 			}
 		} else {
@@ -190,3 +260,26 @@ func daemon(config *docker.DaemonConfig) error {
 	}
 	return nil
 }
+
+func registryServe(args []string) error {
+	cmd := flag.NewFlagSet("registry-serve", flag.ExitOnError)
+	cmd.Usage = func() {
+		fmt.Fprintf(os.Stderr, "\nUsage: docker registry-serve [OPTIONS]\n\nServe a local registry, storing its images in a directory\n\n")
+		cmd.PrintDefaults()
+	}
+	flRoot := cmd.String("root", "/var/lib/docker-registry", "Directory where the images and the repositories are stored")
+	flAddr := cmd.String("addr", "127.0.0.1:5000", "Address to listen on")
+	if err := cmd.Parse(args); err != nil {
+		return err
+	}
+	if cmd.NArg() != 0 {
+		cmd.Usage()
+		return nil
+	}
+	server, err := registry.NewServer(*flRoot)
+	if err != nil {
+		return err
+	}
+	log.Printf("Serving the registry %s on %s", *flRoot, *flAddr)
+	return server.ListenAndServe(*flAddr)
+}
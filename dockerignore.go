@@ -0,0 +1,111 @@
+package docker
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// A .dockerignore file at the root of a build context lists glob patterns,
+// one per line, of the files to leave out of the context. Patterns are
+// matched against paths relative to the root of the context with
+// filepath.Match, so that `*` doesn't match `/`. Excluding a directory
+// excludes all its content. Lines starting with # are comments.
+const dockerIgnoreFile = ".dockerignore"
+
+// readDockerIgnore returns the patterns of the .dockerignore file of the
+// build context at `root`, if any.
+func readDockerIgnore(root string) ([]string, error) {
+	file, err := os.Open(path.Join(root, dockerIgnoreFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer file.Close()
+
+	var patterns []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		pattern := strings.TrimSpace(scanner.Text())
+		if pattern == "" || pattern[0] == '#' {
+			continue
+		}
+		pattern = path.Clean(strings.TrimPrefix(pattern, "/"))
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("Invalid pattern in %s: %s", dockerIgnoreFile, pattern)
+		}
+		patterns = append(patterns, pattern)
+	}
+	return patterns, scanner.Err()
+}
+
+// excludedPaths returns the paths in the build context at `root`, relative
+// to it, matched by one of `patterns`. The content of an excluded directory
+// isn't listed. The Dockerfile and the .dockerignore file are never excluded.
+func excludedPaths(root string, patterns []string) ([]string, error) {
+	var excluded []string
+	if len(patterns) == 0 {
+		return nil, nil
+	}
+	err := filepath.Walk(root, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(root, filePath)
+		if err != nil {
+			return err
+		}
+		if relPath == "." || relPath == "Dockerfile" || relPath == dockerIgnoreFile {
+			return nil
+		}
+		for _, pattern := range patterns {
+			if matched, _ := filepath.Match(pattern, relPath); matched {
+				excluded = append(excluded, relPath)
+				if info.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+		}
+		return nil
+	})
+	return excluded, err
+}
+
+// TarContext creates the archive of the build context at `root`, without
+// the files excluded by its .dockerignore file.
+func TarContext(root string) (Archive, error) {
+	patterns, err := readDockerIgnore(root)
+	if err != nil {
+		return nil, err
+	}
+	excluded, err := excludedPaths(root, patterns)
+	if err != nil {
+		return nil, err
+	}
+	return TarFilter(root, Uncompressed, nil, excluded)
+}
+
+// removeExcluded removes the files excluded by the .dockerignore file from
+// the build context unpacked at `root`, whatever sent it.
+func removeExcluded(root string) error {
+	patterns, err := readDockerIgnore(root)
+	if err != nil {
+		return err
+	}
+	excluded, err := excludedPaths(root, patterns)
+	if err != nil {
+		return err
+	}
+	for _, relPath := range excluded {
+		if err := os.RemoveAll(filepath.Join(root, relPath)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,135 @@
+package docker
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func mkIgnoreContext(t *testing.T, dockerignore string) string {
+	root, err := ioutil.TempDir("", "docker-test-dockerignore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range []string{
+		"Dockerfile",
+		"main.go",
+		"debug.log",
+		"node_modules/foo/index.js",
+		".git/HEAD",
+		"src/app.go",
+		"src/app.log",
+		"src/deep/trace.log",
+	} {
+		if err := os.MkdirAll(path.Join(root, path.Dir(file)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path.Join(root, file), []byte(file), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(path.Join(root, dockerIgnoreFile), []byte(dockerignore), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return root
+}
+
+// listFiles returns the regular files under root, relative to it
+func listFiles(t *testing.T, root string) []string {
+	var files []string
+	var walk func(dir string)
+	walk = func(dir string) {
+		infos, err := ioutil.ReadDir(path.Join(root, dir))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, info := range infos {
+			if info.IsDir() {
+				walk(path.Join(dir, info.Name()))
+			} else {
+				files = append(files, path.Join(dir, info.Name()))
+			}
+		}
+	}
+	walk("")
+	sort.Strings(files)
+	return files
+}
+
+const testDockerIgnore = `
+# Dependencies and VCS
+node_modules
+/.git
+*.log
+src/*.log
+Dockerfile
+`
+
+var testContextKept = []string{".dockerignore", "Dockerfile", "main.go", "src/app.go", "src/deep/trace.log"}
+
+func TestExcludedPaths(t *testing.T) {
+	root := mkIgnoreContext(t, testDockerIgnore)
+	defer os.RemoveAll(root)
+
+	patterns, err := readDockerIgnore(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"node_modules", ".git", "*.log", "src/*.log", "Dockerfile"}
+	if !reflect.DeepEqual(patterns, expected) {
+		t.Fatalf("Expected patterns %v, found %v", expected, patterns)
+	}
+
+	excluded, err := excludedPaths(root, patterns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(excluded)
+	expected = []string{".git", "debug.log", "node_modules", "src/app.log"}
+	if !reflect.DeepEqual(excluded, expected) {
+		t.Fatalf("Expected %v to be excluded, found %v", expected, excluded)
+	}
+
+	if err := ioutil.WriteFile(path.Join(root, dockerIgnoreFile), []byte("[a-"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readDockerIgnore(root); err == nil {
+		t.Fatal("Expected an error for an invalid pattern")
+	}
+}
+
+func TestTarContext(t *testing.T) {
+	root := mkIgnoreContext(t, testDockerIgnore)
+	defer os.RemoveAll(root)
+
+	context, err := TarContext(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dest, err := ioutil.TempDir("", "docker-test-dockerignore-dest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dest)
+	if err := Untar(context, dest); err != nil {
+		t.Fatal(err)
+	}
+	if files := listFiles(t, dest); !reflect.DeepEqual(files, testContextKept) {
+		t.Fatalf("Expected %v in the context, found %v", testContextKept, files)
+	}
+}
+
+func TestRemoveExcluded(t *testing.T) {
+	root := mkIgnoreContext(t, testDockerIgnore)
+	defer os.RemoveAll(root)
+
+	if err := removeExcluded(root); err != nil {
+		t.Fatal(err)
+	}
+	if files := listFiles(t, root); !reflect.DeepEqual(files, testContextKept) {
+		t.Fatalf("Expected %v in the context, found %v", testContextKept, files)
+	}
+}
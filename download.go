@@ -0,0 +1,186 @@
+package docker
+
+import (
+	"fmt"
+	"github.com/dotcloud/docker/registry"
+	"github.com/dotcloud/docker/utils"
+	"io"
+	"os"
+	"path"
+	"time"
+)
+
+// maxLayerRetries is how many times an interrupted layer download is resumed
+// before giving up.
+const maxLayerRetries = 5
+
+// Delay before the first retry, increased on each attempt
+var layerRetryDelay = time.Second
+
+var errDownloadAborted = fmt.Errorf("Download aborted")
+
+// resumableReader reads a layer returned by `fetch` from `offset`, and
+// resumes from where it stopped with a new request when the connection
+// breaks. Reads fail once `abort` is closed.
+type resumableReader struct {
+	fetch    func(offset int64) (io.ReadCloser, error)
+	offset   int64
+	abort    <-chan struct{}
+	body     io.ReadCloser
+	retries  int
+	resuming bool
+}
+
+func (r *resumableReader) Read(p []byte) (int, error) {
+	select {
+	case <-r.abort:
+		return 0, errDownloadAborted
+	default:
+	}
+	if r.body == nil {
+		body, err := r.fetch(r.offset)
+		if err != nil {
+			if !r.resuming || err == registry.ErrCannotResume {
+				// The registry can't serve the layer at all, or not from
+				// where it stopped
+				return 0, err
+			}
+			return 0, r.retry(err)
+		}
+		r.body = body
+	}
+	n, err := r.body.Read(p)
+	r.offset += int64(n)
+	if err != nil && err != io.EOF {
+		r.body.Close()
+		r.body = nil
+		r.resuming = true
+		return n, r.retry(err)
+	}
+	return n, err
+}
+
+// retry returns nil if the download can be resumed, and err otherwise.
+func (r *resumableReader) retry(err error) error {
+	if r.retries >= maxLayerRetries {
+		return err
+	}
+	r.retries++
+	utils.Debugf("Layer download interrupted at %d bytes: %s. Resuming (%d/%d)", r.offset, err, r.retries, maxLayerRetries)
+	select {
+	case <-r.abort:
+		return errDownloadAborted
+	case <-time.After(time.Duration(r.retries) * layerRetryDelay):
+	}
+	return nil
+}
+
+func (r *resumableReader) Close() error {
+	if r.body == nil {
+		return nil
+	}
+	return r.body.Close()
+}
+
+// layerDownload is a layer of an image being pulled.
+// `done` is closed once the layer is downloaded and verified, or `err` is set.
+type layerDownload struct {
+	id       string
+	img      *Image
+	jsonData []byte
+	layer    *TempArchive
+	err      error
+	done     chan struct{}
+}
+
+// downloadSlots returns the semaphore limiting the number of layers pulled
+// at the same time, across all pulls.
+func (srv *Server) downloadSlots() chan struct{} {
+	srv.Lock()
+	defer srv.Unlock()
+	if srv.layerSlots == nil {
+		srv.layerSlots = make(chan struct{}, srv.runtime.config.MaxConcurrentDownloads)
+	}
+	return srv.layerSlots
+}
+
+// pullLayer downloads the json and the layer of d.id into the temporary
+// directory of the graph, resuming what an earlier pull left there.
+func (srv *Server) pullLayer(d *layerDownload, r *registry.Registry, out io.Writer, endpoint string, token []string, checksum string, sf *utils.StreamFormatter, abort <-chan struct{}) {
+	defer close(d.done)
+	slots := srv.downloadSlots()
+	select {
+	case slots <- struct{}{}:
+		defer func() { <-slots }()
+	case <-abort:
+		d.err = errDownloadAborted
+		return
+	}
+
+	id := d.id
+	out.Write(sf.FormatProgress(utils.TruncateID(id), "Pulling", "metadata"))
+	imgJSON, imgSize, err := r.GetRemoteImageJSON(id, endpoint, token)
+	if err != nil {
+		out.Write(sf.FormatProgress(utils.TruncateID(id), "Error", "pulling dependend layers"))
+		d.err = err
+		return
+	}
+	img, err := NewImgJSON(imgJSON)
+	if err != nil {
+		out.Write(sf.FormatProgress(utils.TruncateID(id), "Error", "pulling dependend layers"))
+		d.err = fmt.Errorf("Failed to parse json: %s", err)
+		return
+	}
+	if err := ValidateID(img.ID); err != nil {
+		d.err = err
+		return
+	}
+	tmp, err := srv.runtime.graph.tmp()
+	if err != nil {
+		d.err = err
+		return
+	}
+
+	// What an interrupted pull of the layer left
+	partial := path.Join(tmp.Root, img.ID+".partial")
+	var offset int64
+	if st, err := os.Stat(partial); err == nil {
+		offset = st.Size()
+		out.Write(sf.FormatProgress(utils.TruncateID(id), "Resuming", fmt.Sprintf("fs layer from %s", utils.HumanSize(offset))))
+	} else {
+		out.Write(sf.FormatProgress(utils.TruncateID(id), "Pulling", "fs layer"))
+	}
+	download := func(offset int64) (*TempArchive, error) {
+		layer := &resumableReader{
+			fetch: func(offset int64) (io.ReadCloser, error) {
+				return r.GetRemoteImageLayerFrom(img.ID, endpoint, token, offset)
+			},
+			offset: offset,
+			abort:  abort,
+		}
+		defer layer.Close()
+		progress := utils.ResumedProgressReader(layer, int(offset), imgSize, out, sf.FormatProgress(utils.TruncateID(id), "Downloading", "%8v/%v (%v)"), sf, false)
+		return downloadLayer(img.ID, progress, imgJSON, checksum, partial)
+	}
+	layerFile, err := download(offset)
+	if err == registry.ErrCannotResume {
+		// What was downloaded so far can't be trusted
+		utils.Debugf("Unable to resume the download of layer %s, starting over", img.ID)
+		os.Remove(partial)
+		out.Write(sf.FormatProgress(utils.TruncateID(id), "Pulling", "fs layer"))
+		layerFile, err = download(0)
+	}
+	if err != nil {
+		if _, ok := err.(*ChecksumError); ok {
+			out.Write(sf.FormatProgress(utils.TruncateID(id), "Error", "verifying checksum"))
+		} else if err != errDownloadAborted {
+			out.Write(sf.FormatProgress(utils.TruncateID(id), "Error", "downloading dependend layers"))
+		}
+		d.err = err
+		return
+	}
+	if checksum != "" {
+		out.Write(sf.FormatProgress(utils.TruncateID(id), "Verified", "checksum"))
+	}
+	d.img, d.jsonData, d.layer = img, imgJSON, layerFile
+}
@@ -0,0 +1,89 @@
+package docker
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/dotcloud/docker/registry"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+// brokenReader fails after returning `n` bytes
+type brokenReader struct {
+	io.Reader
+	n int
+}
+
+func (r *brokenReader) Read(p []byte) (int, error) {
+	if r.n <= 0 {
+		return 0, fmt.Errorf("connection reset by peer")
+	}
+	if len(p) > r.n {
+		p = p[:r.n]
+	}
+	n, err := r.Reader.Read(p)
+	r.n -= n
+	return n, err
+}
+
+func TestResumableReader(t *testing.T) {
+	defer func(delay time.Duration) { layerRetryDelay = delay }(layerRetryDelay)
+	layerRetryDelay = time.Millisecond
+
+	layer := bytes.Repeat([]byte("0123456789"), 100)
+	var offsets []int64
+	fetch := func(offset int64) (io.ReadCloser, error) {
+		offsets = append(offsets, offset)
+		// Each connection breaks after 350 bytes
+		return ioutil.NopCloser(&brokenReader{bytes.NewReader(layer[offset:]), 350}), nil
+	}
+
+	data, err := ioutil.ReadAll(&resumableReader{fetch: fetch, offset: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, layer[100:]) {
+		t.Fatalf("Expected %d bytes of the layer from byte 100, got %d", len(layer)-100, len(data))
+	}
+	if fmt.Sprint(offsets) != "[100 450 800]" {
+		t.Fatalf("Expected the download to resume at bytes 450 and 800, got %v", offsets)
+	}
+
+	// Give up after maxLayerRetries
+	offsets = nil
+	fetch = func(offset int64) (io.ReadCloser, error) {
+		offsets = append(offsets, offset)
+		return ioutil.NopCloser(&brokenReader{bytes.NewReader(layer[offset:]), 1}), nil
+	}
+	if _, err := ioutil.ReadAll(&resumableReader{fetch: fetch}); err == nil {
+		t.Fatal("Expected an error")
+	}
+	if len(offsets) != maxLayerRetries+1 {
+		t.Fatalf("Expected %d requests, got %d", maxLayerRetries+1, len(offsets))
+	}
+
+	// The registry can't resume the download
+	offsets = nil
+	fetch = func(offset int64) (io.ReadCloser, error) {
+		offsets = append(offsets, offset)
+		if offset > 0 {
+			return nil, registry.ErrCannotResume
+		}
+		return ioutil.NopCloser(&brokenReader{bytes.NewReader(layer), 350}), nil
+	}
+	if _, err := ioutil.ReadAll(&resumableReader{fetch: fetch}); err != registry.ErrCannotResume {
+		t.Fatalf("Expected %s, got %v", registry.ErrCannotResume, err)
+	}
+	if fmt.Sprint(offsets) != "[0 350]" {
+		t.Fatalf("Expected no retry once the download can't be resumed, got %v", offsets)
+	}
+
+	// Stop on abort
+	abort := make(chan struct{})
+	close(abort)
+	if _, err := ioutil.ReadAll(&resumableReader{fetch: fetch, abort: abort}); err != errDownloadAborted {
+		t.Fatalf("Expected errDownloadAborted, got %v", err)
+	}
+}
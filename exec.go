@@ -0,0 +1,245 @@
+package docker
+
+import (
+	"fmt"
+	"github.com/dotcloud/docker/term"
+	"github.com/dotcloud/docker/utils"
+	"github.com/kr/pty"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"sync"
+	"syscall"
+)
+
+// ExecConfig describes a process to run in a running container.
+type ExecConfig struct {
+	User         string // Defaults to the user of the container
+	Tty          bool
+	AttachStdin  bool
+	AttachStdout bool
+	AttachStderr bool
+	Cmd          []string
+}
+
+// ExecCommand is a process run with `docker exec` in a running container.
+// It is created first, so that clients know its ID before it runs, then
+// started by a hijacked request like attach.
+type ExecCommand struct {
+	lock        sync.Mutex
+	ID          string
+	ContainerID string
+	Config      ExecConfig
+	Running     bool
+	ExitCode    int
+
+	started   bool
+	ptyMaster *os.File
+	// Size requested before the pty was allocated
+	height, width int
+}
+
+// execCommands keeps the exec commands of the containers of a runtime,
+// until the containers are destroyed.
+type execCommands struct {
+	sync.Mutex
+	commands map[string]*ExecCommand
+}
+
+func newExecCommands() *execCommands {
+	return &execCommands{commands: make(map[string]*ExecCommand)}
+}
+
+func (e *execCommands) Add(command *ExecCommand) {
+	e.Lock()
+	e.commands[command.ID] = command
+	e.Unlock()
+}
+
+func (e *execCommands) Get(id string) *ExecCommand {
+	e.Lock()
+	defer e.Unlock()
+	return e.commands[id]
+}
+
+// Forget drops the exec commands of a container
+func (e *execCommands) Forget(containerID string) {
+	e.Lock()
+	defer e.Unlock()
+	for id, command := range e.commands {
+		if command.ContainerID == containerID {
+			delete(e.commands, id)
+		}
+	}
+}
+
+// dockerinitArgs returns the arguments of dockerinit to run the command
+// as the user and in the working directory of the container.
+func (command *ExecCommand) dockerinitArgs(container *Container) []string {
+	args := []string{"-exec"}
+	if container.Config.Privileged {
+		args = append(args, "-privileged")
+	}
+	user := command.Config.User
+	if user == "" {
+		user = container.Config.User
+	}
+	if user != "" {
+		args = append(args, "-u", user)
+	}
+	if container.Config.WorkingDir != "" {
+		args = append(args, "-w", container.Config.WorkingDir)
+	}
+	args = append(args, "--")
+	return append(args, command.Config.Cmd...)
+}
+
+// Run starts the command in `container` with its execution driver, copies
+// its standard streams from and to the given ones, and waits for it to exit.
+func (command *ExecCommand) Run(container *Container, stdin io.ReadCloser, stdout, stderr io.Writer) error {
+	command.lock.Lock()
+	if command.started {
+		command.lock.Unlock()
+		return fmt.Errorf("Impossible to start exec command %s twice", command.ID)
+	}
+	command.started = true
+	command.lock.Unlock()
+
+	if !container.State.Running {
+		return fmt.Errorf("Impossible to exec in a stopped container, start it first")
+	}
+	driver, err := container.execDriver()
+	if err != nil {
+		return err
+	}
+	if !command.Config.AttachStdin {
+		stdin = nil
+	}
+	if !command.Config.AttachStdout {
+		stdout = nil
+	}
+	if !command.Config.AttachStderr {
+		stderr = nil
+	}
+
+	var (
+		cmd    *exec.Cmd
+		copies sync.WaitGroup
+	)
+	err = driver.Exec(container, command.dockerinitArgs(container), func(c *exec.Cmd) error {
+		cmd = c
+		if command.Config.Tty {
+			return command.startPty(cmd, stdin, stdout, &copies)
+		}
+		return command.start(cmd, stdin, stdout, stderr)
+	})
+	if err != nil {
+		return err
+	}
+	command.lock.Lock()
+	command.Running = true
+	command.lock.Unlock()
+	utils.Debugf("exec: command %s started in container %s", command.ID, container.ID)
+
+	if err := cmd.Wait(); err != nil {
+		utils.Debugf("exec: cmd.Wait reported exit status %s for command %s", err, command.ID)
+	}
+	copies.Wait()
+
+	command.lock.Lock()
+	command.Running = false
+	command.ExitCode = cmd.ProcessState.Sys().(syscall.WaitStatus).ExitStatus()
+	if command.ptyMaster != nil {
+		command.ptyMaster.Close()
+	}
+	command.lock.Unlock()
+	return nil
+}
+
+func (command *ExecCommand) start(cmd *exec.Cmd, stdin io.ReadCloser, stdout, stderr io.Writer) error {
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	if stdin != nil {
+		// Don't let cmd.Wait wait for the client to close stdin
+		pipe, err := cmd.StdinPipe()
+		if err != nil {
+			return err
+		}
+		go func() {
+			defer pipe.Close()
+			io.Copy(pipe, stdin)
+			utils.Debugf("exec: end of stdin pipe")
+		}()
+	}
+	return cmd.Start()
+}
+
+func (command *ExecCommand) startPty(cmd *exec.Cmd, stdin io.ReadCloser, stdout io.Writer, copies *sync.WaitGroup) error {
+	ptyMaster, ptySlave, err := pty.Open()
+	if err != nil {
+		return err
+	}
+	defer ptySlave.Close()
+
+	command.lock.Lock()
+	command.ptyMaster = ptyMaster
+	if command.height != 0 || command.width != 0 {
+		term.SetWinsize(ptyMaster.Fd(), &term.Winsize{Height: uint16(command.height), Width: uint16(command.width)})
+	}
+	command.lock.Unlock()
+
+	cmd.Stdin = ptySlave
+	cmd.Stdout = ptySlave
+	cmd.Stderr = ptySlave
+	cmd.SysProcAttr.Setctty = true
+
+	if stdout == nil {
+		// The command would block once the pty buffer is full
+		stdout = ioutil.Discard
+	}
+	copies.Add(1)
+	go func() {
+		defer copies.Done()
+		io.Copy(stdout, ptyMaster)
+		utils.Debugf("exec: end of stdout pipe")
+	}()
+	if stdin != nil {
+		go func() {
+			io.Copy(ptyMaster, stdin)
+			utils.Debugf("exec: end of stdin pipe")
+		}()
+	}
+	if err := cmd.Start(); err != nil {
+		ptyMaster.Close()
+		return err
+	}
+	return nil
+}
+
+// Inspect returns the current state of the command
+func (command *ExecCommand) Inspect() *APIExec {
+	command.lock.Lock()
+	defer command.lock.Unlock()
+	return &APIExec{
+		ID:          command.ID,
+		ContainerID: command.ContainerID,
+		Config:      command.Config,
+		Running:     command.Running,
+		ExitCode:    command.ExitCode,
+	}
+}
+
+func (command *ExecCommand) Resize(h, w int) error {
+	command.lock.Lock()
+	defer command.lock.Unlock()
+	if !command.Config.Tty {
+		return fmt.Errorf("Impossible to resize exec command %s: it has no tty", command.ID)
+	}
+	if command.ptyMaster == nil {
+		// Applied once the command starts
+		command.height, command.width = h, w
+		return nil
+	}
+	return term.SetWinsize(command.ptyMaster.Fd(), &term.Winsize{Height: uint16(h), Width: uint16(w)})
+}
@@ -0,0 +1,61 @@
+package docker
+
+import (
+	"fmt"
+	"os/exec"
+)
+
+// An ExecDriver runs the process of a container in an isolated environment.
+type ExecDriver interface {
+	// String returns the name of the driver, as passed to the -e flag.
+	String() string
+
+	// Start builds the command running dockerinit with `args` inside the
+	// container, and hands it to `launch` which sets up its standard
+	// streams and launches it. Once the driver has set up the container
+	// around the process, it calls `running`, which records the container
+	// as running and monitors it. If the setup fails before, the driver
+	// kills and reaps the process itself: the container was never running.
+	// Start returns once the container is running.
+	Start(container *Container, hostConfig *HostConfig, args []string, launch func(*exec.Cmd) error, running func()) error
+	// Exec builds the command running dockerinit with `args` in the
+	// namespaces and cgroups of a running container, and hands it to `start`.
+	Exec(container *Container, args []string, start func(*exec.Cmd) error) error
+	// Kill sends the signal `sig` to the container's process.
+	Kill(container *Container, sig int) error
+	// Running returns true if the process of a container started by a
+	// previous instance of the daemon is still alive.
+	Running(container *Container) (bool, error)
+	// InitPid returns the pid, on the host, of the first process inside
+	// the running container, whose namespaces are the container's.
+	InitPid(container *Container) (int, error)
+	// CgroupPath returns the directory of the cgroup of the container in
+	// the hierarchy of `subsystem`.
+	CgroupPath(container *Container, subsystem string) (string, error)
+	// Cleanup releases the resources held for the container once its
+	// process has exited.
+	Cleanup(container *Container) error
+}
+
+// DefaultExecDriver is used to run containers unless the daemon is told otherwise.
+const DefaultExecDriver = "lxc"
+
+type execDriverInitFunc func() (ExecDriver, error)
+
+var execDrivers = make(map[string]execDriverInitFunc)
+
+func registerExecDriver(name string, initFunc execDriverInitFunc) {
+	if _, exists := execDrivers[name]; exists {
+		panic(fmt.Sprintf("Execution driver %s registered twice", name))
+	}
+	execDrivers[name] = initFunc
+}
+
+// NewExecDriver returns the execution driver named `name`.
+func NewExecDriver(name string) (ExecDriver, error) {
+	initFunc, exists := execDrivers[name]
+	if !exists {
+		return nil, fmt.Errorf("No such execution driver: %s", name)
+	}
+	return initFunc()
+}
@@ -0,0 +1,151 @@
+package docker
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/dotcloud/docker/utils"
+	"log"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+func init() {
+	registerExecDriver("lxc", newLxcDriver)
+}
+
+// lxcDriver runs containers with the LXC userland tools, configured by the
+// template in lxc_template.go.
+type lxcDriver struct{}
+
+func newLxcDriver() (ExecDriver, error) {
+	return &lxcDriver{}, nil
+}
+
+func (d *lxcDriver) String() string {
+	return "lxc"
+}
+
+func (d *lxcDriver) Start(container *Container, hostConfig *HostConfig, args []string, launch func(*exec.Cmd) error, running func()) error {
+	if err := container.generateLXCConfig(hostConfig); err != nil {
+		return err
+	}
+
+	params := []string{
+		"-n", container.ID,
+		"-f", container.lxcConfigPath(),
+		"--",
+		"/.dockerinit",
+	}
+	params = append(params, args...)
+
+	cmd := exec.Command("lxc-start", params...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := launch(cmd); err != nil {
+		return err
+	}
+	// lxc-start sets up the container itself: it is monitored from now on,
+	// so that the loop below notices if it dies
+	running()
+
+	// We wait for the container to be fully running.
+	// Timeout after 5 seconds. In case of broken pipe, just retry.
+	// Note: The container can run and finish correctly before
+	//       the end of this loop
+	for now := time.Now(); time.Since(now) < 5*time.Second; {
+		// If the container dies while waiting for it, just return
+		if !container.State.Running {
+			return nil
+		}
+		output, err := exec.Command("lxc-info", "-s", "-n", container.ID).CombinedOutput()
+		if err != nil {
+			utils.Debugf("Error with lxc-info: %s (%s)", err, output)
+
+			output, err = exec.Command("lxc-info", "-s", "-n", container.ID).CombinedOutput()
+			if err != nil {
+				utils.Debugf("Second Error with lxc-info: %s (%s)", err, output)
+				return err
+			}
+
+		}
+		if strings.Contains(string(output), "RUNNING") {
+			return nil
+		}
+		utils.Debugf("Waiting for the container to start (running: %v): %s", container.State.Running, bytes.TrimSpace(output))
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	if container.State.Running {
+		return ErrContainerStartTimeout
+	}
+	return ErrContainerStart
+}
+
+func (d *lxcDriver) Exec(container *Container, args []string, start func(*exec.Cmd) error) error {
+	params := []string{
+		"-n", container.ID,
+		"--",
+		"/.dockerinit",
+	}
+	params = append(params, args...)
+
+	cmd := exec.Command("lxc-attach", params...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	return start(cmd)
+}
+
+func (d *lxcDriver) Kill(container *Container, sig int) error {
+	if output, err := exec.Command("lxc-kill", "-n", container.ID, strconv.Itoa(sig)).CombinedOutput(); err != nil {
+		log.Printf("error killing container %s (%s, %s)", container.ShortID(), output, err)
+		return err
+	}
+	return nil
+}
+
+func (d *lxcDriver) Running(container *Container) (bool, error) {
+	output, err := exec.Command("lxc-info", "-n", container.ID).CombinedOutput()
+	if err != nil {
+		return false, err
+	}
+	return strings.Contains(string(output), "RUNNING"), nil
+}
+
+// InitPid asks lxc for the pid of the init of the container, since the pid
+// recorded in its state is the one of lxc-start.
+func (d *lxcDriver) InitPid(container *Container) (int, error) {
+	output, err := exec.Command("lxc-info", "-p", "-n", container.ID).CombinedOutput()
+	if err != nil {
+		return 0, fmt.Errorf("lxc-info: %s (%s)", err, bytes.TrimSpace(output))
+	}
+	// "pid: 1234", or "PID: 1234" with older versions
+	fields := strings.Fields(string(output))
+	if len(fields) == 0 {
+		return 0, fmt.Errorf("No process for container %s", container.ShortID())
+	}
+	pid, err := strconv.Atoi(fields[len(fields)-1])
+	if err != nil {
+		return 0, fmt.Errorf("Unable to parse the output of lxc-info: %s", bytes.TrimSpace(output))
+	}
+	return pid, nil
+}
+
+// CgroupPath follows lxc-start, which creates the cgroup of the container
+// under the cgroup it runs in itself, i.e. the cgroup of the daemon.
+func (d *lxcDriver) CgroupPath(container *Container, subsystem string) (string, error) {
+	mountpoint, err := utils.FindCgroupMountpoint(subsystem)
+	if err != nil {
+		return "", err
+	}
+	parent, err := utils.GetThisCgroupDir(subsystem)
+	if err != nil {
+		return "", err
+	}
+	return path.Join(mountpoint, parent, "lxc", container.ID), nil
+}
+
+func (d *lxcDriver) Cleanup(container *Container) error {
+	return nil
+}
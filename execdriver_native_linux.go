@@ -0,0 +1,377 @@
+package docker
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"github.com/dotcloud/docker/sysinit"
+	"github.com/dotcloud/docker/utils"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+func init() {
+	registerExecDriver("native", newNativeDriver)
+}
+
+// nativeDriver runs containers without any external tool: the process is
+// cloned into new namespaces, and dockerinit sets up the rootfs, network
+// interfaces and capabilities from the inside before running the command.
+// Cgroups and the host side of the network are set up by the driver.
+type nativeDriver struct{}
+
+// Cgroup subsystems joined by the containers, when they are mounted
+var nativeCgroupSubsystems = []string{"memory", "cpu", "cpuacct", "devices", "freezer", "blkio"}
+
+// Devices unprivileged containers are allowed to use, like in the lxc template
+var nativeAllowedDevices = []string{
+	"c 1:3 rwm",    // /dev/null
+	"c 1:5 rwm",    // /dev/zero
+	"c 5:1 rwm",    // consoles
+	"c 5:0 rwm",    //
+	"c 4:0 rwm",    //
+	"c 4:1 rwm",    //
+	"c 1:9 rwm",    // /dev/urandom
+	"c 1:8 rwm",    // /dev/random
+	"c 136:* rwm",  // /dev/pts/*
+	"c 5:2 rwm",    // /dev/ptmx
+	"c 10:200 rwm", // tuntap
+}
+
+func newNativeDriver() (ExecDriver, error) {
+	return &nativeDriver{}, nil
+}
+
+func (d *nativeDriver) String() string {
+	return "native"
+}
+
+func (d *nativeDriver) configPath(container *Container) string {
+	return path.Join(container.root, "config.native.json")
+}
+
+func (d *nativeDriver) Start(container *Container, hostConfig *HostConfig, args []string, launch func(*exec.Cmd) error, running func()) error {
+	if hostConfig != nil && len(hostConfig.LxcConf) > 0 {
+		utils.Errorf("Warning: the native execution driver ignores lxc configuration options")
+	}
+
+	config, endpoints := d.config(container)
+	data, err := json.Marshal(config)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(d.configPath(container), data, 0600); err != nil {
+		return err
+	}
+
+	// dockerinit waits for the write end of the pipe to be closed
+	// before setting up the container
+	syncR, syncW, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer syncW.Close()
+
+	params := append([]string{"-driver", "native", "-config", d.configPath(container)}, args...)
+	cmd := exec.Command(container.SysInitPath, params...)
+	cmd.Args[0] = "/.dockerinit"
+	cmd.ExtraFiles = []*os.File{syncR}
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Setsid:     true,
+		Cloneflags: syscall.CLONE_NEWNS | syscall.CLONE_NEWUTS | syscall.CLONE_NEWIPC | syscall.CLONE_NEWPID | syscall.CLONE_NEWNET,
+	}
+	err = launch(cmd)
+	syncR.Close()
+	if err != nil {
+		return err
+	}
+
+	// The process waits for syncW to be closed: it is only running once its
+	// cgroups and interfaces are set up
+	if err := d.setup(container, cmd.Process.Pid, endpoints); err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		d.Cleanup(container)
+		return err
+	}
+	running()
+	return nil
+}
+
+// setup moves the process `pid` into the cgroups of the container, and
+// gives it the interfaces of `endpoints`.
+func (d *nativeDriver) setup(container *Container, pid int, endpoints []*EndpointSettings) error {
+	if err := d.setupCgroups(container, pid); err != nil {
+		return err
+	}
+	for _, endpoint := range endpoints {
+		if err := createVeth(endpoint.Bridge, endpoint.HostVeth, vethPeerName(endpoint.HostVeth), pid); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// config returns the configuration of the container passed to dockerinit,
+// and the endpoints whose veth pair the driver creates.
+func (d *nativeDriver) config(container *Container) (*sysinit.NativeConfig, []*EndpointSettings) {
+	config := &sysinit.NativeConfig{
+		Rootfs:     container.RootfsPath(),
+		Hostname:   container.Config.Hostname,
+		Privileged: container.Config.Privileged,
+		Mounts:     d.mounts(container),
+	}
+	var endpoints []*EndpointSettings
+	if !container.Config.NetworkDisabled {
+		config.Network = &sysinit.NativeNetwork{
+			Name:          "eth0",
+			Interface:     vethPeerName(container.NetworkSettings.HostVeth),
+			IPAddress:     container.NetworkSettings.IPAddress,
+			IPPrefixLen:   container.NetworkSettings.IPPrefixLen,
+			IPv6Address:   container.NetworkSettings.IPv6Address,
+			IPv6PrefixLen: container.NetworkSettings.IPv6PrefixLen,
+			MacAddress:    container.NetworkSettings.MacAddress,
+			Mtu:           1500,
+		}
+		endpoints = append(endpoints, &EndpointSettings{
+			Bridge:   container.NetworkSettings.Bridge,
+			HostVeth: container.NetworkSettings.HostVeth,
+		})
+		for _, endpoint := range container.NetworkSettings.ExtraEndpoints() {
+			config.ExtraNetworks = append(config.ExtraNetworks, &sysinit.NativeNetwork{
+				Name:          endpoint.Interface,
+				Interface:     vethPeerName(endpoint.HostVeth),
+				IPAddress:     endpoint.IPAddress,
+				IPPrefixLen:   endpoint.IPPrefixLen,
+				IPv6Address:   endpoint.IPv6Address,
+				IPv6PrefixLen: endpoint.IPv6PrefixLen,
+				Mtu:           1500,
+			})
+			endpoints = append(endpoints, endpoint)
+		}
+	}
+	return config, endpoints
+}
+
+// mounts returns the bind mounts of the container, like the lxc.mount.entry
+// lines of the lxc template.
+func (d *nativeDriver) mounts(container *Container) []sysinit.NativeMount {
+	var mounts []sysinit.NativeMount
+	if container.HostnamePath != "" && container.HostsPath != "" {
+		mounts = append(mounts,
+			sysinit.NativeMount{Source: container.HostnamePath, Destination: "/etc/hostname"},
+			sysinit.NativeMount{Source: container.HostsPath, Destination: "/etc/hosts"},
+		)
+	}
+	mounts = append(mounts,
+		sysinit.NativeMount{Source: container.SysInitPath, Destination: "/.dockerinit"},
+		sysinit.NativeMount{Source: container.EnvConfigPath(), Destination: "/.dockerenv"},
+		sysinit.NativeMount{Source: container.ResolvConfPath, Destination: "/etc/resolv.conf"},
+	)
+	for virtualPath, realPath := range container.Volumes {
+		mounts = append(mounts, sysinit.NativeMount{
+			Source:      realPath,
+			Destination: virtualPath,
+			Writable:    container.VolumesRW[virtualPath],
+		})
+	}
+	return mounts
+}
+
+func nativeCgroupPath(subsystem, id string) (string, error) {
+	mountpoint, err := utils.FindCgroupMountpoint(subsystem)
+	if err != nil {
+		return "", err
+	}
+	return path.Join(mountpoint, "docker", id), nil
+}
+
+func writeCgroupFile(dir, file, value string) error {
+	if err := ioutil.WriteFile(path.Join(dir, file), []byte(value), 0700); err != nil {
+		return fmt.Errorf("Unable to write %s to %s: %s", value, path.Join(dir, file), err)
+	}
+	return nil
+}
+
+// setupCgroups creates the cgroups of the container, applies the
+// resource limits of its configuration, and moves the process into them.
+func (d *nativeDriver) setupCgroups(container *Container, pid int) error {
+	for _, subsystem := range nativeCgroupSubsystems {
+		dir, err := nativeCgroupPath(subsystem, container.ID)
+		if err != nil {
+			utils.Debugf("Skipping cgroup subsystem %s: %s", subsystem, err)
+			continue
+		}
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+		switch subsystem {
+		case "memory":
+			if container.Config.Memory > 0 {
+				memory := strconv.FormatInt(container.Config.Memory, 10)
+				if err := writeCgroupFile(dir, "memory.limit_in_bytes", memory); err != nil {
+					return err
+				}
+				if err := writeCgroupFile(dir, "memory.soft_limit_in_bytes", memory); err != nil {
+					return err
+				}
+				if memSwap := getMemorySwap(container.Config); memSwap > 0 && container.runtime.capabilities.SwapLimit {
+					if err := writeCgroupFile(dir, "memory.memsw.limit_in_bytes", strconv.FormatInt(memSwap, 10)); err != nil {
+						return err
+					}
+				}
+			}
+		case "cpu":
+			if container.Config.CpuShares > 0 {
+				if err := writeCgroupFile(dir, "cpu.shares", strconv.FormatInt(container.Config.CpuShares, 10)); err != nil {
+					return err
+				}
+			}
+		case "devices":
+			if !container.Config.Privileged {
+				if err := writeCgroupFile(dir, "devices.deny", "a"); err != nil {
+					return err
+				}
+				for _, device := range nativeAllowedDevices {
+					if err := writeCgroupFile(dir, "devices.allow", device); err != nil {
+						return err
+					}
+				}
+			}
+		}
+		if err := writeCgroupFile(dir, "tasks", strconv.Itoa(pid)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *nativeDriver) Exec(container *Container, args []string, start func(*exec.Cmd) error) error {
+	var cgroups []string
+	for _, subsystem := range nativeCgroupSubsystems {
+		if dir, err := nativeCgroupPath(subsystem, container.ID); err == nil {
+			cgroups = append(cgroups, dir)
+		}
+	}
+	// dockerinit joins the cgroups on the host, then enters the container
+	// and runs itself again with `args`
+	params := []string{
+		"-enter", strconv.Itoa(container.State.Pid),
+		"-cgroups", strings.Join(cgroups, ":"),
+		"--",
+		"-driver", "native",
+	}
+	params = append(params, args...)
+
+	cmd := exec.Command(container.SysInitPath, params...)
+	cmd.Args[0] = "/.dockerinit"
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	return start(cmd)
+}
+
+func (d *nativeDriver) Kill(container *Container, sig int) error {
+	if container.State.Pid == 0 {
+		return fmt.Errorf("No process to kill for container %s", container.ShortID())
+	}
+	return syscall.Kill(container.State.Pid, syscall.Signal(sig))
+}
+
+// Running checks that the pid recorded for the container still belongs to a
+// process of its cgroup, and not to an unrelated process which reused it.
+func (d *nativeDriver) Running(container *Container) (bool, error) {
+	if container.State.Pid == 0 {
+		return false, nil
+	}
+	content, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/cgroup", container.State.Pid))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return strings.Contains(string(content), "/docker/"+container.ID), nil
+}
+
+func (d *nativeDriver) InitPid(container *Container) (int, error) {
+	if container.State.Pid == 0 {
+		return 0, fmt.Errorf("No process for container %s", container.ShortID())
+	}
+	return container.State.Pid, nil
+}
+
+func (d *nativeDriver) CgroupPath(container *Container, subsystem string) (string, error) {
+	return nativeCgroupPath(subsystem, container.ID)
+}
+
+// Cleanup removes the cgroups of the container. The veth pair disappears
+// with the network namespace.
+func (d *nativeDriver) Cleanup(container *Container) error {
+	for _, subsystem := range nativeCgroupSubsystems {
+		dir, err := nativeCgroupPath(subsystem, container.ID)
+		if err != nil {
+			continue
+		}
+		if err := os.Remove(dir); err != nil && !os.IsNotExist(err) {
+			utils.Debugf("Unable to remove cgroup %s: %s", dir, err)
+		}
+	}
+	return nil
+}
+
+// nativeTop runs ps on the host and keeps the processes which belong to the
+// cgroup of the container, since there is no lxc-ps to do it for us.
+func nativeTop(container *Container, psArgs string) (*APITop, error) {
+	dir, err := nativeCgroupPath("freezer", container.ID)
+	if err != nil {
+		return nil, err
+	}
+	tasks, err := ioutil.ReadFile(path.Join(dir, "tasks"))
+	if err != nil {
+		return nil, err
+	}
+	pids := make(map[string]bool)
+	for _, pid := range strings.Fields(string(tasks)) {
+		pids[pid] = true
+	}
+
+	args := []string{}
+	if psArgs != "" {
+		args = append(args, psArgs)
+	}
+	output, err := exec.Command("ps", args...).CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("ps: %s (%s)", err, output)
+	}
+	procs := &APITop{}
+	pidColumn := -1
+	for i, line := range strings.Split(string(output), "\n") {
+		if len(line) == 0 {
+			continue
+		}
+		words := []string{}
+		scanner := bufio.NewScanner(strings.NewReader(line))
+		scanner.Split(bufio.ScanWords)
+		for scanner.Scan() {
+			words = append(words, scanner.Text())
+		}
+		if i == 0 {
+			for j, title := range words {
+				if title == "PID" {
+					pidColumn = j
+				}
+			}
+			if pidColumn == -1 {
+				return nil, fmt.Errorf("Couldn't find the PID column in the output of ps")
+			}
+			procs.Titles = words
+		} else if len(words) > pidColumn && pids[words[pidColumn]] {
+			procs.Processes = append(procs.Processes, words)
+		}
+	}
+	return procs, nil
+}
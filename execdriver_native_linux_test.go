@@ -0,0 +1,67 @@
+package docker
+
+import (
+	"testing"
+)
+
+func TestNativeDriverConfig(t *testing.T) {
+	container := &Container{
+		root:           "/var/lib/docker/containers/foo",
+		rootfs:         "/var/lib/docker/containers/foo/rootfs",
+		SysInitPath:    "/usr/bin/dockerinit",
+		ResolvConfPath: "/var/lib/docker/containers/foo/resolv.conf",
+		HostnamePath:   "/var/lib/docker/containers/foo/hostname",
+		HostsPath:      "/var/lib/docker/containers/foo/hosts",
+		Config:         &Config{Hostname: "foo"},
+		Volumes:        map[string]string{"/data": "/srv/data", "/logs": "/srv/logs"},
+		VolumesRW:      map[string]bool{"/data": true},
+		NetworkSettings: &NetworkSettings{
+			IPAddress:   "172.17.0.2",
+			IPPrefixLen: 16,
+			MacAddress:  "02:42:ac:11:00:02",
+			Bridge:      "docker0",
+			HostVeth:    "vethfoo0",
+			Networks: map[string]*EndpointSettings{
+				DefaultNetworkName: {Interface: "eth0", IPAddress: "172.17.0.2", IPPrefixLen: 16, Bridge: "docker0", HostVeth: "vethfoo0"},
+				"back":             {Interface: "eth1", IPAddress: "10.1.0.2", IPPrefixLen: 24, Bridge: "br-back", HostVeth: "vethfoo1"},
+			},
+		},
+	}
+	d := &nativeDriver{}
+	config, endpoints := d.config(container)
+
+	if config.Rootfs != container.rootfs || config.Hostname != "foo" || config.Privileged {
+		t.Fatalf("Unexpected configuration: %#v", config)
+	}
+	mounts := make(map[string]bool)
+	for _, m := range config.Mounts {
+		mounts[m.Destination] = m.Writable
+	}
+	for _, destination := range []string{"/etc/hostname", "/etc/hosts", "/.dockerinit", "/.dockerenv", "/etc/resolv.conf", "/data", "/logs"} {
+		if _, exists := mounts[destination]; !exists {
+			t.Fatalf("Expected a mount on %s, got %v", destination, config.Mounts)
+		}
+	}
+	if !mounts["/data"] || mounts["/logs"] {
+		t.Fatalf("Expected only /data to be writable, got %v", mounts)
+	}
+
+	network := config.Network
+	if network == nil || network.Name != "eth0" || network.IPAddress != "172.17.0.2" || network.MacAddress != "02:42:ac:11:00:02" {
+		t.Fatalf("Unexpected network: %#v", network)
+	}
+	if network.Interface != vethPeerName("vethfoo0") {
+		t.Fatalf("Expected the peer of the host veth, got %s", network.Interface)
+	}
+	if len(config.ExtraNetworks) != 1 || config.ExtraNetworks[0].Name != "eth1" || config.ExtraNetworks[0].IPAddress != "10.1.0.2" {
+		t.Fatalf("Unexpected extra networks: %v", config.ExtraNetworks)
+	}
+	if len(endpoints) != 2 || endpoints[0].Bridge != "docker0" || endpoints[1].Bridge != "br-back" {
+		t.Fatalf("Expected a veth pair on each bridge, got %v", endpoints)
+	}
+
+	container.Config.NetworkDisabled = true
+	if config, endpoints := d.config(container); config.Network != nil || len(endpoints) != 0 {
+		t.Fatal("Expected no network when networking is disabled")
+	}
+}
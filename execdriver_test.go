@@ -0,0 +1,55 @@
+package docker
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNewExecDriver(t *testing.T) {
+	for _, name := range []string{"lxc", "native"} {
+		driver, err := NewExecDriver(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if driver.String() != name {
+			t.Fatalf("Expected the %s driver, got %s", name, driver)
+		}
+	}
+	if _, err := NewExecDriver("bogus"); err == nil || !strings.HasPrefix(err.Error(), "No such execution driver") {
+		t.Fatalf("Expected an unknown driver to be refused, got %v", err)
+	}
+}
+
+// Containers keep the driver they were started with, whatever the default
+func TestContainerExecDriver(t *testing.T) {
+	lxc, err := NewExecDriver("lxc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	native, err := NewExecDriver("native")
+	if err != nil {
+		t.Fatal(err)
+	}
+	runtime := &Runtime{
+		execDriver:  native,
+		execDrivers: map[string]ExecDriver{"lxc": lxc, "native": native},
+	}
+	for name, expected := range map[string]ExecDriver{
+		"":       lxc, // Started before the drivers existed
+		"lxc":    lxc,
+		"native": native,
+	} {
+		container := &Container{ExecDriver: name, runtime: runtime}
+		driver, err := container.execDriver()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if driver != expected {
+			t.Fatalf("Expected the %s driver for %q, got %s", expected, name, driver)
+		}
+	}
+	container := &Container{ExecDriver: "bogus", runtime: runtime}
+	if _, err := container.execDriver(); err == nil {
+		t.Fatal("Expected an error for a container started with an unknown driver")
+	}
+}
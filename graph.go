@@ -9,6 +9,7 @@ import (
 	"path"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -16,11 +17,17 @@ import (
 type Graph struct {
 	Root    string
 	idIndex *utils.TruncIndex
+	driver  GraphDriver
+
+	// The images being registered, closed when their Register returns
+	registerLock sync.Mutex
+	registering  map[string]chan struct{}
 }
 
 // NewGraph instantiates a new graph at the given root path in the filesystem.
-// `root` will be created if it doesn't exist.
-func NewGraph(root string) (*Graph, error) {
+// `root` will be created if it doesn't exist. The filesystem layers of the
+// images are stored by `driver`.
+func NewGraph(root string, driver GraphDriver) (*Graph, error) {
 	abspath, err := filepath.Abs(root)
 	if err != nil {
 		return nil, err
@@ -30,8 +37,10 @@ func NewGraph(root string) (*Graph, error) {
 		return nil, err
 	}
 	graph := &Graph{
-		Root:    abspath,
-		idIndex: utils.NewTruncIndex(),
+		Root:        abspath,
+		idIndex:     utils.NewTruncIndex(),
+		driver:      driver,
+		registering: make(map[string]chan struct{}),
 	}
 	if err := graph.restore(); err != nil {
 		return nil, err
@@ -86,7 +95,7 @@ func (graph *Graph) Get(name string) (*Image, error) {
 		if err != nil {
 			return nil, err
 		}
-		if err := StoreSize(img, root); err != nil {
+		if err := StoreSize(img, root, graph.driver); err != nil {
 			return nil, err
 		}
 	}
@@ -115,13 +124,39 @@ func (graph *Graph) Create(layerData Archive, container *Container, comment, aut
 	return img, nil
 }
 
+// lockRegister waits for the other Register of the image `id` to return,
+// as the layers of the driver are named after the images: two of them would
+// remove or fill each other's layer.
+func (graph *Graph) lockRegister(id string) {
+	for {
+		graph.registerLock.Lock()
+		done, exists := graph.registering[id]
+		if !exists {
+			graph.registering[id] = make(chan struct{})
+			graph.registerLock.Unlock()
+			return
+		}
+		graph.registerLock.Unlock()
+		<-done
+	}
+}
+
+func (graph *Graph) unlockRegister(id string) {
+	graph.registerLock.Lock()
+	close(graph.registering[id])
+	delete(graph.registering, id)
+	graph.registerLock.Unlock()
+}
+
 // Register imports a pre-existing image into the graph.
 // FIXME: pass img as first argument
 func (graph *Graph) Register(jsonData []byte, layerData Archive, img *Image) error {
 	if err := ValidateID(img.ID); err != nil {
 		return err
 	}
-	// (This is a convenience to save time. Race conditions are taken care of by os.Rename)
+	graph.lockRegister(img.ID)
+	defer graph.unlockRegister(img.ID)
+	// Checked once the previous Register of the image, if any, returned
 	if graph.Exists(img.ID) {
 		return fmt.Errorf("Image %s already exists", img.ID)
 	}
@@ -130,7 +165,19 @@ func (graph *Graph) Register(jsonData []byte, layerData Archive, img *Image) err
 	if err != nil {
 		return fmt.Errorf("Mktemp failed: %s", err)
 	}
-	if err := StoreImage(img, jsonData, layerData, tmp); err != nil {
+
+	// If the driver has this layer but the graph doesn't, it is a leftover
+	// of an interrupted Register: start fresh, the graph is the source of truth.
+	if graph.driver.Exists(img.ID) {
+		if err := graph.driver.Remove(img.ID); err != nil {
+			return fmt.Errorf("Driver %s failed to remove leftover layer %s: %s", graph.driver, img.ID, err)
+		}
+	}
+	if err := graph.driver.Create(img.ID, img.Parent); err != nil {
+		return fmt.Errorf("Driver %s failed to create image rootfs %s: %s", graph.driver, img.ID, err)
+	}
+	if err := StoreImage(img, jsonData, layerData, tmp, graph.driver); err != nil {
+		graph.driver.Remove(img.ID)
 		return err
 	}
 	// Commit
@@ -142,11 +189,71 @@ func (graph *Graph) Register(jsonData []byte, layerData Archive, img *Image) err
 	return nil
 }
 
+// migrateLegacyLayers imports into the driver the filesystem layers stored
+// in <root>/<id>/layer by versions of docker which predate storage drivers.
+// Parents are migrated before their children.
+func (graph *Graph) migrateLegacyLayers() error {
+	files, err := ioutil.ReadDir(graph.Root)
+	if err != nil {
+		return err
+	}
+	migrated := make(map[string]bool)
+	var migrate func(id string) error
+	migrate = func(id string) error {
+		if migrated[id] {
+			return nil
+		}
+		migrated[id] = true
+		legacy := layerPath(graph.imageRoot(id))
+		if _, err := os.Stat(legacy); err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		img, err := LoadImage(graph.imageRoot(id))
+		if err != nil {
+			return err
+		}
+		if img.Parent != "" {
+			if err := migrate(img.Parent); err != nil {
+				return err
+			}
+		}
+		utils.Debugf("Migrating image %s to the %s storage driver", id, graph.driver)
+		if graph.driver.Exists(id) {
+			if err := graph.driver.Remove(id); err != nil {
+				return err
+			}
+		}
+		if err := graph.driver.Create(id, img.Parent); err != nil {
+			return err
+		}
+		layerData, err := Tar(legacy, Uncompressed)
+		if err != nil {
+			return err
+		}
+		if err := graph.driver.ApplyDiff(id, layerData); err != nil {
+			return err
+		}
+		return os.RemoveAll(legacy)
+	}
+	for _, st := range files {
+		if !st.IsDir() || st.Name() == "_tmp" {
+			continue
+		}
+		if err := migrate(st.Name()); err != nil {
+			return fmt.Errorf("Error migrating image %s: %s", st.Name(), err)
+		}
+	}
+	return nil
+}
+
 // TempLayerArchive creates a temporary archive of the given image's filesystem layer.
 //   The archive is stored on disk and will be automatically deleted as soon as has been read.
 //   If output is not nil, a human-readable progress bar will be written to it.
 //   FIXME: does this belong in Graph? How about MktempFile, let the caller use it for archives?
-func (graph *Graph) TempLayerArchive(id string, compression Compression, sf *utils.StreamFormatter, output io.Writer) (*TempArchive, error) {
+func (graph *Graph) TempLayerArchive(id string, sf *utils.StreamFormatter, output io.Writer) (*TempArchive, error) {
 	image, err := graph.Get(id)
 	if err != nil {
 		return nil, err
@@ -155,7 +262,7 @@ func (graph *Graph) TempLayerArchive(id string, compression Compression, sf *uti
 	if err != nil {
 		return nil, err
 	}
-	archive, err := image.TarLayer(compression)
+	archive, err := image.TarLayer()
 	if err != nil {
 		return nil, err
 	}
@@ -177,24 +284,14 @@ func (graph *Graph) Mktemp(id string) (string, error) {
 	return tmp.imageRoot(id), nil
 }
 
-// getDockerInitLayer returns the path of a layer containing a mountpoint suitable
-// for bind-mounting dockerinit into the container. The mountpoint is simply an
-// empty file at /.dockerinit
+// setupInitLayer populates the directory `initLayer` with the mountpoints
+// needed to bind-mount dockerinit and the runtime-generated configuration
+// files into the container. The mountpoints are simply empty files and
+// directories.
 //
-// This extra layer is used by all containers as the top-most ro layer. It protects
-// the container from unwanted side-effects on the rw layer.
-func (graph *Graph) getDockerInitLayer() (string, error) {
-	tmp, err := graph.tmp()
-	if err != nil {
-		return "", err
-	}
-	initLayer := tmp.imageRoot("_dockerinit")
-	if err := os.Mkdir(initLayer, 0755); err != nil && !os.IsExist(err) {
-		// If directory already existed, keep going.
-		// For all other errors, abort.
-		return "", err
-	}
-
+// This extra layer sits between the image and the container's own layer.
+// It protects the container from unwanted side-effects on its rw layer.
+func setupInitLayer(initLayer string) error {
 	for pth, typ := range map[string]string{
 		"/dev/pts":         "dir",
 		"/dev/shm":         "dir",
@@ -213,32 +310,32 @@ func (graph *Graph) getDockerInitLayer() (string, error) {
 				switch typ {
 				case "dir":
 					if err := os.MkdirAll(path.Join(initLayer, pth), 0755); err != nil {
-						return "", err
+						return err
 					}
 				case "file":
 					if err := os.MkdirAll(path.Join(initLayer, path.Dir(pth)), 0755); err != nil {
-						return "", err
+						return err
 					}
 
 					if f, err := os.OpenFile(path.Join(initLayer, pth), os.O_CREATE, 0755); err != nil {
-						return "", err
+						return err
 					} else {
 						f.Close()
 					}
 				}
 			} else {
-				return "", err
+				return err
 			}
 		}
 	}
 
 	// Layer is ready to use, if it wasn't before.
-	return initLayer, nil
+	return nil
 }
 
 func (graph *Graph) tmp() (*Graph, error) {
 	// Changed to _tmp from :tmp:, because it messed with ":" separators in aufs branch syntax...
-	return NewGraph(path.Join(graph.Root, "_tmp"))
+	return NewGraph(path.Join(graph.Root, "_tmp"), graph.driver)
 }
 
 // Check if given error is "not empty".
@@ -270,6 +367,10 @@ func (graph *Graph) Delete(name string) error {
 	if err != nil {
 		return err
 	}
+	// Remove the layer from the driver
+	if err := graph.driver.Remove(id); err != nil {
+		return err
+	}
 	return os.RemoveAll(tmp)
 }
 
@@ -9,6 +9,7 @@ import (
 	"io/ioutil"
 	"os"
 	"path"
+	"strings"
 	"testing"
 	"time"
 )
@@ -54,6 +55,51 @@ func TestInterruptedRegister(t *testing.T) {
 	}
 }
 
+// Test that concurrent Registers of an image don't corrupt its layer
+func TestConcurrentRegister(t *testing.T) {
+	graph := tempGraph(t)
+	defer os.RemoveAll(graph.Root)
+	image := &Image{
+		ID:      GenerateID(),
+		Comment: "testing",
+		Created: time.Now(),
+	}
+	errs := make(chan error)
+	for i := 0; i < 2; i++ {
+		go func() {
+			archive, err := fakeTar()
+			if err != nil {
+				errs <- err
+				return
+			}
+			errs <- graph.Register(nil, archive, image)
+		}()
+	}
+	var failed int
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != nil {
+			if !strings.Contains(err.Error(), "already exists") {
+				t.Fatal(err)
+			}
+			failed++
+		}
+	}
+	if failed != 1 {
+		t.Fatalf("Expected exactly one Register to fail, got %d", failed)
+	}
+	img, err := graph.Get(image.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rootfs, err := graph.driver.Get(img.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path.Join(rootfs, "etc", "passwd")); err != nil {
+		t.Fatalf("Expected the layer of the image to be complete: %s", err)
+	}
+}
+
 // FIXME: Do more extensive tests (ex: create multiple, delete, recreate;
 //       create multiple, check the amount of images and paths, etc..)
 func TestGraphCreate(t *testing.T) {
@@ -131,28 +177,18 @@ func TestMount(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	tmp, err := ioutil.TempDir("", "docker-test-graph-mount-")
+	rootfs, err := graph.driver.Get(image.ID)
 	if err != nil {
 		t.Fatal(err)
 	}
-	defer os.RemoveAll(tmp)
-	rootfs := path.Join(tmp, "rootfs")
-	if err := os.MkdirAll(rootfs, 0700); err != nil {
-		t.Fatal(err)
-	}
-	rw := path.Join(tmp, "rw")
-	if err := os.MkdirAll(rw, 0700); err != nil {
-		t.Fatal(err)
-	}
-	if err := image.Mount(rootfs, rw); err != nil {
-		t.Fatal(err)
-	}
-	// FIXME: test for mount contents
 	defer func() {
-		if err := Unmount(rootfs); err != nil {
+		if err := graph.driver.Put(image.ID); err != nil {
 			t.Error(err)
 		}
 	}()
+	if _, err := os.Stat(path.Join(rootfs, "etc/postgres/postgres.conf")); err != nil {
+		t.Fatal(err)
+	}
 }
 
 // Test that an image can be deleted by its shorthand prefix
@@ -294,7 +330,11 @@ func tempGraph(t *testing.T) *Graph {
 	if err != nil {
 		t.Fatal(err)
 	}
-	graph, err := NewGraph(tmp)
+	driver, err := NewGraphDriver(tmp, "vfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	graph, err := NewGraph(tmp, driver)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -0,0 +1,98 @@
+package docker
+
+import (
+	"fmt"
+	"github.com/dotcloud/docker/utils"
+	"path"
+)
+
+// A GraphDriver stores the filesystem layers of images and containers.
+// Each layer is addressed by an id and may have a parent layer; the
+// driver is responsible for presenting the union of a layer and its
+// parents as a regular directory.
+type GraphDriver interface {
+	// String returns the name of the driver, as passed to the -s flag.
+	String() string
+
+	// Create creates a new, empty layer with the given id on top of parent.
+	// If parent is empty, the layer has no parent.
+	Create(id, parent string) error
+	// Remove removes the layer with the given id.
+	Remove(id string) error
+	// Exists returns true if a layer with the given id exists.
+	Exists(id string) bool
+
+	// Get returns the path of a directory holding the full filesystem of
+	// the layer, mounting it first if necessary.
+	Get(id string) (string, error)
+	// Put releases the directory returned by Get.
+	Put(id string) error
+
+	// Diff returns an archive of the changes between the layer and its parent.
+	// Deleted files are recorded as AUFS-style whiteouts.
+	Diff(id string) (Archive, error)
+	// ApplyDiff extracts an archive produced by Diff into the layer.
+	ApplyDiff(id string, diff Archive) error
+	// DiffSize returns the size in bytes of the changes between the layer
+	// and its parent.
+	DiffSize(id string) (int64, error)
+	// Changes returns the list of changes between the layer and its parent.
+	Changes(id string) ([]Change, error)
+
+	// Cleanup releases any resource held by the driver, such as mounts.
+	Cleanup() error
+}
+
+type graphDriverInitFunc func(home string) (GraphDriver, error)
+
+var (
+	// ErrGraphDriverNotSupported is returned by a driver's init function
+	// when the host can't run it.
+	ErrGraphDriverNotSupported = fmt.Errorf("Storage driver not supported")
+
+	graphDrivers = make(map[string]graphDriverInitFunc)
+
+	// graphDriverPriority lists the drivers tried, in order, when none is
+	// requested explicitly.
+	graphDriverPriority = []string{
+		"aufs",
+		"overlay",
+		"vfs",
+	}
+)
+
+func registerGraphDriver(name string, initFunc graphDriverInitFunc) {
+	if _, exists := graphDrivers[name]; exists {
+		panic(fmt.Sprintf("Storage driver %s registered twice", name))
+	}
+	graphDrivers[name] = initFunc
+}
+
+func getGraphDriver(name, root string) (GraphDriver, error) {
+	initFunc, exists := graphDrivers[name]
+	if !exists {
+		return nil, fmt.Errorf("No such storage driver: %s", name)
+	}
+	return initFunc(path.Join(root, name))
+}
+
+// NewGraphDriver returns the storage driver named `name`, storing its data
+// in a sub-directory of `root`.
+// If `name` is empty, the first driver supported by the host is picked.
+func NewGraphDriver(root, name string) (GraphDriver, error) {
+	if name != "" {
+		return getGraphDriver(name, root)
+	}
+	for _, name := range graphDriverPriority {
+		driver, err := getGraphDriver(name, root)
+		if err != nil {
+			if err == ErrGraphDriverNotSupported {
+				utils.Debugf("Storage driver %s not supported, trying the next one", name)
+				continue
+			}
+			return nil, err
+		}
+		return driver, nil
+	}
+	return nil, fmt.Errorf("No supported storage driver found")
+}
@@ -0,0 +1,242 @@
+package docker
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/dotcloud/docker/utils"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+func init() {
+	registerGraphDriver("aufs", newAufsDriver)
+}
+
+// aufsDriver stores the content of each layer in diff/<id>, and mounts the
+// union of a layer and its parents at mnt/<id>. The list of parents of each
+// layer, closest first, is kept in layers/<id>.
+type aufsDriver struct {
+	home string
+}
+
+func newAufsDriver(home string) (GraphDriver, error) {
+	if err := supportsAufs(); err != nil {
+		return nil, ErrGraphDriverNotSupported
+	}
+	for _, p := range []string{"diff", "mnt", "layers"} {
+		if err := os.MkdirAll(path.Join(home, p), 0755); err != nil {
+			return nil, err
+		}
+	}
+	return &aufsDriver{home: home}, nil
+}
+
+// supportsAufs checks /proc/filesystems for aufs, loading the kernel
+// module first if necessary.
+func supportsAufs() error {
+	if hasFilesystem("aufs") {
+		return nil
+	}
+	utils.Debugf("Kernel does not support AUFS, trying to load the AUFS module with modprobe...")
+	if err := exec.Command("modprobe", "aufs").Run(); err != nil {
+		return fmt.Errorf("Unable to load the AUFS module")
+	}
+	if !hasFilesystem("aufs") {
+		return fmt.Errorf("AUFS is not supported by the kernel")
+	}
+	return nil
+}
+
+// hasFilesystem returns true if the running kernel lists `name` in
+// /proc/filesystems.
+func hasFilesystem(name string) bool {
+	f, err := os.Open("/proc/filesystems")
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		if fields := strings.Fields(s.Text()); len(fields) > 0 && fields[len(fields)-1] == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *aufsDriver) String() string {
+	return "aufs"
+}
+
+func (a *aufsDriver) diffPath(id string) string {
+	return path.Join(a.home, "diff", id)
+}
+
+func (a *aufsDriver) mntPath(id string) string {
+	return path.Join(a.home, "mnt", id)
+}
+
+func (a *aufsDriver) layersPath(id string) string {
+	return path.Join(a.home, "layers", id)
+}
+
+// parents returns the ids of all the parents of the layer, closest first.
+func (a *aufsDriver) parents(id string) ([]string, error) {
+	content, err := ioutil.ReadFile(a.layersPath(id))
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for _, line := range strings.Split(string(content), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			ids = append(ids, line)
+		}
+	}
+	return ids, nil
+}
+
+func (a *aufsDriver) Create(id, parent string) error {
+	var ids []string
+	if parent != "" {
+		if !a.Exists(parent) {
+			return fmt.Errorf("No such layer: %s", parent)
+		}
+		parents, err := a.parents(parent)
+		if err != nil {
+			return err
+		}
+		ids = append([]string{parent}, parents...)
+	}
+	if err := os.Mkdir(a.diffPath(id), 0755); err != nil {
+		return err
+	}
+	if err := os.Mkdir(a.mntPath(id), 0755); err != nil && !os.IsExist(err) {
+		return err
+	}
+	return ioutil.WriteFile(a.layersPath(id), []byte(strings.Join(ids, "\n")), 0600)
+}
+
+func (a *aufsDriver) Remove(id string) error {
+	if err := a.Put(id); err != nil {
+		return err
+	}
+	for _, p := range []string{a.diffPath(id), a.mntPath(id), a.layersPath(id)} {
+		if err := os.RemoveAll(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (a *aufsDriver) Exists(id string) bool {
+	_, err := os.Stat(a.diffPath(id))
+	return err == nil
+}
+
+func (a *aufsDriver) Get(id string) (string, error) {
+	parents, err := a.parents(id)
+	if err != nil {
+		return "", err
+	}
+	// A layer without parents doesn't need to be mounted
+	if len(parents) == 0 {
+		return a.diffPath(id), nil
+	}
+	target := a.mntPath(id)
+	if mounted, err := Mounted(target); err != nil {
+		return "", err
+	} else if mounted {
+		return target, nil
+	}
+	ro := make([]string, len(parents))
+	for i, parent := range parents {
+		ro[i] = a.diffPath(parent)
+	}
+	if err := os.MkdirAll(target, 0755); err != nil {
+		return "", err
+	}
+	if err := mountAufs(ro, a.diffPath(id), target); err != nil {
+		return "", err
+	}
+	return target, nil
+}
+
+func (a *aufsDriver) Put(id string) error {
+	target := a.mntPath(id)
+	if mounted, err := Mounted(target); err != nil || !mounted {
+		return err
+	}
+	if err := exec.Command("auplink", target, "flush").Run(); err != nil {
+		utils.Errorf("[warning]: couldn't run auplink before unmount: %s", err)
+	}
+	return syscall.Unmount(target, 0)
+}
+
+func (a *aufsDriver) Diff(id string) (Archive, error) {
+	return Tar(a.diffPath(id), Uncompressed)
+}
+
+func (a *aufsDriver) ApplyDiff(id string, diff Archive) error {
+	return Untar(diff, a.diffPath(id))
+}
+
+func (a *aufsDriver) DiffSize(id string) (int64, error) {
+	var size int64
+	err := filepath.Walk(a.diffPath(id), func(path string, fileInfo os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !fileInfo.IsDir() {
+			size += fileInfo.Size()
+		}
+		return nil
+	})
+	return size, err
+}
+
+func (a *aufsDriver) Changes(id string) ([]Change, error) {
+	parents, err := a.parents(id)
+	if err != nil {
+		return nil, err
+	}
+	layers := make([]string, len(parents))
+	for i, parent := range parents {
+		layers[i] = a.diffPath(parent)
+	}
+	return Changes(layers, a.diffPath(id))
+}
+
+// Cleanup unmounts every layer still mounted by the driver.
+func (a *aufsDriver) Cleanup() error {
+	ids, err := ioutil.ReadDir(path.Join(a.home, "mnt"))
+	if err != nil {
+		return err
+	}
+	for _, fi := range ids {
+		if err := a.Put(fi.Name()); err != nil {
+			utils.Errorf("Unable to unmount %s: %s", fi.Name(), err)
+		}
+	}
+	return nil
+}
+
+func mountAufs(ro []string, rw string, target string) error {
+	rwBranch := fmt.Sprintf("%v=rw", rw)
+	roBranches := ""
+	for _, layer := range ro {
+		roBranches += fmt.Sprintf("%v=ro+wh:", layer)
+	}
+	branches := fmt.Sprintf("br:%v:%v", rwBranch, roBranches)
+
+	branches += ",xino=/dev/shm/aufs.xino"
+
+	if err := mount("none", target, "aufs", 0, branches); err != nil {
+		return fmt.Errorf("Unable to mount using aufs: %s", err)
+	}
+	return nil
+}
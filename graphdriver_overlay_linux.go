@@ -0,0 +1,340 @@
+package docker
+
+import (
+	"fmt"
+	"github.com/dotcloud/docker/utils"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+func init() {
+	registerGraphDriver("overlay", newOverlayDriver)
+}
+
+// overlayDriver stores each layer in <id>/diff, and mounts the union of a
+// layer and its parents at <id>/merged using the kernel's overlay
+// filesystem. The ids of the parents, closest first, are kept in <id>/lower.
+//
+// Overlay records deletions as 0/0 character devices and opaque
+// directories as a trusted.overlay.opaque xattr; those are translated
+// to and from AUFS-style whiteouts so that layer archives stay portable
+// across drivers.
+type overlayDriver struct {
+	home string
+}
+
+const overlayOpaqueXattr = "trusted.overlay.opaque"
+
+func newOverlayDriver(home string) (GraphDriver, error) {
+	if !hasFilesystem("overlay") {
+		if err := exec.Command("modprobe", "overlay").Run(); err != nil || !hasFilesystem("overlay") {
+			return nil, ErrGraphDriverNotSupported
+		}
+	}
+	if err := os.MkdirAll(home, 0700); err != nil {
+		return nil, err
+	}
+	return &overlayDriver{home: home}, nil
+}
+
+func (o *overlayDriver) String() string {
+	return "overlay"
+}
+
+func (o *overlayDriver) dir(id string) string {
+	return path.Join(o.home, id)
+}
+
+func (o *overlayDriver) upperPath(id string) string {
+	return path.Join(o.dir(id), "diff")
+}
+
+func (o *overlayDriver) workPath(id string) string {
+	return path.Join(o.dir(id), "work")
+}
+
+func (o *overlayDriver) mergedPath(id string) string {
+	return path.Join(o.dir(id), "merged")
+}
+
+// parents returns the ids of all the parents of the layer, closest first.
+func (o *overlayDriver) parents(id string) ([]string, error) {
+	content, err := ioutil.ReadFile(path.Join(o.dir(id), "lower"))
+	if err != nil {
+		return nil, err
+	}
+	if lower := strings.TrimSpace(string(content)); lower != "" {
+		return strings.Split(lower, ":"), nil
+	}
+	return nil, nil
+}
+
+func (o *overlayDriver) Create(id, parent string) error {
+	var ids []string
+	if parent != "" {
+		if !o.Exists(parent) {
+			return fmt.Errorf("No such layer: %s", parent)
+		}
+		parents, err := o.parents(parent)
+		if err != nil {
+			return err
+		}
+		ids = append([]string{parent}, parents...)
+	}
+	if err := os.Mkdir(o.dir(id), 0700); err != nil {
+		return err
+	}
+	for _, p := range []string{o.upperPath(id), o.workPath(id), o.mergedPath(id)} {
+		if err := os.Mkdir(p, 0755); err != nil {
+			return err
+		}
+	}
+	return ioutil.WriteFile(path.Join(o.dir(id), "lower"), []byte(strings.Join(ids, ":")), 0600)
+}
+
+func (o *overlayDriver) Remove(id string) error {
+	if err := o.Put(id); err != nil {
+		return err
+	}
+	return os.RemoveAll(o.dir(id))
+}
+
+func (o *overlayDriver) Exists(id string) bool {
+	_, err := os.Stat(o.upperPath(id))
+	return err == nil
+}
+
+func (o *overlayDriver) Get(id string) (string, error) {
+	parents, err := o.parents(id)
+	if err != nil {
+		return "", err
+	}
+	// A layer without parents doesn't need to be mounted
+	if len(parents) == 0 {
+		return o.upperPath(id), nil
+	}
+	target := o.mergedPath(id)
+	if mounted, err := Mounted(target); err != nil {
+		return "", err
+	} else if mounted {
+		return target, nil
+	}
+	lower := make([]string, len(parents))
+	for i, parent := range parents {
+		lower[i] = o.upperPath(parent)
+	}
+	opts := fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s", strings.Join(lower, ":"), o.upperPath(id), o.workPath(id))
+	if err := mount("overlay", target, "overlay", 0, opts); err != nil {
+		return "", fmt.Errorf("Unable to mount using overlay: %s", err)
+	}
+	return target, nil
+}
+
+func (o *overlayDriver) Put(id string) error {
+	target := o.mergedPath(id)
+	if mounted, err := Mounted(target); err != nil || !mounted {
+		return err
+	}
+	return syscall.Unmount(target, 0)
+}
+
+func (o *overlayDriver) Diff(id string) (Archive, error) {
+	changes, err := o.Changes(id)
+	if err != nil {
+		return nil, err
+	}
+	// Every file added or modified by the layer was copied up in full,
+	// so the archive can be produced without mounting anything.
+	return ExportChanges(o.upperPath(id), changes)
+}
+
+// ApplyDiff extracts the archive in the upper directory of the layer, and
+// turns the AUFS whiteouts it contains into their overlay counterpart.
+func (o *overlayDriver) ApplyDiff(id string, diff Archive) error {
+	upper := o.upperPath(id)
+	if err := Untar(diff, upper); err != nil {
+		return err
+	}
+	return filepath.Walk(upper, func(fullPath string, f os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		filename := filepath.Base(fullPath)
+		if !strings.HasPrefix(filename, ".wh.") {
+			return nil
+		}
+		parent := filepath.Dir(fullPath)
+		if err := os.RemoveAll(fullPath); err != nil {
+			return err
+		}
+		if filename == ".wh..wh..opq" {
+			return syscall.Setxattr(parent, overlayOpaqueXattr, []byte("y"), 0)
+		} else if strings.HasPrefix(filename, ".wh..wh.") {
+			// Other AUFS metadata is meaningless here
+			return nil
+		}
+		target := filepath.Join(parent, filename[len(".wh."):])
+		if err := os.RemoveAll(target); err != nil {
+			return err
+		}
+		return syscall.Mknod(target, syscall.S_IFCHR, 0)
+	})
+}
+
+func (o *overlayDriver) DiffSize(id string) (int64, error) {
+	var size int64
+	err := filepath.Walk(o.upperPath(id), func(path string, fileInfo os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fileInfo.Mode().IsRegular() {
+			size += fileInfo.Size()
+		}
+		return nil
+	})
+	return size, err
+}
+
+// Changes walks the upper directory of the layer. Whiteouts are reported as
+// deletions, anything else is a modification if it exists in one of the
+// parents, and an addition otherwise.
+func (o *overlayDriver) Changes(id string) ([]Change, error) {
+	parents, err := o.parents(id)
+	if err != nil {
+		return nil, err
+	}
+	upper := o.upperPath(id)
+	var changes []Change
+	err = filepath.Walk(upper, func(fullPath string, f os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		path, err := filepath.Rel(upper, fullPath)
+		if err != nil {
+			return err
+		}
+		path = filepath.Join("/", path)
+		if path == "/" {
+			return nil
+		}
+
+		change := Change{
+			Path: path,
+			Kind: ChangeAdd,
+		}
+		if isOverlayWhiteout(f) {
+			change.Kind = ChangeDelete
+		} else {
+			for _, parent := range parents {
+				stat, err := os.Lstat(filepath.Join(o.upperPath(parent), path))
+				if err != nil && !os.IsNotExist(err) {
+					return err
+				}
+				if err != nil {
+					continue
+				}
+				if isOverlayWhiteout(stat) {
+					// Deleted in that parent, so it's new from our point of view
+					break
+				}
+				// Directories which only exist because one of their children changed aren't changes themselves
+				if stat.IsDir() && f.IsDir() && !isOverlayOpaque(fullPath) && sameFileInfo(f, stat) {
+					return nil
+				}
+				change.Kind = ChangeModify
+				break
+			}
+		}
+		changes = append(changes, change)
+
+		// An opaque directory hides everything its parents contained
+		if f.IsDir() && isOverlayOpaque(fullPath) {
+			hidden, err := o.hiddenByOpaque(parents, upper, path)
+			if err != nil {
+				return err
+			}
+			changes = append(changes, hidden...)
+		}
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return changes, nil
+}
+
+// hiddenByOpaque returns a deletion for each entry of the directory at
+// `dir` in the parent layers which isn't present in `upper`.
+func (o *overlayDriver) hiddenByOpaque(parents []string, upper, dir string) ([]Change, error) {
+	var changes []Change
+	seen := make(map[string]bool)
+	for _, parent := range parents {
+		parentDir := filepath.Join(o.upperPath(parent), dir)
+		st, err := os.Lstat(parentDir)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		if !st.IsDir() {
+			break
+		}
+		entries, err := ioutil.ReadDir(parentDir)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			name := filepath.Join(dir, entry.Name())
+			if seen[name] {
+				continue
+			}
+			seen[name] = true
+			if isOverlayWhiteout(entry) {
+				continue
+			}
+			if _, err := os.Lstat(filepath.Join(upper, name)); os.IsNotExist(err) {
+				changes = append(changes, Change{Path: name, Kind: ChangeDelete})
+			}
+		}
+		if isOverlayOpaque(parentDir) {
+			break
+		}
+	}
+	return changes, nil
+}
+
+func (o *overlayDriver) Cleanup() error {
+	ids, err := ioutil.ReadDir(o.home)
+	if err != nil {
+		return err
+	}
+	for _, fi := range ids {
+		if err := o.Put(fi.Name()); err != nil {
+			utils.Errorf("Unable to unmount %s: %s", fi.Name(), err)
+		}
+	}
+	return nil
+}
+
+func isOverlayWhiteout(f os.FileInfo) bool {
+	if f.Mode()&os.ModeCharDevice == 0 {
+		return false
+	}
+	st, ok := f.Sys().(*syscall.Stat_t)
+	return ok && st.Rdev == 0
+}
+
+func isOverlayOpaque(dir string) bool {
+	buf := make([]byte, 1)
+	n, err := syscall.Getxattr(dir, overlayOpaqueXattr, buf)
+	return err == nil && n == 1 && buf[0] == 'y'
+}
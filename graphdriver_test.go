@@ -0,0 +1,111 @@
+package docker
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func tempVfsDriver(t *testing.T) GraphDriver {
+	tmp, err := ioutil.TempDir("", "docker-graphdriver-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	driver, err := NewGraphDriver(tmp, "vfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return driver
+}
+
+func TestVfsChangesAndDiff(t *testing.T) {
+	driver := tempVfsDriver(t)
+	defer os.RemoveAll(path.Dir(driver.(*vfsDriver).home))
+
+	if err := driver.Create("base", ""); err != nil {
+		t.Fatal(err)
+	}
+	archive, err := fakeTar()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := driver.ApplyDiff("base", archive); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := driver.Create("child", "base"); err != nil {
+		t.Fatal(err)
+	}
+	if changes, err := driver.Changes("child"); err != nil {
+		t.Fatal(err)
+	} else if len(changes) != 0 {
+		t.Fatalf("A new layer should have no changes, found %v", changes)
+	}
+
+	dir, err := driver.Get("child")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(path.Join(dir, "etc/passwd")); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path.Join(dir, "hello"), []byte("world"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := driver.Put("child"); err != nil {
+		t.Fatal(err)
+	}
+
+	changes, err := driver.Changes("child")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]ChangeType{
+		"/etc":        ChangeModify,
+		"/etc/passwd": ChangeDelete,
+		"/hello":      ChangeAdd,
+	}
+	if len(changes) != len(expected) {
+		t.Fatalf("Expected %d changes, found %v", len(expected), changes)
+	}
+	for _, change := range changes {
+		if kind, exists := expected[change.Path]; !exists || kind != change.Kind {
+			t.Fatalf("Unexpected change %s", change.String())
+		}
+	}
+
+	// Applying the diff on top of the parent should give the same filesystem
+	diff, err := driver.Diff("child")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := driver.Create("copy", "base"); err != nil {
+		t.Fatal(err)
+	}
+	if err := driver.ApplyDiff("copy", diff); err != nil {
+		t.Fatal(err)
+	}
+	copyDir, err := driver.Get("copy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path.Join(copyDir, "etc/passwd")); !os.IsNotExist(err) {
+		t.Fatalf("/etc/passwd should have been removed by the whiteout (err=%v)", err)
+	}
+	if content, err := ioutil.ReadFile(path.Join(copyDir, "hello")); err != nil {
+		t.Fatal(err)
+	} else if string(content) != "world" {
+		t.Fatalf("Unexpected content for /hello: %s", content)
+	}
+	if _, err := os.Stat(path.Join(copyDir, ".wh.passwd")); !os.IsNotExist(err) {
+		t.Fatalf("Whiteouts should not be left in the layer (err=%v)", err)
+	}
+
+	if err := driver.Remove("child"); err != nil {
+		t.Fatal(err)
+	}
+	if driver.Exists("child") {
+		t.Fatalf("The layer should not exist after Remove")
+	}
+}
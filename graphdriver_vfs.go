@@ -0,0 +1,144 @@
+package docker
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+func init() {
+	registerGraphDriver("vfs", newVfsDriver)
+}
+
+// vfsDriver stores every layer as a full copy of its parent. It needs no
+// kernel support at all, at the cost of disk space and slower creation.
+type vfsDriver struct {
+	home string
+}
+
+func newVfsDriver(home string) (GraphDriver, error) {
+	for _, p := range []string{"dir", "parent"} {
+		if err := os.MkdirAll(path.Join(home, p), 0700); err != nil {
+			return nil, err
+		}
+	}
+	return &vfsDriver{home: home}, nil
+}
+
+func (d *vfsDriver) String() string {
+	return "vfs"
+}
+
+func (d *vfsDriver) dir(id string) string {
+	return path.Join(d.home, "dir", id)
+}
+
+func (d *vfsDriver) parentPath(id string) string {
+	return path.Join(d.home, "parent", id)
+}
+
+func (d *vfsDriver) parent(id string) (string, error) {
+	parent, err := ioutil.ReadFile(d.parentPath(id))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(parent)), nil
+}
+
+func (d *vfsDriver) Create(id, parent string) error {
+	dir := d.dir(id)
+	if err := os.Mkdir(dir, 0755); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(d.parentPath(id), []byte(parent), 0600); err != nil {
+		return err
+	}
+	if parent == "" {
+		return nil
+	}
+	if !d.Exists(parent) {
+		return fmt.Errorf("No such layer: %s", parent)
+	}
+	if output, err := exec.Command("cp", "-aT", "--reflink=auto", d.dir(parent), dir).CombinedOutput(); err != nil {
+		return fmt.Errorf("Error copying layer %s: %s (%s)", parent, err, output)
+	}
+	return nil
+}
+
+func (d *vfsDriver) Remove(id string) error {
+	if err := os.RemoveAll(d.dir(id)); err != nil {
+		return err
+	}
+	if err := os.Remove(d.parentPath(id)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (d *vfsDriver) Exists(id string) bool {
+	_, err := os.Stat(d.dir(id))
+	return err == nil
+}
+
+func (d *vfsDriver) Get(id string) (string, error) {
+	dir := d.dir(id)
+	if st, err := os.Stat(dir); err != nil {
+		return "", err
+	} else if !st.IsDir() {
+		return "", fmt.Errorf("%s is not a directory", dir)
+	}
+	return dir, nil
+}
+
+func (d *vfsDriver) Put(id string) error {
+	return nil
+}
+
+func (d *vfsDriver) Diff(id string) (Archive, error) {
+	changes, err := d.Changes(id)
+	if err != nil {
+		return nil, err
+	}
+	return ExportChanges(d.dir(id), changes)
+}
+
+func (d *vfsDriver) ApplyDiff(id string, diff Archive) error {
+	return ApplyLayer(d.dir(id), diff)
+}
+
+func (d *vfsDriver) DiffSize(id string) (int64, error) {
+	changes, err := d.Changes(id)
+	if err != nil {
+		return 0, err
+	}
+	var size int64
+	for _, change := range changes {
+		if change.Kind == ChangeDelete {
+			continue
+		}
+		if fi, err := os.Lstat(filepath.Join(d.dir(id), change.Path)); err == nil && !fi.IsDir() {
+			size += fi.Size()
+		}
+	}
+	return size, nil
+}
+
+func (d *vfsDriver) Changes(id string) ([]Change, error) {
+	parent, err := d.parent(id)
+	if err != nil {
+		return nil, err
+	}
+	var parentDir string
+	if parent != "" {
+		parentDir = d.dir(parent)
+	}
+	return ChangesDirs(d.dir(id), parentDir)
+}
+
+func (d *vfsDriver) Cleanup() error {
+	return nil
+}
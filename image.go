@@ -8,16 +8,17 @@ import (
 	"github.com/dotcloud/docker/utils"
 	"io"
 	"io/ioutil"
-	"log"
 	"os"
-	"os/exec"
 	"path"
-	"path/filepath"
+	"regexp"
 	"strconv"
 	"strings"
 	"time"
 )
 
+// validFullID matches the ids given by GenerateID.
+var validFullID = regexp.MustCompile(`^[a-f0-9]{64}$`)
+
 type Image struct {
 	ID              string    `json:"id"`
 	Parent          string    `json:"parent,omitempty"`
@@ -60,28 +61,17 @@ func LoadImage(root string) (*Image, error) {
 		}
 	}
 
-	// Check that the filesystem layer exists
-	if stat, err := os.Stat(layerPath(root)); err != nil {
-		if os.IsNotExist(err) {
-			return nil, fmt.Errorf("Couldn't load image %s: no filesystem layer", img.ID)
-		}
-		return nil, err
-	} else if !stat.IsDir() {
-		return nil, fmt.Errorf("Couldn't load image %s: %s is not a directory", img.ID, layerPath(root))
-	}
 	return img, nil
 }
 
-func StoreImage(img *Image, jsonData []byte, layerData Archive, root string) error {
+func StoreImage(img *Image, jsonData []byte, layerData Archive, root string, driver GraphDriver) error {
 	// Check that root doesn't already exist
 	if _, err := os.Stat(root); err == nil {
 		return fmt.Errorf("Image %s already exists", img.ID)
 	} else if !os.IsNotExist(err) {
 		return err
 	}
-	// Store the layer
-	layer := layerPath(root)
-	if err := os.MkdirAll(layer, 0755); err != nil {
+	if err := os.MkdirAll(root, 0755); err != nil {
 		return err
 	}
 
@@ -89,7 +79,7 @@ func StoreImage(img *Image, jsonData []byte, layerData Archive, root string) err
 	if layerData != nil {
 		start := time.Now()
 		utils.Debugf("Start untar layer")
-		if err := Untar(layerData, layer); err != nil {
+		if err := driver.ApplyDiff(img.ID, layerData); err != nil {
 			return err
 		}
 		utils.Debugf("Untar time: %vs", time.Now().Sub(start).Seconds())
@@ -97,7 +87,9 @@ func StoreImage(img *Image, jsonData []byte, layerData Archive, root string) err
 
 	// If raw json is provided, then use it
 	if jsonData != nil {
-		return ioutil.WriteFile(jsonPath(root), jsonData, 0600)
+		if err := ioutil.WriteFile(jsonPath(root), jsonData, 0600); err != nil {
+			return err
+		}
 	} else { // Otherwise, unmarshal the image
 		jsonData, err := json.Marshal(img)
 		if err != nil {
@@ -108,17 +100,14 @@ func StoreImage(img *Image, jsonData []byte, layerData Archive, root string) err
 		}
 	}
 
-	return StoreSize(img, root)
+	return StoreSize(img, root, driver)
 }
 
-func StoreSize(img *Image, root string) error {
-	layer := layerPath(root)
-
-	var totalSize int64 = 0
-	filepath.Walk(layer, func(path string, fileInfo os.FileInfo, err error) error {
-		totalSize += fileInfo.Size()
-		return nil
-	})
+func StoreSize(img *Image, root string, driver GraphDriver) error {
+	totalSize, err := driver.DiffSize(img.ID)
+	if err != nil {
+		return err
+	}
 	img.Size = totalSize
 
 	if err := ioutil.WriteFile(path.Join(root, "layersize"), []byte(strconv.Itoa(int(totalSize))), 0600); err != nil {
@@ -128,77 +117,48 @@ func StoreSize(img *Image, root string) error {
 	return nil
 }
 
-func layerPath(root string) string {
-	return path.Join(root, "layer")
-}
-
-func jsonPath(root string) string {
-	return path.Join(root, "json")
+// StoreContentHash records the hash of the files added to the image by the
+// ADD instruction which built it, next to its metadata. The build cache
+// only reuses the image for an ADD of the same content.
+func (img *Image) StoreContentHash(hash string) error {
+	root, err := img.root()
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path.Join(root, "contenthash"), []byte(hash), 0600)
 }
 
-func MountAUFS(ro []string, rw string, target string) error {
-	// FIXME: Now mount the layers
-	rwBranch := fmt.Sprintf("%v=rw", rw)
-	roBranches := ""
-	for _, layer := range ro {
-		roBranches += fmt.Sprintf("%v=ro+wh:", layer)
+// ContentHash returns the hash recorded by StoreContentHash, or an empty
+// string if the image wasn't built by ADD.
+func (img *Image) ContentHash() (string, error) {
+	root, err := img.root()
+	if err != nil {
+		return "", err
 	}
-	branches := fmt.Sprintf("br:%v:%v", rwBranch, roBranches)
-
-	branches += ",xino=/dev/shm/aufs.xino"
-
-	//if error, try to load aufs kernel module
-	if err := mount("none", target, "aufs", 0, branches); err != nil {
-		log.Printf("Kernel does not support AUFS, trying to load the AUFS module with modprobe...")
-		if err := exec.Command("modprobe", "aufs").Run(); err != nil {
-			return fmt.Errorf("Unable to load the AUFS module")
-		}
-		log.Printf("...module loaded.")
-		if err := mount("none", target, "aufs", 0, branches); err != nil {
-			return fmt.Errorf("Unable to mount using aufs")
+	hash, err := ioutil.ReadFile(path.Join(root, "contenthash"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
 		}
+		return "", err
 	}
-	return nil
+	return string(hash), nil
 }
 
-// TarLayer returns a tar archive of the image's filesystem layer.
-func (image *Image) TarLayer(compression Compression) (Archive, error) {
-	layerPath, err := image.layer()
-	if err != nil {
-		return nil, err
-	}
-	return Tar(layerPath, compression)
+func layerPath(root string) string {
+	return path.Join(root, "layer")
 }
 
-func (image *Image) Mount(root, rw string) error {
-	if mounted, err := Mounted(root); err != nil {
-		return err
-	} else if mounted {
-		return fmt.Errorf("%s is already mounted", root)
-	}
-	layers, err := image.layers()
-	if err != nil {
-		return err
-	}
-	// Create the target directories if they don't exist
-	if err := os.Mkdir(root, 0755); err != nil && !os.IsExist(err) {
-		return err
-	}
-	if err := os.Mkdir(rw, 0755); err != nil && !os.IsExist(err) {
-		return err
-	}
-	if err := MountAUFS(layers, rw, root); err != nil {
-		return err
-	}
-	return nil
+func jsonPath(root string) string {
+	return path.Join(root, "json")
 }
 
-func (image *Image) Changes(rw string) ([]Change, error) {
-	layers, err := image.layers()
-	if err != nil {
-		return nil, err
+// TarLayer returns a tar archive of the image's filesystem layer.
+func (image *Image) TarLayer() (Archive, error) {
+	if image.graph == nil {
+		return nil, fmt.Errorf("Can't export the layer of unregistered image")
 	}
-	return Changes(layers, rw)
+	return image.graph.driver.Diff(image.ID)
 }
 
 func (image *Image) ShortID() string {
@@ -240,39 +200,6 @@ func (img *Image) History() ([]*Image, error) {
 	return parents, nil
 }
 
-// layers returns all the filesystem layers needed to mount an image
-// FIXME: @shykes refactor this function with the new error handling
-//        (I'll do it if I have time tonight, I focus on the rest)
-func (img *Image) layers() ([]string, error) {
-	var list []string
-	var e error
-	if err := img.WalkHistory(
-		func(img *Image) (err error) {
-			if layer, err := img.layer(); err != nil {
-				e = err
-			} else if layer != "" {
-				list = append(list, layer)
-			}
-			return err
-		},
-	); err != nil {
-		return nil, err
-	} else if e != nil { // Did an error occur inside the handler?
-		return nil, e
-	}
-	if len(list) == 0 {
-		return nil, fmt.Errorf("No layer found for image %s\n", img.ID)
-	}
-
-	// Inject the dockerinit layer (empty place-holder for mount-binding dockerinit)
-	if dockerinitLayer, err := img.getDockerInitLayer(); err != nil {
-		return nil, err
-	} else {
-		list = append([]string{dockerinitLayer}, list...)
-	}
-	return list, nil
-}
-
 func (img *Image) WalkHistory(handler func(*Image) error) (err error) {
 	currentImg := img
 	for currentImg != nil {
@@ -299,13 +226,6 @@ func (img *Image) GetParent() (*Image, error) {
 	return img.graph.Get(img.Parent)
 }
 
-func (img *Image) getDockerInitLayer() (string, error) {
-	if img.graph == nil {
-		return "", fmt.Errorf("Can't lookup dockerinit layer of unregistered image")
-	}
-	return img.graph.getDockerInitLayer()
-}
-
 func (img *Image) root() (string, error) {
 	if img.graph == nil {
 		return "", fmt.Errorf("Can't lookup root of unregistered image")
@@ -313,15 +233,6 @@ func (img *Image) root() (string, error) {
 	return img.graph.imageRoot(img.ID), nil
 }
 
-// Return the path of an image's layer
-func (img *Image) layer() (string, error) {
-	root, err := img.root()
-	if err != nil {
-		return "", err
-	}
-	return layerPath(root), nil
-}
-
 func (img *Image) getParentsSize(size int64) int64 {
 	parentImage, err := img.GetParent()
 	if err != nil || parentImage == nil {
@@ -40,6 +40,23 @@ func NewLink(parent, child *Container, name, bridgeInterface string) (*Link, err
 		ChildEnvironment: child.Config.Env,
 		Ports:            ports,
 	}
+
+	// Links go through the first network the containers share
+	if len(parent.NetworkSettings.Networks) > 0 || len(child.NetworkSettings.Networks) > 0 {
+		shared := false
+		for _, network := range parent.NetworkSettings.networkNames() {
+			if endpoint, exists := child.NetworkSettings.Networks[network]; exists {
+				l.BridgeInterface = endpoint.Bridge
+				l.ChildIP = endpoint.IPAddress
+				l.ParentIP = parent.NetworkSettings.Networks[network].IPAddress
+				shared = true
+				break
+			}
+		}
+		if !shared {
+			return nil, fmt.Errorf("Cannot link to %s AS %s: it isn't on any network of %s", child.Name, name, parent.Name)
+		}
+	}
 	return l, nil
 
 }
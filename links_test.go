@@ -111,3 +111,30 @@ func TestLinkEnv(t *testing.T) {
 		t.Fatalf("Expected gordon, got %s", env["DOCKER_ENV_PASSWORD"])
 	}
 }
+
+func TestLinkNetworks(t *testing.T) {
+	from := newMockLinkContainer(GenerateID(), "172.17.0.2")
+	from.State = State{Running: true}
+	from.NetworkSettings.Networks = map[string]*EndpointSettings{
+		"bridge": {Interface: "eth0", IPAddress: "172.17.0.2", Bridge: "docker0"},
+		"back":   {Interface: "eth1", IPAddress: "172.18.0.2", Bridge: "br-back"},
+	}
+	to := newMockLinkContainer(GenerateID(), "172.19.0.3")
+	to.NetworkSettings.Networks = map[string]*EndpointSettings{
+		"front": {Interface: "eth0", IPAddress: "172.19.0.3", Bridge: "br-front"},
+		"back":  {Interface: "eth1", IPAddress: "172.18.0.3", Bridge: "br-back"},
+	}
+
+	link, err := NewLink(to, from, "/web/db", "docker0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if link.BridgeInterface != "br-back" || link.ParentIP != "172.18.0.3" || link.ChildIP != "172.18.0.2" {
+		t.Fatalf("Expected the link to go through the shared network, got %s: %s -> %s", link.BridgeInterface, link.ParentIP, link.ChildIP)
+	}
+
+	delete(to.NetworkSettings.Networks, "back")
+	if _, err := NewLink(to, from, "/web/db", "docker0"); err == nil {
+		t.Fatal("Linking containers which share no network should fail")
+	}
+}
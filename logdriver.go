@@ -0,0 +1,406 @@
+package docker
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/dotcloud/docker/utils"
+	"io"
+	"log/syslog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultLogDriver stores the output of containers as JSON lines in
+// <id>-json.log, which is what `docker logs` reads.
+const DefaultLogDriver = "json"
+
+// LogConfig tells where the output of a container goes.
+//
+// The json driver accepts the options max-size (e.g. "10m"), after which the
+// log file is rotated, and max-file, the number of files kept including the
+// current one. The syslog driver sends each line to the local syslog daemon,
+// and the none driver drops the output altogether.
+type LogConfig struct {
+	Driver  string
+	Options map[string]string
+}
+
+// Options accepted by each log driver
+var logDriverOptions = map[string][]string{
+	"json":   {"max-size", "max-file"},
+	"syslog": {},
+	"none":   {},
+}
+
+func parseLogOpts(opts utils.ListOpts) (map[string]string, error) {
+	out := make(map[string]string, len(opts))
+	for _, o := range opts {
+		parts := strings.SplitN(o, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("Unable to parse log option: %s", o)
+		}
+		out[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	}
+	return out, nil
+}
+
+func validateLogConfig(config LogConfig) error {
+	driver := config.Driver
+	if driver == "" {
+		driver = DefaultLogDriver
+	}
+	allowed, exists := logDriverOptions[driver]
+	if !exists {
+		return fmt.Errorf("No such log driver: %s", driver)
+	}
+	for key := range config.Options {
+		valid := false
+		for _, option := range allowed {
+			if key == option {
+				valid = true
+			}
+		}
+		if !valid {
+			return fmt.Errorf("Unknown option %s for the %s log driver", key, driver)
+		}
+	}
+	_, _, err := jsonLogLimits(config)
+	return err
+}
+
+// jsonLogLimits returns the maximum size of a log file, 0 for no limit,
+// and the number of files kept when rotating it.
+func jsonLogLimits(config LogConfig) (int64, int, error) {
+	var (
+		maxSize  int64
+		maxFiles = 1
+		err      error
+	)
+	if value, exists := config.Options["max-size"]; exists {
+		if maxSize, err = utils.RAMInBytes(value); err != nil {
+			return 0, 0, err
+		}
+	}
+	if value, exists := config.Options["max-file"]; exists {
+		if maxFiles, err = strconv.Atoi(value); err != nil || maxFiles < 1 {
+			return 0, 0, fmt.Errorf("Invalid max-file: %s", value)
+		}
+		if maxSize == 0 {
+			return 0, 0, fmt.Errorf("max-file is only valid along with max-size")
+		}
+	}
+	return maxSize, maxFiles, nil
+}
+
+// setupLogging attaches the log driver of the container to its stdout and stderr.
+func (container *Container) setupLogging(hostConfig *HostConfig) error {
+	switch hostConfig.LogConfig.Driver {
+	case "", "json":
+		maxSize, maxFiles, err := jsonLogLimits(hostConfig.LogConfig)
+		if err != nil {
+			return err
+		}
+		// Both streams share the file so that they are rotated together
+		log, err := newRotatingFile(container.logPath("json"), maxSize, maxFiles)
+		if err != nil {
+			return err
+		}
+		container.stdout.AddWriter(log, "stdout")
+		container.stderr.AddWriter(log, "stderr")
+	case "syslog":
+		tag := "docker/" + container.ShortID()
+		stdout, err := newSyslogWriter(syslog.LOG_DAEMON|syslog.LOG_INFO, tag)
+		if err != nil {
+			return err
+		}
+		stderr, err := newSyslogWriter(syslog.LOG_DAEMON|syslog.LOG_ERR, tag)
+		if err != nil {
+			stdout.Close()
+			return err
+		}
+		container.stdout.AddWriter(stdout, "")
+		container.stderr.AddWriter(stderr, "")
+	case "none":
+	default:
+		return fmt.Errorf("No such log driver: %s", hostConfig.LogConfig.Driver)
+	}
+	return nil
+}
+
+// rotatingFile appends to a log file, and renames it to <path>.1 (shifting
+// the older ones to <path>.2, etc.) once it would grow beyond maxSize.
+// Writes are never split across files, so that each file holds whole lines.
+type rotatingFile struct {
+	sync.Mutex
+	path     string
+	maxSize  int64 // 0 means no rotation
+	maxFiles int
+	file     *os.File
+	size     int64
+}
+
+func newRotatingFile(path string, maxSize int64, maxFiles int) (*rotatingFile, error) {
+	r := &rotatingFile{path: path, maxSize: maxSize, maxFiles: maxFiles}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *rotatingFile) open() error {
+	file, err := os.OpenFile(r.path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	r.file = file
+	r.size = info.Size()
+	return nil
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.Lock()
+	defer r.Unlock()
+	if r.file == nil {
+		return 0, fmt.Errorf("%s is closed", r.path)
+	}
+	if r.maxSize > 0 && r.size > 0 && r.size+int64(len(p)) > r.maxSize {
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := r.file.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+func (r *rotatingFile) rotate() error {
+	if err := r.file.Close(); err != nil {
+		return err
+	}
+	r.file = nil
+	if r.maxFiles > 1 {
+		for i := r.maxFiles - 1; i > 1; i-- {
+			if err := os.Rename(fmt.Sprintf("%s.%d", r.path, i-1), fmt.Sprintf("%s.%d", r.path, i)); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		if err := os.Rename(r.path, r.path+".1"); err != nil {
+			return err
+		}
+	} else if err := os.Truncate(r.path, 0); err != nil {
+		return err
+	}
+	return r.open()
+}
+
+// Close is called once for each stream sharing the file
+func (r *rotatingFile) Close() error {
+	r.Lock()
+	defer r.Unlock()
+	if r.file == nil {
+		return nil
+	}
+	err := r.file.Close()
+	r.file = nil
+	return err
+}
+
+// openRotatedLogs opens a log file along with its rotated copies, and
+// returns a reader going through them from the oldest to the newest.
+// If tail is positive, only the last `tail` lines are read.
+func openRotatedLogs(path string, tail int) (io.ReadCloser, error) {
+	current, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	matches, err := filepath.Glob(path + ".*")
+	if err != nil {
+		current.Close()
+		return nil, err
+	}
+	var indexes []int
+	for _, match := range matches {
+		if i, err := strconv.Atoi(strings.TrimPrefix(match, path+".")); err == nil && i > 0 {
+			indexes = append(indexes, i)
+		}
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(indexes)))
+
+	files := []*os.File{}
+	for _, i := range indexes {
+		file, err := os.Open(fmt.Sprintf("%s.%d", path, i))
+		if err != nil {
+			// Rotated away in the meantime
+			if os.IsNotExist(err) {
+				continue
+			}
+			closeFiles(append(files, current))
+			return nil, err
+		}
+		files = append(files, file)
+	}
+	files = append(files, current)
+
+	if tail < 0 {
+		readers := make([]io.Reader, len(files))
+		for i, file := range files {
+			readers[i] = file
+		}
+		return &multiFileReader{Reader: io.MultiReader(readers...), files: files}, nil
+	}
+	reader, err := tailFiles(files, tail)
+	if err != nil {
+		closeFiles(files)
+		return nil, err
+	}
+	return &multiFileReader{Reader: reader, files: files}, nil
+}
+
+// tailLogsSince returns a reader over the last n lines of the json log
+// `r` logged after `since`.
+func tailLogsSince(r io.Reader, n int, since time.Time) (io.Reader, error) {
+	var lines [][]byte
+	reader := bufio.NewReader(r)
+	for n > 0 {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		l := &utils.JSONLog{}
+		if err := json.Unmarshal(line, l); err != nil {
+			return nil, fmt.Errorf("Error streaming logs: %s", err)
+		}
+		if !l.Created.After(since) {
+			continue
+		}
+		if lines = append(lines, line); len(lines) > n {
+			lines = lines[1:]
+		}
+	}
+	return bytes.NewReader(bytes.Join(lines, nil)), nil
+}
+
+// tailFiles returns a reader over the last n lines of files, ordered from
+// the oldest to the newest. The files are read backwards from their end,
+// so that the cost doesn't depend on the size of the logs.
+func tailFiles(files []*os.File, n int) (io.Reader, error) {
+	const blockSize = 4096
+	var (
+		readers []io.Reader
+		block   = make([]byte, blockSize)
+	)
+	for i := len(files) - 1; i >= 0 && n > 0; i-- {
+		info, err := files[i].Stat()
+		if err != nil {
+			return nil, err
+		}
+		size := info.Size()
+		if size == 0 {
+			continue
+		}
+		// The newline ending the last line doesn't start a new one
+		start, end := int64(0), size-1
+		for end > 0 && n > 0 {
+			offset := end - blockSize
+			if offset < 0 {
+				offset = 0
+			}
+			count, err := files[i].ReadAt(block[:end-offset], offset)
+			if err != nil && err != io.EOF {
+				return nil, err
+			}
+			for j := count - 1; j >= 0; j-- {
+				if block[j] == '\n' {
+					if n--; n == 0 {
+						start = offset + int64(j) + 1
+						break
+					}
+				}
+			}
+			end = offset
+		}
+		if n > 0 {
+			// The first line of the file
+			n--
+		}
+		readers = append([]io.Reader{io.NewSectionReader(files[i], start, size-start)}, readers...)
+	}
+	return io.MultiReader(readers...), nil
+}
+
+func closeFiles(files []*os.File) {
+	for _, file := range files {
+		file.Close()
+	}
+}
+
+type multiFileReader struct {
+	io.Reader
+	files []*os.File
+}
+
+func (r *multiFileReader) Close() error {
+	closeFiles(r.files)
+	return nil
+}
+
+// syslogWriter sends one syslog message per line written to it.
+type syslogWriter struct {
+	writer   *syslog.Writer
+	priority syslog.Priority
+	buf      bytes.Buffer
+}
+
+func newSyslogWriter(priority syslog.Priority, tag string) (*syslogWriter, error) {
+	writer, err := syslog.New(priority, tag)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to connect to syslog: %s", err)
+	}
+	return &syslogWriter{writer: writer, priority: priority}, nil
+}
+
+func (w *syslogWriter) Write(p []byte) (int, error) {
+	w.buf.Write(p)
+	for {
+		line, err := w.buf.ReadString('\n')
+		if err != nil {
+			// Keep the incomplete line for the next write
+			w.buf.WriteString(line)
+			break
+		}
+		if err := w.send(strings.TrimSuffix(line, "\n")); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+func (w *syslogWriter) send(line string) error {
+	if w.priority&0x7 == syslog.LOG_ERR {
+		return w.writer.Err(line)
+	}
+	return w.writer.Info(line)
+}
+
+func (w *syslogWriter) Close() error {
+	if w.buf.Len() > 0 {
+		w.send(w.buf.String())
+		w.buf.Reset()
+	}
+	return w.writer.Close()
+}
@@ -0,0 +1,194 @@
+package docker
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/dotcloud/docker/utils"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRotatingFile(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "docker-logdriver-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	logPath := path.Join(tmp, "test-json.log")
+
+	// Each line is 8 bytes long: 2 lines fit in a file
+	log, err := newRotatingFile(logPath, 16, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 7; i++ {
+		if _, err := fmt.Fprintf(log, "line %02d\n", i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := log.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{
+		logPath:        "line 06\n",
+		logPath + ".1": "line 04\nline 05\n",
+		logPath + ".2": "line 02\nline 03\n",
+	}
+	for file, content := range expected {
+		if data, err := ioutil.ReadFile(file); err != nil {
+			t.Fatal(err)
+		} else if string(data) != content {
+			t.Fatalf("Expected %q in %s, found %q", content, file, data)
+		}
+	}
+	if _, err := os.Stat(logPath + ".3"); !os.IsNotExist(err) {
+		t.Fatalf("Only 3 files should be kept (err=%v)", err)
+	}
+
+	reader, err := openRotatedLogs(logPath, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "line 02\nline 03\nline 04\nline 05\nline 06\n" {
+		t.Fatalf("Logs should be read from the oldest file to the newest, found %q", data)
+	}
+
+	tails := map[int]string{
+		0:  "",
+		1:  "line 06\n",
+		2:  "line 05\nline 06\n",
+		4:  "line 03\nline 04\nline 05\nline 06\n",
+		10: "line 02\nline 03\nline 04\nline 05\nline 06\n",
+	}
+	for n, expected := range tails {
+		reader, err := openRotatedLogs(logPath, n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadAll(reader)
+		reader.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != expected {
+			t.Fatalf("Expected %q for the last %d lines, found %q", expected, n, data)
+		}
+	}
+}
+
+func TestValidateLogConfig(t *testing.T) {
+	valid := []LogConfig{
+		{},
+		{Driver: "json", Options: map[string]string{"max-size": "10m", "max-file": "5"}},
+		{Driver: "syslog"},
+		{Driver: "none"},
+	}
+	for _, config := range valid {
+		if err := validateLogConfig(config); err != nil {
+			t.Fatalf("Unexpected error for %v: %s", config, err)
+		}
+	}
+
+	invalid := []LogConfig{
+		{Driver: "carrier-pigeon"},
+		{Driver: "syslog", Options: map[string]string{"max-size": "10m"}},
+		{Driver: "json", Options: map[string]string{"max-size": "lots"}},
+		{Driver: "json", Options: map[string]string{"max-file": "2"}},
+		{Driver: "json", Options: map[string]string{"max-size": "1k", "max-file": "0"}},
+	}
+	for _, config := range invalid {
+		if err := validateLogConfig(config); err == nil {
+			t.Fatalf("Expected an error for %v", config)
+		}
+	}
+}
+
+// jsonLogLines returns the lines logged at `start` plus each second of
+// `seconds`, as written by the json log driver.
+func jsonLogLines(t *testing.T, stream string, start time.Time, seconds ...int) []byte {
+	buf := &bytes.Buffer{}
+	for _, s := range seconds {
+		line, err := json.Marshal(&utils.JSONLog{Log: fmt.Sprintf("line %d\n", s), Stream: stream, Created: start.Add(time.Duration(s) * time.Second)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf.Write(append(line, '\n'))
+	}
+	return buf.Bytes()
+}
+
+func TestTailLogsSince(t *testing.T) {
+	start := time.Now()
+	logs := jsonLogLines(t, "stdout", start, 1, 2, 3, 4, 5)
+
+	// The lines before since don't count in the tail
+	reader, err := tailLogsSince(bytes.NewReader(logs), 3, start.Add(3*time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := jsonLogLines(t, "stdout", start, 4, 5); !bytes.Equal(data, expected) {
+		t.Fatalf("Expected %s, found %s", expected, data)
+	}
+
+	reader, err = tailLogsSince(bytes.NewReader(logs), 2, start)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, err = ioutil.ReadAll(reader); err != nil {
+		t.Fatal(err)
+	}
+	if expected := jsonLogLines(t, "stdout", start, 4, 5); !bytes.Equal(data, expected) {
+		t.Fatalf("Expected %s, found %s", expected, data)
+	}
+}
+
+func TestLogFollowerRelease(t *testing.T) {
+	start := time.Now()
+	out := &bytes.Buffer{}
+	output := &logWriter{stdout: true, outStream: out}
+	follower := newLogFollower(output)
+
+	// Lines 2 and 3 are logged while the log file is read, after line 2
+	// made it into the file
+	if _, err := follower.Write(jsonLogLines(t, "stdout", start, 2, 3)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := output.Write(jsonLogLines(t, "stdout", start, 1, 2)); err != nil {
+		t.Fatal(err)
+	}
+	if err := follower.release(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := follower.Write(jsonLogLines(t, "stdout", start, 4)); err != nil {
+		t.Fatal(err)
+	}
+	if expected := "line 1\nline 2\nline 3\nline 4\n"; out.String() != expected {
+		t.Fatalf("Expected each line once, in order, found %q", out.String())
+	}
+
+	// A follower released before anything was read forwards every line
+	out.Reset()
+	follower = newLogFollower(&logWriter{stdout: true, outStream: out})
+	follower.Write(jsonLogLines(t, "stdout", start, 1))
+	if err := follower.release(); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "line 1") {
+		t.Fatalf("Expected the held line, found %q", out.String())
+	}
+}
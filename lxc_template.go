@@ -21,9 +21,29 @@ lxc.network.type = empty
 lxc.network.type = veth
 lxc.network.flags = up
 lxc.network.link = {{.NetworkSettings.Bridge}}
+{{if .NetworkSettings.HostVeth}}
+lxc.network.veth.pair = {{.NetworkSettings.HostVeth}}
+{{end}}
 lxc.network.name = eth0
 lxc.network.mtu = 1500
+{{if .NetworkSettings.MacAddress}}
+lxc.network.hwaddr = {{.NetworkSettings.MacAddress}}
+{{end}}
 lxc.network.ipv4 = {{.NetworkSettings.IPAddress}}/{{.NetworkSettings.IPPrefixLen}}
+{{if .NetworkSettings.IPv6Address}}
+lxc.network.ipv6 = {{.NetworkSettings.IPv6Address}}/{{.NetworkSettings.IPv6PrefixLen}}
+{{end}}{{range .NetworkSettings.ExtraEndpoints}}
+# interface on another network
+lxc.network.type = veth
+lxc.network.flags = up
+lxc.network.link = {{.Bridge}}
+lxc.network.veth.pair = {{.HostVeth}}
+lxc.network.name = {{.Interface}}
+lxc.network.mtu = 1500
+lxc.network.ipv4 = {{.IPAddress}}/{{.IPPrefixLen}}
+{{if .IPv6Address}}
+lxc.network.ipv6 = {{.IPv6Address}}/{{.IPv6PrefixLen}}
+{{end}}{{end}}
 {{end}}
 
 # root filesystem
@@ -427,8 +427,6 @@ func NetworkLinkAdd(name string, linkType string) error {
 	nameData := newRtAttr(syscall.IFLA_IFNAME, zeroTerminated(name))
 	wb.AddData(nameData)
 
-	IFLA_INFO_KIND := 1
-
 	kindData := newRtAttr(IFLA_INFO_KIND, nonZeroTerminated(linkType))
 
 	infoData := newRtAttr(syscall.IFLA_LINKINFO, kindData.ToWireFormat())
@@ -441,6 +439,131 @@ func NetworkLinkAdd(name string, linkType string) error {
 	return s.HandleAck(wb.Seq)
 }
 
+// Delete a network interface. Deleting one end of a veth pair deletes the
+// other one too. This is identical to: ip link del $iface
+func NetworkLinkDel(iface *net.Interface) error {
+	s, err := getNetlinkSocket()
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	wb := newNetlinkRequest(syscall.RTM_DELLINK, syscall.NLM_F_ACK)
+
+	msg := newIfInfomsg(syscall.AF_UNSPEC)
+	msg.Index = int32(iface.Index)
+	wb.AddData(msg)
+
+	if err := s.Send(wb); err != nil {
+		return err
+	}
+
+	return s.HandleAck(wb.Seq)
+}
+
+const (
+	IFLA_INFO_KIND = 1
+	IFLA_INFO_DATA = 2
+	VETH_INFO_PEER = 1
+)
+
+// wireFormat concatenates the wire format of several pieces of request data,
+// to be used as the payload of a nested attribute.
+func wireFormat(data ...NetlinkRequestData) []byte {
+	var b []byte
+	for _, d := range data {
+		b = append(b, d.ToWireFormat()...)
+	}
+	return b
+}
+
+func uint32Attr(attrType int, value uint32) *RtAttr {
+	b := make([]byte, 4)
+	nativeEndian().PutUint32(b, value)
+	return newRtAttr(attrType, b)
+}
+
+// Send a RTM_NEWLINK request changing a single attribute of an existing interface
+func networkLinkSetAttr(iface *net.Interface, attr *RtAttr) error {
+	s, err := getNetlinkSocket()
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	wb := newNetlinkRequest(syscall.RTM_NEWLINK, syscall.NLM_F_ACK)
+
+	msg := newIfInfomsg(syscall.AF_UNSPEC)
+	msg.Index = int32(iface.Index)
+	wb.AddData(msg)
+	wb.AddData(attr)
+
+	if err := s.Send(wb); err != nil {
+		return err
+	}
+
+	return s.HandleAck(wb.Seq)
+}
+
+// Create a pair of connected veth interfaces. This is identical to:
+// ip link add $name type veth peer name $peerName
+func NetworkCreateVethPair(name, peerName string) error {
+	s, err := getNetlinkSocket()
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	wb := newNetlinkRequest(syscall.RTM_NEWLINK, syscall.NLM_F_CREATE|syscall.NLM_F_EXCL|syscall.NLM_F_ACK)
+
+	msg := newIfInfomsg(syscall.AF_UNSPEC)
+	wb.AddData(msg)
+
+	nameData := newRtAttr(syscall.IFLA_IFNAME, zeroTerminated(name))
+	wb.AddData(nameData)
+
+	peer := newRtAttr(VETH_INFO_PEER, wireFormat(newIfInfomsg(syscall.AF_UNSPEC), newRtAttr(syscall.IFLA_IFNAME, zeroTerminated(peerName))))
+	kindData := newRtAttr(IFLA_INFO_KIND, nonZeroTerminated("veth"))
+	infoData := newRtAttr(IFLA_INFO_DATA, peer.ToWireFormat())
+	wb.AddData(newRtAttr(syscall.IFLA_LINKINFO, wireFormat(kindData, infoData)))
+
+	if err := s.Send(wb); err != nil {
+		return err
+	}
+
+	return s.HandleAck(wb.Seq)
+}
+
+// Move a network interface to the network namespace of a process. This is identical to:
+// ip link set $iface netns $pid
+func NetworkSetNsPid(iface *net.Interface, pid int) error {
+	return networkLinkSetAttr(iface, uint32Attr(syscall.IFLA_NET_NS_PID, uint32(pid)))
+}
+
+// Rename a network interface, which must be down. This is identical to:
+// ip link set $iface name $name
+func NetworkChangeName(iface *net.Interface, name string) error {
+	return networkLinkSetAttr(iface, newRtAttr(syscall.IFLA_IFNAME, zeroTerminated(name)))
+}
+
+// Set the MTU of a network interface. This is identical to:
+// ip link set $iface mtu $mtu
+func NetworkSetMTU(iface *net.Interface, mtu int) error {
+	return networkLinkSetAttr(iface, uint32Attr(syscall.IFLA_MTU, uint32(mtu)))
+}
+
+// Change the MAC address of a network interface. This is identical to:
+// ip link set $iface address $hwaddr
+func NetworkSetMacAddress(iface *net.Interface, hwaddr net.HardwareAddr) error {
+	return networkLinkSetAttr(iface, newRtAttr(syscall.IFLA_ADDRESS, []byte(hwaddr)))
+}
+
+// Attach a network interface to a bridge. This is identical to:
+// ip link set $iface master $master
+func NetworkSetMaster(iface, master *net.Interface) error {
+	return networkLinkSetAttr(iface, uint32Attr(syscall.IFLA_MASTER, uint32(master.Index)))
+}
+
 // Returns an array of IPNet for all the currently routed subnets on ipv4
 // This is similar to the first column of "ip route" output
 func NetworkGetRoutes() ([]*net.IPNet, error) {
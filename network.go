@@ -8,9 +8,13 @@ import (
 	"github.com/dotcloud/docker/netlink"
 	"github.com/dotcloud/docker/proxy"
 	"github.com/dotcloud/docker/utils"
+	"io/ioutil"
 	"log"
+	"math/big"
 	"net"
+	"path"
 	"strconv"
+	"strings"
 	"sync"
 )
 
@@ -24,8 +28,11 @@ const (
 // Calculates the first and last IP addresses in an IPNet
 func networkRange(network *net.IPNet) (net.IP, net.IP) {
 	netIP := network.IP.To4()
+	if len(network.Mask) == net.IPv6len {
+		netIP = network.IP.To16()
+	}
 	firstIP := netIP.Mask(network.Mask)
-	lastIP := net.IPv4(0, 0, 0, 0).To4()
+	lastIP := make(net.IP, len(netIP))
 	for i := 0; i < len(lastIP); i++ {
 		lastIP[i] = netIP[i] | ^network.Mask[i]
 	}
@@ -57,6 +64,19 @@ func intToIP(n int32) net.IP {
 	return net.IP(b)
 }
 
+// Converts a 16 bytes IP into a big integer
+func ipv6ToBig(ip net.IP) *big.Int {
+	return new(big.Int).SetBytes(ip.To16())
+}
+
+// Converts a big integer into a 16 bytes IP address
+func bigToIPv6(n *big.Int) net.IP {
+	b := n.Bytes()
+	ip := make(net.IP, net.IPv6len)
+	copy(ip[net.IPv6len-len(b):], b)
+	return ip
+}
+
 // Given a netmask, calculates the number of available hosts
 func networkSize(mask net.IPMask) int32 {
 	m := net.IPv4Mask(0, 0, 0, 0)
@@ -122,10 +142,26 @@ func CreateBridgeIface(config *DaemonConfig) error {
 	}
 	utils.Debugf("Creating bridge %s with network %s", config.BridgeIface, ifaceAddr)
 
-	if err := netlink.NetworkLinkAdd(config.BridgeIface, "bridge"); err != nil {
+	if err := createBridge(config.BridgeIface, ifaceAddr); err != nil {
+		return err
+	}
+
+	if config.EnableIptables {
+		if err := iptables.Raw("-t", "nat", "-A", "POSTROUTING", "-s", ifaceAddr,
+			"!", "-d", ifaceAddr, "-j", "MASQUERADE"); err != nil {
+			return fmt.Errorf("Unable to enable network bridge NAT: %s", err)
+		}
+	}
+	return nil
+}
+
+// createBridge creates the bridge `name`, with the address `ifaceAddr` in
+// CIDR notation, and brings it up.
+func createBridge(name, ifaceAddr string) error {
+	if err := netlink.NetworkLinkAdd(name, "bridge"); err != nil {
 		return fmt.Errorf("Error creating bridge: %s", err)
 	}
-	iface, err := net.InterfaceByName(config.BridgeIface)
+	iface, err := net.InterfaceByName(name)
 	if err != nil {
 		return err
 	}
@@ -139,14 +175,95 @@ func CreateBridgeIface(config *DaemonConfig) error {
 	if err := netlink.NetworkLinkUp(iface); err != nil {
 		return fmt.Errorf("Unable to start network bridge: %s", err)
 	}
+	return nil
+}
 
-	if config.EnableIptables {
-		if err := iptables.Raw("-t", "nat", "-A", "POSTROUTING", "-s", ifaceAddr,
-			"!", "-d", ifaceAddr, "-j", "MASQUERADE"); err != nil {
-			return fmt.Errorf("Unable to enable network bridge NAT: %s", err)
+// setupBridgeIPv6 gives the bridge `name` an address on the IPv6 subnet
+// `subnet`, and enables the forwarding of IPv6. The address is the one of
+// `subnet` if it has one, as in 2001:db8::1/64, or else its first address.
+func setupBridgeIPv6(name, subnet string) (*net.IPNet, error) {
+	ip, ipNet, err := net.ParseCIDR(subnet)
+	if err != nil || ip.To4() != nil {
+		return nil, fmt.Errorf("%s is not an IPv6 subnet", subnet)
+	}
+	if ones, _ := ipNet.Mask.Size(); ones > 126 {
+		return nil, fmt.Errorf("The IPv6 subnet %s is too small", subnet)
+	}
+	if ip.Equal(ipNet.IP) {
+		ip = bigToIPv6(new(big.Int).Add(ipv6ToBig(ip), big.NewInt(1)))
+	}
+	bridgeNetwork := &net.IPNet{IP: ip, Mask: ipNet.Mask}
+
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	configured := false
+	for _, addr := range addrs {
+		if addr.(*net.IPNet).IP.Equal(ip) {
+			configured = true
 		}
 	}
-	return nil
+	if !configured {
+		utils.Debugf("Adding %s to bridge %s", bridgeNetwork, name)
+		if err := netlink.NetworkLinkAddIp(iface, ip, bridgeNetwork); err != nil {
+			return nil, fmt.Errorf("Unable to add IPv6 network: %s", err)
+		}
+	}
+	if err := ioutil.WriteFile("/proc/sys/net/ipv6/conf/all/forwarding", []byte("1\n"), 0644); err != nil {
+		return nil, fmt.Errorf("Unable to enable IPv6 forwarding: %s", err)
+	}
+	return bridgeNetwork, nil
+}
+
+// createVeth creates a veth pair, attaches the end `vethHost` to `bridge`
+// and moves the end `vethPeer` into the network namespace of the process
+// `pid`.
+func createVeth(bridge, vethHost, vethPeer string, pid int) error {
+	master, err := net.InterfaceByName(bridge)
+	if err != nil {
+		return fmt.Errorf("Unable to find bridge %s: %s", bridge, err)
+	}
+	if err := netlink.NetworkCreateVethPair(vethHost, vethPeer); err != nil {
+		return fmt.Errorf("Unable to create veth pair %s: %s", vethHost, err)
+	}
+	host, err := net.InterfaceByName(vethHost)
+	if err != nil {
+		return err
+	}
+	if err := netlink.NetworkSetMaster(host, master); err != nil {
+		return fmt.Errorf("Unable to attach %s to %s: %s", vethHost, bridge, err)
+	}
+	if err := netlink.NetworkSetMTU(host, 1500); err != nil {
+		return err
+	}
+	if err := netlink.NetworkLinkUp(host); err != nil {
+		return err
+	}
+	peer, err := net.InterfaceByName(vethPeer)
+	if err != nil {
+		return err
+	}
+	return netlink.NetworkSetNsPid(peer, pid)
+}
+
+// deleteVeth deletes the veth pair whose host end is `vethHost`.
+func deleteVeth(vethHost string) error {
+	iface, err := net.InterfaceByName(vethHost)
+	if err != nil {
+		return err
+	}
+	return netlink.NetworkLinkDel(iface)
+}
+
+// vethPeerName returns the name of the end of the veth pair `vethHost`
+// moved into the container, before it is renamed there.
+func vethPeerName(vethHost string) string {
+	return "vethc" + strings.TrimPrefix(vethHost, "veth")
 }
 
 // Return the IPv4 address of a network interface
@@ -178,6 +295,8 @@ func getIfaceAddr(name string) (net.Addr, error) {
 
 // Port mapper takes care of mapping external ports to containers by setting
 // up iptables rules.
+// Ports published on IPv6 addresses are only forwarded by the userland
+// proxy, iptables being IPv4 only.
 // It keeps track of all mappings and is able to unmap at will
 type PortMapper struct {
 	tcpMapping map[int]*net.TCPAddr
@@ -193,7 +312,7 @@ func (mapper *PortMapper) Map(ip net.IP, port int, backendAddr net.Addr) error {
 	if _, isTCP := backendAddr.(*net.TCPAddr); isTCP {
 		backendPort := backendAddr.(*net.TCPAddr).Port
 		backendIP := backendAddr.(*net.TCPAddr).IP
-		if mapper.iptables != nil {
+		if mapper.iptables != nil && ip.To4() != nil {
 			if err := mapper.iptables.Forward(iptables.Add, ip, port, "tcp", backendIP.String(), backendPort); err != nil {
 				return err
 			}
@@ -209,7 +328,7 @@ func (mapper *PortMapper) Map(ip net.IP, port int, backendAddr net.Addr) error {
 	} else {
 		backendPort := backendAddr.(*net.UDPAddr).Port
 		backendIP := backendAddr.(*net.UDPAddr).IP
-		if mapper.iptables != nil {
+		if mapper.iptables != nil && ip.To4() != nil {
 			if err := mapper.iptables.Forward(iptables.Add, ip, port, "udp", backendIP.String(), backendPort); err != nil {
 				return err
 			}
@@ -236,7 +355,7 @@ func (mapper *PortMapper) Unmap(ip net.IP, port int, proto string) error {
 			proxy.Close()
 			delete(mapper.tcpProxies, port)
 		}
-		if mapper.iptables != nil {
+		if mapper.iptables != nil && ip.To4() != nil {
 			if err := mapper.iptables.Forward(iptables.Delete, ip, port, proto, backendAddr.IP.String(), backendAddr.Port); err != nil {
 				return err
 			}
@@ -251,7 +370,7 @@ func (mapper *PortMapper) Unmap(ip net.IP, port int, proto string) error {
 			proxy.Close()
 			delete(mapper.udpProxies, port)
 		}
-		if mapper.iptables != nil {
+		if mapper.iptables != nil && ip.To4() != nil {
 			if err := mapper.iptables.Forward(iptables.Delete, ip, port, proto, backendAddr.IP.String(), backendAddr.Port); err != nil {
 				return err
 			}
@@ -359,6 +478,7 @@ type IPAllocator struct {
 	network       *net.IPNet
 	queueAlloc    chan allocatedIP
 	queueReleased chan net.IP
+	queueReserved chan reservedIP
 	inUse         map[int32]struct{}
 	quit          chan bool
 }
@@ -368,6 +488,11 @@ type allocatedIP struct {
 	err error
 }
 
+type reservedIP struct {
+	ip  net.IP
+	err chan error
+}
+
 func (alloc *IPAllocator) run() {
 	firstIP, _ := networkRange(alloc.network)
 	ipNum := ipToInt(firstIP)
@@ -428,6 +553,22 @@ func (alloc *IPAllocator) run() {
 					pos--
 				}
 			}
+		case reserved := <-alloc.queueReserved:
+			r := ipToInt(reserved.ip)
+			if _, exists := alloc.inUse[r]; exists {
+				reserved.err <- fmt.Errorf("IP already in use: %s", reserved.ip)
+			} else {
+				alloc.inUse[r] = struct{}{}
+				reserved.err <- nil
+			}
+			// The IP found above may be the one just reserved: look again
+			if !inUse {
+				if pos == 1 {
+					pos = max
+				} else {
+					pos--
+				}
+			}
 		}
 	}
 }
@@ -441,11 +582,19 @@ func (alloc *IPAllocator) Release(ip net.IP) {
 	alloc.queueReleased <- ip
 }
 
+// Reserve marks `ip` as in use, unless it already is.
+func (alloc *IPAllocator) Reserve(ip net.IP) error {
+	err := make(chan error)
+	alloc.queueReserved <- reservedIP{ip: ip, err: err}
+	return <-err
+}
+
 func (alloc *IPAllocator) Close() error {
 	alloc.quit <- true
 	close(alloc.quit)
 	close(alloc.queueAlloc)
 	close(alloc.queueReleased)
+	close(alloc.queueReserved)
 	return nil
 }
 
@@ -454,6 +603,7 @@ func newIPAllocator(network *net.IPNet) *IPAllocator {
 		network:       network,
 		queueAlloc:    make(chan allocatedIP),
 		queueReleased: make(chan net.IP),
+		queueReserved: make(chan reservedIP),
 		inUse:         make(map[int32]struct{}),
 		quit:          make(chan bool),
 	}
@@ -463,19 +613,100 @@ func newIPAllocator(network *net.IPNet) *IPAllocator {
 	return alloc
 }
 
+// IPv6 allocator: hands out the addresses of an IPv6 subnet in turn. The
+// subnets are too large to keep track of their free addresses, so only the
+// addresses in use are kept.
+type IPv6Allocator struct {
+	sync.Mutex
+	network *net.IPNet // Address of the gateway and mask of the subnet
+	first   *big.Int
+	size    *big.Int
+	next    *big.Int // Offset in the subnet of the next address handed out
+	inUse   map[string]struct{}
+}
+
+func newIPv6Allocator(network *net.IPNet) *IPv6Allocator {
+	firstIP, _ := networkRange(network)
+	ones, bits := network.Mask.Size()
+	return &IPv6Allocator{
+		network: network,
+		first:   ipv6ToBig(firstIP),
+		size:    new(big.Int).Lsh(big.NewInt(1), uint(bits-ones)),
+		next:    big.NewInt(1),
+		inUse:   make(map[string]struct{}),
+	}
+}
+
+func (alloc *IPv6Allocator) Acquire() (net.IP, error) {
+	alloc.Lock()
+	defer alloc.Unlock()
+	// Only the addresses in use, the gateway and the subnet-router anycast
+	// address can be skipped before finding a free one, plus one more
+	// attempt for the address after them
+	for attempt := 0; attempt < len(alloc.inUse)+3; attempt++ {
+		offset := new(big.Int).Set(alloc.next)
+		alloc.next.Add(alloc.next, big.NewInt(1))
+		alloc.next.Mod(alloc.next, alloc.size)
+		if offset.Sign() == 0 {
+			continue
+		}
+		ip := bigToIPv6(offset.Add(offset, alloc.first))
+		if ip.Equal(alloc.network.IP) {
+			continue
+		}
+		if _, inUse := alloc.inUse[ip.String()]; !inUse {
+			alloc.inUse[ip.String()] = struct{}{}
+			return ip, nil
+		}
+	}
+	return nil, errors.New("No unallocated IPv6 available")
+}
+
+// Reserve marks `ip` as in use, unless it already is.
+func (alloc *IPv6Allocator) Reserve(ip net.IP) error {
+	alloc.Lock()
+	defer alloc.Unlock()
+	if _, exists := alloc.inUse[ip.String()]; exists {
+		return fmt.Errorf("IP already in use: %s", ip)
+	}
+	alloc.inUse[ip.String()] = struct{}{}
+	return nil
+}
+
+func (alloc *IPv6Allocator) Release(ip net.IP) {
+	alloc.Lock()
+	delete(alloc.inUse, ip.String())
+	alloc.Unlock()
+}
+
 // Network interface represents the networking stack of a container
 type NetworkInterface struct {
 	IPNet   net.IPNet
 	Gateway net.IP
 
+	// nil when the network has no IPv6 subnet
+	IPv6Net     *net.IPNet
+	IPv6Gateway net.IP
+
 	manager  *NetworkManager
+	network  *Network
 	extPorts []*Nat
 	disabled bool
+	static   bool // The IPv4 address stays reserved until the container is destroyed
 }
 
 // Allocate an external port and map it to the interface
 func (iface *NetworkInterface) AllocatePort(port Port, binding PortBinding) (*Nat, error) {
+	return iface.mapPort(port, binding, false)
+}
 
+// restorePort maps the host port of `binding`, which the runtime reserved
+// when it was restored, to the interface.
+func (iface *NetworkInterface) restorePort(port Port, binding PortBinding) (*Nat, error) {
+	return iface.mapPort(port, binding, true)
+}
+
+func (iface *NetworkInterface) mapPort(port Port, binding PortBinding, reserved bool) (*Nat, error) {
 	if iface.disabled {
 		return nil, fmt.Errorf("Trying to allocate port for interface %v, which is disabled", iface) // FIXME
 	}
@@ -499,9 +730,15 @@ func (iface *NetworkInterface) AllocatePort(port Port, binding PortBinding) (*Na
 	}
 
 	hostPort, _ := parsePort(nat.Binding.HostPort)
+	acquire := func(allocator *PortAllocator) (int, error) {
+		if reserved && hostPort != 0 {
+			return hostPort, nil
+		}
+		return allocator.Acquire(hostPort)
+	}
 
 	if nat.Port.Proto() == "tcp" {
-		extPort, err := iface.manager.tcpPortAllocator.Acquire(hostPort)
+		extPort, err := acquire(iface.manager.tcpPortAllocator)
 		if err != nil {
 			return nil, err
 		}
@@ -513,7 +750,7 @@ func (iface *NetworkInterface) AllocatePort(port Port, binding PortBinding) (*Na
 		}
 		nat.Binding.HostPort = strconv.Itoa(extPort)
 	} else {
-		extPort, err := iface.manager.udpPortAllocator.Acquire(hostPort)
+		extPort, err := acquire(iface.manager.udpPortAllocator)
 		if err != nil {
 			return nil, err
 		}
@@ -564,7 +801,12 @@ func (iface *NetworkInterface) Release() {
 		}
 	}
 
-	iface.manager.ipAllocator.Release(iface.IPNet.IP)
+	if !iface.static {
+		iface.network.ipAllocator.Release(iface.IPNet.IP)
+	}
+	if iface.IPv6Net != nil {
+		iface.network.ipv6Allocator.Release(iface.IPv6Net.IP)
+	}
 }
 
 // Network Manager manages a set of network interfaces
@@ -578,6 +820,14 @@ type NetworkManager struct {
 	udpPortAllocator *PortAllocator
 	portMapper       *PortMapper
 
+	// The default network is the bridge above
+	defaultNetwork *Network
+	networks       map[string]*Network // User-defined networks, by ID
+	networksPath   string
+	networksLock   sync.Mutex
+	enableIptables bool
+	icc            bool
+
 	disabled bool
 }
 
@@ -611,6 +861,11 @@ func (manager *NetworkManager) Allocate() (*NetworkInterface, error) {
 		IPNet:   net.IPNet{IP: ip, Mask: manager.bridgeNetwork.Mask},
 		Gateway: manager.bridgeNetwork.IP,
 		manager: manager,
+		network: manager.defaultNetwork,
+	}
+	if err := manager.defaultNetwork.acquireIPv6(iface); err != nil {
+		manager.ipAllocator.Release(ip)
+		return nil, err
 	}
 	return iface, nil
 }
@@ -619,6 +874,9 @@ func (manager *NetworkManager) Close() error {
 	err1 := manager.tcpPortAllocator.Close()
 	err2 := manager.udpPortAllocator.Close()
 	err3 := manager.ipAllocator.Close()
+	for _, network := range manager.networks {
+		network.ipAllocator.Close()
+	}
 	if err1 != nil {
 		return err1
 	}
@@ -651,23 +909,20 @@ func newNetworkManager(config *DaemonConfig) (*NetworkManager, error) {
 
 	// Configure iptables for link support
 	if config.EnableIptables {
-		args := []string{"FORWARD", "-i", config.BridgeIface, "-o", config.BridgeIface, "-j", "DROP"}
-
-		if !config.InterContainerCommunication {
-			if !iptables.Exists(args...) {
-				utils.Debugf("Disable inter-container communication")
-				if err := iptables.Raw(append([]string{"-A"}, args...)...); err != nil {
-					return nil, fmt.Errorf("Unable to prevent intercontainer communication: %s", err)
-				}
-			}
-		} else {
-			utils.Debugf("Enable inter-container communication")
-			iptables.Raw(append([]string{"-D"}, args...)...)
+		if err := setupIcc(config.BridgeIface, config.InterContainerCommunication); err != nil {
+			return nil, err
 		}
 	}
 
 	ipAllocator := newIPAllocator(network)
 
+	var networkV6 *net.IPNet
+	if config.IPv6Subnet != "" {
+		if networkV6, err = setupBridgeIPv6(config.BridgeIface, config.IPv6Subnet); err != nil {
+			return nil, err
+		}
+	}
+
 	tcpPortAllocator, err := newPortAllocator()
 	if err != nil {
 		return nil, err
@@ -689,7 +944,47 @@ func newNetworkManager(config *DaemonConfig) (*NetworkManager, error) {
 		tcpPortAllocator: tcpPortAllocator,
 		udpPortAllocator: udpPortAllocator,
 		portMapper:       portMapper,
+		networks:         make(map[string]*Network),
+		networksPath:     path.Join(config.GraphPath, "networks.json"),
+		enableIptables:   config.EnableIptables,
+		icc:              config.InterContainerCommunication,
+	}
+	manager.defaultNetwork = &Network{
+		Name:          DefaultNetworkName,
+		Bridge:        config.BridgeIface,
+		Subnet:        (&net.IPNet{IP: network.IP.Mask(network.Mask), Mask: network.Mask}).String(),
+		Gateway:       network.IP.String(),
+		bridgeNetwork: network,
+		ipAllocator:   ipAllocator,
+	}
+	if networkV6 != nil {
+		manager.defaultNetwork.SubnetIPv6 = (&net.IPNet{IP: networkV6.IP.Mask(networkV6.Mask), Mask: networkV6.Mask}).String()
+		manager.defaultNetwork.GatewayIPv6 = networkV6.IP.String()
+		manager.defaultNetwork.bridgeNetworkV6 = networkV6
+		manager.defaultNetwork.ipv6Allocator = newIPv6Allocator(networkV6)
+	}
+	if err := manager.loadNetworks(); err != nil {
+		return nil, err
 	}
 
 	return manager, nil
 }
+
+// setupIcc allows or prevents the communication between the containers on
+// `bridge`, which links allow again between two containers.
+func setupIcc(bridge string, icc bool) error {
+	args := []string{"FORWARD", "-i", bridge, "-o", bridge, "-j", "DROP"}
+
+	if !icc {
+		if !iptables.Exists(args...) {
+			utils.Debugf("Disable inter-container communication on %s", bridge)
+			if err := iptables.Raw(append([]string{"-A"}, args...)...); err != nil {
+				return fmt.Errorf("Unable to prevent intercontainer communication: %s", err)
+			}
+		}
+	} else {
+		utils.Debugf("Enable inter-container communication on %s", bridge)
+		iptables.Raw(append([]string{"-D"}, args...)...)
+	}
+	return nil
+}
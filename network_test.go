@@ -1,7 +1,9 @@
 package docker
 
 import (
+	"fmt"
 	"net"
+	"strings"
 	"testing"
 )
 
@@ -118,6 +120,22 @@ func TestNetworkRange(t *testing.T) {
 	}
 }
 
+func TestNetworkRangeIPv6(t *testing.T) {
+	_, network, _ := net.ParseCIDR("2001:db8:1:2::1/64")
+	first, last := networkRange(network)
+	if !first.Equal(net.ParseIP("2001:db8:1:2::")) {
+		t.Error(first.String())
+	}
+	if !last.Equal(net.ParseIP("2001:db8:1:2:ffff:ffff:ffff:ffff")) {
+		t.Error(last.String())
+	}
+
+	ip := net.ParseIP("2001:db8::ff")
+	if conv := bigToIPv6(ipv6ToBig(ip)); !ip.Equal(conv) {
+		t.Error(conv.String())
+	}
+}
+
 func TestConversion(t *testing.T) {
 	ip := net.ParseIP("127.0.0.1")
 	i := ipToInt(ip)
@@ -235,6 +253,113 @@ func TestIPAllocator(t *testing.T) {
 	}
 }
 
+func TestIPAllocatorReserve(t *testing.T) {
+	gwIP, n, _ := net.ParseCIDR("127.0.0.1/29")
+	alloc := newIPAllocator(&net.IPNet{IP: gwIP, Mask: n.Mask})
+	defer alloc.Close()
+
+	// 127.0.0.2 would be handed out next
+	if err := alloc.Reserve(net.IPv4(127, 0, 0, 2)); err != nil {
+		t.Fatal(err)
+	}
+	ip, err := alloc.Acquire()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertIPEquals(t, net.IPv4(127, 0, 0, 3), ip)
+
+	if err := alloc.Reserve(net.IPv4(127, 0, 0, 2)); err == nil {
+		t.Fatal("127.0.0.2 shouldn't be reserved twice")
+	}
+	if err := alloc.Reserve(net.IPv4(127, 0, 0, 3)); err == nil {
+		t.Fatal("127.0.0.3 shouldn't be reserved once acquired")
+	}
+	if err := alloc.Reserve(net.IPv4(127, 0, 0, 4)); err != nil {
+		t.Fatal(err)
+	}
+	ip, err = alloc.Acquire()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertIPEquals(t, net.IPv4(127, 0, 0, 5), ip)
+}
+
+func TestReserveIP(t *testing.T) {
+	gwIP, n, _ := net.ParseCIDR("10.0.3.1/24")
+	bridgeNetwork := &net.IPNet{IP: gwIP, Mask: n.Mask}
+	network := &Network{
+		Name:          "test",
+		Subnet:        n.String(),
+		bridgeNetwork: bridgeNetwork,
+		ipAllocator:   newIPAllocator(bridgeNetwork),
+	}
+	defer network.ipAllocator.Close()
+	manager := &NetworkManager{}
+
+	for _, ip := range []string{"10.0.4.2", "10.0.3.0", "10.0.3.1", "10.0.3.255"} {
+		if err := manager.ReserveIP(network, net.ParseIP(ip)); err == nil || !strings.HasPrefix(err.Error(), "Bad parameter") {
+			t.Errorf("Expected %s to be refused, got %v", ip, err)
+		}
+	}
+	if err := manager.ReserveIP(network, net.ParseIP("10.0.3.42")); err != nil {
+		t.Fatal(err)
+	}
+	if err := manager.ReserveIP(network, net.ParseIP("10.0.3.42")); err == nil || !strings.HasPrefix(err.Error(), "Conflict") {
+		t.Fatalf("Expected a conflict, got %v", err)
+	}
+	manager.ReleaseIP(network, net.ParseIP("10.0.3.42"))
+	if err := manager.ReserveIP(network, net.ParseIP("10.0.3.42")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReserveMAC(t *testing.T) {
+	network := &Network{Name: "test"}
+	other := &Network{Name: "other"}
+	manager := &NetworkManager{}
+
+	if err := manager.ReserveMAC(network, "02:42:0a:00:03:2a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := manager.ReserveMAC(network, "02:42:0a:00:03:2a"); err == nil || !strings.HasPrefix(err.Error(), "Conflict") {
+		t.Fatalf("Expected a conflict, got %v", err)
+	}
+	if err := manager.ReserveMAC(other, "02:42:0a:00:03:2a"); err != nil {
+		t.Fatal(err)
+	}
+	manager.ReleaseMAC(network, "02:42:0a:00:03:2a")
+	if err := manager.ReserveMAC(network, "02:42:0a:00:03:2a"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRemoveNetworkInUse(t *testing.T) {
+	network := &Network{ID: "abc", Name: "test"}
+	manager := &NetworkManager{
+		defaultNetwork: &Network{Name: DefaultNetworkName},
+		networks:       map[string]*Network{network.ID: network},
+	}
+	unused := func(*Network) error { return nil }
+
+	// A container being created on the network holds it
+	joined, err := manager.beginJoin("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := manager.RemoveNetwork(network, unused); err == nil || !strings.HasPrefix(err.Error(), "Conflict") {
+		t.Fatalf("Expected a conflict while a container joins the network, got %v", err)
+	}
+	manager.endJoin(joined)
+
+	inUse := fmt.Errorf("Conflict, network test is used by container abc")
+	if err := manager.RemoveNetwork(network, func(*Network) error { return inUse }); err != inUse {
+		t.Fatalf("Expected %s, got %v", inUse, err)
+	}
+	if _, err := manager.beginJoin("missing"); err == nil {
+		t.Fatal("Expected an error joining a missing network")
+	}
+}
+
 func assertIPEquals(t *testing.T, ip1, ip2 net.IP) {
 	if !ip1.Equal(ip2) {
 		t.Fatalf("Expected IP %s, got %s", ip1, ip2)
@@ -257,6 +382,68 @@ func AssertNoOverlap(CIDRx string, CIDRy string, t *testing.T) {
 	}
 }
 
+func TestIPv6Allocator(t *testing.T) {
+	// The gateway is ::2, so ::1 and ::3 are handed out first
+	alloc := newIPv6Allocator(&net.IPNet{IP: net.ParseIP("2001:db8::2"), Mask: net.CIDRMask(126, 128)})
+	expectedIPs := []string{"2001:db8::1", "2001:db8::3"}
+	for _, expected := range expectedIPs {
+		ip, err := alloc.Acquire()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ip.String() != expected {
+			t.Fatalf("Expected %s, got %s", expected, ip)
+		}
+	}
+	if ip, err := alloc.Acquire(); err == nil {
+		t.Fatalf("There shouldn't be any IPv6 left, got %s", ip)
+	}
+
+	alloc.Release(net.ParseIP("2001:db8::1"))
+	ip, err := alloc.Acquire()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip.String() != "2001:db8::1" {
+		t.Fatalf("Expected the released IPv6 2001:db8::1, got %s", ip)
+	}
+
+	// The subnet-router anycast address and the gateway are skipped when
+	// wrapping around, even with no address in use
+	alloc = newIPv6Allocator(&net.IPNet{IP: net.ParseIP("2001:db8::1"), Mask: net.CIDRMask(126, 128)})
+	for _, expected := range []string{"2001:db8::2", "2001:db8::3"} {
+		if ip, err = alloc.Acquire(); err != nil {
+			t.Fatal(err)
+		}
+		if ip.String() != expected {
+			t.Fatalf("Expected %s, got %s", expected, ip)
+		}
+	}
+	alloc.Release(net.ParseIP("2001:db8::2"))
+	alloc.Release(net.ParseIP("2001:db8::3"))
+	if ip, err = alloc.Acquire(); err != nil {
+		t.Fatal(err)
+	}
+	if ip.String() != "2001:db8::2" {
+		t.Fatalf("Expected 2001:db8::2 after wrapping around, got %s", ip)
+	}
+
+	// Reserved addresses are skipped
+	alloc = newIPv6Allocator(&net.IPNet{IP: net.ParseIP("2001:db8::1"), Mask: net.CIDRMask(64, 128)})
+	if err := alloc.Reserve(net.ParseIP("2001:db8::2")); err != nil {
+		t.Fatal(err)
+	}
+	if err := alloc.Reserve(net.ParseIP("2001:db8::2")); err == nil {
+		t.Fatal("2001:db8::2 shouldn't be reserved twice")
+	}
+	if ip, err = alloc.Acquire(); err != nil {
+		t.Fatal(err)
+	}
+	if ip.String() != "2001:db8::3" {
+		t.Fatalf("Expected 2001:db8::3, got %s", ip)
+	}
+}
+
 func TestNetworkOverlaps(t *testing.T) {
 	//netY starts at same IP and ends within netX
 	AssertOverlap("172.16.0.1/24", "172.16.0.1/25", t)
@@ -295,3 +482,137 @@ func TestCheckRouteOverlaps(t *testing.T) {
 		t.Fatalf("10.0.2.0/24 and 10.0.2.0 should overlap but it doesn't")
 	}
 }
+
+func TestChooseSubnet(t *testing.T) {
+	_, docker0, _ := net.ParseCIDR("172.17.42.1/16")
+	_, taken, _ := net.ParseCIDR("172.18.0.0/16")
+
+	subnet, err := chooseSubnet("", []*net.IPNet{docker0, taken})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if subnet.String() != "172.19.0.0/16" {
+		t.Fatalf("Expected the first free subnet 172.19.0.0/16, got %s", subnet)
+	}
+
+	if subnet, err := chooseSubnet("10.1.2.0/24", []*net.IPNet{docker0}); err != nil {
+		t.Fatal(err)
+	} else if subnet.String() != "10.1.2.0/24" {
+		t.Fatalf("Expected 10.1.2.0/24, got %s", subnet)
+	}
+	if _, err := chooseSubnet("172.18.5.0/24", []*net.IPNet{taken}); err == nil {
+		t.Fatal("A subnet overlapping with another network should be refused")
+	}
+	if _, err := chooseSubnet("10.1.2.0/31", nil); err == nil {
+		t.Fatal("A subnet too small for a gateway and a container should be refused")
+	}
+	if _, err := chooseSubnet("fe80::/64", nil); err == nil {
+		t.Fatal("An IPv6 subnet should be refused")
+	}
+}
+
+func TestGetNetwork(t *testing.T) {
+	manager := &NetworkManager{
+		defaultNetwork: &Network{Name: DefaultNetworkName},
+		networks: map[string]*Network{
+			"abcdef": {ID: "abcdef", Name: "front"},
+			"abc123": {ID: "abc123", Name: "back"},
+		},
+	}
+	for name, expected := range map[string]string{
+		DefaultNetworkName: DefaultNetworkName,
+		"front":            "front",
+		"abc1":             "back",
+		"abcdef":           "front",
+	} {
+		network, err := manager.GetNetwork(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if network.Name != expected {
+			t.Fatalf("Expected %s to be network %s, got %s", name, expected, network.Name)
+		}
+	}
+	// Ambiguous prefix
+	if _, err := manager.GetNetwork("abc"); err == nil {
+		t.Fatal("An ambiguous prefix shouldn't match any network")
+	}
+	if _, err := manager.GetNetwork("middle"); err == nil {
+		t.Fatal("Looking up an unknown network should fail")
+	}
+}
+
+func TestExtraEndpoints(t *testing.T) {
+	settings := &NetworkSettings{
+		Networks: map[string]*EndpointSettings{
+			"c": {Interface: "eth10"},
+			"a": {Interface: "eth0"},
+			"b": {Interface: "eth2"},
+		},
+	}
+	endpoints := settings.ExtraEndpoints()
+	if len(endpoints) != 2 || endpoints[0].Interface != "eth2" || endpoints[1].Interface != "eth10" {
+		t.Fatalf("Expected eth2 and eth10, got %v", endpoints)
+	}
+}
+
+func TestRestoreAllocations(t *testing.T) {
+	gwIP, n, _ := net.ParseCIDR("10.0.3.1/29")
+	bridgeNetwork := &net.IPNet{IP: gwIP, Mask: n.Mask}
+	ipAllocator := newIPAllocator(bridgeNetwork)
+	defer ipAllocator.Close()
+	tcpPortAllocator, err := newPortAllocator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcpPortAllocator.Close()
+	udpPortAllocator, err := newPortAllocator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udpPortAllocator.Close()
+	runtime := &Runtime{
+		networkManager: &NetworkManager{
+			ipAllocator:      ipAllocator,
+			tcpPortAllocator: tcpPortAllocator,
+			udpPortAllocator: udpPortAllocator,
+			defaultNetwork: &Network{
+				Name:          DefaultNetworkName,
+				bridgeNetwork: bridgeNetwork,
+				ipAllocator:   ipAllocator,
+			},
+		},
+	}
+
+	// A container which was running before the daemon restarted
+	container := &Container{
+		ID:     "ghost",
+		Config: &Config{},
+		NetworkSettings: &NetworkSettings{
+			IPAddress: "10.0.3.2",
+			Ports: map[Port][]PortBinding{
+				NewPort("tcp", "80"): {{HostIp: "0.0.0.0", HostPort: "49153"}},
+			},
+		},
+	}
+	runtime.reserveAllocations(container)
+
+	ip, err := ipAllocator.Acquire()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertIPEquals(t, net.IPv4(10, 0, 3, 3), ip)
+	if port, err := tcpPortAllocator.Acquire(0); err != nil {
+		t.Fatal(err)
+	} else if port == 49153 {
+		t.Fatal("The port of the restored container shouldn't be handed out")
+	}
+
+	runtime.releaseAllocations(container)
+	if err := ipAllocator.Reserve(net.IPv4(10, 0, 3, 2)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tcpPortAllocator.Acquire(49153); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,481 @@
+package docker
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/dotcloud/docker/iptables"
+	"github.com/dotcloud/docker/netlink"
+	"github.com/dotcloud/docker/utils"
+	"io/ioutil"
+	"net"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// DefaultNetworkName is the name of the network of the default bridge, which
+// the containers join unless they are given other networks.
+const DefaultNetworkName = "bridge"
+
+var validNetworkName = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+
+// Network is a user-defined network. It has a bridge and a subnet of its
+// own, and its containers can't reach the containers of the other networks.
+type Network struct {
+	ID      string
+	Name    string
+	Bridge  string
+	Subnet  string // In CIDR notation
+	Gateway string // Address of the bridge
+	Created time.Time
+
+	// Only the default network has an IPv6 subnet, set with -ipv6-subnet
+	SubnetIPv6  string `json:",omitempty"`
+	GatewayIPv6 string `json:",omitempty"`
+
+	joining         int        // Containers being created on or connected to the network
+	bridgeNetwork   *net.IPNet // Address and mask of the bridge
+	ipAllocator     *IPAllocator
+	bridgeNetworkV6 *net.IPNet
+	ipv6Allocator   *IPv6Allocator
+	staticMACs      map[string]bool // Guarded by the networksLock of the manager
+}
+
+// candidateNetworkSubnets returns the subnets tried, in order, for the
+// networks created without one.
+func candidateNetworkSubnets() []string {
+	var subnets []string
+	for i := 18; i < 32; i++ {
+		subnets = append(subnets, fmt.Sprintf("172.%d.0.0/16", i))
+	}
+	for i := 100; i < 200; i++ {
+		subnets = append(subnets, fmt.Sprintf("192.168.%d.0/24", i))
+	}
+	return subnets
+}
+
+// chooseSubnet returns the subnet `subnet`, or the first free candidate if
+// it is empty. It must not overlap with any network of `taken`.
+func chooseSubnet(subnet string, taken []*net.IPNet) (*net.IPNet, error) {
+	if subnet == "" {
+		for _, candidate := range candidateNetworkSubnets() {
+			_, ipNet, err := net.ParseCIDR(candidate)
+			if err != nil {
+				return nil, err
+			}
+			if err := checkRouteOverlaps(taken, ipNet); err == nil {
+				return ipNet, nil
+			}
+		}
+		return nil, fmt.Errorf("Could not find a free subnet, please choose one")
+	}
+	_, ipNet, err := net.ParseCIDR(subnet)
+	if err != nil || ipNet.IP.To4() == nil {
+		return nil, fmt.Errorf("Bad parameter: %s is not an IPv4 subnet", subnet)
+	}
+	if ones, _ := ipNet.Mask.Size(); ones > 30 {
+		return nil, fmt.Errorf("Bad parameter: the subnet %s is too small", subnet)
+	}
+	for _, other := range taken {
+		if networkOverlaps(ipNet, other) {
+			return nil, fmt.Errorf("Conflict, the subnet %s overlaps with %s", subnet, other)
+		}
+	}
+	return ipNet, nil
+}
+
+// lookupNetwork returns the user-defined network named `name`, or whose ID
+// is or starts with `name`. The caller must hold networksLock.
+func (manager *NetworkManager) lookupNetwork(name string) *Network {
+	var found *Network
+	for _, network := range manager.networks {
+		if network.Name == name || network.ID == name {
+			return network
+		}
+		if strings.HasPrefix(network.ID, name) {
+			if found != nil {
+				return nil
+			}
+			found = network
+		}
+	}
+	return found
+}
+
+// GetNetwork returns the network named `name`, or whose ID is or starts with
+// `name`. DefaultNetworkName is the network of the default bridge.
+func (manager *NetworkManager) GetNetwork(name string) (*Network, error) {
+	if manager.disabled {
+		return nil, fmt.Errorf("Impossible to use network %s: networking is disabled", name)
+	}
+	if name == DefaultNetworkName {
+		return manager.defaultNetwork, nil
+	}
+	manager.networksLock.Lock()
+	defer manager.networksLock.Unlock()
+	if network := manager.lookupNetwork(name); network != nil {
+		return network, nil
+	}
+	return nil, fmt.Errorf("No such network: %s", name)
+}
+
+// beginJoin returns the network `name`, which can't be removed until
+// endJoin is called: the runtime only lists a container on the network once
+// it is created or connected.
+func (manager *NetworkManager) beginJoin(name string) (*Network, error) {
+	if manager.disabled || name == DefaultNetworkName {
+		return manager.GetNetwork(name)
+	}
+	manager.networksLock.Lock()
+	defer manager.networksLock.Unlock()
+	network := manager.lookupNetwork(name)
+	if network == nil {
+		return nil, fmt.Errorf("No such network: %s", name)
+	}
+	network.joining++
+	return network, nil
+}
+
+func (manager *NetworkManager) endJoin(network *Network) {
+	if network == manager.defaultNetwork {
+		return
+	}
+	manager.networksLock.Lock()
+	network.joining--
+	manager.networksLock.Unlock()
+}
+
+// Networks returns the user-defined networks, sorted by name.
+func (manager *NetworkManager) Networks() []*Network {
+	manager.networksLock.Lock()
+	defer manager.networksLock.Unlock()
+	networks := []*Network{}
+	for _, network := range manager.networks {
+		networks = append(networks, network)
+	}
+	sortNetworks(networks, func(i, j *Network) bool { return i.Name < j.Name })
+	return networks
+}
+
+// CreateNetwork creates the network `name` on the subnet `subnet`, or on a
+// free one if it is empty.
+func (manager *NetworkManager) CreateNetwork(name, subnet string) (*Network, error) {
+	if manager.disabled {
+		return nil, fmt.Errorf("Impossible to create network %s: networking is disabled", name)
+	}
+	if !validNetworkName.MatchString(name) {
+		return nil, fmt.Errorf("Bad parameter: invalid network name %s, only [a-zA-Z0-9_.-] are allowed", name)
+	}
+	manager.networksLock.Lock()
+	defer manager.networksLock.Unlock()
+	if name == DefaultNetworkName || manager.lookupNetwork(name) != nil {
+		return nil, fmt.Errorf("Conflict, network %s already exists.", name)
+	}
+
+	taken, err := netlink.NetworkGetRoutes()
+	if err != nil {
+		return nil, err
+	}
+	taken = append(taken, manager.bridgeNetwork)
+	for _, network := range manager.networks {
+		taken = append(taken, network.bridgeNetwork)
+	}
+	ipNet, err := chooseSubnet(subnet, taken)
+	if err != nil {
+		return nil, err
+	}
+
+	id := GenerateID()
+	network := &Network{
+		ID:      id,
+		Name:    name,
+		Bridge:  "br-" + id[:12],
+		Subnet:  ipNet.String(),
+		Gateway: intToIP(ipToInt(ipNet.IP) + 1).String(),
+		Created: time.Now(),
+	}
+	if err := manager.setupNetwork(network); err != nil {
+		return nil, err
+	}
+	if err := manager.saveNetworks(); err != nil {
+		manager.teardownNetwork(network)
+		return nil, err
+	}
+	return network, nil
+}
+
+// RemoveNetwork removes the user-defined network `network` and its bridge,
+// unless `inUse` returns an error because containers are on it. `inUse` is
+// called with networksLock held, so that none joins it in the meantime.
+func (manager *NetworkManager) RemoveNetwork(network *Network, inUse func(*Network) error) error {
+	if network == manager.defaultNetwork {
+		return fmt.Errorf("Conflict, the default network can't be removed")
+	}
+	manager.networksLock.Lock()
+	defer manager.networksLock.Unlock()
+	if manager.networks[network.ID] != network {
+		return fmt.Errorf("No such network: %s", network.Name)
+	}
+	if network.joining > 0 {
+		return fmt.Errorf("Conflict, containers are joining network %s", network.Name)
+	}
+	if err := inUse(network); err != nil {
+		return err
+	}
+	manager.teardownNetwork(network)
+	return manager.saveNetworks()
+}
+
+// setupNetwork creates the bridge of `network` if it doesn't exist yet,
+// sets up its iptables rules and registers it. The caller must hold
+// networksLock.
+func (manager *NetworkManager) setupNetwork(network *Network) error {
+	_, subnet, err := net.ParseCIDR(network.Subnet)
+	if err != nil {
+		return err
+	}
+	gateway := net.ParseIP(network.Gateway)
+	if gateway == nil || !subnet.Contains(gateway) {
+		return fmt.Errorf("Invalid gateway %s for network %s", network.Gateway, network.Name)
+	}
+	network.bridgeNetwork = &net.IPNet{IP: gateway.To4(), Mask: subnet.Mask}
+
+	if _, err := net.InterfaceByName(network.Bridge); err != nil {
+		utils.Debugf("Creating bridge %s with network %s", network.Bridge, network.bridgeNetwork)
+		if err := createBridge(network.Bridge, network.bridgeNetwork.String()); err != nil {
+			return err
+		}
+	}
+	if manager.enableIptables {
+		if err := manager.setupNetworkIptables(network); err != nil {
+			return err
+		}
+	}
+	network.ipAllocator = newIPAllocator(network.bridgeNetwork)
+	manager.networks[network.ID] = network
+	return nil
+}
+
+// teardownNetwork undoes setupNetwork, and removes the bridge of `network`.
+// The caller must hold networksLock.
+func (manager *NetworkManager) teardownNetwork(network *Network) {
+	if manager.enableIptables {
+		manager.removeNetworkIptables(network)
+	}
+	if iface, err := net.InterfaceByName(network.Bridge); err == nil {
+		if err := netlink.NetworkLinkDel(iface); err != nil {
+			utils.Errorf("Unable to remove bridge %s: %s", network.Bridge, err)
+		}
+	}
+	if network.ipAllocator != nil {
+		network.ipAllocator.Close()
+		network.ipAllocator = nil
+	}
+	delete(manager.networks, network.ID)
+}
+
+func networkNatRule(network *Network) []string {
+	return []string{"POSTROUTING", "-s", network.Subnet, "!", "-d", network.Subnet, "-j", "MASQUERADE"}
+}
+
+// isolationRules returns the rules of the FORWARD chain dropping the traffic
+// between `network` and the other networks.
+func (manager *NetworkManager) isolationRules(network *Network) [][]string {
+	bridges := []string{manager.bridgeIface}
+	for _, other := range manager.networks {
+		if other.ID != network.ID {
+			bridges = append(bridges, other.Bridge)
+		}
+	}
+	var rules [][]string
+	for _, bridge := range bridges {
+		rules = append(rules,
+			[]string{"FORWARD", "-i", network.Bridge, "-o", bridge, "-j", "DROP"},
+			[]string{"FORWARD", "-i", bridge, "-o", network.Bridge, "-j", "DROP"},
+		)
+	}
+	return rules
+}
+
+func (manager *NetworkManager) setupNetworkIptables(network *Network) error {
+	nat := networkNatRule(network)
+	if err := iptables.Raw(append([]string{"-t", "nat", "-C"}, nat...)...); err != nil {
+		if err := iptables.Raw(append([]string{"-t", "nat", "-A"}, nat...)...); err != nil {
+			return fmt.Errorf("Unable to enable NAT on network %s: %s", network.Name, err)
+		}
+	}
+	if err := setupIcc(network.Bridge, manager.icc); err != nil {
+		return err
+	}
+	for _, rule := range manager.isolationRules(network) {
+		if !iptables.Exists(rule...) {
+			if err := iptables.Raw(append([]string{"-I"}, rule...)...); err != nil {
+				return fmt.Errorf("Unable to isolate network %s: %s", network.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+func (manager *NetworkManager) removeNetworkIptables(network *Network) {
+	// The rules may not exist: ignore the errors
+	iptables.Raw(append([]string{"-t", "nat", "-D"}, networkNatRule(network)...)...)
+	iptables.Raw("-D", "FORWARD", "-i", network.Bridge, "-o", network.Bridge, "-j", "DROP")
+	for _, rule := range manager.isolationRules(network) {
+		iptables.Raw(append([]string{"-D"}, rule...)...)
+	}
+}
+
+// loadNetworks sets up the user-defined networks saved by a previous
+// instance of the daemon.
+func (manager *NetworkManager) loadNetworks() error {
+	manager.networksLock.Lock()
+	defer manager.networksLock.Unlock()
+	jsonData, err := ioutil.ReadFile(manager.networksPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	var networks []*Network
+	if err := json.Unmarshal(jsonData, &networks); err != nil {
+		return err
+	}
+	for _, network := range networks {
+		if err := manager.setupNetwork(network); err != nil {
+			return fmt.Errorf("Unable to set up network %s: %s", network.Name, err)
+		}
+	}
+	return nil
+}
+
+// saveNetworks saves the user-defined networks. The caller must hold
+// networksLock.
+func (manager *NetworkManager) saveNetworks() error {
+	networks := []*Network{}
+	for _, network := range manager.networks {
+		networks = append(networks, network)
+	}
+	sortNetworks(networks, func(i, j *Network) bool { return i.Name < j.Name })
+	jsonData, err := json.Marshal(networks)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(manager.networksPath, jsonData, 0600)
+}
+
+// AllocateOn allocates a network interface on `network`.
+func (manager *NetworkManager) AllocateOn(network *Network) (*NetworkInterface, error) {
+	if network == manager.defaultNetwork {
+		return manager.Allocate()
+	}
+	ip, err := network.ipAllocator.Acquire()
+	if err != nil {
+		return nil, err
+	}
+	iface := &NetworkInterface{
+		IPNet:   net.IPNet{IP: ip, Mask: network.bridgeNetwork.Mask},
+		Gateway: network.bridgeNetwork.IP,
+		manager: manager,
+		network: network,
+	}
+	if err := network.acquireIPv6(iface); err != nil {
+		network.ipAllocator.Release(ip)
+		return nil, err
+	}
+	return iface, nil
+}
+
+// ReserveIP reserves the address `ip` on `network` for a container, until
+// ReleaseIP is called, so that it isn't handed out to the other containers.
+func (manager *NetworkManager) ReserveIP(network *Network, ip net.IP) error {
+	if !network.bridgeNetwork.Contains(ip) {
+		return fmt.Errorf("Bad parameter: %s is not on the subnet %s of network %s", ip, network.Subnet, network.Name)
+	}
+	first, last := networkRange(network.bridgeNetwork)
+	if ip.Equal(first) || ip.Equal(last) || ip.Equal(network.bridgeNetwork.IP) {
+		return fmt.Errorf("Bad parameter: %s is the address of the subnet, of its broadcast or of the gateway of network %s", ip, network.Name)
+	}
+	if err := network.ipAllocator.Reserve(ip); err != nil {
+		return fmt.Errorf("Conflict, %s is already in use on network %s", ip, network.Name)
+	}
+	return nil
+}
+
+// ReleaseIP releases the address `ip` reserved with ReserveIP.
+func (manager *NetworkManager) ReleaseIP(network *Network, ip net.IP) {
+	network.ipAllocator.Release(ip)
+}
+
+// ReserveMAC reserves the static MAC address `hwaddr` on `network` for a
+// container, until ReleaseMAC is called, so that no other container on the
+// network is created with it.
+func (manager *NetworkManager) ReserveMAC(network *Network, hwaddr string) error {
+	manager.networksLock.Lock()
+	defer manager.networksLock.Unlock()
+	if network.staticMACs[hwaddr] {
+		return fmt.Errorf("Conflict, %s is already in use on network %s", hwaddr, network.Name)
+	}
+	if network.staticMACs == nil {
+		network.staticMACs = make(map[string]bool)
+	}
+	network.staticMACs[hwaddr] = true
+	return nil
+}
+
+// ReleaseMAC releases the address `hwaddr` reserved with ReserveMAC.
+func (manager *NetworkManager) ReleaseMAC(network *Network, hwaddr string) {
+	manager.networksLock.Lock()
+	defer manager.networksLock.Unlock()
+	delete(network.staticMACs, hwaddr)
+}
+
+// allocateWithIP returns an interface with the address `ip` on `network`,
+// which ReserveIP reserved.
+func (manager *NetworkManager) allocateWithIP(network *Network, ip net.IP) (*NetworkInterface, error) {
+	iface := &NetworkInterface{
+		IPNet:   net.IPNet{IP: ip, Mask: network.bridgeNetwork.Mask},
+		Gateway: network.bridgeNetwork.IP,
+		manager: manager,
+		network: network,
+	}
+	if err := network.acquireIPv6(iface); err != nil {
+		return nil, err
+	}
+	return iface, nil
+}
+
+// acquireIPv6 gives `iface` an IPv6 address too, if `network` has an IPv6
+// subnet.
+func (network *Network) acquireIPv6(iface *NetworkInterface) error {
+	if network.ipv6Allocator == nil {
+		return nil
+	}
+	ip, err := network.ipv6Allocator.Acquire()
+	if err != nil {
+		return err
+	}
+	iface.IPv6Net = &net.IPNet{IP: ip, Mask: network.bridgeNetworkV6.Mask}
+	iface.IPv6Gateway = network.bridgeNetworkV6.IP
+	return nil
+}
+
+// restoreInterface returns the interface with the addresses `ip` and `ipv6`
+// on `network` of a container which kept running while the daemon was down.
+// `ipv6` is nil if the container has no IPv6 address. The addresses were
+// reserved by Runtime.restore.
+func (manager *NetworkManager) restoreInterface(network *Network, ip, ipv6 net.IP) *NetworkInterface {
+	iface := &NetworkInterface{
+		IPNet:   net.IPNet{IP: ip, Mask: network.bridgeNetwork.Mask},
+		Gateway: network.bridgeNetwork.IP,
+		manager: manager,
+		network: network,
+	}
+	if ipv6 != nil && network.ipv6Allocator != nil {
+		iface.IPv6Net = &net.IPNet{IP: ipv6, Mask: network.bridgeNetworkV6.Mask}
+		iface.IPv6Gateway = network.bridgeNetworkV6.IP
+	}
+	return iface
+}
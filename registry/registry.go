@@ -21,8 +21,10 @@ import (
 
 var (
 	ErrAlreadyExists         = errors.New("Image already exists")
+	ErrCannotResume          = errors.New("The download of the layer can't be resumed")
 	ErrInvalidRepositoryName = errors.New("Invalid repository name (ex: \"registry.domain.tld/myrepos\")")
 	ErrLoginRequired         = errors.New("Authentication is required.")
+	ErrSignatureNotFound     = errors.New("No signature found for this tag")
 )
 
 func pingRegistryEndpoint(endpoint string) error {
@@ -77,8 +79,10 @@ func validateRepositoryName(repositoryName string) error {
 	return nil
 }
 
-// Resolves a repository name to a endpoint + name
-func ResolveRepositoryName(reposName string) (string, string, error) {
+// SplitReposName splits a repository name into the hostname of its
+// registry, empty for the index, and its name on that registry. Unlike
+// ResolveRepositoryName, it doesn't contact the registry.
+func SplitReposName(reposName string) (string, string, error) {
 	if strings.Contains(reposName, "://") {
 		// It cannot contain a scheme!
 		return "", "", ErrInvalidRepositoryName
@@ -88,7 +92,7 @@ func ResolveRepositoryName(reposName string) (string, string, error) {
 		nameParts[0] != "localhost" {
 		// This is a Docker Index repos (ex: samalba/hipache or ubuntu)
 		err := validateRepositoryName(reposName)
-		return auth.IndexServerAddress(), reposName, err
+		return "", reposName, err
 	}
 	if len(nameParts) < 2 {
 		// There is a dot in repos name (and no registry address)
@@ -103,17 +107,43 @@ func ResolveRepositoryName(reposName string) (string, string, error) {
 	if err := validateRepositoryName(reposName); err != nil {
 		return "", "", err
 	}
-	endpoint, err := ExpandAndVerifyRegistryUrl(hostname)
+	return hostname, reposName, nil
+}
+
+// Resolves a repository name to a endpoint + name.
+// Registries are reached over HTTPS, unless their hostname is listed in
+// `insecureRegistries`, in which case plain HTTP is tried if HTTPS fails.
+func ResolveRepositoryName(reposName string, insecureRegistries []string) (string, string, error) {
+	hostname, reposName, err := SplitReposName(reposName)
+	if err != nil {
+		return "", "", err
+	}
+	if hostname == "" {
+		return auth.IndexServerAddress(), reposName, nil
+	}
+	endpoint, err := ExpandAndVerifyRegistryUrl(hostname, IsInsecureRegistry(hostname, insecureRegistries))
 	if err != nil {
 		return "", "", err
 	}
 	return endpoint, reposName, err
 }
 
+// IsInsecureRegistry tells whether the registry at `hostname` (with its
+// port, if any) may be reached over plain HTTP.
+func IsInsecureRegistry(hostname string, insecureRegistries []string) bool {
+	for _, insecure := range insecureRegistries {
+		if insecure == hostname {
+			return true
+		}
+	}
+	return false
+}
+
 // this method expands the registry name as used in the prefix of a repo
 // to a full url. if it already is a url, there will be no change.
-// The registry is pinged to test if it http or https
-func ExpandAndVerifyRegistryUrl(hostname string) (string, error) {
+// The registry is pinged over https, and over http if it fails and
+// `insecure` is set.
+func ExpandAndVerifyRegistryUrl(hostname string, insecure bool) (string, error) {
 	if strings.HasPrefix(hostname, "http:") || strings.HasPrefix(hostname, "https:") {
 		// if there is no slash after https:// (8 characters) then we have no path in the url
 		if strings.LastIndex(hostname, "/") < 9 {
@@ -127,6 +157,9 @@ func ExpandAndVerifyRegistryUrl(hostname string) (string, error) {
 	}
 	endpoint := fmt.Sprintf("https://%s/v1/", hostname)
 	if err := pingRegistryEndpoint(endpoint); err != nil {
+		if !insecure {
+			return "", fmt.Errorf("Invalid Registry endpoint %s: %s. If this registry only supports plain HTTP, allow it with -insecure-registry=%s on the daemon", endpoint, err, hostname)
+		}
 		utils.Debugf("Registry %s does not work (%s), falling back to http", endpoint, err)
 		endpoint = fmt.Sprintf("http://%s/v1/", hostname)
 		if err = pingRegistryEndpoint(endpoint); err != nil {
@@ -137,6 +170,27 @@ func ExpandAndVerifyRegistryUrl(hostname string) (string, error) {
 	return endpoint, nil
 }
 
+// ValidateMirror checks the URL of a registry mirror, and expands it with
+// the default path.
+func ValidateMirror(mirror string) (string, error) {
+	u, err := url.Parse(mirror)
+	if err != nil {
+		return "", fmt.Errorf("Invalid registry mirror %s: %s", mirror, err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return "", fmt.Errorf("Invalid registry mirror %s: the URL must start with http:// or https://", mirror)
+	}
+	if u.Host == "" {
+		return "", fmt.Errorf("Invalid registry mirror %s: no hostname", mirror)
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = "/v1/"
+	} else if !strings.HasSuffix(u.Path, "/") {
+		u.Path += "/"
+	}
+	return u.String(), nil
+}
+
 func doWithCookies(c *http.Client, req *http.Request) (*http.Response, error) {
 	for _, cookie := range c.Jar.Cookies(req.URL) {
 		req.AddCookie(cookie)
@@ -200,14 +254,27 @@ func (r *Registry) LookupRemoteImage(imgID, registry string, token []string) boo
 	return res.StatusCode == 200
 }
 
-// Retrieve an image from the Registry.
+// Retrieve an image from the Registry, or from one of its mirrors.
 func (r *Registry) GetRemoteImageJSON(imgID, registry string, token []string) ([]byte, int, error) {
+	for _, mirror := range r.Mirrors {
+		jsonString, imageSize, err := r.getRemoteImageJSON(imgID, mirror, nil)
+		if err == nil {
+			return jsonString, imageSize, nil
+		}
+		utils.Debugf("[registry] Unable to get the json of %s from mirror %s: %s", imgID, mirror, err)
+	}
+	return r.getRemoteImageJSON(imgID, registry, token)
+}
+
+func (r *Registry) getRemoteImageJSON(imgID, registry string, token []string) ([]byte, int, error) {
 	// Get the JSON
 	req, err := r.reqFactory.NewRequest("GET", registry+"images/"+imgID+"/json", nil)
 	if err != nil {
 		return nil, -1, fmt.Errorf("Failed to download json: %s", err)
 	}
-	req.Header.Set("Authorization", "Token "+strings.Join(token, ", "))
+	if token != nil {
+		req.Header.Set("Authorization", "Token "+strings.Join(token, ", "))
+	}
 	res, err := doWithCookies(r.client, req)
 	if err != nil {
 		return nil, -1, fmt.Errorf("Failed to download json: %s", err)
@@ -230,21 +297,80 @@ func (r *Registry) GetRemoteImageJSON(imgID, registry string, token []string) ([
 }
 
 func (r *Registry) GetRemoteImageLayer(imgID, registry string, token []string) (io.ReadCloser, error) {
+	return r.GetRemoteImageLayerFrom(imgID, registry, token, 0)
+}
+
+// GetRemoteImageLayerFrom returns the layer of an image starting `offset`
+// bytes in, to resume an interrupted download. It sends a Range request,
+// and skips the first bytes itself if the registry ignores it. It returns
+// ErrCannotResume if the registry refuses the range or answers with another
+// one, in which case the download must start over.
+// The mirrors of the registry are tried first.
+func (r *Registry) GetRemoteImageLayerFrom(imgID, registry string, token []string, offset int64) (io.ReadCloser, error) {
+	for _, mirror := range r.Mirrors {
+		layer, err := r.getRemoteImageLayer(imgID, mirror, nil, offset)
+		if err == nil {
+			return layer, nil
+		}
+		utils.Debugf("[registry] Unable to get the layer of %s from mirror %s: %s", imgID, mirror, err)
+	}
+	return r.getRemoteImageLayer(imgID, registry, token, offset)
+}
+
+func (r *Registry) getRemoteImageLayer(imgID, registry string, token []string, offset int64) (io.ReadCloser, error) {
 	req, err := r.reqFactory.NewRequest("GET", registry+"images/"+imgID+"/layer", nil)
 	if err != nil {
 		return nil, fmt.Errorf("Error while getting from the server: %s\n", err)
 	}
-	req.Header.Set("Authorization", "Token "+strings.Join(token, ", "))
+	if token != nil {
+		req.Header.Set("Authorization", "Token "+strings.Join(token, ", "))
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
 	res, err := doWithCookies(r.client, req)
 	if err != nil {
 		return nil, err
 	}
-	if res.StatusCode != 200 {
+	switch {
+	case res.StatusCode == 200:
+		if offset > 0 {
+			utils.Debugf("[registry] Range requests are not supported, skipping %d bytes of layer %s", offset, imgID)
+			if _, err := io.CopyN(ioutil.Discard, res.Body, offset); err != nil {
+				res.Body.Close()
+				return nil, err
+			}
+		}
+		return res.Body, nil
+	case res.StatusCode == 206 && offset > 0:
+		if start, err := contentRangeStart(res.Header.Get("Content-Range")); err != nil || start != offset {
+			utils.Debugf("[registry] Unexpected range %q for layer %s resumed at %d bytes", res.Header.Get("Content-Range"), imgID, offset)
+			res.Body.Close()
+			return nil, ErrCannotResume
+		}
+		return res.Body, nil
+	case res.StatusCode == 416 && offset > 0:
+		// Either the partial layer is complete, or it is longer than the
+		// layer and was corrupted: without a checksum it can't be told.
 		res.Body.Close()
-		return nil, fmt.Errorf("Server error: Status %d while fetching image layer (%s)",
-			res.StatusCode, imgID)
+		return nil, ErrCannotResume
+	}
+	res.Body.Close()
+	return nil, fmt.Errorf("Server error: Status %d while fetching image layer (%s)",
+		res.StatusCode, imgID)
+}
+
+// contentRangeStart returns the first byte of the Content-Range header
+// `value`, of the form "bytes <first>-<last>/<length>".
+func contentRangeStart(value string) (int64, error) {
+	if !strings.HasPrefix(value, "bytes ") {
+		return 0, fmt.Errorf("Invalid Content-Range: %q", value)
+	}
+	i := strings.Index(value, "-")
+	if i < 0 {
+		return 0, fmt.Errorf("Invalid Content-Range: %q", value)
 	}
-	return res.Body, nil
+	return strconv.ParseInt(strings.TrimSpace(value[len("bytes "):i]), 10, 64)
 }
 
 func (r *Registry) GetRemoteTags(registries []string, repository string, token []string) (map[string]string, error) {
@@ -476,6 +602,52 @@ func (r *Registry) PushRegistryTag(remote, revision, tag, registry string, token
 	return nil
 }
 
+// GetTagSignature returns the signed manifest of the tag `tag` of the
+// repository `remote`, or ErrSignatureNotFound if it wasn't signed.
+func (r *Registry) GetTagSignature(remote, tag, registry string, token []string) ([]byte, error) {
+	if strings.Count(remote, "/") == 0 {
+		remote = "library/" + remote
+	}
+	req, err := r.reqFactory.NewRequest("GET", fmt.Sprintf("%srepositories/%s/signatures/%s", registry, remote, tag), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Token "+strings.Join(token, ", "))
+	res, err := doWithCookies(r.client, req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode == 404 {
+		return nil, ErrSignatureNotFound
+	}
+	if res.StatusCode != 200 {
+		return nil, utils.NewHTTPRequestError(fmt.Sprintf("HTTP code %d while fetching the signature of %s:%s", res.StatusCode, remote, tag), res)
+	}
+	return ioutil.ReadAll(res.Body)
+}
+
+// PushTagSignature stores the signed manifest of the tag `tag` of the
+// repository `remote` on the registry.
+func (r *Registry) PushTagSignature(remote, tag, registry string, token []string, signature []byte) error {
+	req, err := r.reqFactory.NewRequest("PUT", fmt.Sprintf("%srepositories/%s/signatures/%s", registry, remote, tag), bytes.NewReader(signature))
+	if err != nil {
+		return err
+	}
+	req.Header.Add("Content-type", "application/json")
+	req.Header.Set("Authorization", "Token "+strings.Join(token, ","))
+	req.ContentLength = int64(len(signature))
+	res, err := doWithCookies(r.client, req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode != 200 && res.StatusCode != 201 {
+		return utils.NewHTTPRequestError(fmt.Sprintf("HTTP code %d while pushing the signature of %s:%s", res.StatusCode, remote, tag), res)
+	}
+	return nil
+}
+
 func (r *Registry) PushImageJSONIndex(indexEp, remote string, imgList []*ImgData, validate bool, regs []string) (*RepositoryData, error) {
 	cleanImgList := []*ImgData{}
 
@@ -637,6 +809,9 @@ type Registry struct {
 	client     *http.Client
 	authConfig *auth.AuthConfig
 	reqFactory *utils.HTTPRequestFactory
+	// Mirrors are tried, in order, before the registry itself to get the
+	// json and the layers of images. They are sent no credentials.
+	Mirrors []string
 }
 
 func NewRegistry(root string, authConfig *auth.AuthConfig, factory *utils.HTTPRequestFactory) (r *Registry, err error) {
@@ -192,6 +192,11 @@ func handlerGetImage(w http.ResponseWriter, r *http.Request) {
 	writeHeaders(w)
 	layer_size := len(layer["layer"])
 	w.Header().Add("X-Docker-Size", strconv.Itoa(layer_size))
+	if vars["action"] == "layer" {
+		// Supports the Range requests of resumed downloads
+		http.ServeContent(w, r, "layer", time.Time{}, strings.NewReader(layer["layer"]))
+		return
+	}
 	io.WriteString(w, layer[vars["action"]])
 }
 
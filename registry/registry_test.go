@@ -1,8 +1,12 @@
 package registry
 
 import (
+	"bytes"
 	"github.com/dotcloud/docker/auth"
 	"github.com/dotcloud/docker/utils"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"strings"
 	"testing"
 )
@@ -82,6 +86,68 @@ func TestGetRemoteImageLayer(t *testing.T) {
 	}
 }
 
+func TestGetRemoteImageLayerFrom(t *testing.T) {
+	r := spawnTestRegistry(t)
+	layer, err := r.GetRemoteImageLayer(IMAGE_ID, makeURL("/v1/"), TOKEN)
+	if err != nil {
+		t.Fatal(err)
+	}
+	full, err := ioutil.ReadAll(layer)
+	layer.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	layer, err = r.GetRemoteImageLayerFrom(IMAGE_ID, makeURL("/v1/"), TOKEN, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(layer)
+	layer.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, full[10:]) {
+		t.Fatalf("Expected the layer from byte 10, got %d bytes", len(data))
+	}
+
+	// The registry refuses a range past the end of the layer
+	if _, err := r.GetRemoteImageLayerFrom(IMAGE_ID, makeURL("/v1/"), TOKEN, int64(len(full))); err != ErrCannotResume {
+		t.Fatalf("Expected %s, got %v", ErrCannotResume, err)
+	}
+}
+
+func TestGetRemoteImageLayerFromWrongRange(t *testing.T) {
+	for _, contentRange := range []string{"bytes 0-99/100", "bytes 5-99/100", "", "items 10-99/100"} {
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if contentRange != "" {
+				w.Header().Set("Content-Range", contentRange)
+			}
+			w.WriteHeader(http.StatusPartialContent)
+			w.Write([]byte("partial"))
+		}))
+		r := spawnTestRegistry(t)
+		if _, err := r.GetRemoteImageLayerFrom(IMAGE_ID, ts.URL+"/v1/", TOKEN, 10); err != ErrCannotResume {
+			t.Errorf("Expected %s for the range %q, got %v", ErrCannotResume, contentRange, err)
+		}
+		ts.Close()
+	}
+}
+
+func TestContentRangeStart(t *testing.T) {
+	if start, err := contentRangeStart("bytes 42-99/100"); err != nil || start != 42 {
+		t.Fatalf("Expected 42, got %d (%v)", start, err)
+	}
+	if start, err := contentRangeStart("bytes 42-99/*"); err != nil || start != 42 {
+		t.Fatalf("Expected 42, got %d (%v)", start, err)
+	}
+	for _, value := range []string{"", "bytes */100", "bytes -99/100", "42-99/100"} {
+		if _, err := contentRangeStart(value); err == nil {
+			t.Errorf("Expected an error for %q", value)
+		}
+	}
+}
+
 func TestGetRemoteTags(t *testing.T) {
 	r := spawnTestRegistry(t)
 	tags, err := r.GetRemoteTags([]string{makeURL("/v1/")}, REPO, TOKEN)
@@ -130,9 +196,9 @@ func TestPushImageLayerRegistry(t *testing.T) {
 }
 
 func TestResolveRepositoryName(t *testing.T) {
-	_, _, err := ResolveRepositoryName("https://github.com/dotcloud/docker")
+	_, _, err := ResolveRepositoryName("https://github.com/dotcloud/docker", nil)
 	assertEqual(t, err, ErrInvalidRepositoryName, "Expected error invalid repo name")
-	ep, repo, err := ResolveRepositoryName("fooo/bar")
+	ep, repo, err := ResolveRepositoryName("fooo/bar", nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -140,12 +206,84 @@ func TestResolveRepositoryName(t *testing.T) {
 	assertEqual(t, repo, "fooo/bar", "Expected resolved repo to be foo/bar")
 
 	u := makeURL("")[7:]
-	ep, repo, err = ResolveRepositoryName(u + "/private/moonbase")
+	ep, repo, err = ResolveRepositoryName(u+"/private/moonbase", []string{u})
 	if err != nil {
 		t.Fatal(err)
 	}
 	assertEqual(t, ep, "http://"+u+"/v1/", "Expected endpoint to be "+u)
 	assertEqual(t, repo, "private/moonbase", "Expected endpoint to be private/moonbase")
+
+	// The test registry only speaks plain HTTP
+	if _, _, err := ResolveRepositoryName(u+"/private/moonbase", nil); err == nil {
+		t.Fatal("Expected an error for a plain HTTP registry which isn't allowed")
+	}
+}
+
+func TestSplitReposName(t *testing.T) {
+	for name, expected := range map[string][2]string{
+		"fooo/bar":                      {"", "fooo/bar"},
+		"ubuntu":                        {"", "ubuntu"},
+		"localhost/fooo/bar":            {"localhost", "fooo/bar"},
+		"registry.local:5000/fooo/bar":  {"registry.local:5000", "fooo/bar"},
+		"registry.local/private/images": {"registry.local", "private/images"},
+	} {
+		hostname, reposName, err := SplitReposName(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hostname != expected[0] || reposName != expected[1] {
+			t.Fatalf("Expected %v for %s, got [%s %s]", expected, name, hostname, reposName)
+		}
+	}
+	for _, name := range []string{"https://registry.local/fooo/bar", "registry.local", "index.docker.io/fooo/bar"} {
+		if _, _, err := SplitReposName(name); err == nil {
+			t.Fatalf("Expected an error for %s", name)
+		}
+	}
+}
+
+func TestValidateMirror(t *testing.T) {
+	for mirror, expected := range map[string]string{
+		"http://mirror.local":           "http://mirror.local/v1/",
+		"https://mirror.local:5000/":    "https://mirror.local:5000/v1/",
+		"https://mirror.local/cache/v1": "https://mirror.local/cache/v1/",
+	} {
+		if validated, err := ValidateMirror(mirror); err != nil {
+			t.Fatal(err)
+		} else if validated != expected {
+			t.Fatalf("Expected %s for %s, got %s", expected, mirror, validated)
+		}
+	}
+	for _, mirror := range []string{"mirror.local", "ftp://mirror.local", "http://"} {
+		if _, err := ValidateMirror(mirror); err == nil {
+			t.Fatalf("Expected an error for %s", mirror)
+		}
+	}
+}
+
+func TestMirrors(t *testing.T) {
+	r := spawnTestRegistry(t)
+	// Unreachable and broken mirrors are skipped
+	r.Mirrors = []string{"http://127.0.0.1:1/v1/", makeURL("/broken/")}
+	if _, _, err := r.GetRemoteImageJSON(IMAGE_ID, makeURL("/v1/"), TOKEN); err != nil {
+		t.Fatal(err)
+	}
+	layer, err := r.GetRemoteImageLayer(IMAGE_ID, makeURL("/v1/"), TOKEN)
+	if err != nil {
+		t.Fatal(err)
+	}
+	layer.Close()
+
+	// A working mirror is used even if the registry is down
+	r.Mirrors = []string{makeURL("/v1/")}
+	if _, _, err := r.GetRemoteImageJSON(IMAGE_ID, "http://127.0.0.1:1/v1/", TOKEN); err != nil {
+		t.Fatal(err)
+	}
+	layer, err = r.GetRemoteImageLayer(IMAGE_ID, "http://127.0.0.1:1/v1/", TOKEN)
+	if err != nil {
+		t.Fatal(err)
+	}
+	layer.Close()
 }
 
 func TestPushRegistryTag(t *testing.T) {
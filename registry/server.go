@@ -0,0 +1,550 @@
+package registry
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/dotcloud/docker/utils"
+	"github.com/gorilla/mux"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ServerVersion is sent in the X-Docker-Registry-Version header, which the
+// client checks when it pings a registry.
+const ServerVersion = "0.6.0-docker"
+
+var (
+	validImageID    = regexp.MustCompile(`^[a-f0-9]{64}$`)
+	validRepoPart   = regexp.MustCompile(`^[a-z0-9-_.]+$`)
+	errImageMissing = errors.New("Image not found")
+)
+
+// Server is a registry, and the index of its repositories, storing its
+// images and its tags in a local directory. It implements the v1 endpoints
+// called by Registry, and is meant to test push and pull without a
+// connection, or to share images on a trusted network: it doesn't check
+// the credentials of its clients.
+//
+// The layout of the directory is:
+//
+//	images/<id>/{json,layer,ancestry,checksum}
+//	repositories/<namespace>/<name>/{tags/<tag>,signatures/<tag>,_index_images}
+type Server struct {
+	sync.Mutex
+	root    string
+	handler http.Handler
+}
+
+// NewServer returns a registry storing its data in `root`, which is
+// created if needed.
+func NewServer(root string) (*Server, error) {
+	for _, dir := range []string{"images", "repositories"} {
+		if err := os.MkdirAll(path.Join(root, dir), 0700); err != nil {
+			return nil, err
+		}
+	}
+	s := &Server{root: root}
+	s.handler = s.createRouter()
+	return s, nil
+}
+
+func (s *Server) createRouter() http.Handler {
+	r := mux.NewRouter()
+	r.HandleFunc("/v1/_ping", s.getPing).Methods("GET")
+	r.HandleFunc("/v1/images/{image_id:[^/]+}/{action:json|layer|ancestry}", s.getImage).Methods("GET")
+	r.HandleFunc("/v1/images/{image_id:[^/]+}/json", s.putImageJSON).Methods("PUT")
+	r.HandleFunc("/v1/images/{image_id:[^/]+}/layer", s.putImageLayer).Methods("PUT")
+	r.HandleFunc("/v1/images/{image_id:[^/]+}/checksum", s.putImageChecksum).Methods("PUT")
+	r.HandleFunc("/v1/repositories/{repository:.+}/tags", s.getTags).Methods("GET")
+	r.HandleFunc("/v1/repositories/{repository:.+}/tags/{tag:[^/]+}", s.getTag).Methods("GET")
+	r.HandleFunc("/v1/repositories/{repository:.+}/tags/{tag:[^/]+}", s.putTag).Methods("PUT")
+	r.HandleFunc("/v1/repositories/{repository:.+}/tags/{tag:[^/]+}", s.deleteTag).Methods("DELETE")
+	r.HandleFunc("/v1/repositories/{repository:.+}/signatures/{tag:[^/]+}", s.getSignature).Methods("GET")
+	r.HandleFunc("/v1/repositories/{repository:.+}/signatures/{tag:[^/]+}", s.putSignature).Methods("PUT")
+	r.HandleFunc("/v1/repositories/{repository:.+}/images", s.getIndexImages).Methods("GET")
+	r.HandleFunc("/v1/repositories/{repository:.+}{action:/images|/}", s.putIndexImages).Methods("PUT")
+	return r
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	utils.Debugf("[registry-server] %s %s", r.Method, r.URL)
+	w.Header().Set("X-Docker-Registry-Version", ServerVersion)
+	w.Header().Set("X-Docker-Registry-Config", "local")
+	s.handler.ServeHTTP(w, r)
+}
+
+// ListenAndServe serves the registry on the tcp address `addr`.
+func (s *Server) ListenAndServe(addr string) error {
+	utils.Debugf("[registry-server] Serving %s on %s", s.root, addr)
+	return http.ListenAndServe(addr, s)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}, code int) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(body)
+}
+
+// writeError sends the error the way the client expects it, in the
+// "error" field of a json object.
+func writeError(w http.ResponseWriter, message string, code int) {
+	writeJSON(w, map[string]string{"error": message}, code)
+}
+
+// writeIndexHeaders sends what the index hands to clients: a token for the
+// registry, and the registry itself as the only endpoint.
+func writeIndexHeaders(w http.ResponseWriter, r *http.Request, repository string) {
+	w.Header().Set("X-Docker-Token", fmt.Sprintf("signature=%d,repository=\"%s\",access=write", time.Now().UnixNano(), repository))
+	w.Header().Set("X-Docker-Endpoints", r.Host)
+}
+
+func (s *Server) imagePath(id string, file string) string {
+	return path.Join(s.root, "images", id, file)
+}
+
+// repositoryPath returns the directory of `repository`, or an error if its
+// name could escape the root of the registry.
+func (s *Server) repositoryPath(repository string) (string, error) {
+	parts := strings.Split(repository, "/")
+	if len(parts) == 1 {
+		parts = []string{"library", parts[0]}
+	}
+	if len(parts) != 2 {
+		return "", fmt.Errorf("Invalid repository name: %s", repository)
+	}
+	for _, part := range parts {
+		if !validRepoPart.MatchString(part) || part == "." || part == ".." {
+			return "", fmt.Errorf("Invalid repository name: %s", repository)
+		}
+	}
+	return path.Join(s.root, "repositories", parts[0], parts[1]), nil
+}
+
+// imageID returns the id of the image of the request, which is used as a
+// path in the registry and so must be checked.
+func imageID(w http.ResponseWriter, r *http.Request) (string, bool) {
+	id := mux.Vars(r)["image_id"]
+	if !validImageID.MatchString(id) {
+		writeError(w, "Invalid image id", http.StatusBadRequest)
+		return "", false
+	}
+	return id, true
+}
+
+// writeFile replaces the content of `dst` atomically, so that a reader never
+// sees a partial file.
+func writeFile(dst string, src io.Reader) (int64, error) {
+	if err := os.MkdirAll(path.Dir(dst), 0700); err != nil {
+		return 0, err
+	}
+	tmp, err := ioutil.TempFile(path.Dir(dst), "."+path.Base(dst))
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(tmp, src)
+	if err1 := tmp.Close(); err == nil {
+		err = err1
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return 0, err
+	}
+	return n, os.Rename(tmp.Name(), dst)
+}
+
+func (s *Server) getPing(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, true, http.StatusOK)
+}
+
+func (s *Server) getImage(w http.ResponseWriter, r *http.Request) {
+	id, ok := imageID(w, r)
+	if !ok {
+		return
+	}
+	action := mux.Vars(r)["action"]
+	// An image is only served once its upload is complete
+	if _, err := os.Stat(s.imagePath(id, "checksum")); err != nil {
+		writeError(w, errImageMissing.Error(), http.StatusNotFound)
+		return
+	}
+	f, err := os.Open(s.imagePath(id, action))
+	if err != nil {
+		writeError(w, errImageMissing.Error(), http.StatusNotFound)
+		return
+	}
+	defer f.Close()
+
+	switch action {
+	case "json":
+		var size int64
+		if fi, err := os.Stat(s.imagePath(id, "layer")); err == nil {
+			size = fi.Size()
+		}
+		w.Header().Set("X-Docker-Size", strconv.FormatInt(size, 10))
+		if checksum, err := ioutil.ReadFile(s.imagePath(id, "checksum")); err == nil {
+			w.Header().Set("X-Docker-Checksum", string(checksum))
+		}
+		w.Header().Set("Content-Type", "application/json")
+		io.Copy(w, f)
+	case "ancestry":
+		w.Header().Set("Content-Type", "application/json")
+		io.Copy(w, f)
+	case "layer":
+		// Supports the Range requests of resumed downloads
+		w.Header().Set("Content-Type", "application/octet-stream")
+		http.ServeContent(w, r, "layer", time.Time{}, f)
+	}
+}
+
+func (s *Server) putImageJSON(w http.ResponseWriter, r *http.Request) {
+	id, ok := imageID(w, r)
+	if !ok {
+		return
+	}
+	if _, err := os.Stat(s.imagePath(id, "checksum")); err == nil {
+		writeError(w, "Image already exists", http.StatusConflict)
+		return
+	}
+	jsonData, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var img struct {
+		ID     string `json:"id"`
+		Parent string `json:"parent"`
+	}
+	if err := json.Unmarshal(jsonData, &img); err != nil {
+		writeError(w, fmt.Sprintf("Invalid json: %s", err), http.StatusBadRequest)
+		return
+	}
+	if img.ID != id {
+		writeError(w, "The id of the json doesn't match the URL", http.StatusBadRequest)
+		return
+	}
+
+	ancestry := []string{id}
+	if img.Parent != "" {
+		// The parent must be a complete upload, like the images served
+		if !validImageID.MatchString(img.Parent) {
+			writeError(w, "Parent image not found", http.StatusBadRequest)
+			return
+		}
+		if _, err := os.Stat(s.imagePath(img.Parent, "checksum")); err != nil {
+			writeError(w, "Parent image not found", http.StatusBadRequest)
+			return
+		}
+		parentAncestry, err := ioutil.ReadFile(s.imagePath(img.Parent, "ancestry"))
+		if err != nil {
+			writeError(w, "Parent image not found", http.StatusBadRequest)
+			return
+		}
+		var parents []string
+		if err := json.Unmarshal(parentAncestry, &parents); err != nil {
+			writeError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		ancestry = append(ancestry, parents...)
+	}
+	ancestryData, err := json.Marshal(ancestry)
+	if err != nil {
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// A new upload of the image starts over
+	os.Remove(s.imagePath(id, "layer"))
+	if _, err := writeFile(s.imagePath(id, "json"), strings.NewReader(string(jsonData))); err != nil {
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if _, err := writeFile(s.imagePath(id, "ancestry"), strings.NewReader(string(ancestryData))); err != nil {
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, true, http.StatusOK)
+}
+
+func (s *Server) putImageLayer(w http.ResponseWriter, r *http.Request) {
+	id, ok := imageID(w, r)
+	if !ok {
+		return
+	}
+	if _, err := os.Stat(s.imagePath(id, "json")); err != nil {
+		writeError(w, "Image not found, the json must be pushed first", http.StatusNotFound)
+		return
+	}
+	if _, err := os.Stat(s.imagePath(id, "checksum")); err == nil {
+		writeError(w, "Image already exists", http.StatusConflict)
+		return
+	}
+	if _, err := writeFile(s.imagePath(id, "layer"), r.Body); err != nil {
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, true, http.StatusOK)
+}
+
+func (s *Server) putImageChecksum(w http.ResponseWriter, r *http.Request) {
+	id, ok := imageID(w, r)
+	if !ok {
+		return
+	}
+	checksum := r.Header.Get("X-Docker-Checksum")
+	if checksum == "" {
+		writeError(w, "Missing the X-Docker-Checksum header", http.StatusBadRequest)
+		return
+	}
+	if _, err := os.Stat(s.imagePath(id, "layer")); err != nil {
+		writeError(w, "Image not found, the layer must be pushed first", http.StatusNotFound)
+		return
+	}
+	if _, err := writeFile(s.imagePath(id, "checksum"), strings.NewReader(checksum)); err != nil {
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, true, http.StatusOK)
+}
+
+func (s *Server) readTags(repository string) (map[string]string, error) {
+	repoPath, err := s.repositoryPath(repository)
+	if err != nil {
+		return nil, err
+	}
+	files, err := ioutil.ReadDir(path.Join(repoPath, "tags"))
+	if err != nil {
+		return nil, err
+	}
+	tags := make(map[string]string)
+	for _, f := range files {
+		if strings.HasPrefix(f.Name(), ".") {
+			continue
+		}
+		id, err := ioutil.ReadFile(path.Join(repoPath, "tags", f.Name()))
+		if err != nil {
+			return nil, err
+		}
+		tags[f.Name()] = string(id)
+	}
+	return tags, nil
+}
+
+func (s *Server) getTags(w http.ResponseWriter, r *http.Request) {
+	tags, err := s.readTags(mux.Vars(r)["repository"])
+	if err != nil {
+		writeError(w, "Repository not found", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, tags, http.StatusOK)
+}
+
+func (s *Server) getTag(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	tags, err := s.readTags(vars["repository"])
+	if err != nil {
+		writeError(w, "Repository not found", http.StatusNotFound)
+		return
+	}
+	id, exists := tags[vars["tag"]]
+	if !exists {
+		writeError(w, "Tag not found", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, id, http.StatusOK)
+}
+
+func (s *Server) putTag(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	repoPath, err := s.repositoryPath(vars["repository"])
+	if err != nil {
+		writeError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	tag := vars["tag"]
+	if !validRepoPart.MatchString(tag) || tag == "." || tag == ".." {
+		writeError(w, "Invalid tag name", http.StatusBadRequest)
+		return
+	}
+	var id string
+	if err := json.NewDecoder(r.Body).Decode(&id); err != nil {
+		writeError(w, fmt.Sprintf("Invalid json: %s", err), http.StatusBadRequest)
+		return
+	}
+	if !validImageID.MatchString(id) {
+		writeError(w, "Invalid image id", http.StatusBadRequest)
+		return
+	}
+	if _, err := os.Stat(s.imagePath(id, "json")); err != nil {
+		writeError(w, errImageMissing.Error(), http.StatusNotFound)
+		return
+	}
+	if _, err := writeFile(path.Join(repoPath, "tags", tag), strings.NewReader(id)); err != nil {
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, true, http.StatusOK)
+}
+
+func (s *Server) deleteTag(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	repoPath, err := s.repositoryPath(vars["repository"])
+	if err != nil {
+		writeError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	tag := vars["tag"]
+	if !validRepoPart.MatchString(tag) || tag == "." || tag == ".." {
+		writeError(w, "Invalid tag name", http.StatusBadRequest)
+		return
+	}
+	if err := os.Remove(path.Join(repoPath, "tags", tag)); err != nil {
+		writeError(w, "Tag not found", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, true, http.StatusOK)
+}
+
+// signaturePath returns the file of the signature of a tag. The registry
+// stores the signatures as they are: they are checked by the clients.
+func (s *Server) signaturePath(repository, tag string) (string, error) {
+	repoPath, err := s.repositoryPath(repository)
+	if err != nil {
+		return "", err
+	}
+	if !validRepoPart.MatchString(tag) || tag == "." || tag == ".." {
+		return "", fmt.Errorf("Invalid tag name: %s", tag)
+	}
+	return path.Join(repoPath, "signatures", tag), nil
+}
+
+func (s *Server) getSignature(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	sigPath, err := s.signaturePath(vars["repository"], vars["tag"])
+	if err != nil {
+		writeError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	data, err := ioutil.ReadFile(sigPath)
+	if err != nil {
+		writeError(w, "Signature not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+func (s *Server) putSignature(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	sigPath, err := s.signaturePath(vars["repository"], vars["tag"])
+	if err != nil {
+		writeError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if _, err := writeFile(sigPath, r.Body); err != nil {
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, true, http.StatusOK)
+}
+
+func (s *Server) getIndexImages(w http.ResponseWriter, r *http.Request) {
+	repository := mux.Vars(r)["repository"]
+	repoPath, err := s.repositoryPath(repository)
+	if err != nil {
+		writeError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	data, err := ioutil.ReadFile(path.Join(repoPath, "_index_images"))
+	if err != nil {
+		writeError(w, "Repository not found", http.StatusNotFound)
+		return
+	}
+	writeIndexHeaders(w, r, repository)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+// putIndexImages records the images of a repository. The client sends the
+// list twice: before the push, without the checksums, and once it is done,
+// with them.
+func (s *Server) putIndexImages(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	repository := vars["repository"]
+	repoPath, err := s.repositoryPath(repository)
+	if err != nil {
+		writeError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var imgList []*ImgData
+	if err := json.NewDecoder(r.Body).Decode(&imgList); err != nil {
+		writeError(w, fmt.Sprintf("Invalid json: %s", err), http.StatusBadRequest)
+		return
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	// Merge the list with the images already in the repository
+	images := make(map[string]*ImgData)
+	order := []string{}
+	if data, err := ioutil.ReadFile(path.Join(repoPath, "_index_images")); err == nil {
+		var current []*ImgData
+		if err := json.Unmarshal(data, &current); err != nil {
+			writeError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		for _, img := range current {
+			images[img.ID] = img
+			order = append(order, img.ID)
+		}
+	}
+	for _, img := range imgList {
+		if !validImageID.MatchString(img.ID) {
+			writeError(w, "Invalid image id", http.StatusBadRequest)
+			return
+		}
+		current, exists := images[img.ID]
+		if !exists {
+			current = &ImgData{ID: img.ID}
+			images[img.ID] = current
+			order = append(order, img.ID)
+		}
+		if img.Checksum != "" {
+			current.Checksum = img.Checksum
+		}
+	}
+	merged := make([]*ImgData, 0, len(order))
+	for _, id := range order {
+		merged = append(merged, images[id])
+	}
+	data, err := json.Marshal(merged)
+	if err != nil {
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if _, err := writeFile(path.Join(repoPath, "_index_images"), strings.NewReader(string(data))); err != nil {
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if vars["action"] == "/images" {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	writeIndexHeaders(w, r, repository)
+	writeJSON(w, "", http.StatusOK)
+}
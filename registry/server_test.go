@@ -0,0 +1,198 @@
+package registry
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func spawnTestServer(t *testing.T) (*httptest.Server, string) {
+	root, err := ioutil.TempDir("", "docker-test-registry-server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewServer(root)
+	if err != nil {
+		os.RemoveAll(root)
+		t.Fatal(err)
+	}
+	return httptest.NewServer(s), root
+}
+
+func TestServerPing(t *testing.T) {
+	ts, root := spawnTestServer(t)
+	defer os.RemoveAll(root)
+	defer ts.Close()
+
+	if err := pingRegistryEndpoint(ts.URL + "/v1/"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// serverTestImage returns the json and the uncompressed layer of a test
+// image. The tests of the server use their own images rather than those of
+// the mock registry, which its handlers modify.
+func serverTestImage(t *testing.T, id, parent string) ([]byte, []byte) {
+	jsonRaw := fmt.Sprintf(`{"id":%q,"comment":"test image","created":"2013-03-23T12:53:11.10432-07:00"`, id)
+	if parent != "" {
+		jsonRaw += fmt.Sprintf(`,"parent":%q`, parent)
+	}
+	jsonRaw += "}"
+
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	content := []byte("layer of " + id + "\n")
+	if err := tw.WriteHeader(&tar.Header{Name: id, Mode: 0644, Size: int64(len(content))}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tw.Write(content); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return []byte(jsonRaw), buf.Bytes()
+}
+
+// Push images to a local server, and pull them back
+func TestServerPushPull(t *testing.T) {
+	ts, root := spawnTestServer(t)
+	defer os.RemoveAll(root)
+	defer ts.Close()
+
+	var (
+		r       = spawnTestRegistry(t)
+		indexEp = ts.URL + "/v1/"
+		baseID  = "5f2f4c8e1e0c4a8f9b7d3a6e2c1b0a9d8e7f6a5b4c3d2e1f0a9b8c7d6e5f4a3b"
+		imageID = "9a8b7c6d5e4f3a2b1c0d9e8f7a6b5c4d3e2f1a0b9c8d7e6f5a4b3c2d1e0f9a8b"
+		imgList = []*ImgData{{ID: baseID, Tag: "latest"}, {ID: imageID, Tag: "latest"}}
+		parents = map[string]string{imageID: baseID}
+	)
+
+	repoData, err := r.PushImageJSONIndex(indexEp, REPO, imgList, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, len(repoData.Endpoints), 1, "Expected the server to be its own endpoint")
+	ep := repoData.Endpoints[0]
+	for _, img := range imgList {
+		if r.LookupRemoteImage(img.ID, ep, repoData.Tokens) {
+			t.Fatalf("Image %s should not exist before its push", img.ID)
+		}
+		// The client sends the layer uncompressed
+		jsonRaw, layer := serverTestImage(t, img.ID, parents[img.ID])
+		if err := r.PushImageJSONRegistry(img, jsonRaw, ep, repoData.Tokens); err != nil {
+			t.Fatal(err)
+		}
+		img.Checksum, err = r.PushImageLayerRegistry(img.ID, bytes.NewReader(layer), ep, repoData.Tokens, jsonRaw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := r.PushImageChecksumRegistry(img, ep, repoData.Tokens); err != nil {
+			t.Fatal(err)
+		}
+		if err := r.PushRegistryTag(REPO, img.ID, img.Tag, ep, repoData.Tokens); err != nil {
+			t.Fatal(err)
+		}
+		if err := r.PushImageJSONRegistry(img, jsonRaw, ep, repoData.Tokens); err != ErrAlreadyExists {
+			t.Fatalf("Expected %s, got %v", ErrAlreadyExists, err)
+		}
+	}
+	if _, err := r.PushImageJSONIndex(indexEp, REPO, imgList, true, repoData.Endpoints); err != nil {
+		t.Fatal(err)
+	}
+	signature := []byte(`{"KeyID":"fake-key"}`)
+	if err := r.PushTagSignature(REPO, "latest", ep, repoData.Tokens, signature); err != nil {
+		t.Fatal(err)
+	}
+
+	repoData, err = r.GetRepositoryData(indexEp, REPO)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, len(repoData.ImgList), 2, "Expected 2 images in the repository")
+	for _, img := range imgList {
+		assertEqual(t, repoData.ImgList[img.ID].Checksum, img.Checksum, "Expected the checksum of "+img.ID)
+	}
+	tags, err := r.GetRemoteTags(repoData.Endpoints, REPO, repoData.Tokens)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, tags["latest"], imageID, "Expected latest to be the last pushed image")
+	if data, err := r.GetTagSignature(REPO, "latest", ep, repoData.Tokens); err != nil {
+		t.Fatal(err)
+	} else {
+		assertEqual(t, string(data), string(signature), "Expected the pushed signature")
+	}
+	if _, err := r.GetTagSignature(REPO, "unsigned", ep, repoData.Tokens); err != ErrSignatureNotFound {
+		t.Fatalf("Expected %s, got %v", ErrSignatureNotFound, err)
+	}
+
+	history, err := r.GetRemoteHistory(imageID, ep, repoData.Tokens)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, len(history), 2, "Expected 2 images in history")
+	assertEqual(t, history[1], baseID, "Expected the base image as second ancestry")
+
+	if _, size, err := r.GetRemoteImageJSON(imageID, ep, repoData.Tokens); err != nil {
+		t.Fatal(err)
+	} else if size <= 0 {
+		t.Fatalf("Expected the size of the layer, got %d", size)
+	}
+	layer, err := r.GetRemoteImageLayerFrom(imageID, ep, repoData.Tokens, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer layer.Close()
+	data, err := ioutil.ReadAll(layer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) == 0 {
+		t.Fatal("Expected the end of the layer")
+	}
+}
+
+func TestServerInvalidNames(t *testing.T) {
+	ts, root := spawnTestServer(t)
+	defer os.RemoveAll(root)
+	defer ts.Close()
+
+	r := spawnTestRegistry(t)
+	if _, err := r.GetRepositoryData(ts.URL+"/v1/", "foo42/../../etc"); err == nil {
+		t.Fatal("Expected an error for a repository outside of the registry")
+	}
+	if _, _, err := r.GetRemoteImageJSON("../../etc", ts.URL+"/v1/", nil); err == nil {
+		t.Fatal("Expected an error for an invalid image id")
+	}
+}
+
+func TestServerIncompleteParent(t *testing.T) {
+	ts, root := spawnTestServer(t)
+	defer os.RemoveAll(root)
+	defer ts.Close()
+
+	var (
+		r       = spawnTestRegistry(t)
+		ep      = ts.URL + "/v1/"
+		baseID  = "5f2f4c8e1e0c4a8f9b7d3a6e2c1b0a9d8e7f6a5b4c3d2e1f0a9b8c7d6e5f4a3b"
+		imageID = "9a8b7c6d5e4f3a2b1c0d9e8f7a6b5c4d3e2f1a0b9c8d7e6f5a4b3c2d1e0f9a8b"
+	)
+
+	// The layer and the checksum of the parent are never pushed
+	jsonRaw, _ := serverTestImage(t, baseID, "")
+	if err := r.PushImageJSONRegistry(&ImgData{ID: baseID}, jsonRaw, ep, nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, parent := range []string{baseID, "../" + baseID} {
+		jsonRaw, _ := serverTestImage(t, imageID, parent)
+		if err := r.PushImageJSONRegistry(&ImgData{ID: imageID}, jsonRaw, ep, nil); err == nil {
+			t.Fatalf("Expected the parent %s to be refused", parent)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package docker
+
+import (
+	"github.com/dotcloud/docker/dns"
+	"github.com/dotcloud/docker/utils"
+	"net"
+	"path"
+	"strings"
+)
+
+// dnsResolver answers the DNS queries of the containers with the addresses
+// of the containers named in the name database.
+type dnsResolver struct {
+	runtime *Runtime
+}
+
+// Accepts only serves the containers.
+func (resolver *dnsResolver) Accepts(client net.IP) bool {
+	return resolver.runtime.containerByIP(client) != nil
+}
+
+// Lookup returns the addresses of the container `name`, looked up among the
+// links of the container `client` first, on the networks they share.
+func (resolver *dnsResolver) Lookup(client net.IP, name string) ([]net.IP, bool) {
+	if name == "" || name == "." || name == ".." || strings.Contains(name, "/") {
+		return nil, false
+	}
+	runtime := resolver.runtime
+	querier := runtime.containerByIP(client)
+	if querier == nil {
+		return nil, false
+	}
+	target := runtime.containerByDnsName(querier, name)
+	if target == nil {
+		return nil, false
+	}
+	// The address of a stopped container may be given to another one
+	if !target.State.Running {
+		return nil, true
+	}
+	var ips []net.IP
+	shared := querier.NetworkSettings.endpoints()
+	for name, endpoint := range target.NetworkSettings.endpoints() {
+		if _, exists := shared[name]; !exists {
+			continue
+		}
+		for _, addr := range []string{endpoint.IPAddress, endpoint.IPv6Address} {
+			if ip := net.ParseIP(addr); ip != nil {
+				ips = append(ips, ip)
+			}
+		}
+	}
+	return ips, true
+}
+
+// Upstream returns the dns servers of the container `client`, or of the
+// daemon, or else of the host.
+func (resolver *dnsResolver) Upstream(client net.IP) []string {
+	runtime := resolver.runtime
+	if container := runtime.containerByIP(client); container != nil && len(container.Config.Dns) > 0 {
+		return container.Config.Dns
+	}
+	if len(runtime.config.Dns) > 0 {
+		return runtime.config.Dns
+	}
+	// The daemon runs on the host: unlike the containers, it can reach its
+	// local dns servers
+	if resolvConf, err := utils.GetResolvConf(); err == nil {
+		if nameservers := utils.GetNameservers(resolvConf); len(nameservers) > 0 {
+			return nameservers
+		}
+	}
+	return defaultDns
+}
+
+// containerByDnsName returns the container `name` as seen by `querier`:
+// the alias of one of its links, or else the name of a container. DNS names
+// are case-insensitive, unlike those of the containers: the names are only
+// compared ignoring case when they don't match as they are.
+func (runtime *Runtime) containerByDnsName(querier *Container, name string) *Container {
+	name = strings.ToLower(name)
+	if target, err := runtime.GetByName(path.Join(querier.Name, name)); err == nil {
+		return target
+	}
+	if target, err := runtime.GetByName(name); err == nil {
+		return target
+	}
+	if children, err := runtime.Children(querier.Name); err == nil {
+		for p, child := range children {
+			if strings.EqualFold(p, path.Join(querier.Name, name)) {
+				return child
+			}
+		}
+	}
+	for _, container := range runtime.List() {
+		if strings.EqualFold(container.Name, "/"+name) {
+			return container
+		}
+	}
+	return nil
+}
+
+// containerByIP returns the running container with the address `ip`, nil
+// if there is none.
+func (runtime *Runtime) containerByIP(ip net.IP) *Container {
+	for _, container := range runtime.List() {
+		if !container.State.Running {
+			continue
+		}
+		for _, endpoint := range container.NetworkSettings.endpoints() {
+			for _, addr := range []string{endpoint.IPAddress, endpoint.IPv6Address} {
+				if ip.Equal(net.ParseIP(addr)) {
+					return container
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// startDnsServer serves the dns queries of the containers on the gateway
+// of the bridge.
+func (runtime *Runtime) startDnsServer() error {
+	addr := &net.UDPAddr{IP: runtime.networkManager.bridgeNetwork.IP, Port: 53}
+	srv, err := dns.NewServer(addr, &dnsResolver{runtime: runtime})
+	if err != nil {
+		return err
+	}
+	runtime.dnsServer = srv
+	go srv.Run()
+	utils.Debugf("Serving the dns queries of the containers on %s", addr)
+	return nil
+}
@@ -0,0 +1,153 @@
+package docker
+
+import (
+	"container/list"
+	"database/sql"
+	"github.com/dotcloud/docker/dns"
+	"github.com/dotcloud/docker/gograph"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestDnsResolverLookup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "docker-test-resolver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	conn, err := sql.Open("sqlite3", path.Join(dir, "linkgraph.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	graph, err := gograph.NewDatabase(conn, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer graph.Close()
+
+	runtime := &Runtime{
+		containers:     list.New(),
+		containerGraph: graph,
+		config:         &DaemonConfig{Dns: []string{"10.0.0.53"}},
+	}
+	newContainer := func(name, network, ip string) *Container {
+		container := &Container{
+			ID:     name,
+			Name:   "/" + name,
+			Config: &Config{},
+			State:  State{Running: true},
+			NetworkSettings: &NetworkSettings{
+				Networks: map[string]*EndpointSettings{
+					network: {Interface: "eth0", IPAddress: ip},
+				},
+			},
+		}
+		runtime.containers.PushBack(container)
+		if _, err := graph.Set(container.Name, container.ID); err != nil {
+			t.Fatal(err)
+		}
+		return container
+	}
+	web := newContainer("web", DefaultNetworkName, "172.17.0.2")
+	db := newContainer("db", DefaultNetworkName, "172.17.0.3")
+	newContainer("other", "isolated", "10.1.0.2")
+	if _, err := graph.Set("/web/database", db.ID); err != nil {
+		t.Fatal(err)
+	}
+	resolver := &dnsResolver{runtime: runtime}
+	client := net.ParseIP("172.17.0.2")
+
+	for _, name := range []string{"db", "database", "DB", "Database"} {
+		ips, known := resolver.Lookup(client, name)
+		if !known || len(ips) != 1 || !ips[0].Equal(net.ParseIP("172.17.0.3")) {
+			t.Fatalf("Expected %s to resolve to 172.17.0.3, got %v (%v)", name, ips, known)
+		}
+	}
+	// The links of other containers aren't visible
+	if _, known := resolver.Lookup(net.ParseIP("172.17.0.3"), "database"); known {
+		t.Fatal("The alias of a link shouldn't be resolved for another container")
+	}
+	// No address on networks which aren't shared
+	if ips, known := resolver.Lookup(client, "other"); !known || len(ips) != 0 {
+		t.Fatalf("Expected no address for a container on another network, got %v (%v)", ips, known)
+	}
+	// Names are case-insensitive, even those of containers with capitals
+	upper := newContainer("Upper", DefaultNetworkName, "172.17.0.5")
+	if ips, known := resolver.Lookup(client, "upper"); !known || len(ips) != 1 || !ips[0].Equal(net.ParseIP("172.17.0.5")) {
+		t.Fatalf("Expected upper to resolve to 172.17.0.5, got %v (%v)", ips, known)
+	}
+	upper.State.Running = false
+	// Only the containers are served
+	if resolver.Accepts(net.ParseIP("172.17.0.1")) || !resolver.Accepts(client) {
+		t.Fatal("Expected only the containers to be served")
+	}
+	if _, known := resolver.Lookup(client, "docker.io"); known {
+		t.Fatal("Unknown names should be forwarded")
+	}
+	// The new address of a restarted container is resolved
+	db.NetworkSettings.Networks[DefaultNetworkName].IPAddress = "172.17.0.4"
+	if ips, _ := resolver.Lookup(client, "database"); len(ips) != 1 || !ips[0].Equal(net.ParseIP("172.17.0.4")) {
+		t.Fatalf("Expected the new address of the container, got %v", ips)
+	}
+	db.State.Running = false
+	if ips, known := resolver.Lookup(client, "db"); !known || len(ips) != 0 {
+		t.Fatalf("Expected no address for a stopped container, got %v (%v)", ips, known)
+	}
+
+	if upstream := resolver.Upstream(client); len(upstream) != 1 || upstream[0] != "10.0.0.53" {
+		t.Fatalf("Expected the dns servers of the daemon, got %v", upstream)
+	}
+	web.Config.Dns = []string{"10.0.0.54"}
+	if upstream := resolver.Upstream(client); len(upstream) != 1 || upstream[0] != "10.0.0.54" {
+		t.Fatalf("Expected the dns servers of the container, got %v", upstream)
+	}
+}
+
+func TestSetupResolvConf(t *testing.T) {
+	dir, err := ioutil.TempDir("", "docker-test-resolvconf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	srv, err := dns.NewServer(&net.UDPAddr{IP: net.ParseIP("127.0.0.1")}, &dnsResolver{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	runtime := &Runtime{
+		config:    &DaemonConfig{Dns: []string{"10.0.0.53"}},
+		dnsServer: srv,
+	}
+	container := &Container{root: dir, Config: &Config{}}
+	resolvConf := func() string {
+		if container.ResolvConfPath != path.Join(dir, "resolv.conf") {
+			t.Fatalf("Unexpected resolv.conf %s", container.ResolvConfPath)
+		}
+		content, err := ioutil.ReadFile(container.ResolvConfPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(content)
+	}
+
+	if err := runtime.setupResolvConf(container); err != nil {
+		t.Fatal(err)
+	}
+	if content := resolvConf(); !strings.HasPrefix(content, "nameserver 127.0.0.1\n") {
+		t.Fatalf("Expected the embedded dns server, got %q", content)
+	}
+
+	// The daemon restarted without its embedded dns server
+	runtime.dnsServer = nil
+	if err := runtime.setupResolvConf(container); err != nil {
+		t.Fatal(err)
+	}
+	if content := resolvConf(); content != "nameserver 10.0.0.53\n" {
+		t.Fatalf("Expected the dns servers of the daemon, got %q", content)
+	}
+}
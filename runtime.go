@@ -5,13 +5,15 @@ import (
 	"container/list"
 	"database/sql"
 	"fmt"
+	"github.com/dotcloud/docker/dns"
 	"github.com/dotcloud/docker/gograph"
+	"github.com/dotcloud/docker/registry"
 	"github.com/dotcloud/docker/utils"
 	"io"
 	"io/ioutil"
 	"log"
+	"net"
 	"os"
-	"os/exec"
 	"path"
 	"sort"
 	"strings"
@@ -31,6 +33,10 @@ type Runtime struct {
 	containers     *list.List
 	networkManager *NetworkManager
 	graph          *Graph
+	driver         GraphDriver
+	execDriver     ExecDriver
+	execDrivers    map[string]ExecDriver
+	execCommands   *execCommands
 	repositories   *TagStore
 	idIndex        *utils.TruncIndex
 	capabilities   *Capabilities
@@ -38,6 +44,8 @@ type Runtime struct {
 	srv            *Server
 	config         *DaemonConfig
 	containerGraph *gograph.Database
+	trust          *TrustStore
+	dnsServer      *dns.Server // nil when the containers use the dns servers directly
 }
 
 // List returns an array of all containers registered in the runtime.
@@ -139,12 +147,17 @@ func (runtime *Runtime) Register(container *Container) error {
 	//        if so, then we need to restart monitor and init a new lock
 	// If the container is supposed to be running, make sure of it
 	if container.State.Running {
-		output, err := exec.Command("lxc-info", "-n", container.ID).CombinedOutput()
+		driver, err := container.execDriver()
 		if err != nil {
 			return err
 		}
-		if !strings.Contains(string(output), "RUNNING") {
+		running, err := driver.Running(container)
+		if err != nil {
+			return err
+		}
+		if !running {
 			utils.Debugf("Container %s was supposed to be running be is not.", container.ID)
+			runtime.releaseAllocations(container)
 			if runtime.config.AutoRestart {
 				utils.Debugf("Restarting")
 				container.State.Ghost = false
@@ -176,15 +189,6 @@ func (runtime *Runtime) Register(container *Container) error {
 	return nil
 }
 
-func (runtime *Runtime) LogToDisk(src *utils.WriteBroadcaster, dst, stream string) error {
-	log, err := os.OpenFile(dst, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0600)
-	if err != nil {
-		return err
-	}
-	src.AddWriter(log, stream)
-	return nil
-}
-
 // Destroy unregisters a container from the runtime and cleanly removes its contents from the filesystem.
 func (runtime *Runtime) Destroy(container *Container) error {
 	if container == nil {
@@ -199,13 +203,10 @@ func (runtime *Runtime) Destroy(container *Container) error {
 	if err := container.Stop(3); err != nil {
 		return err
 	}
+	runtime.releaseStaticAddresses(container)
 
-	if mounted, err := container.Mounted(); err != nil {
-		return err
-	} else if mounted {
-		if err := container.Unmount(); err != nil {
-			return fmt.Errorf("Unable to unmount container %v: %v", container.ID, err)
-		}
+	if err := container.Unmount(); err != nil {
+		return fmt.Errorf("Unable to unmount container %v: %v", container.ID, err)
 	}
 
 	if _, err := runtime.containerGraph.Purge(container.ID); err != nil {
@@ -215,6 +216,16 @@ func (runtime *Runtime) Destroy(container *Container) error {
 	// Deregister the container before removing its directory, to avoid race conditions
 	runtime.idIndex.Delete(container.ID)
 	runtime.containers.Remove(element)
+	runtime.execCommands.Forget(container.ID)
+
+	if err := runtime.driver.Remove(container.ID); err != nil {
+		return fmt.Errorf("Driver %s failed to remove root filesystem %s: %s", runtime.driver, container.ID, err)
+	}
+	initID := fmt.Sprintf("%s-init", container.ID)
+	if err := runtime.driver.Remove(initID); err != nil {
+		return fmt.Errorf("Driver %s failed to remove init filesystem %s: %s", runtime.driver, initID, err)
+	}
+
 	if err := os.RemoveAll(container.root); err != nil {
 		return fmt.Errorf("Unable to remove filesystem for %v: %v", container.ID, err)
 	}
@@ -242,6 +253,17 @@ func (runtime *Runtime) restore() error {
 			utils.Errorf("Failed to load container %v: %v", id, err)
 			continue
 		}
+		if err := runtime.migrateLegacyContainer(container); err != nil {
+			utils.Errorf("Failed to migrate container %v: %v", id, err)
+			continue
+		}
+		// Before any container starts, and may be given the addresses
+		if err := runtime.reserveStaticAddresses(container); err != nil {
+			utils.Errorf("Failed to reserve the addresses of container %v: %v", id, err)
+		}
+		if container.State.Ghost {
+			runtime.reserveAllocations(container)
+		}
 		utils.Debugf("Loaded container %v", container.ID)
 		containers[container.ID] = container
 	}
@@ -249,6 +271,9 @@ func (runtime *Runtime) restore() error {
 	register := func(container *Container) {
 		if err := runtime.Register(container); err != nil {
 			utils.Debugf("Failed to register container %s: %s", container.ID, err)
+			if container.State.Ghost {
+				runtime.releaseAllocations(container)
+			}
 		}
 	}
 
@@ -284,6 +309,25 @@ func (runtime *Runtime) restore() error {
 	return nil
 }
 
+// updateNetworkHosts rewrites the hosts files of the running containers of
+// the user-defined networks `networks`, but the one of `except`, after a
+// container joined or left them.
+func (runtime *Runtime) updateNetworkHosts(networks []string, except *Container) {
+	for _, container := range runtime.List() {
+		if (except != nil && container.ID == except.ID) || !container.State.Running || container.NetworkSettings == nil {
+			continue
+		}
+		for _, network := range networks {
+			if _, exists := container.NetworkSettings.Networks[network]; exists && network != DefaultNetworkName {
+				if err := container.writeHostsFile(); err != nil {
+					utils.Errorf("Unable to update the hosts file of %s: %s", container.ShortID(), err)
+				}
+				break
+			}
+		}
+	}
+}
+
 // FIXME: comment please!
 func (runtime *Runtime) UpdateCapabilities(quiet bool) {
 	if cgroupMemoryMountpoint, err := utils.FindCgroupMountpoint("memory"); err != nil {
@@ -319,6 +363,12 @@ func (runtime *Runtime) Create(config *Config, name string) (*Container, []strin
 	if err != nil {
 		return nil, nil, err
 	}
+	if runtime.config.RequireSignedImages && !runtime.trust.IsTrusted(img.ID) {
+		if runtime.srv != nil {
+			runtime.srv.LogEvent("untrusted", img.ShortID(), runtime.repositories.ImageName(img.ID))
+		}
+		return nil, nil, &UntrustedImageError{ID: img.ID}
+	}
 
 	checkDeprecatedExpose := func(config *Config) bool {
 		if config != nil {
@@ -350,6 +400,46 @@ func (runtime *Runtime) Create(config *Config, name string) (*Container, []strin
 		return nil, nil, fmt.Errorf("No command specified")
 	}
 
+	if len(config.Networks) > 0 {
+		if config.NetworkDisabled {
+			return nil, nil, ErrConflictNetworkDisabled
+		}
+		networks := []string{}
+		seen := make(map[string]bool)
+		for _, name := range config.Networks {
+			network, err := runtime.networkManager.beginJoin(name)
+			if err != nil {
+				return nil, nil, err
+			}
+			// The network can't be removed until the container is registered
+			defer runtime.networkManager.endJoin(network)
+			if !seen[network.Name] {
+				seen[network.Name] = true
+				networks = append(networks, network.Name)
+			}
+		}
+		config.Networks = networks
+	}
+	if config.IPAddress != "" || config.MacAddress != "" {
+		if config.NetworkDisabled {
+			return nil, nil, ErrConflictStaticAddress
+		}
+		if config.IPAddress != "" {
+			ip := net.ParseIP(config.IPAddress)
+			if ip == nil || ip.To4() == nil {
+				return nil, nil, fmt.Errorf("Bad parameter: %s is not an IPv4 address", config.IPAddress)
+			}
+			config.IPAddress = ip.String()
+		}
+		if config.MacAddress != "" {
+			hwaddr, err := net.ParseMAC(config.MacAddress)
+			if err != nil || len(hwaddr) != 6 || hwaddr[0]&1 != 0 {
+				return nil, nil, fmt.Errorf("Bad parameter: %s is not a unicast MAC address", config.MacAddress)
+			}
+			config.MacAddress = hwaddr.String()
+		}
+	}
+
 	sysInitPath := utils.DockerInitPath()
 	if sysInitPath == "" {
 		return nil, nil, fmt.Errorf("Could not locate dockerinit: This usually means docker was built incorrectly. See http://docs.docker.io/en/latest/contributing/devenvironment for official build instructions.")
@@ -407,80 +497,271 @@ func (runtime *Runtime) Create(config *Config, name string) (*Container, []strin
 		Name:        name,
 	}
 	container.root = runtime.containerRoot(container.ID)
+	if err := runtime.reserveStaticAddresses(container); err != nil {
+		return nil, nil, err
+	}
+	created := false
+	defer func() {
+		if !created {
+			runtime.releaseStaticAddresses(container)
+		}
+	}()
 	// Step 1: create the container directory.
 	// This doubles as a barrier to avoid race conditions.
 	if err := os.Mkdir(container.root, 0700); err != nil {
 		return nil, nil, err
 	}
+	if err := runtime.createRootfs(container, img); err != nil {
+		return nil, nil, err
+	}
 
+	if err := runtime.setupResolvConf(container); err != nil {
+		return nil, nil, err
+	}
+
+	// Step 2: save the container json
+	if err := container.ToDisk(); err != nil {
+		return nil, nil, err
+	}
+
+	// Step 3: if hostname, build hostname and hosts files
+	container.HostnamePath = path.Join(container.root, "hostname")
+	ioutil.WriteFile(container.HostnamePath, []byte(container.Config.Hostname+"\n"), 0644)
+
+	container.HostsPath = path.Join(container.root, "hosts")
+	container.writeHostsFile()
+
+	// Step 4: register the container
+	if err := runtime.Register(container); err != nil {
+		return nil, nil, err
+	}
+	created = true
+	return container, warnings, nil
+}
+
+// setupResolvConf gives `container` the dns servers of the current dns mode
+// of the daemon. It runs on each start, as the daemon may have been restarted
+// with another mode, or without its embedded dns server, since the container
+// was created.
+func (runtime *Runtime) setupResolvConf(container *Container) error {
 	resolvConf, err := utils.GetResolvConf()
 	if err != nil {
-		return nil, nil, err
+		return err
 	}
 
-	if len(config.Dns) == 0 && len(runtime.config.Dns) == 0 && utils.CheckLocalDns(resolvConf) {
+	// The embedded dns server forwards the queries to the other servers
+	embeddedDns := runtime.dnsServer != nil && !container.Config.NetworkDisabled
+
+	if !embeddedDns && len(container.Config.Dns) == 0 && len(runtime.config.Dns) == 0 && utils.CheckLocalDns(resolvConf) {
 		//"WARNING: Docker detected local DNS server on resolv.conf. Using default external servers: %v", defaultDns
 		runtime.config.Dns = defaultDns
 	}
 
-	// If custom dns exists, then create a resolv.conf for the container
-	if len(config.Dns) > 0 || len(runtime.config.Dns) > 0 {
+	if embeddedDns {
+		container.ResolvConfPath = path.Join(container.root, "resolv.conf")
+		content := "nameserver " + runtime.dnsServer.Addr().IP.String() + "\n"
+		if search := utils.GetSearchDomains(resolvConf); len(search) > 0 {
+			content += "search " + strings.Join(search, " ") + "\n"
+		}
+		if err := ioutil.WriteFile(container.ResolvConfPath, []byte(content), 0644); err != nil {
+			return err
+		}
+	} else if len(container.Config.Dns) > 0 || len(runtime.config.Dns) > 0 {
+		// If custom dns exists, then create a resolv.conf for the container
 		var dns []string
-		if len(config.Dns) > 0 {
-			dns = config.Dns
+		if len(container.Config.Dns) > 0 {
+			dns = container.Config.Dns
 		} else {
 			dns = runtime.config.Dns
 		}
 		container.ResolvConfPath = path.Join(container.root, "resolv.conf")
 		f, err := os.Create(container.ResolvConfPath)
 		if err != nil {
-			return nil, nil, err
+			return err
 		}
 		defer f.Close()
 		for _, dns := range dns {
 			if _, err := f.Write([]byte("nameserver " + dns + "\n")); err != nil {
-				return nil, nil, err
+				return err
 			}
 		}
 	} else {
 		container.ResolvConfPath = "/etc/resolv.conf"
 	}
+	return nil
+}
 
-	// Step 2: save the container json
-	if err := container.ToDisk(); err != nil {
-		return nil, nil, err
+// reserveStaticAddresses reserves the static IP and MAC addresses of
+// `container`, if it has any, on the network of its eth0 for as long as the
+// container exists.
+func (runtime *Runtime) reserveStaticAddresses(container *Container) error {
+	if container.Config.IPAddress == "" && container.Config.MacAddress == "" {
+		return nil
 	}
+	network, err := runtime.networkManager.GetNetwork(container.networkNames()[0])
+	if err != nil {
+		return err
+	}
+	if container.Config.MacAddress != "" {
+		if err := runtime.networkManager.ReserveMAC(network, container.Config.MacAddress); err != nil {
+			return err
+		}
+	}
+	if container.Config.IPAddress != "" {
+		if err := runtime.networkManager.ReserveIP(network, net.ParseIP(container.Config.IPAddress)); err != nil {
+			if container.Config.MacAddress != "" {
+				runtime.networkManager.ReleaseMAC(network, container.Config.MacAddress)
+			}
+			return err
+		}
+	}
+	return nil
+}
 
-	// Step 3: if hostname, build hostname and hosts files
-	container.HostnamePath = path.Join(container.root, "hostname")
-	ioutil.WriteFile(container.HostnamePath, []byte(container.Config.Hostname+"\n"), 0644)
+// reserveAllocations marks the addresses and host ports of a container
+// which was running when the daemon stopped as in use, so that the
+// containers started in the meantime aren't given them. Register hands them
+// over to the container if it is still running, or releases them.
+func (runtime *Runtime) reserveAllocations(container *Container) {
+	runtime.walkAllocations(container, true)
+}
 
-	hostsContent := []byte(`
-127.0.0.1	localhost
-::1		localhost ip6-localhost ip6-loopback
-fe00::0		ip6-localnet
-ff00::0		ip6-mcastprefix
-ff02::1		ip6-allnodes
-ff02::2		ip6-allrouters
-`)
+func (runtime *Runtime) releaseAllocations(container *Container) {
+	runtime.walkAllocations(container, false)
+}
 
-	container.HostsPath = path.Join(container.root, "hosts")
+// walkAllocations reserves, or releases, the addresses other than the
+// static IP and the host ports of `container` found in its NetworkSettings.
+func (runtime *Runtime) walkAllocations(container *Container, reserve bool) {
+	manager := runtime.networkManager
+	if manager.disabled || container.Config.NetworkDisabled || container.NetworkSettings == nil {
+		return
+	}
+	for name, endpoint := range container.NetworkSettings.endpoints() {
+		network, err := manager.GetNetwork(name)
+		if err != nil {
+			utils.Errorf("Unable to restore the network of container %s: %s", container.ID, err)
+			continue
+		}
+		if ip := net.ParseIP(endpoint.IPAddress); ip != nil && !container.isStaticEndpoint(endpoint) {
+			if !reserve {
+				network.ipAllocator.Release(ip)
+			} else if err := network.ipAllocator.Reserve(ip); err != nil {
+				utils.Errorf("Unable to restore the address of container %s: %s", container.ID, err)
+			}
+		}
+		if ip := net.ParseIP(endpoint.IPv6Address); ip != nil && network.ipv6Allocator != nil {
+			if !reserve {
+				network.ipv6Allocator.Release(ip)
+			} else if err := network.ipv6Allocator.Reserve(ip); err != nil {
+				utils.Errorf("Unable to restore the address of container %s: %s", container.ID, err)
+			}
+		}
+	}
+	for port, bindings := range container.NetworkSettings.Ports {
+		allocator := manager.tcpPortAllocator
+		if port.Proto() != "tcp" {
+			allocator = manager.udpPortAllocator
+		}
+		for _, binding := range bindings {
+			hostPort, err := parsePort(binding.HostPort)
+			if err != nil || hostPort == 0 {
+				continue
+			}
+			if !reserve {
+				allocator.Release(hostPort)
+			} else if _, err := allocator.Acquire(hostPort); err != nil {
+				utils.Errorf("Unable to restore the port of container %s: %s", container.ID, err)
+			}
+		}
+	}
+}
 
-	if container.Config.Domainname != "" {
-		hostsContent = append([]byte(fmt.Sprintf("::1\t\t%s.%s %s\n", container.Config.Hostname, container.Config.Domainname, container.Config.Hostname)), hostsContent...)
-		hostsContent = append([]byte(fmt.Sprintf("127.0.0.1\t%s.%s %s\n", container.Config.Hostname, container.Config.Domainname, container.Config.Hostname)), hostsContent...)
-	} else {
-		hostsContent = append([]byte(fmt.Sprintf("::1\t\t%s\n", container.Config.Hostname)), hostsContent...)
-		hostsContent = append([]byte(fmt.Sprintf("127.0.0.1\t%s\n", container.Config.Hostname)), hostsContent...)
+func (runtime *Runtime) releaseStaticAddresses(container *Container) {
+	if container.Config.IPAddress == "" && container.Config.MacAddress == "" {
+		return
+	}
+	network, err := runtime.networkManager.GetNetwork(container.networkNames()[0])
+	if err != nil {
+		return
+	}
+	if container.Config.MacAddress != "" {
+		runtime.networkManager.ReleaseMAC(network, container.Config.MacAddress)
 	}
+	if container.Config.IPAddress != "" {
+		runtime.networkManager.ReleaseIP(network, net.ParseIP(container.Config.IPAddress))
+	}
+}
 
-	ioutil.WriteFile(container.HostsPath, hostsContent, 0644)
+// createRootfs creates the filesystem layers of a new container: an init
+// layer holding the mountpoints for dockerinit and the generated
+// configuration files, and the container's own rw layer on top of it.
+func (runtime *Runtime) createRootfs(container *Container, img *Image) error {
+	initID := fmt.Sprintf("%s-init", container.ID)
+	if err := runtime.driver.Create(initID, img.ID); err != nil {
+		return err
+	}
+	initPath, err := runtime.driver.Get(initID)
+	if err != nil {
+		return err
+	}
+	defer runtime.driver.Put(initID)
+	if err := setupInitLayer(initPath); err != nil {
+		return err
+	}
+	return runtime.driver.Create(container.ID, initID)
+}
 
-	// Step 4: register the container
-	if err := runtime.Register(container); err != nil {
-		return nil, nil, err
+// migrateLegacyContainer moves the rw layer of a container created by a
+// version of docker which predates storage drivers into the driver.
+func (runtime *Runtime) migrateLegacyContainer(container *Container) error {
+	rw := path.Join(container.root, "rw")
+	if _, err := os.Stat(rw); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
 	}
-	return container, warnings, nil
+	// The legacy mount can't be released while the container is running:
+	// it will be migrated on the next start of the daemon.
+	if container.State.Running {
+		utils.Debugf("Container %s is running, not migrating it to the %s storage driver", container.ID, runtime.driver)
+		return nil
+	}
+	utils.Debugf("Migrating container %s to the %s storage driver", container.ID, runtime.driver)
+	rootfs := path.Join(container.root, "rootfs")
+	if mounted, err := Mounted(rootfs); err != nil {
+		return err
+	} else if mounted {
+		if err := Unmount(rootfs); err != nil {
+			return err
+		}
+	}
+	img, err := runtime.graph.Get(container.Image)
+	if err != nil {
+		return err
+	}
+	for _, id := range []string{container.ID, fmt.Sprintf("%s-init", container.ID)} {
+		if runtime.driver.Exists(id) {
+			if err := runtime.driver.Remove(id); err != nil {
+				return err
+			}
+		}
+	}
+	if err := runtime.createRootfs(container, img); err != nil {
+		return err
+	}
+	rwData, err := Tar(rw, Uncompressed)
+	if err != nil {
+		return err
+	}
+	if err := runtime.driver.ApplyDiff(container.ID, rwData); err != nil {
+		return err
+	}
+	if err := os.RemoveAll(rootfs); err != nil {
+		return err
+	}
+	return os.RemoveAll(rw)
 }
 
 // Commit creates a new filesystem image from the current state of a container.
@@ -501,6 +782,13 @@ func (runtime *Runtime) Commit(container *Container, repository, tag, comment, a
 	if err != nil {
 		return nil, err
 	}
+	// Any change can be committed: the image stays untrusted unless the
+	// daemon was told to sign the images made from trusted ones
+	if runtime.config.TrustDerivedImages {
+		if err := runtime.trust.Inherit(img.ID, container.Image); err != nil {
+			return img, err
+		}
+	}
 	// Register the image if needed
 	if repository != "" {
 		if err := runtime.repositories.Set(repository, tag, img.ID, true); err != nil {
@@ -582,11 +870,26 @@ func NewRuntimeFromDirectory(config *DaemonConfig) (*Runtime, error) {
 		return nil, err
 	}
 
-	g, err := NewGraph(path.Join(config.GraphPath, "graph"))
+	driver, err := NewGraphDriver(config.GraphPath, config.GraphDriver)
+	if err != nil {
+		return nil, err
+	}
+	utils.Debugf("Using storage driver %s", driver)
+
+	g, err := NewGraph(path.Join(config.GraphPath, "graph"), driver)
+	if err != nil {
+		return nil, err
+	}
+	if err := g.migrateLegacyLayers(); err != nil {
+		return nil, err
+	}
+
+	// Volumes are plain directories: they don't need anything fancier than vfs
+	volumesDriver, err := NewGraphDriver(path.Join(config.GraphPath, "volumes"), "vfs")
 	if err != nil {
 		return nil, err
 	}
-	volumes, err := NewGraph(path.Join(config.GraphPath, "volumes"))
+	volumes, err := NewGraph(path.Join(config.GraphPath, "volumes"), volumesDriver)
 	if err != nil {
 		return nil, err
 	}
@@ -597,11 +900,48 @@ func NewRuntimeFromDirectory(config *DaemonConfig) (*Runtime, error) {
 	if config.BridgeIface == "" {
 		config.BridgeIface = DefaultNetworkBridge
 	}
+	if config.MaxConcurrentDownloads <= 0 {
+		config.MaxConcurrentDownloads = DefaultMaxConcurrentDownloads
+	}
+	for i, mirror := range config.Mirrors {
+		if config.Mirrors[i], err = registry.ValidateMirror(mirror); err != nil {
+			return nil, err
+		}
+	}
+	trustRoot := path.Join(config.GraphPath, "trust")
+	if config.TrustKey == "" {
+		config.TrustKey = path.Join(trustRoot, "key.pem")
+	}
+	if config.TrustKeyring == "" {
+		config.TrustKeyring = path.Join(trustRoot, "keyring")
+	}
+	trust, err := NewTrustStore(trustRoot, config.TrustKey, config.TrustKeyring)
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't load the trust store: %s", err)
+	}
 	netManager, err := newNetworkManager(config)
 	if err != nil {
 		return nil, err
 	}
 
+	// Containers keep running with the driver they were started with, so
+	// every driver is loaded even if only one is used for new containers.
+	if config.ExecDriver == "" {
+		config.ExecDriver = DefaultExecDriver
+	}
+	if _, exists := execDrivers[config.ExecDriver]; !exists {
+		return nil, fmt.Errorf("No such execution driver: %s", config.ExecDriver)
+	}
+	loadedExecDrivers := make(map[string]ExecDriver)
+	for name := range execDrivers {
+		execDriver, err := NewExecDriver(name)
+		if err != nil {
+			return nil, err
+		}
+		loadedExecDrivers[name] = execDriver
+	}
+	utils.Debugf("Using execution driver %s", config.ExecDriver)
+
 	gographPath := path.Join(config.GraphPath, "linkgraph.db")
 	initDatabase := false
 	if _, err := os.Stat(gographPath); err != nil {
@@ -625,22 +965,38 @@ func NewRuntimeFromDirectory(config *DaemonConfig) (*Runtime, error) {
 		containers:     list.New(),
 		networkManager: netManager,
 		graph:          g,
+		driver:         driver,
+		execDriver:     loadedExecDrivers[config.ExecDriver],
+		execDrivers:    loadedExecDrivers,
+		execCommands:   newExecCommands(),
 		repositories:   repositories,
 		idIndex:        utils.NewTruncIndex(),
 		capabilities:   &Capabilities{},
 		volumes:        volumes,
 		config:         config,
 		containerGraph: graph,
+		trust:          trust,
 	}
 
 	if err := runtime.restore(); err != nil {
 		return nil, err
 	}
+	if config.EmbeddedDns && !netManager.disabled {
+		if err := runtime.startDnsServer(); err != nil {
+			log.Printf("WARNING: Unable to start the embedded dns server, the containers will use the dns servers directly: %s\n", err)
+		}
+	}
 	return runtime, nil
 }
 
 func (runtime *Runtime) Close() error {
+	if runtime.dnsServer != nil {
+		runtime.dnsServer.Close()
+	}
 	runtime.networkManager.Close()
+	if err := runtime.driver.Cleanup(); err != nil {
+		utils.Errorf("Error cleaning up the %s storage driver: %s", runtime.driver, err)
+	}
 	return runtime.containerGraph.Close()
 }
 
@@ -2,6 +2,7 @@ package docker
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -81,6 +82,9 @@ func (srv *Server) versionInfos() []utils.VersionInfo {
 // If a signal is given, then just send it to the container and return.
 func (srv *Server) ContainerKill(name string, sig int) error {
 	if container := srv.runtime.Get(name); container != nil {
+		if container.State.Paused {
+			return fmt.Errorf("Conflict, container %s is paused, unpause it first", name)
+		}
 		// If no signal is passed, perform regular Kill (SIGKILL + wait())
 		if sig == 0 {
 			if err := container.Kill(); err != nil {
@@ -287,6 +291,8 @@ func (srv *Server) DockerInfo() *APIInfo {
 	return &APIInfo{
 		Containers:         len(srv.runtime.List()),
 		Images:             imgcount,
+		Driver:             srv.runtime.driver.String(),
+		ExecutionDriver:    srv.runtime.execDriver.String(),
 		MemoryLimit:        srv.runtime.capabilities.MemoryLimit,
 		SwapLimit:          srv.runtime.capabilities.SwapLimit,
 		IPv4Forwarding:     !srv.runtime.capabilities.IPv4ForwardingDisabled,
@@ -334,6 +340,9 @@ func (srv *Server) ImageHistory(name string) ([]APIHistory, error) {
 
 func (srv *Server) ContainerTop(name, ps_args string) (*APITop, error) {
 	if container := srv.runtime.Get(name); container != nil {
+		if container.ExecDriver == "native" {
+			return nativeTop(container, ps_args)
+		}
 		output, err := exec.Command("lxc-ps", "--name", container.ID, "--", ps_args).CombinedOutput()
 		if err != nil {
 			return nil, fmt.Errorf("lxc-ps: %s (%s)", err, output)
@@ -445,53 +454,78 @@ func (srv *Server) ContainerTag(name, repo, tag string, force bool) error {
 	return nil
 }
 
-func (srv *Server) pullImage(r *registry.Registry, out io.Writer, imgID, endpoint string, token []string, sf *utils.StreamFormatter) error {
+// pullImage pulls the image `imgID` along with its parents. The missing
+// layers are downloaded concurrently, and registered parents first. Each
+// layer is checked against its entry in `checksums`, as listed by the index,
+// before it is registered, or against the checksum signed in the manifest
+// of `signed` if the image is signed: its layers are then trusted.
+func (srv *Server) pullImage(r *registry.Registry, out io.Writer, imgID, endpoint string, token []string, checksums map[string]string, signed *signedTag, sf *utils.StreamFormatter) error {
 	history, err := r.GetRemoteHistory(imgID, endpoint, token)
 	if err != nil {
 		return err
 	}
+	if signed != nil {
+		if !sameHistory(history, signed.manifest.History) {
+			return &SignatureError{Name: signed.manifest.Name, Tag: signed.manifest.Tag, Reason: "the registry serves another history than the signed one"}
+		}
+		checksums = signed.manifest.Checksums
+	}
 	out.Write(sf.FormatProgress(utils.TruncateID(imgID), "Pulling", "dependend layers"))
-	// FIXME: Try to stream the images?
-	// FIXME: Launch the getRemoteImage() in goroutines
 
 	for _, id := range history {
-
 		// ensure no two downloads of the same layer happen at the same time
 		if err := srv.poolAdd("pull", "layer:"+id); err != nil {
 			utils.Errorf("Image (id: %s) pull is already running, skipping: %v", id, err)
 			return nil
 		}
 		defer srv.poolRemove("pull", "layer:"+id)
+	}
 
-		if !srv.runtime.graph.Exists(id) {
-			out.Write(sf.FormatProgress(utils.TruncateID(id), "Pulling", "metadata"))
-			imgJSON, imgSize, err := r.GetRemoteImageJSON(id, endpoint, token)
-			if err != nil {
-				out.Write(sf.FormatProgress(utils.TruncateID(id), "Error", "pulling dependend layers"))
-				// FIXME: Keep going in case of error?
-				return err
+	var (
+		downloads = make([]*layerDownload, len(history))
+		abort     = make(chan struct{})
+	)
+	for i, id := range history {
+		if srv.runtime.graph.Exists(id) {
+			continue
+		}
+		downloads[i] = &layerDownload{id: id, done: make(chan struct{})}
+		go srv.pullLayer(downloads[i], r, out, endpoint, token, checksums[id], sf, abort)
+	}
+	defer func() {
+		// Stop the downloads still running if a layer failed, and drop
+		// the layers which weren't registered
+		close(abort)
+		for _, d := range downloads {
+			if d == nil {
+				continue
 			}
-			img, err := NewImgJSON(imgJSON)
-			if err != nil {
-				out.Write(sf.FormatProgress(utils.TruncateID(id), "Error", "pulling dependend layers"))
-				return fmt.Errorf("Failed to parse json: %s", err)
+			<-d.done
+			if d.layer != nil {
+				d.layer.Close()
+				os.Remove(d.layer.Name())
 			}
+		}
+	}()
 
-			// Get the layer
-			out.Write(sf.FormatProgress(utils.TruncateID(id), "Pulling", "fs layer"))
-			layer, err := r.GetRemoteImageLayer(img.ID, endpoint, token)
-			if err != nil {
-				out.Write(sf.FormatProgress(utils.TruncateID(id), "Error", "pulling dependend layers"))
-				return err
+	// The history goes from the image to its base layer
+	for i := len(history) - 1; i >= 0; i-- {
+		if d := downloads[i]; d != nil {
+			<-d.done
+			if d.err != nil {
+				return d.err
 			}
-			defer layer.Close()
-			if err := srv.runtime.graph.Register(imgJSON, utils.ProgressReader(layer, imgSize, out, sf.FormatProgress(utils.TruncateID(id), "Downloading", "%8v/%v (%v)"), sf, false), img); err != nil {
-				out.Write(sf.FormatProgress(utils.TruncateID(id), "Error", "downloading dependend layers"))
+			if err := srv.runtime.graph.Register(d.jsonData, d.layer, d.img); err != nil {
+				out.Write(sf.FormatProgress(utils.TruncateID(d.id), "Error", "registering dependend layers"))
 				return err
 			}
+			if signed != nil {
+				if err := srv.runtime.trust.SetVerified(signed.keyID, d.id); err != nil {
+					return err
+				}
+			}
 		}
-		out.Write(sf.FormatProgress(utils.TruncateID(id), "Download", "complete"))
-
+		out.Write(sf.FormatProgress(utils.TruncateID(history[i]), "Download", "complete"))
 	}
 	return nil
 }
@@ -512,10 +546,33 @@ func (srv *Server) pullRepository(r *registry.Registry, out io.Writer, localName
 	}
 
 	for tag, id := range tagsList {
-		repoData.ImgList[id] = &registry.ImgData{
-			ID:       id,
-			Tag:      tag,
-			Checksum: "",
+		// Keep the checksum listed by the index, if any
+		if _, exists := repoData.ImgList[id]; !exists {
+			repoData.ImgList[id] = &registry.ImgData{ID: id}
+		}
+		repoData.ImgList[id].Tag = tag
+	}
+	checksums := make(map[string]string)
+	for id, img := range repoData.ImgList {
+		checksums[id] = img.Checksum
+	}
+
+	// The signatures are verified before anything is downloaded: the layers
+	// of a signed image are checked against the signed checksums, not those
+	// of the index
+	signedTags := make(map[string]*signedTag)
+	signedImages := make(map[string]*signedTag)
+	for tag, id := range tagsList {
+		if askedTag != "" && tag != askedTag {
+			continue
+		}
+		signed, err := srv.fetchSignedTag(r, out, repoData, localName, remoteName, tag, id, sf)
+		if err != nil {
+			return err
+		}
+		if signed != nil {
+			signedTags[tag] = signed
+			signedImages[id] = signed
 		}
 	}
 
@@ -534,7 +591,11 @@ func (srv *Server) pullRepository(r *registry.Registry, out io.Writer, localName
 		repoData.ImgList[id].Tag = askedTag
 	}
 
-	errors := make(chan error)
+	var (
+		errors = make(chan error)
+		// A layer which doesn't match its checksum fails the whole pull
+		checksumErr error
+	)
 	for _, image := range repoData.ImgList {
 		downloadImage := func(img *registry.ImgData) {
 			if askedTag != "" && img.Tag != askedTag {
@@ -568,7 +629,7 @@ func (srv *Server) pullRepository(r *registry.Registry, out io.Writer, localName
 			var lastErr error
 			for _, ep := range repoData.Endpoints {
 				out.Write(sf.FormatProgress(utils.TruncateID(img.ID), "Pulling", fmt.Sprintf("image (%s) from %s, endpoint: %s", img.Tag, localName, ep)))
-				if err := srv.pullImage(r, out, img.ID, ep, repoData.Tokens, sf); err != nil {
+				if err := srv.pullImage(r, out, img.ID, ep, repoData.Tokens, checksums, signedImages[img.ID], sf); err != nil {
 					// Its not ideal that only the last error  is returned, it would be better to concatenate the errors.
 					// As the error is also given to the output stream the user will see the error.
 					lastErr = err
@@ -580,6 +641,14 @@ func (srv *Server) pullRepository(r *registry.Registry, out io.Writer, localName
 			}
 			if !success {
 				out.Write(sf.FormatProgress(utils.TruncateID(img.ID), "Error pulling", fmt.Sprintf("image (%s) from %s, %s", img.Tag, localName, lastErr)))
+				if isVerificationError(lastErr) {
+					if parallel {
+						errors <- lastErr
+					} else {
+						checksumErr = lastErr
+					}
+					return
+				}
 				if parallel {
 					errors <- fmt.Errorf("Could not find repository on any of the indexed registries.")
 					return
@@ -596,15 +665,24 @@ func (srv *Server) pullRepository(r *registry.Registry, out io.Writer, localName
 			go downloadImage(image)
 		} else {
 			downloadImage(image)
+			if checksumErr != nil {
+				return checksumErr
+			}
 		}
 	}
 	if parallel {
 		var lastError error
 		for i := 0; i < len(repoData.ImgList); i++ {
 			if err := <-errors; err != nil {
+				if isVerificationError(err) {
+					checksumErr = err
+				}
 				lastError = err
 			}
 		}
+		if checksumErr != nil {
+			return checksumErr
+		}
 		if lastError != nil {
 			return lastError
 		}
@@ -614,6 +692,11 @@ func (srv *Server) pullRepository(r *registry.Registry, out io.Writer, localName
 		if askedTag != "" && tag != askedTag {
 			continue
 		}
+		if signed := signedTags[tag]; signed != nil {
+			if err := srv.trustSignedTag(out, signed, localName, sf); err != nil {
+				return err
+			}
+		}
 		if err := srv.runtime.repositories.Set(localName, tag, id, true); err != nil {
 			return err
 		}
@@ -625,6 +708,93 @@ func (srv *Server) pullRepository(r *registry.Registry, out io.Writer, localName
 	return nil
 }
 
+// signedTag is a tag whose signature was verified, along with the key
+// which signed it.
+type signedTag struct {
+	manifest *Manifest
+	keyID    string
+}
+
+// isVerificationError returns whether `err` is a layer or a tag which
+// doesn't match what was signed or listed: trying another endpoint won't
+// help, and the pull fails.
+func isVerificationError(err error) bool {
+	switch err.(type) {
+	case *ChecksumError, *SignatureError:
+		return true
+	}
+	return false
+}
+
+func sameHistory(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// fetchSignedTag checks the signature of the tag `tag`, if the registry has
+// one, against the keyring of the daemon. A tag without signature is pulled
+// anyway, but its image isn't trusted, and nil is returned; a tag whose
+// signature doesn't verify isn't pulled.
+func (srv *Server) fetchSignedTag(r *registry.Registry, out io.Writer, repoData *registry.RepositoryData, localName, remoteName, tag, id string, sf *utils.StreamFormatter) (*signedTag, error) {
+	var (
+		signature []byte
+		err       error
+	)
+	for _, ep := range repoData.Endpoints {
+		signature, err = r.GetTagSignature(remoteName, tag, ep, repoData.Tokens)
+		if err == nil || err == registry.ErrSignatureNotFound {
+			break
+		}
+	}
+	if err == registry.ErrSignatureNotFound {
+		out.Write(sf.FormatStatus("", "%s:%s is not signed", localName, tag))
+		return nil, nil
+	} else if err != nil {
+		// Failing to fetch the signature doesn't make the tag unsigned
+		return nil, fmt.Errorf("Unable to fetch the signature of %s:%s: %s", localName, tag, err)
+	}
+	manifest, keyID, err := srv.runtime.trust.Verify(signature, remoteName, tag, id)
+	if err != nil {
+		srv.LogEvent("untrusted", utils.TruncateID(id), localName+":"+tag)
+		return nil, err
+	}
+	return &signedTag{manifest: manifest, keyID: keyID}, nil
+}
+
+// trustSignedTag trusts the image of the pulled tag `signed` and its
+// history. The layers pulled against the signed checksums are already
+// trusted; those which were already there, or pulled by another pull, are
+// checked against the signed checksums first.
+func (srv *Server) trustSignedTag(out io.Writer, signed *signedTag, localName string, sf *utils.StreamFormatter) error {
+	manifest := signed.manifest
+	for _, id := range manifest.History {
+		if srv.runtime.trust.IsTrusted(id) {
+			continue
+		}
+		checksum, err := srv.runtime.graph.LayerChecksum(id)
+		if err != nil {
+			return err
+		}
+		if checksum != manifest.Checksums[id] {
+			srv.LogEvent("untrusted", utils.TruncateID(manifest.ID), localName+":"+manifest.Tag)
+			return &SignatureError{Name: manifest.Name, Tag: manifest.Tag, Reason: fmt.Sprintf("the local layer %s doesn't match the signed checksum", utils.TruncateID(id))}
+		}
+	}
+	if err := srv.runtime.trust.SetVerified(signed.keyID, manifest.History...); err != nil {
+		return err
+	}
+	srv.LogEvent("verify", utils.TruncateID(manifest.ID), localName+":"+manifest.Tag)
+	out.Write(sf.FormatStatus("", "%s:%s is signed by the trusted key %s", localName, manifest.Tag, utils.TruncateID(signed.keyID)))
+	return nil
+}
+
 func (srv *Server) poolAdd(kind, key string) error {
 	srv.Lock()
 	defer srv.Unlock()
@@ -674,7 +844,7 @@ func (srv *Server) ImagePull(localName string, tag string, out io.Writer, sf *ut
 	defer srv.poolRemove("pull", localName+":"+tag)
 
 	// Resolve the Repository name from fqn to endpoint + name
-	endpoint, remoteName, err := registry.ResolveRepositoryName(localName)
+	endpoint, remoteName, err := registry.ResolveRepositoryName(localName, srv.runtime.config.InsecureRegistries)
 	if err != nil {
 		return err
 	}
@@ -682,6 +852,8 @@ func (srv *Server) ImagePull(localName string, tag string, out io.Writer, sf *ut
 	if endpoint == auth.IndexServerAddress() {
 		// If pull "index.docker.io/foo/bar", it's stored locally under "foo/bar"
 		localName = remoteName
+		// Mirrors only cache the images of the index
+		r.Mirrors = srv.runtime.config.Mirrors
 	}
 
 	out = utils.NewWriteFlusher(out)
@@ -689,8 +861,14 @@ func (srv *Server) ImagePull(localName string, tag string, out io.Writer, sf *ut
 	if err == registry.ErrLoginRequired {
 		return err
 	}
+	if _, ok := err.(*ChecksumError); ok {
+		return err
+	}
+	if _, ok := err.(*SignatureError); ok {
+		return err
+	}
 	if err != nil {
-		if err := srv.pullImage(r, out, remoteName, endpoint, nil, sf); err != nil {
+		if err := srv.pullImage(r, out, remoteName, endpoint, nil, nil, nil, sf); err != nil {
 			return err
 		}
 		return nil
@@ -769,6 +947,8 @@ func (srv *Server) pushRepository(r *registry.Registry, out io.Writer, localName
 		return err
 	}
 
+	// The checksums of the pushed layers, signed along with the tags
+	checksums := make(map[string]string)
 	for _, ep := range repoData.Endpoints {
 		out.Write(sf.FormatStatus("", "Pushing repository %s (%d tags)", localName, len(localRepo)))
 		// This section can not be parallelized (each round depends on the previous one)
@@ -801,12 +981,23 @@ func (srv *Server) pushRepository(r *registry.Registry, out io.Writer, localName
 					return err
 				} else {
 					elem.Checksum = checksum
+					if checksum != "" {
+						checksums[elem.ID] = checksum
+					}
 				}
 				if err := pushTags(); err != nil {
 					return err
 				}
 			}
 		}
+		for tag, id := range localRepo {
+			if err := srv.pushSignature(r, remoteName, tag, id, ep, repoData.Tokens, checksums); err != nil {
+				// Not every registry stores signatures
+				out.Write(sf.FormatStatus("", "Unable to push the signature of %s:%s: %s", localName, tag, err))
+				continue
+			}
+			out.Write(sf.FormatStatus("", "Signed %s:%s with the key %s", localName, tag, utils.TruncateID(srv.runtime.trust.KeyID())))
+		}
 	}
 
 	if _, err := r.PushImageJSONIndex(indexEp, remoteName, flattenedImgList, true, repoData.Endpoints); err != nil {
@@ -816,6 +1007,37 @@ func (srv *Server) pushRepository(r *registry.Registry, out io.Writer, localName
 	return nil
 }
 
+// pushSignature signs the tag `tag` of the repository with the key of the
+// daemon, and pushes the signature to the registry. The checksums of the
+// layers which weren't pushed, as they already were on the registry, are
+// computed and added to `checksums`.
+func (srv *Server) pushSignature(r *registry.Registry, remoteName, tag, id, ep string, token []string, checksums map[string]string) error {
+	img, err := srv.runtime.graph.Get(id)
+	if err != nil {
+		return err
+	}
+	manifest := &Manifest{Name: remoteName, Tag: tag, ID: img.ID, Checksums: make(map[string]string)}
+	if err := img.WalkHistory(func(current *Image) error {
+		if _, exists := checksums[current.ID]; !exists {
+			checksum, err := srv.runtime.graph.LayerChecksum(current.ID)
+			if err != nil {
+				return err
+			}
+			checksums[current.ID] = checksum
+		}
+		manifest.History = append(manifest.History, current.ID)
+		manifest.Checksums[current.ID] = checksums[current.ID]
+		return nil
+	}); err != nil {
+		return err
+	}
+	signature, err := srv.runtime.trust.Sign(manifest)
+	if err != nil {
+		return err
+	}
+	return r.PushTagSignature(remoteName, tag, ep, token, signature)
+}
+
 func (srv *Server) pushImage(r *registry.Registry, out io.Writer, remote, imgID, ep string, token []string, sf *utils.StreamFormatter) (checksum string, err error) {
 	out = utils.NewWriteFlusher(out)
 	jsonRaw, err := ioutil.ReadFile(path.Join(srv.runtime.graph.Root, imgID, "json"))
@@ -837,7 +1059,7 @@ func (srv *Server) pushImage(r *registry.Registry, out io.Writer, remote, imgID,
 		return "", err
 	}
 
-	layerData, err := srv.runtime.graph.TempLayerArchive(imgID, Uncompressed, sf, out)
+	layerData, err := srv.runtime.graph.TempLayerArchive(imgID, sf, out)
 	if err != nil {
 		return "", fmt.Errorf("Failed to generate layer archive: %s", err)
 	}
@@ -866,7 +1088,7 @@ func (srv *Server) ImagePush(localName string, out io.Writer, sf *utils.StreamFo
 	defer srv.poolRemove("push", localName)
 
 	// Resolve the Repository name from fqn to endpoint + name
-	endpoint, remoteName, err := registry.ResolveRepositoryName(localName)
+	endpoint, remoteName, err := registry.ResolveRepositoryName(localName, srv.runtime.config.InsecureRegistries)
 	if err != nil {
 		return err
 	}
@@ -938,6 +1160,205 @@ func (srv *Server) ImageImport(src, repo, tag string, in io.Reader, out io.Write
 	return nil
 }
 
+// ImageExport writes to `out` a tar archive of the image or repository
+// `name`, which ImageLoad can load back on another host. For each image
+// of the history, the archive holds a directory named after its ID with its
+// json and its filesystem layer. The tags of `name` are listed in a
+// repositories file at the root.
+func (srv *Server) ImageExport(name string, out io.Writer) error {
+	var (
+		images = []*Image{}
+		tags   = map[string]Repository{}
+	)
+	repoName, tag := utils.ParseRepositoryTag(name)
+	if repo, exists := srv.runtime.repositories.Repositories[repoName]; exists && tag == "" {
+		// The whole repository
+		tags[repoName] = Repository{}
+		for tag, id := range repo {
+			img, err := srv.runtime.graph.Get(id)
+			if err != nil {
+				return err
+			}
+			images = append(images, img)
+			tags[repoName][tag] = id
+		}
+	} else {
+		img, err := srv.runtime.repositories.LookupImage(name)
+		if err != nil {
+			return fmt.Errorf("No such image: %s", name)
+		}
+		images = append(images, img)
+		if !strings.HasPrefix(img.ID, name) {
+			if tag == "" {
+				tag = DEFAULTTAG
+			}
+			tags[repoName] = Repository{tag: img.ID}
+		}
+	}
+
+	tmp, err := ioutil.TempDir("", "docker-export-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	exported := make(map[string]bool)
+	for _, img := range images {
+		if err := img.WalkHistory(func(img *Image) error {
+			if exported[img.ID] {
+				return nil
+			}
+			exported[img.ID] = true
+			return srv.exportImage(img, path.Join(tmp, img.ID))
+		}); err != nil {
+			return err
+		}
+	}
+	if len(tags) > 0 {
+		data, err := json.Marshal(tags)
+		if err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(path.Join(tmp, "repositories"), data, 0644); err != nil {
+			return err
+		}
+	}
+
+	archive, err := Tar(tmp, Uncompressed)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, archive)
+	return err
+}
+
+func (srv *Server) exportImage(img *Image, dir string) error {
+	utils.Debugf("Exporting image %s", img.ID)
+	if err := os.Mkdir(dir, 0755); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(path.Join(dir, "VERSION"), []byte("1.0"), 0644); err != nil {
+		return err
+	}
+	// Keep the json as it was registered, so that it round-trips untouched
+	jsonData, err := ioutil.ReadFile(path.Join(srv.runtime.graph.Root, img.ID, "json"))
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(path.Join(dir, "json"), jsonData, 0644); err != nil {
+		return err
+	}
+	layer, err := img.TarLayer()
+	if err != nil {
+		return err
+	}
+	file, err := os.Create(path.Join(dir, "layer.tar"))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = io.Copy(file, layer)
+	return err
+}
+
+// ImageLoad registers the images of an archive written by ImageExport,
+// parents first, and restores their tags. Images which already exist are
+// left untouched.
+func (srv *Server) ImageLoad(in io.Reader) error {
+	tmp, err := srv.runtime.graph.Mktemp("")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	if err := os.MkdirAll(tmp, 0700); err != nil {
+		return err
+	}
+	if err := Untar(in, tmp); err != nil {
+		return err
+	}
+
+	dirs, err := ioutil.ReadDir(tmp)
+	if err != nil {
+		return err
+	}
+	loading := make(map[string]bool)
+	for _, d := range dirs {
+		if !d.IsDir() {
+			continue
+		}
+		if err := srv.loadImage(tmp, d.Name(), loading); err != nil {
+			return err
+		}
+	}
+
+	data, err := ioutil.ReadFile(path.Join(tmp, "repositories"))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	tags := map[string]Repository{}
+	if err := json.Unmarshal(data, &tags); err != nil {
+		return fmt.Errorf("Invalid repositories file: %s", err)
+	}
+	for repoName, repo := range tags {
+		for tag, id := range repo {
+			if err := srv.runtime.repositories.Set(repoName, tag, id, true); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// loadImage registers the image `id` of the archive extracted in `root`,
+// after its parents. `loading` holds the images whose parents are being
+// loaded, so that a cycle among them is an error.
+func (srv *Server) loadImage(root, id string, loading map[string]bool) error {
+	// The id is a path in the archive
+	if !validFullID.MatchString(id) {
+		return fmt.Errorf("Invalid image id in the archive: %s", id)
+	}
+	if srv.runtime.graph.Exists(id) {
+		utils.Debugf("Image %s already exists, skipping", id)
+		return nil
+	}
+	if loading[id] {
+		return fmt.Errorf("Image %s is its own ancestor in the archive", id)
+	}
+	loading[id] = true
+	jsonData, err := ioutil.ReadFile(path.Join(root, id, "json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("No such image in the archive: %s", id)
+		}
+		return err
+	}
+	img, err := NewImgJSON(jsonData)
+	if err != nil {
+		return fmt.Errorf("Invalid json for image %s: %s", id, err)
+	}
+	if img.ID != id {
+		return fmt.Errorf("The json of image %s describes image %s", id, img.ID)
+	}
+	if img.Parent != "" {
+		if err := srv.loadImage(root, img.Parent, loading); err != nil {
+			return err
+		}
+	}
+	layer, err := os.Open(path.Join(root, id, "layer.tar"))
+	if err != nil {
+		return err
+	}
+	defer layer.Close()
+	utils.Debugf("Loading image %s", id)
+	if err := srv.runtime.graph.Register(jsonData, layer, img); err != nil {
+		return err
+	}
+	srv.LogEvent("load", img.ShortID(), "")
+	return nil
+}
+
 func (srv *Server) ContainerCreate(config *Config, name string) (string, []string, error) {
 	if config.Memory != 0 && config.Memory < 524288 {
 		return "", nil, fmt.Errorf("Memory limit must be given in bytes (minimum 524288 bytes)")
@@ -969,6 +1390,10 @@ func (srv *Server) ContainerCreate(config *Config, name string) (string, []strin
 
 func (srv *Server) ContainerRestart(name string, t int) error {
 	if container := srv.runtime.Get(name); container != nil {
+		if container.State.Paused {
+			return fmt.Errorf("Conflict, container %s is paused, unpause it first", name)
+		}
+		container.RestartCount = 0
 		if err := container.Restart(t); err != nil {
 			return fmt.Errorf("Cannot restart container %s: %s", name, err)
 		}
@@ -1179,12 +1604,15 @@ func (srv *Server) ImageDelete(name string, autoPrune bool) ([]APIRmi, error) {
 	return srv.deleteImage(img, name, tag)
 }
 
-func (srv *Server) ImageGetCached(imgID string, config *Config) (*Image, error) {
+// ImageGetCached looks for a child of the image `imgID` built with the same
+// config, and for ADD, from files with the same content hash. If it only
+// finds one built from other files, it returns it as `stale`.
+func (srv *Server) ImageGetCached(imgID string, config *Config, contentHash string) (cached, stale *Image, err error) {
 
 	// Retrieve all images
 	images, err := srv.runtime.graph.Map()
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	// Store the tree in a map of map (map[parentId][childId])
@@ -1200,13 +1628,21 @@ func (srv *Server) ImageGetCached(imgID string, config *Config) (*Image, error)
 	for elem := range imageMap[imgID] {
 		img, err := srv.runtime.graph.Get(elem)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
-		if CompareConfig(&img.ContainerConfig, config) {
-			return img, nil
+		if !CompareConfig(&img.ContainerConfig, config) {
+			continue
 		}
+		hash, err := img.ContentHash()
+		if err != nil {
+			return nil, nil, err
+		}
+		if hash == contentHash {
+			return img, nil, nil
+		}
+		stale = img
 	}
-	return nil, nil
+	return nil, stale, nil
 }
 
 func (srv *Server) RegisterLinks(name string, hostConfig *HostConfig) error {
@@ -1252,7 +1688,16 @@ func (srv *Server) ContainerStart(name string, hostConfig *HostConfig) error {
 	if container == nil {
 		return fmt.Errorf("No such container: %s", name)
 	}
+	if hostConfig != nil {
+		if err := validateRestartPolicy(hostConfig.RestartPolicy); err != nil {
+			return fmt.Errorf("Bad parameter: %s", err)
+		}
+	}
 
+	// Starting a container by hand gives its restart policy a fresh start
+	if !container.State.Running {
+		container.RestartCount = 0
+	}
 	if err := container.Start(hostConfig); err != nil {
 		return fmt.Errorf("Cannot start container %s: %s", name, err)
 	}
@@ -1263,6 +1708,9 @@ func (srv *Server) ContainerStart(name string, hostConfig *HostConfig) error {
 
 func (srv *Server) ContainerStop(name string, t int) error {
 	if container := srv.runtime.Get(name); container != nil {
+		if container.State.Paused {
+			return fmt.Errorf("Conflict, container %s is paused, unpause it first", name)
+		}
 		if err := container.Stop(t); err != nil {
 			return fmt.Errorf("Cannot stop container %s: %s", name, err)
 		}
@@ -1273,6 +1721,65 @@ func (srv *Server) ContainerStop(name string, t int) error {
 	return nil
 }
 
+func (srv *Server) ContainerPause(name string) error {
+	container := srv.runtime.Get(name)
+	if container == nil {
+		return fmt.Errorf("No such container: %s", name)
+	}
+	if err := container.Pause(); err != nil {
+		return fmt.Errorf("Cannot pause container %s: %s", name, err)
+	}
+	srv.LogEvent("pause", container.ShortID(), srv.runtime.repositories.ImageName(container.Image))
+	return nil
+}
+
+func (srv *Server) ContainerUnpause(name string) error {
+	container := srv.runtime.Get(name)
+	if container == nil {
+		return fmt.Errorf("No such container: %s", name)
+	}
+	if err := container.Unpause(); err != nil {
+		return fmt.Errorf("Cannot unpause container %s: %s", name, err)
+	}
+	srv.LogEvent("unpause", container.ShortID(), srv.runtime.repositories.ImageName(container.Image))
+	return nil
+}
+
+// ContainerStats writes a sample of the resource usage of the container as
+// JSON to `out`. If `stream` is true, it keeps writing one every second
+// until the container stops or `out` fails.
+func (srv *Server) ContainerStats(name string, stream bool, out io.Writer) error {
+	container := srv.runtime.Get(name)
+	if container == nil {
+		return fmt.Errorf("No such container: %s", name)
+	}
+	if !container.State.Running {
+		return fmt.Errorf("Impossible to get the stats of a stopped container, start it first")
+	}
+	waitLock := container.waitLock
+	encoder := json.NewEncoder(out)
+	for {
+		stats, err := container.Stats()
+		if err != nil {
+			if !container.State.Running {
+				return nil
+			}
+			return err
+		}
+		if err := encoder.Encode(stats); err != nil {
+			return err
+		}
+		if !stream {
+			return nil
+		}
+		select {
+		case <-time.After(time.Second):
+		case <-waitLock:
+			return nil
+		}
+	}
+}
+
 func (srv *Server) ContainerWait(name string) (int, error) {
 	if container := srv.runtime.Get(name); container != nil {
 		return container.Wait(), nil
@@ -1280,6 +1787,56 @@ func (srv *Server) ContainerWait(name string) (int, error) {
 	return 0, fmt.Errorf("No such container: %s", name)
 }
 
+func (srv *Server) ContainerExecCreate(name string, config *ExecConfig) (string, error) {
+	container := srv.runtime.Get(name)
+	if container == nil {
+		return "", fmt.Errorf("No such container: %s", name)
+	}
+	if !container.State.Running {
+		return "", fmt.Errorf("Impossible to exec in a stopped container, start it first")
+	}
+	if container.State.Paused {
+		return "", fmt.Errorf("Conflict, container %s is paused, unpause it first", name)
+	}
+	if len(config.Cmd) == 0 {
+		return "", fmt.Errorf("Bad parameters: no command specified")
+	}
+	command := &ExecCommand{
+		ID:          GenerateID(),
+		ContainerID: container.ID,
+		Config:      *config,
+	}
+	srv.runtime.execCommands.Add(command)
+	return command.ID, nil
+}
+
+func (srv *Server) ContainerExecStart(id string, inStream io.ReadCloser, outStream, errStream io.Writer) error {
+	command := srv.runtime.execCommands.Get(id)
+	if command == nil {
+		return fmt.Errorf("No such exec command: %s", id)
+	}
+	container := srv.runtime.Get(command.ContainerID)
+	if container == nil {
+		return fmt.Errorf("No such container: %s", command.ContainerID)
+	}
+	srv.LogEvent("exec", container.ShortID(), srv.runtime.repositories.ImageName(container.Image))
+	return command.Run(container, inStream, outStream, errStream)
+}
+
+func (srv *Server) ContainerExecResize(id string, h, w int) error {
+	if command := srv.runtime.execCommands.Get(id); command != nil {
+		return command.Resize(h, w)
+	}
+	return fmt.Errorf("No such exec command: %s", id)
+}
+
+func (srv *Server) ContainerExecInspect(id string) (*APIExec, error) {
+	if command := srv.runtime.execCommands.Get(id); command != nil {
+		return command.Inspect(), nil
+	}
+	return nil, fmt.Errorf("No such exec command: %s", id)
+}
+
 func (srv *Server) ContainerResize(name string, h, w int) error {
 	if container := srv.runtime.Get(name); container != nil {
 		return container.Resize(h, w)
@@ -1287,6 +1844,201 @@ func (srv *Server) ContainerResize(name string, h, w int) error {
 	return fmt.Errorf("No such container: %s", name)
 }
 
+// ContainerLogs writes the logs of a container, as stored by the json log
+// driver, to outStream and errStream. Only the last `tail` lines are written
+// if tail is positive, and only the lines logged after `since` if it is set.
+// With follow, it then keeps streaming the output of the container until
+// it stops, or `closed` is signaled when the client goes away.
+func (srv *Server) ContainerLogs(name string, stdout, stderr, follow, timestamps bool, tail int, since time.Time, outStream, errStream io.Writer, closed <-chan bool) error {
+	container := srv.runtime.Get(name)
+	if container == nil {
+		return fmt.Errorf("No such container: %s", name)
+	}
+	if hostConfig, _ := container.ReadHostConfig(); hostConfig.LogConfig.Driver != "" && hostConfig.LogConfig.Driver != "json" {
+		return fmt.Errorf("Impossible to fetch the logs of container %s: the %s log driver doesn't store them", name, hostConfig.LogConfig.Driver)
+	}
+
+	output := &logWriter{stdout: stdout, stderr: stderr, timestamps: timestamps, since: since, outStream: outStream, errStream: errStream}
+
+	// The follower is attached before the log file is read, so that no line
+	// is lost in between. It holds the lines it receives until then.
+	var follower *logFollower
+	if follow && container.State.Running {
+		// The output of the container is received as JSON lines, like in the log file
+		follower = newLogFollower(output)
+		defer follower.Close()
+		if stdout {
+			container.stdout.AddWriter(follower, "stdout")
+		}
+		if stderr {
+			container.stderr.AddWriter(follower, "stderr")
+		}
+	}
+
+	// The lines before `since` are left out before the last `tail` are kept
+	readTail := tail
+	if !since.IsZero() {
+		readTail = -1
+	}
+	cLog, err := openRotatedLogs(container.logPath("json"), readTail)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	} else if err == nil {
+		var reader io.Reader = cLog
+		if readTail != tail {
+			reader, err = tailLogsSince(cLog, tail, since)
+		}
+		if err == nil {
+			_, err = io.Copy(output, reader)
+		}
+		cLog.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	if follower == nil {
+		return nil
+	}
+	if err := follower.release(); err != nil {
+		return err
+	}
+	// The follower is closed when the container stops, unless it already stopped
+	if !container.State.Running {
+		return nil
+	}
+	select {
+	case <-follower.done:
+	case <-closed:
+	}
+	return nil
+}
+
+// logWriter decodes the JSON lines written by the json log driver, and
+// writes the lines of the requested streams to outStream and errStream.
+type logWriter struct {
+	sync.Mutex
+	stdout, stderr       bool
+	timestamps           bool
+	since                time.Time
+	outStream, errStream io.Writer
+	buf                  bytes.Buffer
+	last                 map[string]time.Time // Time of the last line read of each stream
+}
+
+func (w *logWriter) Write(p []byte) (int, error) {
+	w.Lock()
+	defer w.Unlock()
+	w.buf.Write(p)
+	for {
+		line, err := w.buf.ReadBytes('\n')
+		if err != nil {
+			w.buf.Write(line)
+			break
+		}
+		l := &utils.JSONLog{}
+		if err := json.Unmarshal(line, l); err != nil {
+			return 0, fmt.Errorf("Error streaming logs: %s", err)
+		}
+		if w.last == nil {
+			w.last = make(map[string]time.Time)
+		}
+		w.last[l.Stream] = l.Created
+		if !w.since.IsZero() && !l.Created.After(w.since) {
+			continue
+		}
+		var out io.Writer
+		if l.Stream == "stdout" && w.stdout {
+			out = w.outStream
+		} else if l.Stream == "stderr" && w.stderr {
+			out = w.errStream
+		} else {
+			continue
+		}
+		if w.timestamps {
+			_, err = fmt.Fprintf(out, "%s %s", l.Created.Format(time.RFC3339Nano), l.Log)
+		} else {
+			_, err = fmt.Fprintf(out, "%s", l.Log)
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// read returns whether the line `l` was already read by the writer: the
+// lines of a stream are logged in order.
+func (w *logWriter) read(l *utils.JSONLog) bool {
+	w.Lock()
+	defer w.Unlock()
+	last, exists := w.last[l.Stream]
+	return exists && !l.Created.After(last)
+}
+
+// logFollower forwards the output of a running container to a logWriter,
+// until the container stops or the client goes away. The same follower is
+// attached to both stdout and stderr, and closed by whichever closes first.
+// It holds the lines it receives until it is released.
+type logFollower struct {
+	sync.Mutex
+	output  *logWriter
+	pending *bytes.Buffer // nil once released
+	done    chan struct{}
+	once    sync.Once
+}
+
+func newLogFollower(output *logWriter) *logFollower {
+	return &logFollower{output: output, pending: &bytes.Buffer{}, done: make(chan struct{})}
+}
+
+func (f *logFollower) Write(p []byte) (int, error) {
+	select {
+	case <-f.done:
+		// Get evicted from the broadcaster
+		return 0, io.ErrClosedPipe
+	default:
+	}
+	f.Lock()
+	defer f.Unlock()
+	if f.pending != nil {
+		return f.pending.Write(p)
+	}
+	n, err := f.output.Write(p)
+	if err != nil {
+		f.Close()
+	}
+	return n, err
+}
+
+// release forwards the lines held by the follower, but those the output
+// already read from the log file, and lets the next ones through.
+func (f *logFollower) release() error {
+	f.Lock()
+	defer f.Unlock()
+	pending := f.pending
+	f.pending = nil
+	for {
+		line, err := pending.ReadBytes('\n')
+		if err != nil {
+			return nil
+		}
+		l := &utils.JSONLog{}
+		if err := json.Unmarshal(line, l); err == nil && f.output.read(l) {
+			continue
+		}
+		if _, err := f.output.Write(line); err != nil {
+			f.Close()
+			return err
+		}
+	}
+}
+
+func (f *logFollower) Close() error {
+	f.once.Do(func() { close(f.done) })
+	return nil
+}
+
 func (srv *Server) ContainerAttach(name string, logs, stream, stdin, stdout, stderr bool, inStream io.ReadCloser, outStream, errStream io.Writer) error {
 	container := srv.runtime.Get(name)
 	if container == nil {
@@ -1294,6 +2046,16 @@ func (srv *Server) ContainerAttach(name string, logs, stream, stdin, stdout, std
 	}
 
 	//logs
+	if logs {
+		if hostConfig, _ := container.ReadHostConfig(); hostConfig.LogConfig.Driver != "" && hostConfig.LogConfig.Driver != "json" {
+			// Only the json driver keeps the logs around, attaching to the
+			// container without them is fine.
+			if !stream {
+				return fmt.Errorf("Impossible to fetch the logs of container %s: the %s log driver doesn't store them", name, hostConfig.LogConfig.Driver)
+			}
+			logs = false
+		}
+	}
 	if logs {
 		cLog, err := container.ReadLog("json")
 		if err != nil && os.IsNotExist(err) {
@@ -1303,21 +2065,28 @@ func (srv *Server) ContainerAttach(name string, logs, stream, stdin, stdout, std
 				cLog, err := container.ReadLog("stdout")
 				if err != nil {
 					utils.Errorf("Error reading logs (stdout): %s", err)
-				} else if _, err := io.Copy(outStream, cLog); err != nil {
-					utils.Errorf("Error streaming logs (stdout): %s", err)
+				} else {
+					if _, err := io.Copy(outStream, cLog); err != nil {
+						utils.Errorf("Error streaming logs (stdout): %s", err)
+					}
+					cLog.Close()
 				}
 			}
 			if stderr {
 				cLog, err := container.ReadLog("stderr")
 				if err != nil {
 					utils.Errorf("Error reading logs (stderr): %s", err)
-				} else if _, err := io.Copy(errStream, cLog); err != nil {
-					utils.Errorf("Error streaming logs (stderr): %s", err)
+				} else {
+					if _, err := io.Copy(errStream, cLog); err != nil {
+						utils.Errorf("Error streaming logs (stderr): %s", err)
+					}
+					cLog.Close()
 				}
 			}
 		} else if err != nil {
 			utils.Errorf("Error reading logs (json): %s", err)
 		} else {
+			defer cLog.Close()
 			dec := json.NewDecoder(cLog)
 			for {
 				l := &utils.JSONLog{}
@@ -1385,6 +2154,105 @@ func (srv *Server) ContainerInspect(name string) (*Container, error) {
 	return nil, fmt.Errorf("No such container: %s", name)
 }
 
+func (srv *Server) apiNetwork(network *Network) APINetwork {
+	out := APINetwork{
+		ID:          network.ID,
+		Name:        network.Name,
+		Bridge:      network.Bridge,
+		Subnet:      network.Subnet,
+		Gateway:     network.Gateway,
+		SubnetIPv6:  network.SubnetIPv6,
+		GatewayIPv6: network.GatewayIPv6,
+	}
+	if !network.Created.IsZero() {
+		out.Created = network.Created.Unix()
+	}
+	for _, container := range srv.runtime.List() {
+		if !container.State.Running || container.NetworkSettings == nil {
+			continue
+		}
+		if endpoint, exists := container.NetworkSettings.Networks[network.Name]; exists {
+			if out.Containers == nil {
+				out.Containers = make(map[string]APINetworkContainer)
+			}
+			out.Containers[container.ID] = APINetworkContainer{
+				Name:        container.Name,
+				Interface:   endpoint.Interface,
+				IPAddress:   endpoint.IPAddress,
+				IPv6Address: endpoint.IPv6Address,
+			}
+		}
+	}
+	return out
+}
+
+// Networks returns the default network followed by the user-defined ones.
+func (srv *Server) Networks() []APINetwork {
+	manager := srv.runtime.networkManager
+	out := []APINetwork{}
+	if manager.disabled {
+		return out
+	}
+	out = append(out, srv.apiNetwork(manager.defaultNetwork))
+	for _, network := range manager.Networks() {
+		out = append(out, srv.apiNetwork(network))
+	}
+	return out
+}
+
+func (srv *Server) NetworkInspect(name string) (*APINetwork, error) {
+	network, err := srv.runtime.networkManager.GetNetwork(name)
+	if err != nil {
+		return nil, err
+	}
+	out := srv.apiNetwork(network)
+	return &out, nil
+}
+
+func (srv *Server) NetworkCreate(name, subnet string) (string, error) {
+	network, err := srv.runtime.networkManager.CreateNetwork(name, subnet)
+	if err != nil {
+		return "", err
+	}
+	return network.ID, nil
+}
+
+func (srv *Server) NetworkRemove(name string) error {
+	network, err := srv.runtime.networkManager.GetNetwork(name)
+	if err != nil {
+		return err
+	}
+	return srv.runtime.networkManager.RemoveNetwork(network, func(network *Network) error {
+		for _, container := range srv.runtime.List() {
+			if container.Config.NetworkDisabled {
+				continue
+			}
+			for _, n := range container.networkNames() {
+				if n == network.Name {
+					return fmt.Errorf("Conflict, network %s is used by container %s", network.Name, container.ShortID())
+				}
+			}
+		}
+		return nil
+	})
+}
+
+func (srv *Server) NetworkConnect(name, containerName string) error {
+	container := srv.runtime.Get(containerName)
+	if container == nil {
+		return fmt.Errorf("No such container: %s", containerName)
+	}
+	return container.ConnectNetwork(name)
+}
+
+func (srv *Server) NetworkDisconnect(name, containerName string) error {
+	container := srv.runtime.Get(containerName)
+	if container == nil {
+		return fmt.Errorf("No such container: %s", containerName)
+	}
+	return container.DisconnectNetwork(name)
+}
+
 func (srv *Server) ImageInspect(name string) (*Image, error) {
 	if image, err := srv.runtime.repositories.LookupImage(name); err == nil && image != nil {
 		return image, nil
@@ -1461,4 +2329,5 @@ type Server struct {
 	events      []utils.JSONMessage
 	listeners   map[string]chan utils.JSONMessage
 	reqFactory  *utils.HTTPRequestFactory
+	layerSlots  chan struct{}
 }
@@ -1,7 +1,11 @@
 package docker
 
 import (
+	"bytes"
 	"github.com/dotcloud/docker/utils"
+	"io/ioutil"
+	"os"
+	"path"
 	"strings"
 	"testing"
 	"time"
@@ -219,6 +223,68 @@ func TestCreateStartRestartStopStartKillRm(t *testing.T) {
 
 }
 
+func TestContainerExec(t *testing.T) {
+	runtime := mkRuntime(t)
+	defer nuke(runtime)
+
+	srv := &Server{runtime: runtime}
+
+	container, _, err := runtime.Create(
+		&Config{
+			Image:     GetTestImage(runtime).ID,
+			Cmd:       []string{"/bin/cat"},
+			OpenStdin: true,
+			Env:       []string{"FOO=bar"},
+		},
+		"",
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer runtime.Destroy(container)
+
+	if _, err := srv.ContainerExecCreate(container.ID, &ExecConfig{Cmd: []string{"env"}}); err == nil {
+		t.Fatal("It should not be possible to exec in a stopped container")
+	}
+
+	if err := container.Start(&HostConfig{}); err != nil {
+		t.Fatal(err)
+	}
+	defer container.Kill()
+
+	id, err := srv.ContainerExecCreate(container.ID, &ExecConfig{
+		AttachStdout: true,
+		AttachStderr: true,
+		Cmd:          []string{"/bin/sh", "-c", "echo $FOO; exit 3"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout, stderr := bytes.NewBuffer(nil), bytes.NewBuffer(nil)
+	if err := srv.ContainerExecStart(id, nil, stdout, stderr); err != nil {
+		t.Fatal(err)
+	}
+	if output := strings.TrimSpace(stdout.String()); output != "bar" {
+		t.Fatalf("The command should get the environment of the container, found %q (stderr: %q)", output, stderr.String())
+	}
+
+	state, err := srv.ContainerExecInspect(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.Running || state.ExitCode != 3 {
+		t.Fatalf("Expected the command to exit with 3, found running=%v exit code=%d", state.Running, state.ExitCode)
+	}
+	if err := srv.ContainerExecStart(id, nil, stdout, stderr); err == nil {
+		t.Fatal("An exec command should not run twice")
+	}
+
+	// The container itself should be unaffected
+	if !container.State.Running {
+		t.Fatal("The container should still be running")
+	}
+}
+
 func TestRunWithTooLowMemoryLimit(t *testing.T) {
 	runtime := mkRuntime(t)
 	defer nuke(runtime)
@@ -521,3 +587,103 @@ func TestImagesFilter(t *testing.T) {
 		t.Fatal("incorrect number of matches returned")
 	}
 }
+
+func TestImageSaveLoad(t *testing.T) {
+	runtime := mkRuntime(t)
+	defer nuke(runtime)
+	srv := &Server{runtime: runtime}
+
+	config, hostConfig, _, err := ParseRun([]string{GetTestImage(runtime).ID, "touch", "/saved"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	containerID, _, err := srv.ContainerCreate(config, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.ContainerStart(containerID, hostConfig); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := srv.ContainerWait(containerID); err != nil {
+		t.Fatal(err)
+	}
+	imageID, err := srv.ContainerCommit(containerID, "utest", "save", "", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	archive := &bytes.Buffer{}
+	if err := srv.ImageExport("utest", archive); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.ContainerDestroy(containerID, false, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := srv.ImageDelete("utest:save", true); err != nil {
+		t.Fatal(err)
+	}
+	if runtime.graph.Exists(imageID) {
+		t.Fatalf("Image %s should have been deleted", imageID)
+	}
+
+	if err := srv.ImageLoad(archive); err != nil {
+		t.Fatal(err)
+	}
+	img, err := runtime.repositories.GetImage("utest", "save")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img == nil || img.ID != imageID {
+		t.Fatalf("utest:save should point to %s after the load, found %v", imageID, img)
+	}
+	if img.Parent != GetTestImage(runtime).ID {
+		t.Fatalf("The parent of the loaded image should be %s, found %s", GetTestImage(runtime).ID, img.Parent)
+	}
+	changes, err := runtime.graph.driver.Changes(imageID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, change := range changes {
+		if change.Path == "/saved" {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatalf("The layer of the loaded image should hold /saved, found %v", changes)
+	}
+}
+
+func TestLoadImageInvalid(t *testing.T) {
+	graph := tempGraph(t)
+	defer os.RemoveAll(graph.Root)
+	srv := &Server{runtime: &Runtime{graph: graph}}
+	root, err := ioutil.TempDir("", "docker-test-load")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	// Each image of the archive names the other as its parent
+	idA := strings.Repeat("a", 64)
+	idB := strings.Repeat("b", 64)
+	for id, parent := range map[string]string{idA: idB, idB: idA} {
+		if err := os.Mkdir(path.Join(root, id), 0700); err != nil {
+			t.Fatal(err)
+		}
+		json := `{"id":"` + id + `","parent":"` + parent + `"}`
+		if err := ioutil.WriteFile(path.Join(root, id, "json"), []byte(json), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := srv.loadImage(root, idA, make(map[string]bool)); err == nil || !strings.Contains(err.Error(), "ancestor") {
+		t.Fatalf("Expected the cycle to be an error, got %v", err)
+	}
+
+	// The ids can't lead out of the archive
+	for _, id := range []string{"../" + idA, "..", strings.ToUpper(idA)} {
+		if err := srv.loadImage(path.Join(root, idA), id, make(map[string]bool)); err == nil {
+			t.Fatalf("Expected the id %s to be refused", id)
+		}
+	}
+}
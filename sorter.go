@@ -81,3 +81,47 @@ func sortContainers(containers []*Container, predicate func(i, j *Container) boo
 	s := &containerSorter{containers, predicate}
 	sort.Sort(s)
 }
+
+type stringSorter struct {
+	strings []string
+	by      func(i, j string) bool
+}
+
+func (s *stringSorter) Len() int {
+	return len(s.strings)
+}
+
+func (s *stringSorter) Swap(i, j int) {
+	s.strings[i], s.strings[j] = s.strings[j], s.strings[i]
+}
+
+func (s *stringSorter) Less(i, j int) bool {
+	return s.by(s.strings[i], s.strings[j])
+}
+
+func sortStrings(strings []string, predicate func(i, j string) bool) {
+	s := &stringSorter{strings, predicate}
+	sort.Sort(s)
+}
+
+type networkSorter struct {
+	networks []*Network
+	by       func(i, j *Network) bool
+}
+
+func (s *networkSorter) Len() int {
+	return len(s.networks)
+}
+
+func (s *networkSorter) Swap(i, j int) {
+	s.networks[i], s.networks[j] = s.networks[j], s.networks[i]
+}
+
+func (s *networkSorter) Less(i, j int) bool {
+	return s.by(s.networks[i], s.networks[j])
+}
+
+func sortNetworks(networks []*Network, predicate func(i, j *Network) bool) {
+	s := &networkSorter{networks, predicate}
+	sort.Sort(s)
+}
@@ -15,6 +15,7 @@ type State struct {
 	StartedAt  time.Time
 	FinishedAt time.Time
 	Ghost      bool
+	Paused     bool
 }
 
 // String returns a human-readable description of the state
@@ -23,6 +24,9 @@ func (s *State) String() string {
 		if s.Ghost {
 			return fmt.Sprintf("Ghost")
 		}
+		if s.Paused {
+			return fmt.Sprintf("Up %s (Paused)", utils.HumanDuration(time.Now().Sub(s.StartedAt)))
+		}
 		return fmt.Sprintf("Up %s", utils.HumanDuration(time.Now().Sub(s.StartedAt)))
 	}
 	return fmt.Sprintf("Exit %d", s.ExitCode)
@@ -31,6 +35,7 @@ func (s *State) String() string {
 func (s *State) setRunning(pid int) {
 	s.Running = true
 	s.Ghost = false
+	s.Paused = false
 	s.ExitCode = 0
 	s.Pid = pid
 	s.StartedAt = time.Now()
@@ -38,6 +43,7 @@ func (s *State) setRunning(pid int) {
 
 func (s *State) setStopped(exitCode int) {
 	s.Running = false
+	s.Paused = false
 	s.Pid = 0
 	s.FinishedAt = time.Now()
 	s.ExitCode = exitCode
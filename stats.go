@@ -0,0 +1,173 @@
+package docker
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Clock ticks per second of the counters of /proc/stat (USER_HZ)
+const clockTicks = 100
+
+// Stats samples the resource usage of the container from its cgroups, and
+// the network counters from the host side of its veth pairs.
+func (container *Container) Stats() (*APIStats, error) {
+	if !container.State.Running {
+		return nil, fmt.Errorf("Container %s is not running", container.ShortID())
+	}
+	driver, err := container.execDriver()
+	if err != nil {
+		return nil, err
+	}
+	stats := &APIStats{Read: time.Now().UnixNano()}
+
+	if dir, err := driver.CgroupPath(container, "cpuacct"); err == nil {
+		if stats.CPU.TotalUsage, err = readCgroupUint(dir, "cpuacct.usage"); err != nil {
+			return nil, err
+		}
+		if content, err := ioutil.ReadFile(path.Join(dir, "cpuacct.usage_percpu")); err == nil {
+			for _, field := range strings.Fields(string(content)) {
+				usage, err := strconv.ParseUint(field, 10, 64)
+				if err != nil {
+					return nil, err
+				}
+				stats.CPU.PercpuUsage = append(stats.CPU.PercpuUsage, usage)
+			}
+		}
+	}
+	if stats.CPU.SystemUsage, err = systemCPUUsage(); err != nil {
+		return nil, err
+	}
+
+	if dir, err := driver.CgroupPath(container, "memory"); err == nil {
+		for file, value := range map[string]*uint64{
+			"memory.usage_in_bytes":     &stats.Memory.Usage,
+			"memory.max_usage_in_bytes": &stats.Memory.MaxUsage,
+			"memory.limit_in_bytes":     &stats.Memory.Limit,
+		} {
+			if *value, err = readCgroupUint(dir, file); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if dir, err := driver.CgroupPath(container, "blkio"); err == nil {
+		content, err := ioutil.ReadFile(path.Join(dir, "blkio.throttle.io_service_bytes"))
+		if err != nil {
+			return nil, err
+		}
+		if stats.Blkio, err = parseBlkioStats(string(content)); err != nil {
+			return nil, err
+		}
+	}
+
+	// The traffic of the container is summed over all its networks
+	for _, endpoint := range container.NetworkSettings.endpoints() {
+		if endpoint.HostVeth == "" {
+			continue
+		}
+		if err := addVethStats(&stats.Network, path.Join("/sys/class/net", endpoint.HostVeth, "statistics")); err != nil {
+			return nil, err
+		}
+	}
+	return stats, nil
+}
+
+// addVethStats adds the counters of the directory `dir`, the statistics of
+// the host side of a veth pair, to `stats`.
+func addVethStats(stats *APINetworkStats, dir string) error {
+	// What the host side of the pair receives, the container sends
+	for file, value := range map[string]*uint64{
+		"tx_bytes":   &stats.RxBytes,
+		"tx_packets": &stats.RxPackets,
+		"tx_errors":  &stats.RxErrors,
+		"tx_dropped": &stats.RxDropped,
+		"rx_bytes":   &stats.TxBytes,
+		"rx_packets": &stats.TxPackets,
+		"rx_errors":  &stats.TxErrors,
+		"rx_dropped": &stats.TxDropped,
+	} {
+		count, err := readCgroupUint(dir, file)
+		if err != nil {
+			return err
+		}
+		*value += count
+	}
+	return nil
+}
+
+// readCgroupUint reads a file holding a single integer, as found in cgroups and sysfs
+func readCgroupUint(dir, file string) (uint64, error) {
+	content, err := ioutil.ReadFile(path.Join(dir, file))
+	if err != nil {
+		return 0, err
+	}
+	value, err := strconv.ParseUint(strings.TrimSpace(string(content)), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("Unable to parse %s: %s", path.Join(dir, file), err)
+	}
+	return value, nil
+}
+
+// parseBlkioStats sums the bytes read and written on each device, from
+// lines such as:
+// 8:0 Read 1024
+// 8:0 Write 4096
+func parseBlkioStats(content string) (APIBlkioStats, error) {
+	stats := APIBlkioStats{}
+	for _, line := range strings.Split(content, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			// The last line holds the total
+			continue
+		}
+		value, err := strconv.ParseUint(fields[2], 10, 64)
+		if err != nil {
+			return stats, fmt.Errorf("Unable to parse blkio stats %q: %s", line, err)
+		}
+		switch fields[1] {
+		case "Read":
+			stats.ReadBytes += value
+		case "Write":
+			stats.WriteBytes += value
+		}
+	}
+	return stats, nil
+}
+
+// systemCPUUsage returns the CPU time used by the host in nanoseconds,
+// summed from the first line of /proc/stat.
+func systemCPUUsage() (uint64, error) {
+	file, err := os.Open("/proc/stat")
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	line, err := bufio.NewReader(file).ReadString('\n')
+	if err != nil {
+		return 0, err
+	}
+	return parseSystemCPUUsage(line)
+}
+
+func parseSystemCPUUsage(line string) (uint64, error) {
+	fields := strings.Fields(line)
+	if len(fields) < 8 || fields[0] != "cpu" {
+		return 0, fmt.Errorf("Invalid cpu line in /proc/stat: %q", line)
+	}
+	var ticks uint64
+	// user, nice, system, idle, iowait, irq and softirq
+	for _, field := range fields[1:8] {
+		value, err := strconv.ParseUint(field, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("Invalid cpu line in /proc/stat: %q", line)
+		}
+		ticks += value
+	}
+	return ticks * uint64(time.Second) / clockTicks, nil
+}
@@ -0,0 +1,76 @@
+package docker
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestParseBlkioStats(t *testing.T) {
+	content := `8:0 Read 1024
+8:0 Write 4096
+8:0 Sync 0
+8:0 Async 5120
+8:0 Total 5120
+8:16 Read 512
+8:16 Write 0
+Total 5632
+`
+	stats, err := parseBlkioStats(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.ReadBytes != 1536 || stats.WriteBytes != 4096 {
+		t.Fatalf("Expected 1536 bytes read and 4096 written, found %d and %d", stats.ReadBytes, stats.WriteBytes)
+	}
+	if _, err := parseBlkioStats("8:0 Read lots\n"); err == nil {
+		t.Fatal("Expected an error for an invalid value")
+	}
+}
+
+func TestParseSystemCPUUsage(t *testing.T) {
+	usage, err := parseSystemCPUUsage("cpu  100 2 30 400 5 0 3 0 0 0\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := uint64(540 * time.Second / clockTicks); usage != expected {
+		t.Fatalf("Expected %d, found %d", expected, usage)
+	}
+	if _, err := parseSystemCPUUsage("cpu0 100 2 30 400 5 0 3 0 0 0\n"); err == nil {
+		t.Fatal("Expected an error for a line which isn't the total")
+	}
+}
+
+func TestAddVethStats(t *testing.T) {
+	root, err := ioutil.TempDir("", "docker-test-stats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	stats := &APINetworkStats{}
+	for i, veth := range []string{"vethfoo", "vethfoo1"} {
+		dir := path.Join(root, veth)
+		if err := os.Mkdir(dir, 0700); err != nil {
+			t.Fatal(err)
+		}
+		for _, file := range []string{"rx_bytes", "rx_packets", "rx_errors", "rx_dropped", "tx_packets", "tx_errors", "tx_dropped"} {
+			if err := ioutil.WriteFile(path.Join(dir, file), []byte("1\n"), 0600); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := ioutil.WriteFile(path.Join(dir, "tx_bytes"), []byte(fmt.Sprintf("%d\n", 100*(i+1))), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := addVethStats(stats, dir); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The host side sends what the container receives
+	if stats.RxBytes != 300 || stats.TxPackets != 2 {
+		t.Fatalf("Expected the counters of both interfaces to be summed, got %+v", stats)
+	}
+}
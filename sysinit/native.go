@@ -0,0 +1,298 @@
+package sysinit
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/dotcloud/docker/netlink"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// NativeConfig describes the environment dockerinit sets up by itself when
+// it is run by the native execution driver rather than by lxc-start.
+// By the time dockerinit reads it, the driver has already moved the process
+// into its cgroups and new namespaces.
+type NativeConfig struct {
+	Rootfs     string
+	Hostname   string
+	Privileged bool
+	Mounts     []NativeMount
+	Network    *NativeNetwork // nil when networking is disabled
+	// Interfaces on the other networks of the container
+	ExtraNetworks []*NativeNetwork `json:",omitempty"`
+}
+
+// NativeMount is a bind mount from the host into the container.
+type NativeMount struct {
+	Source      string
+	Destination string // Relative to the root of the container
+	Writable    bool
+}
+
+// NativeNetwork describes a veth interface the driver moved into the
+// network namespace of the container.
+type NativeNetwork struct {
+	Name          string // Name of the interface once set up, eth0 if empty
+	Interface     string
+	IPAddress     string
+	IPPrefixLen   int
+	IPv6Address   string `json:",omitempty"`
+	IPv6PrefixLen int    `json:",omitempty"`
+	MacAddress    string `json:",omitempty"` // Random if empty
+	Mtu           int
+}
+
+// Capabilities dropped from unprivileged containers, like lxc.cap.drop in the lxc template
+var droppedCapabilities = []uintptr{
+	30, // CAP_AUDIT_CONTROL
+	29, // CAP_AUDIT_WRITE
+	33, // CAP_MAC_ADMIN
+	32, // CAP_MAC_OVERRIDE
+	27, // CAP_MKNOD
+	8,  // CAP_SETPCAP
+	21, // CAP_SYS_ADMIN
+	22, // CAP_SYS_BOOT
+	16, // CAP_SYS_MODULE
+	23, // CAP_SYS_NICE
+	20, // CAP_SYS_PACCT
+	17, // CAP_SYS_RAWIO
+	24, // CAP_SYS_RESOURCE
+	25, // CAP_SYS_TIME
+	26, // CAP_SYS_TTY_CONFIG
+}
+
+const prCapbsetDrop = 24
+
+// The driver keeps the write end of this pipe open until the cgroups and
+// the network interface of the container are ready.
+const nativeSyncFd = 3
+
+func loadNativeConfig(path string) (*NativeConfig, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	config := &NativeConfig{}
+	if err := json.Unmarshal(data, config); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// Set up the container from within its namespaces: filesystem, hostname,
+// network interfaces and capabilities
+func setupNative(configPath string) error {
+	syncPipe := os.NewFile(nativeSyncFd, "sync")
+	if _, err := ioutil.ReadAll(syncPipe); err != nil {
+		return fmt.Errorf("Error waiting for the driver: %v", err)
+	}
+	syncPipe.Close()
+
+	config, err := loadNativeConfig(configPath)
+	if err != nil {
+		return fmt.Errorf("Unable to load the container configuration: %v", err)
+	}
+	if err := setupNativeMounts(config); err != nil {
+		return err
+	}
+	if err := syscall.Sethostname([]byte(config.Hostname)); err != nil {
+		return fmt.Errorf("Unable to set the hostname: %v", err)
+	}
+	if err := setupNativeNetwork(config.Network, config.ExtraNetworks); err != nil {
+		return err
+	}
+	if err := pivotRoot(config.Rootfs); err != nil {
+		return err
+	}
+	if !config.Privileged {
+		return dropCapabilities()
+	}
+	return nil
+}
+
+func dropCapabilities() error {
+	for _, capability := range droppedCapabilities {
+		if _, _, e := syscall.RawSyscall(syscall.SYS_PRCTL, prCapbsetDrop, capability, 0); e != 0 {
+			return fmt.Errorf("Unable to drop capability %d: %v", capability, e)
+		}
+	}
+	return nil
+}
+
+// enterContainer runs dockerinit with `args` inside the running container
+// whose init process is `pid`. It is run on the host, so it first moves
+// itself into the cgroups of the container, and then lets nsenter join its
+// namespaces: nsenter forks once inside the new pid namespace, and the child
+// inherits the cgroups.
+func enterContainer(pid int, cgroups string, args []string) error {
+	for _, dir := range strings.Split(cgroups, ":") {
+		if dir == "" {
+			continue
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, "tasks"), []byte(strconv.Itoa(os.Getpid())), 0700); err != nil {
+			return fmt.Errorf("Unable to join cgroup %s: %v", dir, err)
+		}
+	}
+	nsenter, err := exec.LookPath("nsenter")
+	if err != nil {
+		return fmt.Errorf("Unable to find nsenter: %v", err)
+	}
+	nsenterArgs := []string{
+		"nsenter", "-t", strconv.Itoa(pid),
+		"-m", "-u", "-i", "-n", "-p", // mount, uts, ipc, net and pid namespaces
+		"-r", "-w", // root and working directory of the container
+		"--", "/.dockerinit",
+	}
+	return syscall.Exec(nsenter, append(nsenterArgs, args...), os.Environ())
+}
+
+func setupNativeMounts(config *NativeConfig) error {
+	rootfs := config.Rootfs
+	// Don't let our mounts propagate back to the host
+	if err := syscall.Mount("", "/", "", syscall.MS_PRIVATE|syscall.MS_REC, ""); err != nil {
+		return fmt.Errorf("Unable to make / private: %v", err)
+	}
+	// pivot_root needs the new root to be a mountpoint
+	if err := syscall.Mount(rootfs, rootfs, "bind", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+		return fmt.Errorf("Unable to bind mount the rootfs: %v", err)
+	}
+
+	for _, m := range []struct {
+		source, target, fstype string
+		flags                  uintptr
+		data                   string
+	}{
+		{"proc", "/proc", "proc", syscall.MS_NOSUID | syscall.MS_NODEV | syscall.MS_NOEXEC, ""},
+		{"sysfs", "/sys", "sysfs", syscall.MS_NOSUID | syscall.MS_NODEV | syscall.MS_NOEXEC, ""},
+		{"devpts", "/dev/pts", "devpts", syscall.MS_NOSUID | syscall.MS_NOEXEC, "newinstance,ptmxmode=0666"},
+		{"shm", "/dev/shm", "tmpfs", syscall.MS_NOSUID | syscall.MS_NODEV | syscall.MS_NOEXEC, "size=65536k"},
+	} {
+		target := filepath.Join(rootfs, m.target)
+		if err := os.MkdirAll(target, 0755); err != nil {
+			return err
+		}
+		if err := syscall.Mount(m.source, target, m.fstype, m.flags, m.data); err != nil {
+			return fmt.Errorf("Unable to mount %s: %v", m.target, err)
+		}
+	}
+
+	// Use the ptmx of the container's own devpts instance
+	ptmx := filepath.Join(rootfs, "/dev/ptmx")
+	if _, err := os.Stat(ptmx); err == nil {
+		if err := syscall.Mount(filepath.Join(rootfs, "/dev/pts/ptmx"), ptmx, "bind", syscall.MS_BIND, ""); err != nil {
+			return fmt.Errorf("Unable to bind mount /dev/ptmx: %v", err)
+		}
+	}
+
+	for _, m := range config.Mounts {
+		target := filepath.Join(rootfs, m.Destination)
+		if err := syscall.Mount(m.Source, target, "bind", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+			return fmt.Errorf("Unable to bind mount %s: %v", m.Destination, err)
+		}
+		if !m.Writable {
+			if err := syscall.Mount(m.Source, target, "bind", syscall.MS_BIND|syscall.MS_REMOUNT|syscall.MS_RDONLY|syscall.MS_REC, ""); err != nil {
+				return fmt.Errorf("Unable to remount %s read-only: %v", m.Destination, err)
+			}
+		}
+	}
+	return nil
+}
+
+func setupNativeNetwork(config *NativeNetwork, extra []*NativeNetwork) error {
+	lo, err := net.InterfaceByName("lo")
+	if err != nil {
+		return fmt.Errorf("Unable to find the loopback interface: %v", err)
+	}
+	if err := netlink.NetworkLinkUp(lo); err != nil {
+		return fmt.Errorf("Unable to bring up the loopback interface: %v", err)
+	}
+	if config == nil {
+		return nil
+	}
+	for _, network := range append([]*NativeNetwork{config}, extra...) {
+		if err := setupNativeInterface(network); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setupNativeInterface renames the veth interface of `config` and sets its
+// address.
+func setupNativeInterface(config *NativeNetwork) error {
+	name := config.Name
+	if name == "" {
+		name = "eth0"
+	}
+	iface, err := net.InterfaceByName(config.Interface)
+	if err != nil {
+		return fmt.Errorf("Unable to find interface %s: %v", config.Interface, err)
+	}
+	if err := netlink.NetworkChangeName(iface, name); err != nil {
+		return fmt.Errorf("Unable to rename %s to %s: %v", config.Interface, name, err)
+	}
+	if iface, err = net.InterfaceByName(name); err != nil {
+		return err
+	}
+	if config.Mtu != 0 {
+		if err := netlink.NetworkSetMTU(iface, config.Mtu); err != nil {
+			return fmt.Errorf("Unable to set the MTU of %s: %v", name, err)
+		}
+	}
+	if config.MacAddress != "" {
+		hwaddr, err := net.ParseMAC(config.MacAddress)
+		if err != nil {
+			return err
+		}
+		if err := netlink.NetworkSetMacAddress(iface, hwaddr); err != nil {
+			return fmt.Errorf("Unable to set the MAC address of %s: %v", name, err)
+		}
+	}
+	ip := net.ParseIP(config.IPAddress)
+	if ip == nil {
+		return fmt.Errorf("%s is not a valid IP", config.IPAddress)
+	}
+	ipNet := &net.IPNet{IP: ip, Mask: net.CIDRMask(config.IPPrefixLen, 32)}
+	if err := netlink.NetworkLinkAddIp(iface, ip, ipNet); err != nil {
+		return fmt.Errorf("Unable to set the address of %s: %v", name, err)
+	}
+	if config.IPv6Address != "" {
+		ip := net.ParseIP(config.IPv6Address)
+		if ip == nil {
+			return fmt.Errorf("%s is not a valid IPv6", config.IPv6Address)
+		}
+		ipNet := &net.IPNet{IP: ip, Mask: net.CIDRMask(config.IPv6PrefixLen, 128)}
+		if err := netlink.NetworkLinkAddIp(iface, ip, ipNet); err != nil {
+			return fmt.Errorf("Unable to set the IPv6 address of %s: %v", name, err)
+		}
+	}
+	if err := netlink.NetworkLinkUp(iface); err != nil {
+		return fmt.Errorf("Unable to bring up %s: %v", name, err)
+	}
+	return nil
+}
+
+func pivotRoot(rootfs string) error {
+	pivotDir, err := ioutil.TempDir(rootfs, ".pivot_root")
+	if err != nil {
+		return fmt.Errorf("Unable to create the pivot directory: %v", err)
+	}
+	if err := syscall.PivotRoot(rootfs, pivotDir); err != nil {
+		return fmt.Errorf("pivot_root failed: %v", err)
+	}
+	if err := syscall.Chdir("/"); err != nil {
+		return err
+	}
+	// The old root is now mounted at /<pivotDir>
+	pivotDir = filepath.Join("/", filepath.Base(pivotDir))
+	if err := syscall.Unmount(pivotDir, syscall.MNT_DETACH); err != nil {
+		return fmt.Errorf("Unable to unmount the old root: %v", err)
+	}
+	return os.Remove(pivotDir)
+}
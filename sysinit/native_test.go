@@ -0,0 +1,63 @@
+package sysinit
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestLoadNativeConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "docker-test-sysinit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// As written by the native driver
+	config := &NativeConfig{
+		Rootfs:   "/var/lib/docker/containers/foo/rootfs",
+		Hostname: "foo",
+		Mounts:   []NativeMount{{Source: "/srv/data", Destination: "/data", Writable: true}},
+		Network:  &NativeNetwork{Name: "eth0", Interface: "vethfoo0p", IPAddress: "172.17.0.2", IPPrefixLen: 16, Mtu: 1500},
+		ExtraNetworks: []*NativeNetwork{
+			{Name: "eth1", Interface: "vethfoo1p", IPAddress: "10.1.0.2", IPPrefixLen: 24},
+		},
+	}
+	data, err := json.Marshal(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	configPath := path.Join(dir, "config.native.json")
+	if err := ioutil.WriteFile(configPath, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := loadNativeConfig(configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Rootfs != config.Rootfs || loaded.Hostname != "foo" || loaded.Privileged {
+		t.Fatalf("Unexpected configuration: %#v", loaded)
+	}
+	if len(loaded.Mounts) != 1 || !loaded.Mounts[0].Writable || loaded.Mounts[0].Destination != "/data" {
+		t.Fatalf("Unexpected mounts: %v", loaded.Mounts)
+	}
+	if loaded.Network == nil || loaded.Network.IPAddress != "172.17.0.2" || loaded.Network.Mtu != 1500 {
+		t.Fatalf("Unexpected network: %#v", loaded.Network)
+	}
+	if len(loaded.ExtraNetworks) != 1 || loaded.ExtraNetworks[0].Name != "eth1" {
+		t.Fatalf("Unexpected extra networks: %v", loaded.ExtraNetworks)
+	}
+
+	if err := ioutil.WriteFile(configPath, []byte("{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadNativeConfig(configPath); err == nil {
+		t.Fatal("Expected an invalid configuration to be refused")
+	}
+	if _, err := loadNativeConfig(path.Join(dir, "missing.json")); err == nil {
+		t.Fatal("Expected a missing configuration to be refused")
+	}
+}
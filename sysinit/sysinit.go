@@ -17,19 +17,21 @@ import (
 )
 
 // Setup networking
-func setupNetworking(gw string) {
-	if gw == "" {
-		return
-	}
+func setupNetworking(gw, gw6 string) {
+	for _, gateway := range []string{gw, gw6} {
+		if gateway == "" {
+			continue
+		}
 
-	ip := net.ParseIP(gw)
-	if ip == nil {
-		log.Fatalf("Unable to set up networking, %s is not a valid IP", gw)
-		return
-	}
+		ip := net.ParseIP(gateway)
+		if ip == nil {
+			log.Fatalf("Unable to set up networking, %s is not a valid IP", gateway)
+			return
+		}
 
-	if err := netlink.AddDefaultGw(ip); err != nil {
-		log.Fatalf("Unable to set up networking: %v", err)
+		if err := netlink.AddDefaultGw(ip); err != nil {
+			log.Fatalf("Unable to set up networking: %v", err)
+		}
 	}
 }
 
@@ -113,12 +115,52 @@ func SysInit() {
 	}
 	var u = flag.String("u", "", "username or uid")
 	var gw = flag.String("g", "", "gateway address")
+	var gw6 = flag.String("g6", "", "IPv6 gateway address")
 	var workdir = flag.String("w", "", "workdir")
+	var driver = flag.String("driver", "lxc", "execution driver")
+	var config = flag.String("config", "", "container configuration, for the native driver")
+	var execMode = flag.Bool("exec", false, "run a new process in a running container")
+	var privileged = flag.Bool("privileged", false, "keep all capabilities, with -exec")
+	var enter = flag.Int("enter", 0, "pid of the container to enter, for the native driver")
+	var cgroups = flag.String("cgroups", "", "cgroups to join before entering the container")
+	var connect = flag.String("connect", "", "interface to set up in a running container, as json")
 
 	flag.Parse()
 
+	// Run on the host: the rest happens inside the container
+	if *enter != 0 {
+		if err := enterContainer(*enter, *cgroups, flag.Args()); err != nil {
+			log.Fatalf("Unable to enter the container: %v", err)
+		}
+	}
+
+	// The daemon moved a new interface into the container
+	if *connect != "" {
+		network := &NativeNetwork{}
+		if err := json.Unmarshal([]byte(*connect), network); err != nil {
+			log.Fatalf("Invalid interface %s: %v", *connect, err)
+		}
+		if err := setupNativeInterface(network); err != nil {
+			log.Fatalf("Unable to set up the interface: %v", err)
+		}
+		os.Exit(0)
+	}
+
+	if *driver == "native" {
+		if *execMode {
+			// The container is already set up, but nsenter keeps all the
+			// capabilities of the daemon
+			if !*privileged {
+				if err := dropCapabilities(); err != nil {
+					log.Fatalf("Unable to set up the process: %v", err)
+				}
+			}
+		} else if err := setupNative(*config); err != nil {
+			log.Fatalf("Unable to set up the container: %v", err)
+		}
+	}
 	cleanupEnv()
-	setupNetworking(*gw)
+	setupNetworking(*gw, *gw6)
 	setupWorkingDirectory(*workdir)
 	changeUser(*u)
 	executeProgram(flag.Arg(0), flag.Args())
@@ -0,0 +1,145 @@
+package docker
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+// writeTestCert writes a certificate for `name`, and its key, in `dir`. It
+// is signed by `parent`, or self-signed CA if `parent` is nil.
+func writeTestCert(t *testing.T, dir, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path.Join(dir, name+"-cert.pem"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path.Join(dir, name+"-key.pem"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+// handshake connects to `l` with `config`, and returns the error of the
+// handshake on both sides.
+func handshake(l net.Listener, config *tls.Config) (error, error) {
+	serverErr := make(chan error, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			serverErr <- err
+			return
+		}
+		defer conn.Close()
+		serverErr <- conn.(*tls.Conn).Handshake()
+	}()
+	conn, err := tls.Dial("tcp", l.Addr().String(), config)
+	if err == nil {
+		// The server checks the client certificate after the client is done
+		_, err = conn.Read(make([]byte, 1))
+		conn.Close()
+	}
+	return err, <-serverErr
+}
+
+func TestTLSMutualAuthentication(t *testing.T) {
+	dir, err := ioutil.TempDir("", "docker-test-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca, caKey := writeTestCert(t, dir, "ca", nil, nil)
+	writeTestCert(t, dir, "server", ca, caKey)
+	writeTestCert(t, dir, "client", ca, caKey)
+	writeTestCert(t, dir, "rogue", nil, nil)
+
+	serverConfig, err := NewServerTLSConfig(path.Join(dir, "server-cert.pem"), path.Join(dir, "server-key.pem"), path.Join(dir, "ca-cert.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l = tls.NewListener(l, serverConfig)
+	defer l.Close()
+
+	clientConfig, err := NewClientTLSConfig(path.Join(dir, "client-cert.pem"), path.Join(dir, "client-key.pem"), path.Join(dir, "ca-cert.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, serverErr := handshake(l, clientConfig); serverErr != nil {
+		t.Fatalf("Expected a client with a certificate of the CA to connect: %s", serverErr)
+	}
+
+	// A client without certificate, or with one of another CA, is refused
+	noCertConfig, err := NewClientTLSConfig("", "", path.Join(dir, "ca-cert.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, serverErr := handshake(l, noCertConfig); serverErr == nil {
+		t.Fatal("Expected a client without certificate to be refused")
+	}
+	rogueConfig, err := NewClientTLSConfig(path.Join(dir, "rogue-cert.pem"), path.Join(dir, "rogue-key.pem"), path.Join(dir, "ca-cert.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, serverErr := handshake(l, rogueConfig); serverErr == nil {
+		t.Fatal("Expected a client with a certificate of another CA to be refused")
+	}
+
+	// The client verifies the daemon too
+	otherCAConfig, err := NewClientTLSConfig(path.Join(dir, "client-cert.pem"), path.Join(dir, "client-key.pem"), path.Join(dir, "rogue-cert.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if clientErr, _ := handshake(l, otherCAConfig); clientErr == nil {
+		t.Fatal("Expected the client to refuse a daemon signed by another CA")
+	}
+}
+
+func TestNewClientTLSConfigKeyWithoutCert(t *testing.T) {
+	if _, err := NewClientTLSConfig("", "key.pem", ""); err == nil {
+		t.Fatal("Expected an error for a key without certificate")
+	}
+}
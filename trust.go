@@ -0,0 +1,321 @@
+package docker
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"github.com/dotcloud/docker/utils"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+)
+
+// SignatureError is returned when the signature of a tag pulled from a
+// registry can't be verified: it is invalid, made by a key which isn't in
+// the keyring, or signs another image.
+type SignatureError struct {
+	Name   string
+	Tag    string
+	Reason string
+}
+
+func (e *SignatureError) Error() string {
+	return fmt.Sprintf("Invalid signature for %s:%s: %s", e.Name, e.Tag, e.Reason)
+}
+
+// UntrustedImageError is returned when creating a container from an image
+// with no verified signature, if the daemon requires signed images.
+type UntrustedImageError struct {
+	ID string
+}
+
+func (e *UntrustedImageError) Error() string {
+	return fmt.Sprintf("Image %s is not signed by a trusted key, and the daemon only runs signed images", utils.TruncateID(e.ID))
+}
+
+// Manifest is what is signed when a tag is pushed: it binds the name of a
+// repository and a tag to an image, to its history, and to the content of
+// each layer of the history through its checksum.
+type Manifest struct {
+	Name      string
+	Tag       string
+	ID        string
+	History   []string
+	Checksums map[string]string // Checksum of the layer of each image of the history
+}
+
+// SignedManifest is the signature of a manifest, as stored on the registry.
+// The manifest is kept as it was signed, so that its signature can be
+// checked without encoding it again.
+type SignedManifest struct {
+	Payload   []byte
+	KeyID     string
+	Signature []byte
+}
+
+type ecdsaSignature struct {
+	R, S *big.Int
+}
+
+// TrustStore holds the key of the daemon, the keyring of the keys it
+// trusts, and the images whose signature was verified.
+type TrustStore struct {
+	sync.Mutex
+	key     *ecdsa.PrivateKey
+	keyID   string
+	keyring map[string]*ecdsa.PublicKey
+	path    string
+	// Verified maps the id of an image to the id of the key which signed it
+	Verified map[string]string
+}
+
+// NewTrustStore loads the key at `keyPath`, generating it if needed along
+// with its public key in `keyPath`.pub, and the public keys in the
+// `keyringPath` directory. The verified images are recorded in `root`.
+func NewTrustStore(root, keyPath, keyringPath string) (*TrustStore, error) {
+	if err := os.MkdirAll(root, 0700); err != nil {
+		return nil, err
+	}
+	key, err := loadOrCreateKey(keyPath)
+	if err != nil {
+		return nil, err
+	}
+	keyID, err := publicKeyID(&key.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	store := &TrustStore{
+		key:      key,
+		keyID:    keyID,
+		keyring:  map[string]*ecdsa.PublicKey{keyID: &key.PublicKey},
+		path:     path.Join(root, "verified.json"),
+		Verified: make(map[string]string),
+	}
+	if err := store.loadKeyring(keyringPath); err != nil {
+		return nil, err
+	}
+	if err := store.reload(); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+func loadOrCreateKey(keyPath string) (*ecdsa.PrivateKey, error) {
+	data, err := ioutil.ReadFile(keyPath)
+	if err == nil {
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("Invalid key %s: no PEM data found", keyPath)
+		}
+		return x509.ParseECPrivateKey(block.Bytes)
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	utils.Debugf("Generating the signing key %s", keyPath)
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	pubDer, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(path.Dir(keyPath), 0700); err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(keyPath+".pub", pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubDer}), 0644); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// publicKeyID identifies a key by the sha256 of its DER encoding.
+func publicKeyID(key *ecdsa.PublicKey) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// loadKeyring adds the PEM encoded public keys of the directory `dir`, the
+// *.pem and *.pub files, to the trusted keys. A missing directory is an
+// empty keyring.
+func (store *TrustStore) loadKeyring(dir string) error {
+	var files []string
+	for _, pattern := range []string{"*.pem", "*.pub"} {
+		matches, err := filepath.Glob(path.Join(dir, pattern))
+		if err != nil {
+			return err
+		}
+		files = append(files, matches...)
+	}
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return fmt.Errorf("Invalid key %s: no PEM data found", file)
+		}
+		pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return fmt.Errorf("Invalid key %s: %s", file, err)
+		}
+		ecKey, ok := pub.(*ecdsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("Invalid key %s: only ECDSA keys are supported", file)
+		}
+		keyID, err := publicKeyID(ecKey)
+		if err != nil {
+			return err
+		}
+		utils.Debugf("Trusting the key %s (%s)", keyID, file)
+		store.keyring[keyID] = ecKey
+	}
+	return nil
+}
+
+func (store *TrustStore) reload() error {
+	data, err := ioutil.ReadFile(store.path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, &store.Verified)
+}
+
+func (store *TrustStore) save() error {
+	data, err := json.Marshal(store.Verified)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(store.path, data, 0600)
+}
+
+// KeyID returns the id of the key of the daemon.
+func (store *TrustStore) KeyID() string {
+	return store.keyID
+}
+
+// Sign signs `manifest` with the key of the daemon.
+func (store *TrustStore) Sign(manifest *Manifest) ([]byte, error) {
+	payload, err := json.Marshal(manifest)
+	if err != nil {
+		return nil, err
+	}
+	hash := sha256.Sum256(payload)
+	r, s, err := ecdsa.Sign(rand.Reader, store.key, hash[:])
+	if err != nil {
+		return nil, err
+	}
+	signature, err := asn1.Marshal(ecdsaSignature{r, s})
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(&SignedManifest{
+		Payload:   payload,
+		KeyID:     store.keyID,
+		Signature: signature,
+	})
+}
+
+// Verify checks that `data` is a manifest signed by a key of the keyring,
+// for the image `id` tagged `name`:`tag`. It returns the verified manifest
+// and the id of the key which signed it.
+func (store *TrustStore) Verify(data []byte, name, tag, id string) (*Manifest, string, error) {
+	fail := func(reason string) (*Manifest, string, error) {
+		return nil, "", &SignatureError{Name: name, Tag: tag, Reason: reason}
+	}
+	signed := &SignedManifest{}
+	if err := json.Unmarshal(data, signed); err != nil {
+		return fail(fmt.Sprintf("malformed signature: %s", err))
+	}
+	key, exists := store.keyring[signed.KeyID]
+	if !exists {
+		return fail(fmt.Sprintf("signed by the unknown key %s", signed.KeyID))
+	}
+	sig := &ecdsaSignature{}
+	if _, err := asn1.Unmarshal(signed.Signature, sig); err != nil {
+		return fail(fmt.Sprintf("malformed signature: %s", err))
+	}
+	hash := sha256.Sum256(signed.Payload)
+	if !ecdsa.Verify(key, hash[:], sig.R, sig.S) {
+		return fail("the manifest doesn't match its signature")
+	}
+	manifest := &Manifest{}
+	if err := json.Unmarshal(signed.Payload, manifest); err != nil {
+		return fail(fmt.Sprintf("malformed manifest: %s", err))
+	}
+	if manifest.Name != name || manifest.Tag != tag {
+		return fail(fmt.Sprintf("the signature is for %s:%s", manifest.Name, manifest.Tag))
+	}
+	if len(manifest.History) == 0 || manifest.History[0] != manifest.ID {
+		return fail("the history of the manifest doesn't start with its image")
+	}
+	if manifest.ID != id {
+		return fail(fmt.Sprintf("the signature is for the image %s, not %s", utils.TruncateID(manifest.ID), utils.TruncateID(id)))
+	}
+	// Without the checksums, the registry could serve any layer
+	for _, layerID := range manifest.History {
+		if manifest.Checksums[layerID] == "" {
+			return fail(fmt.Sprintf("the manifest doesn't sign the checksum of the layer %s", utils.TruncateID(layerID)))
+		}
+	}
+	return manifest, signed.KeyID, nil
+}
+
+// SetVerified records that the images `ids` were signed by the key `keyID`.
+func (store *TrustStore) SetVerified(keyID string, ids ...string) error {
+	store.Lock()
+	defer store.Unlock()
+	for _, id := range ids {
+		store.Verified[id] = keyID
+	}
+	return store.save()
+}
+
+// IsTrusted returns whether the image `id` was signed by a trusted key. An
+// image whose key was removed from the keyring isn't trusted anymore.
+func (store *TrustStore) IsTrusted(id string) bool {
+	store.Lock()
+	defer store.Unlock()
+	keyID, exists := store.Verified[id]
+	if !exists {
+		return false
+	}
+	_, trusted := store.keyring[keyID]
+	return trusted
+}
+
+// Inherit records the image `id`, created by the daemon from `parentID`,
+// as signed by the key of the daemon if its parent is trusted. This keeps
+// the images built or committed from a trusted image runnable.
+func (store *TrustStore) Inherit(id, parentID string) error {
+	if !store.IsTrusted(parentID) {
+		return nil
+	}
+	return store.SetVerified(store.keyID, id)
+}
@@ -0,0 +1,209 @@
+package docker
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/dotcloud/docker/registry"
+	"github.com/dotcloud/docker/utils"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func newTestTrustStore(t *testing.T, root, name string) *TrustStore {
+	store, err := NewTrustStore(root, path.Join(root, name+".pem"), path.Join(root, "keyring"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+func TestTrustSignVerify(t *testing.T) {
+	root, err := ioutil.TempDir("", "docker-test-trust")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	store := newTestTrustStore(t, root, "key")
+	manifest := &Manifest{
+		Name:      "foo/bar",
+		Tag:       "latest",
+		ID:        "abc",
+		History:   []string{"abc", "def"},
+		Checksums: map[string]string{"abc": "tarsum+sha256:1", "def": "tarsum+sha256:2"},
+	}
+	signature, err := store.Sign(manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	verified, keyID, err := store.Verify(signature, "foo/bar", "latest", "abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keyID != store.KeyID() {
+		t.Fatalf("Expected the key %s, got %s", store.KeyID(), keyID)
+	}
+	if len(verified.History) != 2 || verified.History[1] != "def" {
+		t.Fatalf("Unexpected history: %v", verified.History)
+	}
+	if verified.Checksums["def"] != "tarsum+sha256:2" {
+		t.Fatalf("Unexpected checksums: %v", verified.Checksums)
+	}
+
+	// The signature is bound to the name, the tag and the image
+	for _, args := range [][]string{
+		{"foo/baz", "latest", "abc"},
+		{"foo/bar", "1.0", "abc"},
+		{"foo/bar", "latest", "xyz"},
+	} {
+		if _, _, err := store.Verify(signature, args[0], args[1], args[2]); err == nil {
+			t.Fatalf("Expected the signature not to verify for %v", args)
+		} else if _, ok := err.(*SignatureError); !ok {
+			t.Fatalf("Expected a SignatureError, got %s", err)
+		}
+	}
+
+	// A key out of the keyring isn't trusted
+	other := newTestTrustStore(t, path.Join(root, "other"), "key")
+	if _, _, err := other.Verify(signature, "foo/bar", "latest", "abc"); err == nil {
+		t.Fatal("Expected a signature by an unknown key not to verify")
+	}
+	// Until its public key is added to the keyring
+	pub, err := ioutil.ReadFile(path.Join(root, "key.pem.pub"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(path.Join(root, "other", "keyring"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path.Join(root, "other", "keyring", "key.pub"), pub, 0644); err != nil {
+		t.Fatal(err)
+	}
+	other = newTestTrustStore(t, path.Join(root, "other"), "key")
+	if _, _, err := other.Verify(signature, "foo/bar", "latest", "abc"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTrustTamperedManifest(t *testing.T) {
+	root, err := ioutil.TempDir("", "docker-test-trust")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	store := newTestTrustStore(t, root, "key")
+	signature, err := store.Sign(&Manifest{Name: "foo/bar", Tag: "latest", ID: "abc", History: []string{"abc"}, Checksums: map[string]string{"abc": "tarsum+sha256:1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := &SignedManifest{}
+	if err := json.Unmarshal(signature, signed); err != nil {
+		t.Fatal(err)
+	}
+	signed.Payload = bytes.Replace(signed.Payload, []byte(`"abc"`), []byte(`"abd"`), -1)
+	tampered, err := json.Marshal(signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := store.Verify(tampered, "foo/bar", "latest", "abd"); err == nil {
+		t.Fatal("Expected a tampered manifest not to verify")
+	}
+}
+
+func TestTrustUnsignedChecksums(t *testing.T) {
+	root, err := ioutil.TempDir("", "docker-test-trust")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	store := newTestTrustStore(t, root, "key")
+	// The checksum of a layer of the history is missing
+	signature, err := store.Sign(&Manifest{Name: "foo/bar", Tag: "latest", ID: "abc", History: []string{"abc", "def"}, Checksums: map[string]string{"abc": "tarsum+sha256:1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := store.Verify(signature, "foo/bar", "latest", "abc"); err == nil {
+		t.Fatal("Expected a manifest which doesn't sign every layer not to verify")
+	}
+}
+
+func TestTrustVerifiedImages(t *testing.T) {
+	root, err := ioutil.TempDir("", "docker-test-trust")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	store := newTestTrustStore(t, root, "key")
+	if store.IsTrusted("abc") {
+		t.Fatal("Expected an unknown image not to be trusted")
+	}
+	if err := store.SetVerified(store.KeyID(), "abc", "def"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Inherit("ghi", "abc"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Inherit("jkl", "xyz"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The verified images are kept across restarts
+	store = newTestTrustStore(t, root, "key")
+	for _, id := range []string{"abc", "def", "ghi"} {
+		if !store.IsTrusted(id) {
+			t.Fatalf("Expected %s to be trusted", id)
+		}
+	}
+	if store.IsTrusted("jkl") {
+		t.Fatal("Expected an image made from an untrusted one not to be trusted")
+	}
+
+	// But not if the key which signed them changed
+	os.Remove(path.Join(root, "key.pem"))
+	store = newTestTrustStore(t, root, "key")
+	if store.IsTrusted("abc") {
+		t.Fatal("Expected an image signed by a removed key not to be trusted")
+	}
+}
+
+func TestFetchSignedTagError(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/signatures/unsigned") {
+			http.NotFound(w, r)
+			return
+		}
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+
+	r, err := registry.NewRegistry("", nil, utils.NewHTTPRequestFactory())
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &Server{runtime: &Runtime{}}
+	repoData := &registry.RepositoryData{Endpoints: []string{ts.URL + "/v1/"}}
+	sf := utils.NewStreamFormatter(false)
+
+	out := &bytes.Buffer{}
+	signed, err := srv.fetchSignedTag(r, out, repoData, "foo", "foo", "unsigned", "abc", sf)
+	if err != nil || signed != nil {
+		t.Fatalf("Expected the tag to be unsigned, got %v (%v)", signed, err)
+	}
+	if !strings.Contains(out.String(), "not signed") {
+		t.Fatalf("Expected the tag to be reported as unsigned, got %q", out)
+	}
+
+	// A registry failing to answer doesn't make the tag unsigned
+	if _, err := srv.fetchSignedTag(r, out, repoData, "foo", "foo", "latest", "abc", sf); err == nil {
+		t.Fatal("Expected the pull to fail when the signature can't be fetched")
+	}
+}
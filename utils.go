@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"github.com/dotcloud/docker/namesgenerator"
 	"github.com/dotcloud/docker/utils"
+	"net"
 	"strconv"
 	"strings"
 )
@@ -196,6 +197,53 @@ func parseLxcOpt(opt string) (string, string, error) {
 	return strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]), nil
 }
 
+// parseRestartPolicy parses the value of the -restart flag:
+// never, always, on-failure or on-failure:<max retry count>
+func parseRestartPolicy(policy string) (RestartPolicy, error) {
+	p := RestartPolicy{}
+	parts := strings.SplitN(policy, ":", 2)
+	switch parts[0] {
+	case "", "never":
+		p.Name = "never"
+	case "always":
+		p.Name = "always"
+	case "on-failure":
+		p.Name = "on-failure"
+		if len(parts) == 2 {
+			count, err := strconv.Atoi(parts[1])
+			if err != nil || count < 0 {
+				return p, fmt.Errorf("Invalid maximum retry count: %s", parts[1])
+			}
+			p.MaximumRetryCount = count
+		}
+		return p, nil
+	default:
+		return p, fmt.Errorf("Invalid restart policy: %s", policy)
+	}
+	if len(parts) == 2 {
+		return p, fmt.Errorf("Maximum retry count is only valid for the on-failure restart policy")
+	}
+	return p, nil
+}
+
+// validateRestartPolicy checks a restart policy given through the remote
+// API, which isn't parsed by parseRestartPolicy.
+func validateRestartPolicy(policy RestartPolicy) error {
+	switch policy.Name {
+	case "", "never", "always":
+		if policy.MaximumRetryCount != 0 {
+			return fmt.Errorf("Maximum retry count is only valid for the on-failure restart policy")
+		}
+	case "on-failure":
+		if policy.MaximumRetryCount < 0 {
+			return fmt.Errorf("Invalid maximum retry count: %d", policy.MaximumRetryCount)
+		}
+	default:
+		return fmt.Errorf("Invalid restart policy: %s", policy.Name)
+	}
+	return nil
+}
+
 // We will receive port specs in the format of ip:public:private/proto and these need to be
 // parsed in the internal types
 func parsePortSpecs(ports []string) (map[Port]struct{}, map[Port][]PortBinding, error) {
@@ -208,6 +256,19 @@ func parsePortSpecs(ports []string) (map[Port]struct{}, map[Port][]PortBinding,
 			proto = rawPort[i+1:]
 			rawPort = rawPort[:i]
 		}
+		// IPv6 host addresses are between brackets, e.g. [::1]:8080:80
+		bracketedIp := ""
+		if strings.HasPrefix(rawPort, "[") {
+			end := strings.Index(rawPort, "]:")
+			if end == -1 || !strings.Contains(rawPort[end+2:], ":") {
+				return nil, nil, fmt.Errorf("Invalid port specification: %s", rawPort)
+			}
+			bracketedIp = rawPort[1:end]
+			if ip := net.ParseIP(bracketedIp); ip == nil || ip.To4() != nil {
+				return nil, nil, fmt.Errorf("Invalid IPv6 address: %s", bracketedIp)
+			}
+			rawPort = rawPort[end+1:]
+		}
 		if !strings.Contains(rawPort, ":") {
 			rawPort = fmt.Sprintf("::%s", rawPort)
 		} else if len(strings.Split(rawPort, ":")) == 2 {
@@ -221,6 +282,9 @@ func parsePortSpecs(ports []string) (map[Port]struct{}, map[Port][]PortBinding,
 		containerPort := parts["containerPort"]
 		rawIp := parts["ip"]
 		hostPort := parts["hostPort"]
+		if bracketedIp != "" {
+			rawIp = bracketedIp
+		}
 
 		if containerPort == "" {
 			return nil, nil, fmt.Errorf("No port specified: %s<empty>", rawPort)
@@ -137,6 +137,15 @@ func ProgressReader(r io.ReadCloser, size int, output io.Writer, tpl []byte, sf
 	}
 }
 
+// ResumedProgressReader is a ProgressReader for a stream which starts
+// `offset` bytes into the data, e.g. a download resumed with a Range request.
+func ResumedProgressReader(r io.ReadCloser, offset, size int, output io.Writer, tpl []byte, sf *StreamFormatter, newline bool) *progressReader {
+	reader := ProgressReader(r, size, output, tpl, sf, newline)
+	reader.readProgress = offset
+	reader.lastUpdate = offset
+	return reader
+}
+
 // HumanDuration returns a human-readable approximation of a duration
 // (eg. "About a minute", "4 hours ago", etc.)
 func HumanDuration(d time.Duration) string {
@@ -176,6 +185,35 @@ func HumanSize(size int64) string {
 	return fmt.Sprintf("%.4g %s", sizef, units[i])
 }
 
+// RAMInBytes parses a human-readable size, such as "32k" or "10m", into
+// a number of bytes. Units are powers of 1024.
+func RAMInBytes(size string) (int64, error) {
+	size = strings.ToLower(strings.TrimSpace(size))
+	if size == "" {
+		return -1, fmt.Errorf("Invalid size: ''")
+	}
+	multiplier := int64(1)
+	switch size[len(size)-1] {
+	case 'k':
+		multiplier = 1024
+	case 'm':
+		multiplier = 1024 * 1024
+	case 'g':
+		multiplier = 1024 * 1024 * 1024
+	case 'b':
+	default:
+		if size[len(size)-1] < '0' || size[len(size)-1] > '9' {
+			return -1, fmt.Errorf("Invalid size: '%s'", size)
+		}
+		size += "b"
+	}
+	n, err := strconv.ParseInt(size[:len(size)-1], 10, 64)
+	if err != nil || n < 0 {
+		return -1, fmt.Errorf("Invalid size: '%s'", size)
+	}
+	return n * multiplier, nil
+}
+
 func Trunc(s string, maxlen int) string {
 	if len(s) <= maxlen {
 		return s
@@ -360,17 +398,24 @@ func (w *WriteBroadcaster) Write(p []byte) (n int, err error) {
 	w.Lock()
 	defer w.Unlock()
 	w.buf.Write(p)
+	// Writers of a named stream receive each complete line encoded as JSON,
+	// the rest is kept until the end of the line is written.
+	var lines []string
+	for {
+		line, err := w.buf.ReadString('\n')
+		if err != nil {
+			w.buf.Write([]byte(line))
+			break
+		}
+		lines = append(lines, line)
+	}
+	created := time.Now()
 	for sw := range w.writers {
 		lp := p
 		if sw.stream != "" {
 			lp = nil
-			for {
-				line, err := w.buf.ReadString('\n')
-				if err != nil {
-					w.buf.Write([]byte(line))
-					break
-				}
-				b, err := json.Marshal(&JSONLog{Log: line, Stream: sw.stream, Created: time.Now()})
+			for _, line := range lines {
+				b, err := json.Marshal(&JSONLog{Log: line, Stream: sw.stream, Created: created})
 				if err != nil {
 					// On error, evict the writer
 					delete(w.writers, sw)
@@ -379,6 +424,9 @@ func (w *WriteBroadcaster) Write(p []byte) (n int, err error) {
 				lp = append(lp, b...)
 				lp = append(lp, '\n')
 			}
+			if len(lp) == 0 {
+				continue
+			}
 		}
 		if n, err := sw.wc.Write(lp); err != nil || n != len(lp) {
 			// On error, evict the writer
@@ -598,6 +646,34 @@ func FindCgroupMountpoint(cgroupType string) (string, error) {
 	return "", fmt.Errorf("cgroup mountpoint not found for %s", cgroupType)
 }
 
+// GetThisCgroupDir returns the cgroup of the current process in the
+// hierarchy of `subsystem`, relative to the mountpoint of the hierarchy.
+func GetThisCgroupDir(subsystem string) (string, error) {
+	output, err := ioutil.ReadFile("/proc/self/cgroup")
+	if err != nil {
+		return "", err
+	}
+	return parseCgroupFile(subsystem, string(output))
+}
+
+// parseCgroupFile looks for `subsystem` in the content of /proc/<pid>/cgroup,
+// which has one hierarchy per line, e.g.
+// 4:cpu,cpuacct:/user/1000
+func parseCgroupFile(subsystem, content string) (string, error) {
+	for _, line := range strings.Split(content, "\n") {
+		parts := strings.SplitN(line, ":", 3)
+		if len(parts) != 3 {
+			continue
+		}
+		for _, s := range strings.Split(parts[1], ",") {
+			if s == subsystem {
+				return parts[2], nil
+			}
+		}
+	}
+	return "", fmt.Errorf("cgroup not found for %s", subsystem)
+}
+
 func GetKernelVersion() (*KernelVersionInfo, error) {
 	var (
 		err error
@@ -880,6 +956,27 @@ func CheckLocalDns(resolvConf []byte) bool {
 	return false
 }
 
+// GetNameservers returns the nameservers of the resolv.conf `resolvConf`.
+func GetNameservers(resolvConf []byte) []string {
+	return resolvConfValues(resolvConf, "nameserver")
+}
+
+// GetSearchDomains returns the search domains of the resolv.conf `resolvConf`.
+func GetSearchDomains(resolvConf []byte) []string {
+	return resolvConfValues(resolvConf, "search")
+}
+
+func resolvConfValues(resolvConf []byte, option string) []string {
+	var values []string
+	for _, line := range bytes.Split(StripComments(resolvConf, []byte("#")), []byte("\n")) {
+		fields := strings.Fields(string(line))
+		if len(fields) > 1 && fields[0] == option {
+			values = append(values, fields[1:]...)
+		}
+	}
+	return values
+}
+
 // StripComments parses input into lines and strips away comments.
 func StripComments(input []byte, commentMarker []byte) []byte {
 	lines := bytes.Split(input, []byte("\n"))
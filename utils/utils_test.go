@@ -265,6 +265,31 @@ func TestHumanSize(t *testing.T) {
 	}
 }
 
+func TestRAMInBytes(t *testing.T) {
+	valid := map[string]int64{
+		"32":    32,
+		"32b":   32,
+		"32k":   32 * 1024,
+		"32K":   32 * 1024,
+		"10m":   10 * 1024 * 1024,
+		"2g":    2 * 1024 * 1024 * 1024,
+		" 1k  ": 1024,
+	}
+	for size, expected := range valid {
+		if n, err := RAMInBytes(size); err != nil {
+			t.Errorf("%s -> unexpected error: %s", size, err)
+		} else if n != expected {
+			t.Errorf("%s -> expected %d, got %d", size, expected, n)
+		}
+	}
+
+	for _, size := range []string{"", "k", "-1m", "1t", "ten"} {
+		if _, err := RAMInBytes(size); err == nil {
+			t.Errorf("%s -> expected an error", size)
+		}
+	}
+}
+
 func TestParseHost(t *testing.T) {
 	if addr, err := ParseHost("127.0.0.1", 4243, "0.0.0.0"); err != nil || addr != "tcp://0.0.0.0:4243" {
 		t.Errorf("0.0.0.0 -> expected tcp://0.0.0.0:4243, got %s", addr)
@@ -351,6 +376,24 @@ search dotcloud.net`: true,
 	}
 }
 
+func TestGetNameservers(t *testing.T) {
+	resolv := []byte(`# Dynamic
+nameserver 10.0.2.3
+#nameserver 10.0.2.4
+nameserver 8.8.8.8 # google
+search dotcloud.net docker.io
+`)
+	if ns := GetNameservers(resolv); len(ns) != 2 || ns[0] != "10.0.2.3" || ns[1] != "8.8.8.8" {
+		t.Fatalf("Wrong nameservers: %v", ns)
+	}
+	if search := GetSearchDomains(resolv); len(search) != 2 || search[0] != "dotcloud.net" || search[1] != "docker.io" {
+		t.Fatalf("Wrong search domains: %v", search)
+	}
+	if ns := GetNameservers([]byte("")); len(ns) != 0 {
+		t.Fatalf("Expected no nameserver, got %v", ns)
+	}
+}
+
 func assertParseRelease(t *testing.T, release string, b *KernelVersionInfo, result int) {
 	var (
 		a *KernelVersionInfo
@@ -444,3 +487,23 @@ func TestParsePortMapping(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestParseCgroupFile(t *testing.T) {
+	content := "5:freezer:/\n4:cpu,cpuacct:/user/1000\n3:memory:/docker\n"
+	expected := map[string]string{
+		"freezer": "/",
+		"cpu":     "/user/1000",
+		"cpuacct": "/user/1000",
+		"memory":  "/docker",
+	}
+	for subsystem, dir := range expected {
+		if found, err := parseCgroupFile(subsystem, content); err != nil {
+			t.Fatal(err)
+		} else if found != dir {
+			t.Fatalf("Expected %s for %s, found %s", dir, subsystem, found)
+		}
+	}
+	if _, err := parseCgroupFile("blkio", content); err == nil {
+		t.Fatal("Expected an error for a missing subsystem")
+	}
+}
@@ -305,6 +305,58 @@ func TestParseLxcConfOpt(t *testing.T) {
 	}
 }
 
+func TestParseRestartPolicy(t *testing.T) {
+	valid := map[string]RestartPolicy{
+		"":              {Name: "never"},
+		"never":         {Name: "never"},
+		"always":        {Name: "always"},
+		"on-failure":    {Name: "on-failure"},
+		"on-failure:10": {Name: "on-failure", MaximumRetryCount: 10},
+	}
+	for value, expected := range valid {
+		policy, err := parseRestartPolicy(value)
+		if err != nil {
+			t.Fatalf("Unexpected error parsing %s: %s", value, err)
+		}
+		if policy != expected {
+			t.Fatalf("Expected %v for %s, found %v", expected, value, policy)
+		}
+	}
+
+	for _, value := range []string{"sometimes", "always:3", "on-failure:-1", "on-failure:many"} {
+		if _, err := parseRestartPolicy(value); err == nil {
+			t.Fatalf("Expected an error parsing %s", value)
+		}
+	}
+}
+
+func TestValidateRestartPolicy(t *testing.T) {
+	valid := []RestartPolicy{
+		{},
+		{Name: "never"},
+		{Name: "always"},
+		{Name: "on-failure"},
+		{Name: "on-failure", MaximumRetryCount: 3},
+	}
+	for _, policy := range valid {
+		if err := validateRestartPolicy(policy); err != nil {
+			t.Fatalf("Unexpected error validating %v: %s", policy, err)
+		}
+	}
+
+	invalid := []RestartPolicy{
+		{Name: "alwayz"},
+		{Name: "always", MaximumRetryCount: 3},
+		{MaximumRetryCount: 1},
+		{Name: "on-failure", MaximumRetryCount: -1},
+	}
+	for _, policy := range invalid {
+		if err := validateRestartPolicy(policy); err == nil {
+			t.Fatalf("Expected an error validating %v", policy)
+		}
+	}
+}
+
 func TestParseNetworkOptsPrivateOnly(t *testing.T) {
 	ports, bindings, err := parsePortSpecs([]string{"192.168.1.100::80"})
 	if err != nil {
@@ -389,6 +441,30 @@ func TestParseNetworkOptsPublic(t *testing.T) {
 	}
 }
 
+func TestParseNetworkOptsIPv6(t *testing.T) {
+	ports, bindings, err := parsePortSpecs([]string{"[::1]:8080:80", "[2001:db8::1]::53/udp"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ports) != 2 {
+		t.Fatalf("Expected 2 got %d", len(ports))
+	}
+	b := bindings[NewPort("tcp", "80")]
+	if len(b) != 1 || b[0].HostIp != "::1" || b[0].HostPort != "8080" {
+		t.Fatalf("Unexpected bindings of 80/tcp: %v", b)
+	}
+	b = bindings[NewPort("udp", "53")]
+	if len(b) != 1 || b[0].HostIp != "2001:db8::1" || b[0].HostPort != "" {
+		t.Fatalf("Unexpected bindings of 53/udp: %v", b)
+	}
+
+	for _, spec := range []string{"[::1]:80", "[::1:8080:80", "[127.0.0.1]:8080:80", "[foo]:8080:80"} {
+		if _, _, err := parsePortSpecs([]string{spec}); err == nil {
+			t.Errorf("Expected an error for %s", spec)
+		}
+	}
+}
+
 func TestParseNetworkOptsUdp(t *testing.T) {
 	ports, bindings, err := parsePortSpecs([]string{"192.168.1.100::6000/udp"})
 	if err != nil {